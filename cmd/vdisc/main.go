@@ -52,6 +52,7 @@ func main() {
 		vdisc_cli.UUIDTypeMapper(),
 		vdisc_cli.SITypeMapper(),
 		vdisc_cli.GcThresholdTypeMapper(),
+		vdisc_cli.StringsTypeMapper(),
 		kong.ConfigureHelp(kong.HelpOptions{
 			Compact: true,
 		}),
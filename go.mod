@@ -17,6 +17,7 @@ require (
 	github.com/hashicorp/go-multierror v1.0.0
 	github.com/hashicorp/golang-lru v0.5.3
 	github.com/jacobsa/fuse v0.0.0-20190923155423-081e9f4bc7d4
+	github.com/klauspost/compress v1.10.3
 	github.com/lukealonso/dnscache v0.0.0-20190603182722-ca742573d4fd
 	github.com/mattn/go-colorable v0.1.2 // indirect
 	github.com/mattn/go-isatty v0.0.9 // indirect
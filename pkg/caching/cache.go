@@ -38,6 +38,38 @@ type Slicer interface {
 	Slice(obj storage.Object, offset int64) Slice
 }
 
+// Versioned is implemented by objects pinned to a revision of their
+// URL. Their slices are cached apart from those of other revisions, so
+// a pin is enforced on cache hits too.
+type Versioned interface {
+	Version() storage.Version
+}
+
+// objectVersion returns the revision obj is pinned to, if any
+func objectVersion(obj storage.Object) storage.Version {
+	if v, ok := obj.(Versioned); ok {
+		return v.Version()
+	}
+	return storage.Version{}
+}
+
+// Encoded is implemented by objects that serve the content of their
+// URL decoded, such as decompressed, rather than as stored. Their
+// slices are cached apart from those of the stored object and of
+// other encodings.
+type Encoded interface {
+	Encoding() string
+}
+
+// objectEncoding returns the encoding obj serves its content in, or ""
+// for the content as stored
+func objectEncoding(obj storage.Object) string {
+	if e, ok := obj.(Encoded); ok {
+		return e.Encoding()
+	}
+	return ""
+}
+
 type Cache interface {
 	// WithCaching applies a read-through caching layer to obj
 	WithCaching(obj storage.Object) storage.Object
@@ -0,0 +1,120 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+)
+
+// revision is one revision of an object at a shared URL
+type revision struct {
+	storage.AnonymousObject
+	version storage.Version
+}
+
+func (r *revision) URL() string {
+	return "test:object"
+}
+
+func (r *revision) Version() storage.Version {
+	return r.version
+}
+
+func TestPinnedRevisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caching-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem, err := caching.NewMemorySlicer(4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk := caching.NewDiskSlicer(dir, 4)
+	defer disk.Wait()
+
+	for _, slicer := range []caching.Slicer{mem, disk} {
+		cache := caching.NewCache(slicer, 0, 0)
+		for _, content := range []string{"first", "second", "first"} {
+			obj, err := storage.Open("data:," + content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cached := cache.WithCaching(&revision{obj, storage.Version{ETag: content}})
+
+			data, err := ioutil.ReadAll(cached)
+			assert.Nil(t, err)
+			assert.Equal(t, content, string(data))
+
+		}
+	}
+}
+
+// encoded serves an object's content as though it were decoded
+type encoded struct {
+	storage.AnonymousObject
+}
+
+func (e *encoded) URL() string {
+	return "test:object"
+}
+
+func (e *encoded) Encoding() string {
+	return "upper"
+}
+
+func TestEncodings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caching-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem, err := caching.NewMemorySlicer(4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk := caching.NewDiskSlicer(dir, 4)
+	defer disk.Wait()
+
+	for _, slicer := range []caching.Slicer{mem, disk} {
+		cache := caching.NewCache(slicer, 0, 0)
+		stored, err := storage.Open("data:,stored")
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := storage.Open("data:,DECODED")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range []storage.Object{&revision{stored, storage.Version{}}, &encoded{decoded}, &revision{stored, storage.Version{}}} {
+			data, err := ioutil.ReadAll(cache.WithCaching(obj))
+			assert.Nil(t, err)
+			expected := "stored"
+			if _, ok := obj.(caching.Encoded); ok {
+				expected = "DECODED"
+			}
+			assert.Equal(t, expected, string(data))
+		}
+	}
+}
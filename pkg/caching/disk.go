@@ -74,7 +74,8 @@ func (ds *DiskSlicer) Slice(obj storage.Object, offset int64) Slice {
 		size = ds.bsize
 	}
 
-	ckey := diskKey{obj.URL(), offset, size}
+	version := objectVersion(obj)
+	ckey := diskKey{obj.URL(), version.ETag, version.VersionID, objectEncoding(obj), offset, size}
 	key, err := json.Marshal(&ckey)
 	if err != nil {
 		panic(err)
@@ -384,9 +385,12 @@ func (ds *diskSlice) cacheFname() string {
 }
 
 type diskKey struct {
-	Url string `json:"url"`
-	Off int64  `json:"off"`
-	Len int64  `json:"len"`
+	Url       string `json:"url"`
+	ETag      string `json:"etag,omitempty"`
+	VersionID string `json:"versionId,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+	Off       int64  `json:"off"`
+	Len       int64  `json:"len"`
 }
 
 type diskIter struct {
@@ -48,7 +48,14 @@ func (ms *memSlicer) Slice(obj storage.Object, offset int64) Slice {
 	if ms.bsize < size {
 		size = ms.bsize
 	}
-	key := fmt.Sprintf("%s[%d,%d)", obj.URL(), offset, offset+size)
+	key := obj.URL()
+	if version := objectVersion(obj); !version.IsZero() {
+		key += fmt.Sprintf("@%q,%q", version.ETag, version.VersionID)
+	}
+	if encoding := objectEncoding(obj); encoding != "" {
+		key += fmt.Sprintf("#%q", encoding)
+	}
+	key += fmt.Sprintf("[%d,%d)", offset, offset+size)
 
 	return &memSlice{
 		bsize: ms.bsize,
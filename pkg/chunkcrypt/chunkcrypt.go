@@ -0,0 +1,235 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chunkcrypt encrypts objects with AES-256-GCM in fixed size
+// chunks, so that any range of the plaintext can be read by fetching
+// and decrypting only the chunks covering it.
+//
+// Each chunk of up to ChunkSize plaintext bytes is stored as a random
+// nonce, followed by the ciphertext and the GCM tag. The index of the
+// chunk and whether it is the last one are authenticated with it, so
+// chunks can't be reordered, and an object can't be truncated at a
+// chunk boundary, without failing decryption.
+package chunkcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// ChunkSize is the plaintext size of every chunk but the last
+	ChunkSize = 64 * 1024
+
+	// KeySize is the size of an AES-256 key
+	KeySize = 32
+
+	nonceSize = 12
+	tagSize   = 16
+
+	// Overhead is the size a chunk adds to its plaintext
+	Overhead = nonceSize + tagSize
+)
+
+// NewAEAD returns the cipher used to encrypt and decrypt chunks with key
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("chunkcrypt: key is %d bytes, expected %d", len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// CiphertextSize returns the size of the encrypted form of size bytes
+func CiphertextSize(size int64) int64 {
+	chunks := (size + ChunkSize - 1) / ChunkSize
+	return size + chunks*Overhead
+}
+
+// PlaintextSize returns the size of the plaintext of an encrypted
+// object of size bytes
+func PlaintextSize(size int64) (int64, error) {
+	full := size / (ChunkSize + Overhead)
+	rem := size % (ChunkSize + Overhead)
+	if rem != 0 && rem <= Overhead {
+		return -1, fmt.Errorf("chunkcrypt: invalid ciphertext size %d", size)
+	}
+	if rem > 0 {
+		rem -= Overhead
+	}
+	return full*ChunkSize + rem, nil
+}
+
+// additionalData authenticates the position of a chunk
+func additionalData(index int64, final bool) []byte {
+	var ad [9]byte
+	binary.BigEndian.PutUint64(ad[:], uint64(index))
+	if final {
+		ad[8] = 1
+	}
+	return ad[:]
+}
+
+// Reader decrypts an encrypted object, fetching only the chunks
+// covering each read
+type Reader struct {
+	r    io.ReaderAt
+	size int64
+	aead cipher.AEAD
+}
+
+// NewReader returns a Reader of the size plaintext bytes encrypted in r
+func NewReader(r io.ReaderAt, size int64, aead cipher.AEAD) *Reader {
+	return &Reader{r, size, aead}
+}
+
+// Size returns the size of the plaintext
+func (cr *Reader) Size() int64 {
+	return cr.size
+}
+
+func (cr *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("chunkcrypt: negative offset")
+	}
+	if off >= cr.size {
+		return 0, io.EOF
+	}
+
+	end := off + int64(len(p))
+	if end > cr.size {
+		end = cr.size
+	}
+
+	// The chunks overlapping [off, end) are fetched with a single read
+	first := off / ChunkSize
+	last := (end - 1) / ChunkSize
+	lastChunk := (cr.size - 1) / ChunkSize
+	start := first * (ChunkSize + Overhead)
+	stop := (last + 1) * (ChunkSize + Overhead)
+	if last == lastChunk {
+		stop = CiphertextSize(cr.size)
+	}
+	buf := make([]byte, stop-start)
+	if _, err := cr.r.ReadAt(buf, start); err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	var n int
+	var plain []byte
+	for i := first; i <= last; i++ {
+		chunk := buf[(i-first)*(ChunkSize+Overhead):]
+		if len(chunk) > ChunkSize+Overhead {
+			chunk = chunk[:ChunkSize+Overhead]
+		}
+
+		var err error
+		plain, err = cr.aead.Open(plain[:0], chunk[:nonceSize], chunk[nonceSize:], additionalData(i, i == lastChunk))
+		if err != nil {
+			return n, fmt.Errorf("chunkcrypt: chunk %d: %v", i, err)
+		}
+
+		lo := int64(0)
+		if i == first {
+			lo = off - first*ChunkSize
+		}
+		n += copy(p[n:], plain[lo:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Writer encrypts to w in chunks. The final chunk is written by Close.
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	out    []byte
+	index  int64
+	closed bool
+}
+
+// NewWriter returns a Writer encrypting to w
+func NewWriter(w io.Writer, aead cipher.AEAD) *Writer {
+	return &Writer{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, ChunkSize),
+	}
+}
+
+func (cw *Writer) Write(p []byte) (int, error) {
+	if cw.closed {
+		return 0, errors.New("chunkcrypt: write to closed Writer")
+	}
+
+	var n int
+	for len(p) > 0 {
+		// A full chunk is only written once more data follows it,
+		// since the last chunk is marked as such
+		if len(cw.buf) == ChunkSize {
+			if err := cw.seal(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(cw.buf[len(cw.buf):ChunkSize], p)
+		cw.buf = cw.buf[:len(cw.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+// seal encrypts and writes the buffered chunk
+func (cw *Writer) seal(final bool) error {
+	if cap(cw.out) < ChunkSize+Overhead {
+		cw.out = make([]byte, nonceSize, ChunkSize+Overhead)
+	}
+	nonce := cw.out[:nonceSize]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	out := cw.aead.Seal(nonce, nonce, cw.buf, additionalData(cw.index, final))
+	if _, err := cw.w.Write(out); err != nil {
+		return err
+	}
+	cw.index++
+	cw.buf = cw.buf[:0]
+	return nil
+}
+
+// Close writes the final chunk. It does not close the underlying
+// writer.
+func (cw *Writer) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	return cw.seal(true)
+}
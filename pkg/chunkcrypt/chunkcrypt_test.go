@@ -0,0 +1,122 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkcrypt_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/chunkcrypt"
+)
+
+func TestRoundTrip(t *testing.T) {
+	aead, err := chunkcrypt.NewAEAD(bytes.Repeat([]byte{7}, chunkcrypt.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range []int{0, 1, chunkcrypt.ChunkSize, 3*chunkcrypt.ChunkSize + 100} {
+		data := make([]byte, size)
+		rng.Read(data)
+
+		var buf bytes.Buffer
+		w := chunkcrypt.NewWriter(&buf, aead)
+		// Uneven writes, so chunks are assembled from several
+		for rest := data; len(rest) > 0; {
+			n := 1 + rng.Intn(20000)
+			if n > len(rest) {
+				n = len(rest)
+			}
+			_, err := w.Write(rest[:n])
+			assert.Nil(t, err)
+			rest = rest[n:]
+		}
+		assert.Nil(t, w.Close())
+
+		assert.Equal(t, chunkcrypt.CiphertextSize(int64(size)), int64(buf.Len()))
+		plain, err := chunkcrypt.PlaintextSize(int64(buf.Len()))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(size), plain)
+		if size > 0 {
+			assert.False(t, bytes.Contains(buf.Bytes(), data))
+		}
+
+		r := chunkcrypt.NewReader(bytes.NewReader(buf.Bytes()), int64(size), aead)
+		for _, tc := range []struct{ off, len int }{
+			{0, size},
+			{size / 3, size / 3},
+			{size / 2, 1},
+		} {
+			if size == 0 {
+				break
+			}
+			p := make([]byte, tc.len)
+			n, err := r.ReadAt(p, int64(tc.off))
+			assert.Nil(t, err)
+			assert.Equal(t, tc.len, n)
+			assert.Equal(t, data[tc.off:tc.off+tc.len], p)
+		}
+
+		p := make([]byte, 10)
+		_, err = r.ReadAt(p, int64(size))
+		assert.Equal(t, io.EOF, err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	aead, err := chunkcrypt.NewAEAD(bytes.Repeat([]byte{7}, chunkcrypt.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := chunkcrypt.NewAEAD(bytes.Repeat([]byte{8}, chunkcrypt.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("secret"), chunkcrypt.ChunkSize/2)
+	var buf bytes.Buffer
+	w := chunkcrypt.NewWriter(&buf, aead)
+	w.Write(data)
+	w.Close()
+	ciphertext := buf.Bytes()
+	p := make([]byte, len(data))
+
+	// The wrong key
+	_, err = chunkcrypt.NewReader(bytes.NewReader(ciphertext), int64(len(data)), other).ReadAt(p, 0)
+	assert.NotNil(t, err)
+
+	// Chunks in the wrong order
+	chunk := chunkcrypt.ChunkSize + chunkcrypt.Overhead
+	swapped := append(append([]byte(nil), ciphertext[chunk:2*chunk]...), ciphertext[:chunk]...)
+	swapped = append(swapped, ciphertext[2*chunk:]...)
+	_, err = chunkcrypt.NewReader(bytes.NewReader(swapped), int64(len(data)), aead).ReadAt(p, 0)
+	assert.NotNil(t, err)
+
+	// Truncated at a chunk boundary
+	_, err = chunkcrypt.NewReader(bytes.NewReader(ciphertext[:2*chunk]), 2*chunkcrypt.ChunkSize, aead).ReadAt(p[:10], 0)
+	assert.Nil(t, err)
+	_, err = chunkcrypt.NewReader(bytes.NewReader(ciphertext[:2*chunk]), 2*chunkcrypt.ChunkSize, aead).ReadAt(p[:10], chunkcrypt.ChunkSize)
+	assert.NotNil(t, err)
+
+	_, err = chunkcrypt.NewAEAD([]byte("short"))
+	assert.NotNil(t, err)
+	_, err = chunkcrypt.PlaintextSize(chunkcrypt.Overhead)
+	assert.NotNil(t, err)
+}
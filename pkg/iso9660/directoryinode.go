@@ -17,6 +17,7 @@ package iso9660
 import (
 	"errors"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/badgerodon/collections/queue"
@@ -34,6 +35,8 @@ type dirEntry struct {
 type DirectoryInode struct {
 	ino           InodeNumber
 	perm          os.FileMode
+	uid           uint32
+	gid           uint32
 	created       time.Time
 	modified      time.Time
 	parent        *DirectoryInode
@@ -84,6 +87,26 @@ func (d *DirectoryInode) SetPerm(perm os.FileMode) {
 	d.perm = perm & os.ModePerm
 }
 
+//Uid returns the owning user id
+func (d *DirectoryInode) Uid() uint32 {
+	return d.uid
+}
+
+//SetUid sets the owning user id
+func (d *DirectoryInode) SetUid(uid uint32) {
+	d.uid = uid
+}
+
+//Gid returns the owning group id
+func (d *DirectoryInode) Gid() uint32 {
+	return d.gid
+}
+
+//SetGid sets the owning group id
+func (d *DirectoryInode) SetGid(gid uint32) {
+	d.gid = gid
+}
+
 //Created returns the creation time
 func (d *DirectoryInode) Created() time.Time {
 	return d.created
@@ -133,6 +156,30 @@ func (d *DirectoryInode) AddChild(name string, child Inode) error {
 	return nil
 }
 
+// sortChildren reassigns the identifiers of the children in name order
+func (d *DirectoryInode) sortChildren() {
+	entries := make([]*dirEntry, 0, d.children.Size())
+	it := d.children.Iterator()
+	for it.Next() {
+		entries = append(entries, it.Value().(*dirEntry))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	d.idAlloc = NewIdentifierAllocator()
+	d.names = make(map[string]string, len(entries))
+	d.children = treemap.NewWithStringComparator()
+	for _, dent := range entries {
+		ident := d.idAlloc.Next()
+		if dent.child.Type() != InodeTypeDirectory {
+			ident += ";1"
+		}
+		d.names[dent.name] = ident
+		d.children.Put(ident, dent)
+	}
+}
+
 //GetChild returns a child Inode based on the name. If no child is found, it returns (nil, false)
 func (d *DirectoryInode) GetChild(name string) (Inode, bool) {
 	ident, ok := d.names[name]
@@ -269,71 +316,19 @@ func (d *DirectoryInode) ToDirectory() (Directory, ContinuationArea, error) {
 }
 
 func (d *DirectoryInode) toDirectory(contStart LogicalBlockAddress) (Directory, ContinuationArea, error) {
-	var dir Directory
-	cont := NewContinuationArea(contStart)
-
-	splitInode := func(identifier string, name string, inode Inode) error {
-		systemUseEntries, err := InodeSystemUseEntries(identifier, name, inode)
-		if err != nil {
-			return err
-		}
-
-		parts := inode.Parts()
-		for i, part := range parts {
-			record := &DirectoryRecord{
-				Identifier: identifier,
-				Start:      part.Start(),
-				Length:     part.Size(),
-				Recorded:   inode.Modified(),
-				SystemUse:  systemUseEntries,
-				VolumeID:   1,
-			}
-
-			if inode.Type() == InodeTypeDirectory {
-				record.Flags |= FileFlagDir
-			}
-
-			if i < len(parts)-1 {
-				record.Flags |= FileFlagNonTerminal
-			}
-
-			// We pack as many system use entries directly into the
-			// record as possible, keeping the record less than one
-			// sector.
-			var overflow []susp.SystemUseEntry
-			baseLen := record.Len()
-			var extraLen int
-			for (baseLen + extraLen) > MaxDirectoryRecordLen {
-				// pop off the last system use entry and move it to the continuation area
-				lastIdx := len(record.SystemUse) - 1
-				last := record.SystemUse[lastIdx]
-				record.SystemUse = record.SystemUse[:lastIdx]
-				overflow = append([]susp.SystemUseEntry{last}, overflow...)
-				baseLen -= last.Len()
-				extraLen = susp.ContinuationAreaEntryLength
-			}
-
-			if len(overflow) > 0 {
-				ce := cont.Append(overflow)
-				record.SystemUse = append(record.SystemUse, ce)
-			}
-
-			dir.Records = append(dir.Records, *record)
-		}
-		return nil
-	}
+	enc := newDirectoryEncoder(contStart)
 
 	parent := d.parent
 	if parent == nil {
 		parent = d
 	}
-	err := splitInode("\x00", ".", d)
+	err := enc.add("\x00", ".", d)
 	if err != nil {
-		return dir, cont, err
+		return enc.dir, enc.cont, err
 	}
-	err = splitInode("\x01", "..", parent)
+	err = enc.add("\x01", "..", parent)
 	if err != nil {
-		return dir, cont, err
+		return enc.dir, enc.cont, err
 	}
 
 	// children
@@ -342,13 +337,76 @@ func (d *DirectoryInode) toDirectory(contStart LogicalBlockAddress) (Directory,
 		ident := it.Key().(string)
 		dent := it.Value().(*dirEntry)
 
-		err := splitInode(ident, dent.name, dent.child)
+		err := enc.add(ident, dent.name, dent.child)
 		if err != nil {
-			return dir, cont, err
+			return enc.dir, enc.cont, err
 		}
 	}
 
-	return dir, cont, nil
+	return enc.dir, enc.cont, nil
+}
+
+// directoryEncoder accumulates the records of a directory extent,
+// moving system use entries that don't fit to a continuation area
+type directoryEncoder struct {
+	dir  Directory
+	cont ContinuationArea
+}
+
+func newDirectoryEncoder(contStart LogicalBlockAddress) *directoryEncoder {
+	return &directoryEncoder{cont: NewContinuationArea(contStart)}
+}
+
+// add appends the records for inode, one per part
+func (enc *directoryEncoder) add(identifier string, name string, inode Inode) error {
+	systemUseEntries, err := InodeSystemUseEntries(identifier, name, inode)
+	if err != nil {
+		return err
+	}
+
+	parts := inode.Parts()
+	for i, part := range parts {
+		record := &DirectoryRecord{
+			Identifier: identifier,
+			Start:      part.Start(),
+			Length:     part.Size(),
+			Recorded:   inode.Modified(),
+			SystemUse:  systemUseEntries,
+			VolumeID:   1,
+		}
+
+		if inode.Type() == InodeTypeDirectory {
+			record.Flags |= FileFlagDir
+		}
+
+		if i < len(parts)-1 {
+			record.Flags |= FileFlagNonTerminal
+		}
+
+		// We pack as many system use entries directly into the
+		// record as possible, keeping the record less than one
+		// sector.
+		var overflow []susp.SystemUseEntry
+		baseLen := record.Len()
+		var extraLen int
+		for (baseLen + extraLen) > MaxDirectoryRecordLen {
+			// pop off the last system use entry and move it to the continuation area
+			lastIdx := len(record.SystemUse) - 1
+			last := record.SystemUse[lastIdx]
+			record.SystemUse = record.SystemUse[:lastIdx]
+			overflow = append([]susp.SystemUseEntry{last}, overflow...)
+			baseLen -= last.Len()
+			extraLen = susp.ContinuationAreaEntryLength
+		}
+
+		if len(overflow) > 0 {
+			ce := enc.cont.Append(overflow)
+			record.SystemUse = append(record.SystemUse, ce)
+		}
+
+		enc.dir.Records = append(enc.dir.Records, *record)
+	}
+	return nil
 }
 
 //ToPathTable computes the PathTable for the inode
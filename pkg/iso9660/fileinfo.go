@@ -28,6 +28,7 @@ type FileInfo struct {
 	gid     uint32
 	ino     uint32
 	modTime time.Time
+	created time.Time
 	isDir   bool
 	extent  LogicalBlockAddress
 	target  string
@@ -49,6 +50,12 @@ func (fi *FileInfo) ModTime() time.Time {
 	return fi.modTime
 }
 
+// Created returns the time recorded as the creation time, which the
+// vdisc builders set to the change time
+func (fi *FileInfo) Created() time.Time {
+	return fi.created
+}
+
 func (fi *FileInfo) IsDir() bool {
 	return fi.isDir
 }
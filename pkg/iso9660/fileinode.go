@@ -27,10 +27,13 @@ import (
 type FileInode struct {
 	ino      InodeNumber
 	perm     os.FileMode
+	uid      uint32
+	gid      uint32
 	created  time.Time
 	modified time.Time
 	nlink    uint32
 	start    LogicalBlockAddress
+	inline   bool
 	o        storage.Object
 }
 
@@ -67,6 +70,22 @@ func (f *FileInode) SetPerm(perm os.FileMode) {
 	f.perm = perm & os.ModePerm
 }
 
+func (f *FileInode) Uid() uint32 {
+	return f.uid
+}
+
+func (f *FileInode) SetUid(uid uint32) {
+	f.uid = uid
+}
+
+func (f *FileInode) Gid() uint32 {
+	return f.gid
+}
+
+func (f *FileInode) SetGid(gid uint32) {
+	f.gid = gid
+}
+
 func (f *FileInode) Created() time.Time {
 	return f.created
 }
@@ -111,6 +130,17 @@ func (f *FileInode) SetStart(start LogicalBlockAddress) {
 	f.start = start
 }
 
+// Inline reports whether the file is laid out with the metadata
+func (f *FileInode) Inline() bool {
+	return f.inline
+}
+
+// SetInline places the file directly after the directory extents, so
+// that its data can be stored along with the volume metadata.
+func (f *FileInode) SetInline(inline bool) {
+	f.inline = inline
+}
+
 func (f *FileInode) WriteTo(w io.Writer) (n int64, err error) {
 	sr := io.NewSectionReader(f.o, 0, f.o.Size())
 	return io.Copy(w, sr)
@@ -20,10 +20,14 @@ import (
 )
 
 var (
-	shortEncoding = base32.StdEncoding.WithPadding('_')
+	// The base32hex alphabet sorts in the same order as the values it
+	// encodes, and only uses ISO 9660 d-characters
+	shortEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
 )
 
-// Assign unique (hidden) names to directory entries
+// Assign unique (hidden) names to directory entries. Identifiers sort
+// in the order they were allocated, so directory records are written
+// in the order entries were added.
 type IdentifierAllocator struct {
 	count uint64
 }
@@ -33,11 +37,12 @@ func NewIdentifierAllocator() *IdentifierAllocator {
 }
 
 func (ia *IdentifierAllocator) Next() string {
-	buf := make([]byte, binary.MaxVarintLen64)
-	n := binary.PutUvarint(buf, ia.count)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], ia.count)
 	ia.count++
-	src := buf[:n]
 
+	// The low 40 bits encode to exactly 8 characters
+	src := buf[3:]
 	dst := make([]byte, shortEncoding.EncodedLen(len(src)))
 	shortEncoding.Encode(dst, src)
 	return string(dst)
@@ -57,6 +57,18 @@ type Inode interface {
 	// SetPerm sets the Unix permissions for this inode
 	SetPerm(perm os.FileMode)
 
+	// Uid returns the owning user id of this inode
+	Uid() uint32
+
+	// SetUid sets the owning user id of this inode
+	SetUid(uid uint32)
+
+	// Gid returns the owning group id of this inode
+	Gid() uint32
+
+	// SetGid sets the owning group id of this inode
+	SetGid(gid uint32)
+
 	Created() time.Time
 
 	SetCreated(time.Time)
@@ -152,6 +164,20 @@ func (ia *inodeAllocator) Next() (InodeNumber, error) {
 	return num, nil
 }
 
+// setInodeNumber replaces the number allocated to inode when it was created
+func setInodeNumber(inode Inode, ino InodeNumber) {
+	switch n := inode.(type) {
+	case *DirectoryInode:
+		n.ino = ino
+	case *FileInode:
+		n.ino = ino
+	case *SymlinkInode:
+		n.ino = ino
+	default:
+		panic("never")
+	}
+}
+
 func InodeSystemUseEntries(identifier string, name string, inode Inode) ([]susp.SystemUseEntry, error) {
 	var result []susp.SystemUseEntry
 
@@ -183,8 +209,8 @@ func InodeSystemUseEntries(identifier string, name string, inode Inode) ([]susp.
 		&rrip.PosixEntry{
 			Mode:  mode,
 			Nlink: inode.Nlink(),
-			Uid:   0, // root
-			Gid:   0, // root
+			Uid:   inode.Uid(),
+			Gid:   inode.Gid(),
 			Ino:   uint32(inode.InodeNumber()),
 		})
 
@@ -0,0 +1,583 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/NVIDIA/vdisc/pkg/iso9660/rrip"
+	"github.com/NVIDIA/vdisc/pkg/iso9660/susp"
+)
+
+// A file, directory or symlink of a StreamingVolume
+type StreamEntry struct {
+	// Slash separated path relative to the root of the volume. An
+	// empty path refers to the root directory itself.
+	Path string
+
+	Type InodeType
+
+	// Size of a file in bytes
+	Size int64
+
+	// Inline files are laid out directly after the directory extents,
+	// ahead of every other file
+	Inline bool
+
+	// Target of a symlink
+	Target string
+
+	// Perm replaces the default permissions when nonzero
+	Perm os.FileMode
+	Uid  uint32
+	Gid  uint32
+
+	// Created and Modified default to the volume timestamp when zero
+	Created  time.Time
+	Modified time.Time
+
+	// Sys is passed through to the file visitor of WriteMetadataTo
+	Sys interface{}
+}
+
+// StreamEntryIterator yields the entries of a StreamingVolume in level
+// order, as defined by LevelOrderKey. Every directory other than the
+// root must have an entry of its own. Next returns io.EOF after the
+// last entry.
+type StreamEntryIterator interface {
+	Next() (*StreamEntry, error)
+}
+
+// LevelOrderKey returns a key for pth such that sorting keys as
+// strings orders paths by depth and then one component at a time,
+// which is the order a StreamingVolume expects its entries in.
+func LevelOrderKey(pth string) string {
+	parts := splitPath(pth)
+	var depth [2]byte
+	binary.BigEndian.PutUint16(depth[:], uint16(len(parts)))
+	return string(depth[:]) + strings.Join(parts, "\x00")
+}
+
+// StreamingVolume writes the same metadata as a Volume without holding
+// the file hierarchy in memory. Instead the entries are read twice,
+// once by Plan to size every directory and again by WriteMetadataTo.
+// Memory use is proportional to the number of directories and the
+// size of the largest directory rather than the number of files.
+//
+// Entries are numbered and laid out in level order, exactly as a
+// Volume is after Canonicalize.
+type StreamingVolume struct {
+	volumeDescriptor
+	now           time.Time
+	nameValidator NameValidator
+	dirs          []*streamDir
+	dirSectors    uint32
+	inlineSectors uint32
+	fileSectors   uint32
+	nextIno       InodeNumber
+	planned       bool
+}
+
+type streamDir struct {
+	path       string
+	identifier string
+	parent     int
+	inode      *streamInode
+	contLen    int
+}
+
+//NewPosixPortableStreamingVolume returns a *StreamingVolume that allows POSIX portable directory names
+func NewPosixPortableStreamingVolume() *StreamingVolume {
+	return newStreamingVolume(NewPosixPortableNameValidator())
+}
+
+//NewNvidiaExtendedStreamingVolume returns a *StreamingVolume that allows directory names in the NVIDIA extended character set
+func NewNvidiaExtendedStreamingVolume() *StreamingVolume {
+	return newStreamingVolume(NewNvidiaExtendedNameValidator())
+}
+
+func newStreamingVolume(validator NameValidator) *StreamingVolume {
+	v := &StreamingVolume{
+		nameValidator: validator,
+	}
+	v.pvd.VolumeSetSize = 1
+	v.pvd.VolumeSequenceNumber = 1
+	v.SetTimestamp(time.Now())
+	return v
+}
+
+// SetTimestamp sets the time recorded in the volume descriptor and
+// used for every entry without timestamps of its own
+func (v *StreamingVolume) SetTimestamp(t time.Time) {
+	v.now = t
+	v.pvd.Created = t
+	v.pvd.Modified = t
+	v.pvd.Effective = t
+}
+
+// Plan reads every entry to compute the layout of the volume. It must
+// be called once before WriteMetadataTo.
+func (v *StreamingVolume) Plan(entries StreamEntryIterator) error {
+	if v.planned {
+		return errors.New("volume already planned")
+	}
+
+	root := v.newInode(&StreamEntry{Type: InodeTypeDirectory}, 1)
+	root.root = true
+	v.dirs = []*streamDir{{identifier: "\x00", inode: root}}
+	v.nextIno = 2
+
+	err := v.walk(entries, true, func(idx int, children []*StreamEntry) error {
+		d := v.dirs[idx]
+		enc := newDirectoryEncoder(0)
+		if err := v.addDots(enc, d); err != nil {
+			return err
+		}
+
+		ids := NewIdentifierAllocator()
+		for _, e := range children {
+			_, name := path.Split(e.Path)
+			if err := v.nameValidator.IsValid(name); err != nil {
+				return fmt.Errorf("%s: AddChild: %v", e.Path, err)
+			}
+			if e.Type == InodeTypeSymlink && len(e.Target) < 1 {
+				return fmt.Errorf("%s: symlink target cannot be empty", e.Path)
+			}
+
+			ident := ids.Next()
+			inode := v.newInode(e, v.nextIno)
+			v.nextIno++
+
+			switch e.Type {
+			case InodeTypeDirectory:
+				d.inode.nlink++
+				v.dirs = append(v.dirs, &streamDir{
+					path:       e.Path,
+					identifier: ident,
+					parent:     idx,
+					inode:      inode,
+				})
+			case InodeTypeFile:
+				ident += ";1"
+				for _, part := range inode.Parts() {
+					if e.Inline {
+						v.inlineSectors += bytesToSectors(part.Size())
+					} else {
+						v.fileSectors += bytesToSectors(part.Size())
+					}
+				}
+			default:
+				ident += ";1"
+			}
+
+			if err := enc.add(ident, name, inode); err != nil {
+				return err
+			}
+		}
+
+		// Directories start relative to the first directory until
+		// the size of the path table is known
+		d.inode.start = LogicalBlockAddress(v.dirSectors)
+		d.inode.size = uint64(enc.dir.Size())
+		d.contLen = enc.cont.Len()
+		v.dirSectors += bytesToSectors(uint32(d.inode.size))
+		if d.contLen > 0 {
+			v.dirSectors += bytesToSectors(uint32(d.contLen))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	pathTable := v.pathTable()
+	v.pvd.PathTableSize = uint32(PathTableEncodedLen(&pathTable))
+
+	sectors := NewSectorAllocator()
+	sectors.Alloc(16 * 2048) // System Use Area
+	sectors.Alloc(2048)      // Primary Volume Descriptor
+	sectors.Alloc(2048)      // Terminator Volume Descriptor
+	v.pvd.LTableStart = sectors.Alloc(v.pvd.PathTableSize)
+	v.pvd.MTableStart = sectors.Alloc(v.pvd.PathTableSize)
+
+	base := LogicalBlockAddress(sectors.Allocated())
+	for _, d := range v.dirs {
+		d.inode.start += base
+	}
+
+	root = v.dirs[0].inode
+	v.pvd.RootStart = root.start
+	v.pvd.RootLength = uint32(root.size)
+	v.pvd.RootModified = root.modified
+	v.pvd.VolumeSpaceSize = uint32(base) + v.dirSectors + v.inlineSectors + v.fileSectors
+
+	v.planned = true
+	return nil
+}
+
+// MetadataSize returns the number of bytes WriteMetadataTo will write
+func (v *StreamingVolume) MetadataSize() int64 {
+	return int64(sectorsToBytes(v.pvd.VolumeSpaceSize - v.inlineSectors - v.fileSectors))
+}
+
+// WriteMetadataTo reads the entries a second time, in the same order
+// as Plan, and writes the volume metadata to w. visit is called for
+// each file with its starting address. Inline files and other files
+// are each visited in address order. The data of inline files, each
+// padded to a whole sector, is expected to follow the metadata.
+func (v *StreamingVolume) WriteMetadataTo(w io.Writer, entries StreamEntryIterator, visit func(e *StreamEntry, start LogicalBlockAddress) error) (int64, error) {
+	if !v.planned {
+		return 0, errors.New("volume not planned")
+	}
+
+	cw := newCountingWriter(w)
+
+	padOutSector := func() error {
+		remainder := int(cw.Written() % LogicalBlockSize)
+		if remainder > 0 {
+			return pad(cw, LogicalBlockSize-remainder)
+		}
+		return nil
+	}
+
+	checkLBA := func(expected LogicalBlockAddress) error {
+		actual := LogicalBlockAddress(cw.Written() / LogicalBlockSize)
+		if cw.Written()%LogicalBlockSize != 0 || expected != actual {
+			return fmt.Errorf("entries changed since Plan: expected lba %d, at offset %d", expected, cw.Written())
+		}
+		return nil
+	}
+
+	// System Use Area
+	if err := pad(cw, 16*LogicalBlockSize); err != nil {
+		return cw.Written(), err
+	}
+
+	// Primary Volume Descriptor
+	if _, err := v.pvd.WriteTo(cw); err != nil {
+		return cw.Written(), err
+	}
+
+	// Terminator
+	var terminator Terminator
+	if _, err := terminator.WriteTo(cw); err != nil {
+		return cw.Written(), err
+	}
+
+	// L-Table and M-Table
+	pathTable := v.pathTable()
+	for _, enc := range []*PathTableEncoder{
+		NewPathTableEncoder(binary.LittleEndian, cw),
+		NewPathTableEncoder(binary.BigEndian, cw),
+	} {
+		if _, err := enc.Encode(&pathTable); err != nil {
+			return cw.Written(), err
+		}
+		if err := padOutSector(); err != nil {
+			return cw.Written(), err
+		}
+	}
+
+	// Directory Extents
+	nextIno := InodeNumber(2)
+	nextDir := 1
+	nextInline := LogicalBlockAddress(v.pvd.VolumeSpaceSize - v.inlineSectors - v.fileSectors)
+	nextFile := LogicalBlockAddress(v.pvd.VolumeSpaceSize - v.fileSectors)
+
+	err := v.walk(entries, false, func(idx int, children []*StreamEntry) error {
+		d := v.dirs[idx]
+		if err := checkLBA(d.inode.start); err != nil {
+			return err
+		}
+
+		enc := newDirectoryEncoder(d.inode.start + LogicalBlockAddress(bytesToSectors(uint32(d.inode.size))))
+		if err := v.addDots(enc, d); err != nil {
+			return err
+		}
+
+		ids := NewIdentifierAllocator()
+		for _, e := range children {
+			_, name := path.Split(e.Path)
+			ident := ids.Next()
+
+			var inode *streamInode
+			switch e.Type {
+			case InodeTypeDirectory:
+				if nextDir >= len(v.dirs) || v.dirs[nextDir].path != e.Path {
+					return fmt.Errorf("entries changed since Plan: unexpected directory %s", e.Path)
+				}
+				inode = v.dirs[nextDir].inode
+				nextDir++
+			case InodeTypeFile:
+				ident += ";1"
+				inode = v.newInode(e, nextIno)
+				next := &nextFile
+				if e.Inline {
+					next = &nextInline
+				}
+				inode.start = *next
+				for _, part := range inode.Parts() {
+					*next += LogicalBlockAddress(bytesToSectors(part.Size()))
+				}
+				if err := visit(e, inode.start); err != nil {
+					return err
+				}
+			default:
+				ident += ";1"
+				inode = v.newInode(e, nextIno)
+			}
+			nextIno++
+
+			if err := enc.add(ident, name, inode); err != nil {
+				return err
+			}
+		}
+
+		if _, err := enc.dir.WriteTo(cw); err != nil {
+			return err
+		}
+		if err := padOutSector(); err != nil {
+			return err
+		}
+
+		if enc.cont.Len() != d.contLen {
+			return fmt.Errorf("entries changed since Plan: continuation area of %s", d.path)
+		}
+		if enc.cont.Len() > 0 {
+			if _, err := enc.cont.WriteTo(cw); err != nil {
+				return err
+			}
+		}
+		return padOutSector()
+	})
+	if err != nil {
+		return cw.Written(), err
+	}
+
+	if nextDir != len(v.dirs) || uint32(nextInline)+v.fileSectors != v.pvd.VolumeSpaceSize || uint32(nextFile) != v.pvd.VolumeSpaceSize {
+		return cw.Written(), errors.New("entries changed since Plan")
+	}
+	return cw.Written(), nil
+}
+
+// walk groups entries by their parent directory and calls visit for
+// every directory in level order along with its children. Directories
+// found along the way are appended to v.dirs by visit during Plan.
+func (v *StreamingVolume) walk(entries StreamEntryIterator, planning bool, visit func(idx int, children []*StreamEntry) error) error {
+	var children []*StreamEntry
+	idx := 0
+	for {
+		e, err := entries.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		e.Path = path.Clean("/" + e.Path)[1:]
+		if e.Path == "" {
+			if e.Type != InodeTypeDirectory {
+				return errors.New("Path may not be the root directory")
+			}
+			if planning {
+				v.dirs[0].inode = v.newInode(e, 1)
+				v.dirs[0].inode.root = true
+			}
+			continue
+		}
+
+		parent, _ := path.Split(e.Path)
+		parent = strings.TrimSuffix(parent, "/")
+		for idx < len(v.dirs) && v.dirs[idx].path != parent {
+			if err := visit(idx, children); err != nil {
+				return err
+			}
+			children = nil
+			idx++
+		}
+		if idx == len(v.dirs) {
+			return fmt.Errorf("%s: parent is not a directory, or entries are not in level order", e.Path)
+		}
+
+		if n := len(children); n > 0 && children[n-1].Path >= e.Path {
+			if children[n-1].Path == e.Path {
+				return fmt.Errorf("%s: Directory entry collision", e.Path)
+			}
+			return fmt.Errorf("%s: entries are not in level order", e.Path)
+		}
+		children = append(children, e)
+	}
+
+	for ; idx < len(v.dirs); idx++ {
+		if err := visit(idx, children); err != nil {
+			return err
+		}
+		children = nil
+	}
+	return nil
+}
+
+// addDots adds the "." and ".." records of d
+func (v *StreamingVolume) addDots(enc *directoryEncoder, d *streamDir) error {
+	if err := enc.add("\x00", ".", d.inode); err != nil {
+		return err
+	}
+	return enc.add("\x01", "..", v.dirs[d.parent].inode)
+}
+
+func (v *StreamingVolume) pathTable() PathTable {
+	var table PathTable
+	for _, d := range v.dirs {
+		table.Records = append(table.Records, PathTableRecord{
+			Identifier:                    d.identifier,
+			ExtendedAttributeRecordLength: 0,
+			Location:                      d.inode.start,
+			ParentIndex:                   uint16(d.parent),
+		})
+	}
+	return table
+}
+
+func (v *StreamingVolume) newInode(e *StreamEntry, ino InodeNumber) *streamInode {
+	inode := &streamInode{
+		typ:      e.Type,
+		ino:      ino,
+		uid:      e.Uid,
+		gid:      e.Gid,
+		created:  v.now,
+		modified: v.now,
+		nlink:    1,
+		target:   e.Target,
+	}
+
+	switch e.Type {
+	case InodeTypeFile:
+		inode.perm = 0444
+		inode.size = uint64(e.Size)
+	case InodeTypeDirectory:
+		inode.perm = 0555
+		inode.nlink = 2
+	case InodeTypeSymlink:
+		inode.perm = 0777
+	}
+
+	if e.Perm&os.ModePerm != 0 {
+		inode.perm = e.Perm & os.ModePerm
+	}
+	if !e.Created.IsZero() {
+		inode.created = e.Created
+	}
+	if !e.Modified.IsZero() {
+		inode.modified = e.Modified
+	}
+	return inode
+}
+
+// streamInode is a self contained Inode used while encoding the
+// directories of a StreamingVolume
+type streamInode struct {
+	typ      InodeType
+	ino      InodeNumber
+	perm     os.FileMode
+	uid      uint32
+	gid      uint32
+	created  time.Time
+	modified time.Time
+	nlink    uint32
+	start    LogicalBlockAddress
+	size     uint64
+	target   string
+	root     bool
+}
+
+func (s *streamInode) Type() InodeType {
+	return s.typ
+}
+
+func (s *streamInode) InodeNumber() InodeNumber {
+	return s.ino
+}
+
+func (s *streamInode) Parts() []InodePart {
+	if s.typ == InodeTypeSymlink {
+		// Symlinks don't have any content
+		return InodeParts(0, 0)
+	}
+	return InodeParts(s.start, s.size)
+}
+
+func (s *streamInode) Perm() os.FileMode {
+	return s.perm
+}
+
+func (s *streamInode) SetPerm(perm os.FileMode) {
+	s.perm = perm & os.ModePerm
+}
+
+func (s *streamInode) Uid() uint32 {
+	return s.uid
+}
+
+func (s *streamInode) SetUid(uid uint32) {
+	s.uid = uid
+}
+
+func (s *streamInode) Gid() uint32 {
+	return s.gid
+}
+
+func (s *streamInode) SetGid(gid uint32) {
+	s.gid = gid
+}
+
+func (s *streamInode) Created() time.Time {
+	return s.created
+}
+
+func (s *streamInode) SetCreated(created time.Time) {
+	s.created = created
+}
+
+func (s *streamInode) Modified() time.Time {
+	return s.modified
+}
+
+func (s *streamInode) SetModified(modified time.Time) {
+	s.modified = modified
+}
+
+func (s *streamInode) AddParent(*DirectoryInode) {}
+
+func (s *streamInode) Nlink() uint32 {
+	return s.nlink
+}
+
+func (s *streamInode) IsRoot() bool {
+	return s.root
+}
+
+func (s *streamInode) AdditionalSystemUseEntries() ([]susp.SystemUseEntry, error) {
+	if s.typ == InodeTypeSymlink {
+		return rrip.NewSymlink(s.target)
+	}
+	return nil, nil
+}
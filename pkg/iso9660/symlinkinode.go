@@ -27,6 +27,8 @@ import (
 type SymlinkInode struct {
 	ino      InodeNumber
 	perm     os.FileMode
+	uid      uint32
+	gid      uint32
 	created  time.Time
 	modified time.Time
 	parent   *DirectoryInode
@@ -71,6 +73,22 @@ func (s *SymlinkInode) SetPerm(perm os.FileMode) {
 	s.perm = perm & os.ModePerm
 }
 
+func (s *SymlinkInode) Uid() uint32 {
+	return s.uid
+}
+
+func (s *SymlinkInode) SetUid(uid uint32) {
+	s.uid = uid
+}
+
+func (s *SymlinkInode) Gid() uint32 {
+	return s.gid
+}
+
+func (s *SymlinkInode) SetGid(gid uint32) {
+	s.gid = gid
+}
+
 func (s *SymlinkInode) Created() time.Time {
 	return s.created
 }
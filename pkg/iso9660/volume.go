@@ -27,7 +27,7 @@ import (
 )
 
 type Volume struct {
-	pvd           PrimaryVolumeDescriptor
+	volumeDescriptor
 	inodeAlloc    InodeAllocator
 	root          *DirectoryInode
 	now           time.Time
@@ -88,6 +88,57 @@ func NewNvidiaExtendedVolume() *Volume {
 	return v
 }
 
+// SetTimestamp sets the creation and modification time recorded in
+// the volume descriptor and the root directory. Inodes added after the
+// call are stamped with t instead of the time the volume was created.
+func (v *Volume) SetTimestamp(t time.Time) {
+	v.now = t
+	v.root.SetCreated(t)
+	v.root.SetModified(t)
+	v.pvd.Created = t
+	v.pvd.Modified = t
+	v.pvd.Effective = t
+}
+
+// Canonicalize reassigns directory entry identifiers and inode numbers
+// in path order, so that the layout written by WriteMetadataTo depends
+// only on the contents of the volume and not on the order they were
+// added in.
+func (v *Volume) Canonicalize() error {
+	ia := NewInodeAllocator()
+	numbered := make(map[Inode]struct{})
+	renumber := func(inode Inode) error {
+		if _, ok := numbered[inode]; ok {
+			return nil
+		}
+		numbered[inode] = struct{}{}
+
+		ino, err := ia.Next()
+		if err != nil {
+			return err
+		}
+		setInodeNumber(inode, ino)
+		return nil
+	}
+
+	if err := renumber(v.root); err != nil {
+		return err
+	}
+
+	return v.root.VisitDirectories(func(rel Relationship) error {
+		dinode := rel.Child.(*DirectoryInode)
+		dinode.sortChildren()
+
+		it := dinode.children.Iterator()
+		for it.Next() {
+			if err := renumber(it.Value().(*dirEntry).child); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (v *Volume) AddSymlink(pth string, target string) (err error) {
 	var leaf Inode
 	leaf, err = NewSymlinkInode(v.inodeAlloc, target)
@@ -114,43 +165,96 @@ func (v *Volume) AddFile(pth string, o storage.Object) (err error) {
 	return
 }
 
+// AddHardlink adds pth as another name for the file at existing. Both
+// names share an inode and the file's data is stored once.
+func (v *Volume) AddHardlink(pth string, existing string) error {
+	inode, ok := v.Lookup(existing)
+	if !ok {
+		return fmt.Errorf("%s: no such file", existing)
+	}
+	if inode.Type() != InodeTypeFile {
+		return fmt.Errorf("%s: hard links are only supported to files", existing)
+	}
+	return v.addLeaf(pth, inode)
+}
+
+// AddDirectory adds a directory, along with any missing parents. It
+// is not an error if the directory already exists.
+func (v *Volume) AddDirectory(pth string) error {
+	parts := splitPath(pth)
+	if len(parts) == 0 {
+		return nil
+	}
+	_, err := v.mkdirAll(parts)
+	return err
+}
+
+// Lookup returns the inode at pth without following symlinks
+func (v *Volume) Lookup(pth string) (Inode, bool) {
+	var inode Inode = v.root
+	for _, part := range splitPath(pth) {
+		dir, ok := inode.(*DirectoryInode)
+		if !ok {
+			return nil, false
+		}
+		inode, ok = dir.GetChild(part)
+		if !ok {
+			return nil, false
+		}
+	}
+	return inode, true
+}
+
 func (v *Volume) addLeaf(pth string, leaf Inode) (err error) {
-	cleaned := path.Clean(pth)
-	if path.IsAbs(cleaned) {
-		cleaned = cleaned[1:]
+	parts := splitPath(pth)
+	if len(parts) == 0 {
+		return errors.New("Path may not be the root directory")
+	}
+
+	parent, err := v.mkdirAll(parts[:len(parts)-1])
+	if err != nil {
+		return
 	}
-	parts := strings.Split(cleaned, "/")
+	err = parent.AddChild(parts[len(parts)-1], leaf)
+	return
+}
 
+// mkdirAll returns the directory at parts, creating it and any
+// missing parents.
+func (v *Volume) mkdirAll(parts []string) (*DirectoryInode, error) {
 	parent := v.root
-	for i, part := range parts {
-		if i == len(parts)-1 {
-			err = parent.AddChild(part, leaf)
-			return
-		}
+	for _, part := range parts {
 		var dir *DirectoryInode
 		inode, ok := parent.GetChild(part)
 		if ok {
 			if inode.Type() != InodeTypeDirectory {
-				err = errors.New("Path segment exists and is not a directory")
-				return
+				return nil, errors.New("Path segment exists and is not a directory")
 			}
 			dir = inode.(*DirectoryInode)
 		} else {
+			var err error
 			dir, err = NewDirectoryInode(v.inodeAlloc, v.nameValidator)
 			if err != nil {
-				return
+				return nil, err
 			}
 			dir.SetCreated(v.now)
 			dir.SetModified(v.now)
 
-			err = parent.AddChild(part, dir)
-			if err != nil {
-				return
+			if err := parent.AddChild(part, dir); err != nil {
+				return nil, err
 			}
 		}
 		parent = dir
 	}
-	return
+	return parent, nil
+}
+
+func splitPath(pth string) []string {
+	cleaned := path.Clean("/" + pth)[1:]
+	if cleaned == "" {
+		return nil
+	}
+	return strings.Split(cleaned, "/")
 }
 
 func (v *Volume) VisitFiles(visit func(storage.Object) error) error {
@@ -160,6 +264,26 @@ func (v *Volume) VisitFiles(visit func(storage.Object) error) error {
 	})
 }
 
+// VisitFileInodesInLayoutOrder visits each FileInode once, hard links
+// included, in the order their data is laid out: inline files and
+// then every other file.
+func (v *Volume) VisitFileInodesInLayoutOrder(visit func(*FileInode) error) error {
+	for _, inline := range []bool{true, false} {
+		visited := make(map[InodeNumber]struct{})
+		err := v.VisitFileInodes(func(finode *FileInode) error {
+			if _, ok := visited[finode.InodeNumber()]; ok || finode.Inline() != inline {
+				return nil
+			}
+			visited[finode.InodeNumber()] = struct{}{}
+			return visit(finode)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (v *Volume) VisitFileInodes(visit func(*FileInode) error) error {
 	return v.root.VisitFiles(func(rel Relationship) error {
 		finode := rel.Child.(*FileInode)
@@ -167,39 +291,45 @@ func (v *Volume) VisitFileInodes(visit func(*FileInode) error) error {
 	})
 }
 
-func (v *Volume) SetSystemIdentifier(val string) {
+// volumeDescriptor holds the primary volume descriptor shared by
+// Volume and StreamingVolume
+type volumeDescriptor struct {
+	pvd PrimaryVolumeDescriptor
+}
+
+func (v *volumeDescriptor) SetSystemIdentifier(val string) {
 	v.pvd.SystemIdentifier = val
 }
 
-func (v *Volume) SetVolumeIdentifier(val string) {
+func (v *volumeDescriptor) SetVolumeIdentifier(val string) {
 	v.pvd.VolumeIdentifier = val
 }
 
-func (v *Volume) SetVolumeSetIdentifier(val string) {
+func (v *volumeDescriptor) SetVolumeSetIdentifier(val string) {
 	v.pvd.VolumeSetIdentifier = val
 }
 
-func (v *Volume) SetPublisherIdentifier(val string) {
+func (v *volumeDescriptor) SetPublisherIdentifier(val string) {
 	v.pvd.PublisherIdentifier = val
 }
 
-func (v *Volume) SetDataPreparerIdentifier(val string) {
+func (v *volumeDescriptor) SetDataPreparerIdentifier(val string) {
 	v.pvd.DataPreparerIdentifier = val
 }
 
-func (v *Volume) SetApplicationIdentifier(val string) {
+func (v *volumeDescriptor) SetApplicationIdentifier(val string) {
 	v.pvd.ApplicationIdentifier = val
 }
 
-func (v *Volume) SetCopyrightFileIdentifier(val string) {
+func (v *volumeDescriptor) SetCopyrightFileIdentifier(val string) {
 	v.pvd.CopyrightFileIdentifier = val
 }
 
-func (v *Volume) SetAbstractFileIdentifier(val string) {
+func (v *volumeDescriptor) SetAbstractFileIdentifier(val string) {
 	v.pvd.AbstractFileIdentifier = val
 }
 
-func (v *Volume) SetBibliographicFileIdentifier(val string) {
+func (v *volumeDescriptor) SetBibliographicFileIdentifier(val string) {
 	v.pvd.BibliographicFileIdentifier = val
 }
 
@@ -242,18 +372,12 @@ func (v *Volume) assignLogicalBlockAddresses() error {
 		return err
 	}
 
-	// Allocate sectors for each FileInode. Only allocate sectors once
-	// per FileInode.
-	inodesVisited := make(map[InodeNumber]struct{})
-	v.root.VisitFiles(func(rel Relationship) error {
-		finode := rel.Child.(*FileInode)
-		if _, ok := inodesVisited[finode.InodeNumber()]; !ok {
-			inodesVisited[finode.InodeNumber()] = struct{}{}
-			parts := finode.Parts()
-			finode.SetStart(sectors.Alloc(parts[0].Size()))
-			for i := 1; i < len(parts); i++ {
-				sectors.Alloc(parts[i].Size())
-			}
+	// Allocate sectors for each FileInode, inline files first
+	v.VisitFileInodesInLayoutOrder(func(finode *FileInode) error {
+		parts := finode.Parts()
+		finode.SetStart(sectors.Alloc(parts[0].Size()))
+		for i := 1; i < len(parts); i++ {
+			sectors.Alloc(parts[i].Size())
 		}
 		return nil
 	})
@@ -262,6 +386,9 @@ func (v *Volume) assignLogicalBlockAddresses() error {
 	return nil
 }
 
+// WriteMetadataTo lays out the volume and writes everything up to the
+// end of the directory extents. The data of inline files, each padded
+// to a whole sector, is expected to follow.
 func (v *Volume) WriteMetadataTo(w io.Writer) (int64, error) {
 	cw := newCountingWriter(w)
 
@@ -388,11 +515,7 @@ func (v *Volume) WriteTo(w io.Writer) (int64, error) {
 		return cw.Written(), err
 	}
 
-	err := v.root.VisitFiles(func(rel Relationship) error {
-		finode := rel.Child.(*FileInode)
-		if finode.Start() == 0 {
-			return nil
-		}
+	err := v.VisitFileInodesInLayoutOrder(func(finode *FileInode) error {
 		assertLBA(finode.Start())
 		if _, err := finode.WriteTo(cw); err != nil {
 			return err
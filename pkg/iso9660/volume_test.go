@@ -20,6 +20,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -170,3 +171,71 @@ func TestVolume(t *testing.T) {
 		assert.Nil(t, err)
 	}
 }
+
+func TestVolumeOwnership(t *testing.T) {
+	volume := iso9660.NewPosixPortableVolume()
+
+	r, err := storage.Open("zero:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, volume.AddFile("a/b.data", r))
+	assert.Nil(t, volume.AddDirectory("a/empty"))
+	assert.Nil(t, volume.AddDirectory("a/empty"))
+
+	inode, ok := volume.Lookup("/a/b.data")
+	assert.True(t, ok)
+	inode.SetUid(1000)
+	inode.SetGid(2000)
+	_, ok = volume.Lookup("a/missing")
+	assert.False(t, ok)
+
+	isow := bytes.NewBuffer(nil)
+	if _, err := volume.WriteMetadataTo(isow); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]*iso9660.FileInfo)
+	walker := iso9660.NewWalker(bytes.NewReader(isow.Bytes()))
+	err = walker.Walk("/", func(path string, info os.FileInfo, err error) error {
+		if info.Name() != "." && info.Name() != ".." {
+			seen[filepath.Join(path, info.Name())] = info.(*iso9660.FileInfo)
+		}
+		return err
+	})
+	assert.Nil(t, err)
+
+	if assert.Contains(t, seen, "/a/b.data") {
+		assert.Equal(t, uint32(1000), seen["/a/b.data"].Uid())
+		assert.Equal(t, uint32(2000), seen["/a/b.data"].Gid())
+	}
+	if assert.Contains(t, seen, "/a/empty") {
+		assert.True(t, seen["/a/empty"].IsDir())
+	}
+}
+
+func TestVolumeCanonicalize(t *testing.T) {
+	paths := []string{"x/a.data", "x/b.data", "y/c.data", "d.data"}
+	epoch := time.Unix(1546300800, 0).UTC()
+
+	burn := func(order []int) []byte {
+		volume := iso9660.NewPosixPortableVolume()
+		volume.SetTimestamp(epoch)
+		for _, i := range order {
+			r, err := storage.Open(fmt.Sprintf("zero:%d", i+1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Nil(t, volume.AddFile(paths[i], r))
+		}
+		assert.Nil(t, volume.Canonicalize())
+
+		isow := bytes.NewBuffer(nil)
+		if _, err := volume.WriteMetadataTo(isow); err != nil {
+			t.Fatal(err)
+		}
+		return isow.Bytes()
+	}
+
+	assert.Equal(t, burn([]int{0, 1, 2, 3}), burn([]int{3, 2, 1, 0}))
+}
@@ -437,9 +437,13 @@ func (it *ReadDirIterator) Next() bool {
 	}
 
 	modTime := time.Unix(0, 0).UTC()
+	created := modTime
 
 	if ts, ok := rrip.DecodeTimestamps(systemUse); ok {
 		modTime = ts.Modified.UTC()
+		if ts.Created != nil {
+			created = ts.Created.UTC()
+		}
 	}
 
 	it.finfo = &FileInfo{
@@ -451,6 +455,7 @@ func (it *ReadDirIterator) Next() bool {
 		gid:     gid,
 		ino:     ino,
 		modTime: modTime,
+		created: created,
 		isDir:   isDir,
 		extent:  curr.Start,
 		target:  target,
@@ -21,6 +21,8 @@ import (
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"go.uber.org/zap"
+
+	"github.com/NVIDIA/vdisc/pkg/storage"
 )
 
 // OpenFile is isoFS openFile ops called in response to a user space file open.
@@ -41,6 +43,10 @@ func (fs *isoFS) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error {
 		fs.logger.Error("open extent", zap.Error(err))
 		return fuse.EINVAL
 	}
+	if obj.Size() > entry.Info.Size() {
+		// Inline files share their extent with other files
+		obj = storage.WithURL(storage.Slice(obj, 0, entry.Info.Size()), obj.URL())
+	}
 
 	fs.fileHandlesMU.Lock()
 	defer fs.fileHandlesMU.Unlock()
@@ -42,6 +42,12 @@ type Remover interface {
 	Remove(ctx context.Context, url string) error
 }
 
+type Copier interface {
+	// Copy an object to another URL of the same driver without
+	// reading it through the client
+	Copy(ctx context.Context, src string, dst string) error
+}
+
 type Readdirer interface {
 	// Readdir reads the contents of the directory and returns a slice
 	// of FileInfo values, as would be returned by Stat, in directory
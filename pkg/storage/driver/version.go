@@ -0,0 +1,73 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"fmt"
+)
+
+// Version identifies a specific revision of an object's content
+type Version struct {
+	ETag      string
+	VersionID string
+}
+
+// IsZero returns true if v does not identify any revision
+func (v Version) IsZero() bool {
+	return v.ETag == "" && v.VersionID == ""
+}
+
+// VersionedFileInfo is implemented by the Sys() value of a FileInfo
+// for drivers that track object revisions.
+type VersionedFileInfo interface {
+	ETag() string
+	Version() string
+}
+
+// FileInfoVersion returns the Version described by fi, if any
+func FileInfoVersion(fi interface{ Sys() interface{} }) Version {
+	if vfi, ok := fi.Sys().(VersionedFileInfo); ok {
+		return Version{ETag: vfi.ETag(), VersionID: vfi.Version()}
+	}
+	return Version{}
+}
+
+// ObjectChangedError is returned when reading an object that no
+// longer matches the Version it was opened with.
+type ObjectChangedError struct {
+	URL     string
+	Version Version
+}
+
+func (e *ObjectChangedError) Error() string {
+	if e.Version.VersionID != "" {
+		return fmt.Sprintf("object changed: %s (version %s)", e.URL, e.Version.VersionID)
+	}
+	return fmt.Sprintf("object changed: %s (etag %s)", e.URL, e.Version.ETag)
+}
+
+var ctxVersionKey int
+
+// CtxWithVersion requests that objects opened with ctx are pinned to v
+func CtxWithVersion(ctx context.Context, v Version) context.Context {
+	return context.WithValue(ctx, &ctxVersionKey, v)
+}
+
+// VersionFromCtx returns the Version objects opened with ctx are pinned to
+func VersionFromCtx(ctx context.Context) (Version, bool) {
+	v, ok := ctx.Value(&ctxVersionKey).(Version)
+	return v, ok && !v.IsZero()
+}
@@ -21,56 +21,89 @@ import (
 	"net/http"
 	"os"
 	"time"
+
+	"github.com/NVIDIA/vdisc/pkg/storage/driver"
 )
 
 func Stat(c *http.Client, url string) (int64, error) {
+	size, _, err := StatVersion(c, url)
+	return size, err
+}
+
+// StatVersion returns the size of an HTTP object along with the
+// revision reported by the server in the ETag and x-amz-version-id
+// headers. A weak ETag doesn't identify the bytes of a revision, so it
+// is left out.
+func StatVersion(c *http.Client, url string) (int64, driver.Version, error) {
+	var version driver.Version
 	resp, err := c.Head(url)
 	if err != nil {
-		return -1, err
+		return -1, version, err
 	}
 
 	defer resp.Body.Close()
 	io.Copy(ioutil.Discard, resp.Body)
 
 	if resp.StatusCode == 404 {
-		return -1, os.ErrNotExist
+		return -1, version, os.ErrNotExist
 	}
 
 	if resp.StatusCode == 405 {
 		// Server doesn't support HEAD, download the whole resource up front.
 		resp, err := c.Get(url)
 		if err != nil {
-			return -1, err
+			return -1, version, err
 		}
 		defer resp.Body.Close()
 		if resp.StatusCode != 200 {
-			return -1, fmt.Errorf("http get %q: HTTP %d", url, resp.StatusCode)
+			return -1, version, fmt.Errorf("http get %q: HTTP %d", url, resp.StatusCode)
 		}
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return -1, fmt.Errorf("http get %q: %+v", url, err)
+			return -1, version, fmt.Errorf("http get %q: %+v", url, err)
 		}
 
-		return int64(len(body)), nil
+		version.ETag = strongETag(resp.Header.Get("ETag"))
+		return int64(len(body)), version, nil
 	}
 
 	if resp.StatusCode != 200 {
-		return -1, fmt.Errorf("http head %q: HTTP %d", url, resp.StatusCode)
+		return -1, version, fmt.Errorf("http head %q: HTTP %d", url, resp.StatusCode)
 	}
 
 	if resp.ContentLength < 0 {
-		return -1, fmt.Errorf("http head %q: bad content length %d", url, resp.ContentLength)
+		return -1, version, fmt.Errorf("http head %q: bad content length %d", url, resp.ContentLength)
+	}
+
+	version.ETag = strongETag(resp.Header.Get("ETag"))
+	version.VersionID = resp.Header.Get("x-amz-version-id")
+	if version.VersionID == "null" {
+		version.VersionID = ""
+	}
+	return resp.ContentLength, version, nil
+}
+
+// strongETag returns etag, or "" if it is a weak validator
+func strongETag(etag string) string {
+	if weakETag(etag) {
+		return ""
 	}
-	return resp.ContentLength, nil
+	return etag
 }
 
 func NewFileInfo(name string, size int64) os.FileInfo {
-	return &finfo{name, size}
+	return &finfo{name: name, size: size}
+}
+
+// NewVersionedFileInfo returns a FileInfo whose Sys() implements driver.VersionedFileInfo
+func NewVersionedFileInfo(name string, size int64, version driver.Version) os.FileInfo {
+	return &finfo{name, size, version}
 }
 
 type finfo struct {
-	name string
-	size int64
+	name    string
+	size    int64
+	version driver.Version
 }
 
 // base name of the file
@@ -100,5 +133,16 @@ func (fi *finfo) IsDir() bool {
 
 // underlying data source (can return nil)
 func (fi *finfo) Sys() interface{} {
-	return nil
+	if fi.version.IsZero() {
+		return nil
+	}
+	return fi
+}
+
+func (fi *finfo) ETag() string {
+	return fi.version.ETag
+}
+
+func (fi *finfo) Version() string {
+	return fi.version.VersionID
 }
@@ -49,7 +49,8 @@ func (d *Driver) Open(ctx context.Context, url string, size int64) (driver.Objec
 	}
 
 	c := d.newClient(ctx)
-	return NewObject(c, url, u, size), nil
+	version, _ := driver.VersionFromCtx(ctx)
+	return NewVersionedObject(c, url, u, size, version), nil
 }
 
 func (d *Driver) Remove(ctx context.Context, url string) error {
@@ -71,13 +72,14 @@ func (d *Driver) Stat(ctx context.Context, url string) (os.FileInfo, error) {
 	name := stdpath.Base(u.Path)
 
 	c := d.newClient(ctx)
+	pinned, _ := driver.VersionFromCtx(ctx)
 
-	size, err := Stat(c, url)
+	size, version, err := StatVersion(c, VersionedURL(u, pinned).String())
 	if err != nil {
 		return nil, err
 	}
 
-	return NewFileInfo(name, size), nil
+	return NewVersionedFileInfo(name, size, version), nil
 }
 
 func (d *Driver) parseURL(url string) (*stdurl.URL, error) {
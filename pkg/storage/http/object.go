@@ -21,6 +21,7 @@ import (
 	"net/http"
 	stdurl "net/url"
 	"os"
+	"strings"
 	"sync"
 
 	"go.uber.org/zap"
@@ -33,19 +34,60 @@ import (
 // NewObject opens an HTTP URL as an Object. If size is negative,
 // a HEAD request will be performed to determine the actual size.
 func NewObject(client *http.Client, url string, u *stdurl.URL, size int64) driver.Object {
+	return NewVersionedObject(client, url, u, size, driver.Version{})
+}
+
+// NewVersionedObject opens an HTTP URL as an Object pinned to a
+// specific revision. Every range read sends the version's ETag as
+// If-Match and its VersionID as the versionId query parameter, and
+// fails with a *driver.ObjectChangedError if the object has changed.
+// If-Match compares ETags strongly, so a weak ETag is instead only
+// compared weakly with the one the response carries.
+func NewVersionedObject(client *http.Client, url string, u *stdurl.URL, size int64, version driver.Version) driver.Object {
 	return &object{
-		client: client,
-		url:    url,
-		u:      u,
-		size:   size,
+		client:  client,
+		url:     url,
+		u:       VersionedURL(u, version),
+		size:    size,
+		version: version,
 	}
 }
 
+// VersionedURL returns u with the versionId query parameter set if
+// version has a VersionID.
+func VersionedURL(u *stdurl.URL, version driver.Version) *stdurl.URL {
+	if version.VersionID == "" {
+		return u
+	}
+
+	pinned := *u
+	q := pinned.Query()
+	q.Set("versionId", version.VersionID)
+	pinned.RawQuery = q.Encode()
+	return &pinned
+}
+
+// weakETag reports whether etag is a weak validator, which only
+// promises semantically equivalent content rather than the same bytes
+func weakETag(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
+
+// matchETag reports whether etag matches the pinned one, comparing
+// them weakly if the pinned one is weak
+func matchETag(pinned, etag string) bool {
+	if weakETag(pinned) {
+		return strings.TrimPrefix(pinned, "W/") == strings.TrimPrefix(etag, "W/")
+	}
+	return pinned == etag
+}
+
 type object struct {
 	client   *http.Client
 	url      string
 	u        *stdurl.URL
 	size     int64
+	version  driver.Version
 	sizeOnce sync.Once
 	sizeErr  error
 	pos      int64
@@ -112,6 +154,9 @@ func (o *object) ReadAt(p []byte, off int64) (n int, err error) {
 
 	req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", off, end-1))
 	req.Header.Add("Accept-Encoding", "identity")
+	if o.version.ETag != "" && !weakETag(o.version.ETag) {
+		req.Header.Add("If-Match", o.version.ETag)
+	}
 
 	resp, err := o.client.Do(req)
 	if err != nil {
@@ -129,10 +174,20 @@ func (o *object) ReadAt(p []byte, off int64) (n int, err error) {
 			err = os.ErrNotExist
 			return
 		}
+		if resp.StatusCode == 412 {
+			err = &driver.ObjectChangedError{URL: o.url, Version: o.version}
+			return
+		}
 		err = fmt.Errorf("http get %q: HTTP %d", o.url, resp.StatusCode)
 		return
 	}
 
+	// Guard against servers that ignore If-Match
+	if etag := resp.Header.Get("ETag"); o.version.ETag != "" && etag != "" && !matchETag(o.version.ETag, etag) {
+		err = &driver.ObjectChangedError{URL: o.url, Version: o.version}
+		return
+	}
+
 	contentRange, err := httputil.GetContentRange(resp)
 	if err != nil {
 		err = fmt.Errorf("http get %q: %+v", o.url, err)
@@ -0,0 +1,104 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpdriver_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	stdurl "net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/storage/driver"
+	"github.com/NVIDIA/vdisc/pkg/storage/http"
+)
+
+func TestVersionedObject(t *testing.T) {
+	content := []byte("hello world")
+	etag := `"v1"`
+	var versionIDs []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		versionIDs = append(versionIDs, r.URL.Query().Get("versionId"))
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "obj", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	u, err := stdurl.Parse(srv.URL + "/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, version, err := httpdriver.StatVersion(srv.Client(), u.String())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	assert.Equal(t, etag, version.ETag)
+
+	version.VersionID = "abc"
+	obj := httpdriver.NewVersionedObject(srv.Client(), u.String(), u, size, version)
+
+	p := make([]byte, 5)
+	n, err := obj.ReadAt(p, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(p[:n]))
+	assert.Equal(t, "abc", versionIDs[len(versionIDs)-1])
+
+	etag = `"v2"`
+	_, err = obj.ReadAt(p, 0)
+	changed, ok := err.(*driver.ObjectChangedError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, u.String(), changed.URL)
+	}
+}
+
+func TestWeakETag(t *testing.T) {
+	content := []byte("hello world")
+	etag := `W/"v1"`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "obj", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	u, err := stdurl.Parse(srv.URL + "/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Weak ETags aren't pinned
+	size, version, err := httpdriver.StatVersion(srv.Client(), u.String())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	assert.True(t, version.IsZero())
+
+	// but an object already pinned to one is still read, since If-Match
+	// would never match it
+	obj := httpdriver.NewVersionedObject(srv.Client(), u.String(), u, size, driver.Version{ETag: etag})
+	p := make([]byte, 5)
+	n, err := obj.ReadAt(p, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(p[:n]))
+
+	etag = `W/"v2"`
+	_, err = obj.ReadAt(p, 0)
+	_, ok := err.(*driver.ObjectChangedError)
+	assert.True(t, ok)
+}
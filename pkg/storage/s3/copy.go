@@ -0,0 +1,125 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3driver
+
+import (
+	"context"
+	"fmt"
+	stdurl "net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/NVIDIA/vdisc/pkg/storage/driver"
+)
+
+const (
+	// maxCopyObjectSize is the largest object S3 copies in a
+	// single request
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+
+	// copyPartSize is the size of the parts larger objects are
+	// copied in
+	copyPartSize = 1024 * 1024 * 1024
+)
+
+// Copy an object server side, possibly between buckets and regions
+func (d *Driver) Copy(ctx context.Context, src string, dst string) error {
+	from, err := d.parseURL(src)
+	if err != nil {
+		return err
+	}
+	to, err := d.parseURL(dst)
+	if err != nil {
+		return err
+	}
+
+	fi, err := d.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	source := (&stdurl.URL{Path: from.Bucket + from.URL.Path}).EscapedPath()
+	var ifMatch *string
+	if pinned, ok := driver.VersionFromCtx(ctx); ok {
+		if pinned.VersionID != "" {
+			source += "?versionId=" + stdurl.QueryEscape(pinned.VersionID)
+		}
+		if pinned.ETag != "" {
+			ifMatch = aws.String(pinned.ETag)
+		}
+	}
+
+	svc := d.newService(ctx, to.BucketRegion)
+	bucket := aws.String(to.Bucket)
+	key := aws.String(to.URL.Path)
+
+	if fi.Size() <= maxCopyObjectSize {
+		_, err := svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:            bucket,
+			Key:               key,
+			CopySource:        aws.String(source),
+			CopySourceIfMatch: ifMatch,
+		})
+		return err
+	}
+
+	upload, err := svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: bucket,
+		Key:    key,
+	})
+	if err != nil {
+		return err
+	}
+
+	var parts []*s3.CompletedPart
+	for off := int64(0); off < fi.Size(); off += copyPartSize {
+		end := off + copyPartSize
+		if end > fi.Size() {
+			end = fi.Size()
+		}
+		number := aws.Int64(int64(len(parts) + 1))
+
+		resp, err := svc.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:            bucket,
+			Key:               key,
+			UploadId:          upload.UploadId,
+			PartNumber:        number,
+			CopySource:        aws.String(source),
+			CopySourceIfMatch: ifMatch,
+			CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", off, end-1)),
+		})
+		if err != nil {
+			svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   bucket,
+				Key:      key,
+				UploadId: upload.UploadId,
+			})
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       resp.CopyPartResult.ETag,
+			PartNumber: number,
+		})
+	}
+
+	_, err = svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          bucket,
+		Key:             key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
@@ -56,7 +56,8 @@ func (d *Driver) Open(ctx context.Context, url string, size int64) (driver.Objec
 	}
 
 	c := d.newClient(ctx, parsed.BucketRegion)
-	return httpdriver.NewObject(c, url, parsed.URL, size), nil
+	version, _ := driver.VersionFromCtx(ctx)
+	return httpdriver.NewVersionedObject(c, url, parsed.URL, size, version), nil
 }
 
 func (d *Driver) Create(ctx context.Context, url string) (driver.ObjectWriter, error) {
@@ -65,16 +66,7 @@ func (d *Driver) Create(ctx context.Context, url string) (driver.ObjectWriter, e
 		return nil, err
 	}
 
-	config := aws.NewConfig().
-		WithRegion(parsed.BucketRegion).
-		WithMaxRetries(100).
-		WithS3DisableContentMD5Validation(true)
-
-	if creds, ok := CredentialsFromCtx(ctx); ok {
-		config = config.WithCredentials(creds)
-	}
-
-	svc := s3.New(d.sess, config)
+	svc := d.newService(ctx, parsed.BucketRegion)
 
 	return NewObjectWriter(svc, parsed.Bucket, parsed.URL.Path, url), nil
 }
@@ -99,8 +91,9 @@ func (d *Driver) Stat(ctx context.Context, url string) (os.FileInfo, error) {
 	name := stdpath.Base(parsed.URL.Path)
 
 	c := d.newClient(ctx, parsed.BucketRegion)
+	pinned, _ := driver.VersionFromCtx(ctx)
 
-	size, err := httpdriver.Stat(c, parsed.URL.String())
+	size, version, err := httpdriver.StatVersion(c, httpdriver.VersionedURL(parsed.URL, pinned).String())
 	if err != nil {
 		return nil, err
 	}
@@ -111,6 +104,8 @@ func (d *Driver) Stat(ctx context.Context, url string) (os.FileInfo, error) {
 		mode:    0644,
 		modTime: time.Unix(0, 0),
 		isDir:   false,
+		etag:    version.ETag,
+		version: version.VersionID,
 	}, nil
 }
 
@@ -219,6 +214,19 @@ func (d *Driver) getBucketRegion(bucketName string) (string, error) {
 	return rp.Apply()
 }
 
+func (d *Driver) newService(ctx context.Context, bucketRegion string) *s3.S3 {
+	config := aws.NewConfig().
+		WithRegion(bucketRegion).
+		WithMaxRetries(100).
+		WithS3DisableContentMD5Validation(true)
+
+	if creds, ok := CredentialsFromCtx(ctx); ok {
+		config = config.WithCredentials(creds)
+	}
+
+	return s3.New(d.sess, config)
+}
+
 func (d *Driver) newClient(ctx context.Context, bucketRegion string) *http.Client {
 	c := &http.Client{}
 	if timeout, ok := TimeoutFromCtx(ctx); ok {
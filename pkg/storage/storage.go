@@ -74,6 +74,24 @@ type VisitorConcurrency interface {
 	driver.VisitorConcurrency
 }
 
+// Version identifies a specific revision of an object's content
+type Version = driver.Version
+
+// ObjectChangedError is returned when reading an object pinned to a
+// Version that has since been modified.
+type ObjectChangedError = driver.ObjectChangedError
+
+// CtxWithVersion pins objects opened with ctx to a specific revision
+func CtxWithVersion(ctx context.Context, v Version) context.Context {
+	return driver.CtxWithVersion(ctx, v)
+}
+
+// FileInfoVersion returns the revision described by a FileInfo
+// returned from Stat or Readdir, if the driver tracks one.
+func FileInfoVersion(fi os.FileInfo) Version {
+	return driver.FileInfoVersion(fi)
+}
+
 // Open opens the Object for reading.
 func Open(url string) (Object, error) {
 	return OpenContextSize(context.Background(), url, -1)
@@ -133,6 +151,50 @@ func RemoveContext(ctx context.Context, url string) error {
 	}
 }
 
+// Copy an object
+func Copy(src string, dst string) error {
+	return CopyContext(context.Background(), src, dst)
+}
+
+// Copy an object. The copy is made server side if both URLs belong to
+// a driver that supports it, and is streamed through the client
+// otherwise. A version in ctx selects the version of src copied.
+func CopyContext(ctx context.Context, src string, dst string) error {
+	sdrvr, err := driver.Find(src)
+	if err != nil {
+		return err
+	}
+	ddrvr, err := driver.Find(dst)
+	if err != nil {
+		return err
+	}
+
+	if copier, ok := sdrvr.(driver.Copier); ok && sdrvr == ddrvr {
+		return copier.Copy(ctx, src, dst)
+	}
+
+	fi, err := sdrvr.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	obj, err := sdrvr.Open(ctx, src, fi.Size())
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	w, err := CreateContext(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, obj); err != nil {
+		w.Abort()
+		return err
+	}
+	_, err = w.Commit()
+	return err
+}
+
 // Stat returns a FileInfo describing the Object
 func Stat(url string) (os.FileInfo, error) {
 	return StatContext(context.Background(), url)
@@ -52,8 +52,9 @@ func (d *Driver) Open(ctx context.Context, url string, size int64) (driver.Objec
 	}
 
 	c := d.newClient(ctx, parsed.Account)
+	version, _ := driver.VersionFromCtx(ctx)
 
-	return httpdriver.NewObject(c, url, parsed.URL, size), nil
+	return httpdriver.NewVersionedObject(c, url, parsed.URL, size, version), nil
 }
 
 func (d *Driver) Create(ctx context.Context, url string) (driver.ObjectWriter, error) {
@@ -101,8 +102,9 @@ func (d *Driver) Stat(ctx context.Context, url string) (os.FileInfo, error) {
 	name := stdpath.Base(parsed.URL.Path)
 
 	c := d.newClient(ctx, parsed.Account)
+	pinned, _ := driver.VersionFromCtx(ctx)
 
-	size, err := httpdriver.Stat(c, parsed.URL.String())
+	size, version, err := httpdriver.StatVersion(c, httpdriver.VersionedURL(parsed.URL, pinned).String())
 	if err != nil {
 		return nil, err
 	}
@@ -112,6 +114,8 @@ func (d *Driver) Stat(ctx context.Context, url string) (os.FileInfo, error) {
 		size:    size,
 		mode:    0644,
 		modTime: time.Unix(0, 0).UTC(),
+		etag:    version.ETag,
+		version: version.VersionID,
 	}, nil
 }
 
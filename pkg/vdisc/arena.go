@@ -0,0 +1,128 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	capnp "zombiezen.com/go/capnproto2"
+
+	"github.com/NVIDIA/vdisc/pkg/storage"
+)
+
+// maxSegments bounds the number of segments of an uncompressed vdisc,
+// enough for pages of billions of extents
+const maxSegments = 1 << 24
+
+// lazyArena is a read-only capnp arena for a message stored
+// uncompressed in the capnp stream framing, which reads each segment
+// from the object the first time it is used
+type lazyArena struct {
+	obj     storage.AnonymousObject
+	offsets []int64
+	segs    []lazySegment
+}
+
+type lazySegment struct {
+	mu     sync.Mutex
+	size   int64
+	data   []byte
+	loaded bool
+}
+
+// newLazyArena reads the segment table of the message stored in obj
+func newLazyArena(obj storage.AnonymousObject) (*lazyArena, error) {
+	var word [4]byte
+	if err := readFull(obj, word[:], 0); err != nil {
+		return nil, err
+	}
+	count := int64(binary.LittleEndian.Uint32(word[:])) + 1
+	hdrLen := (4*(count+1) + 7) / 8 * 8
+	if count > maxSegments || hdrLen > obj.Size() {
+		return nil, validationError("%d segments, in an object of %d bytes", count, obj.Size())
+	}
+
+	hdr := make([]byte, 4*count)
+	if err := readFull(obj, hdr, 4); err != nil {
+		return nil, err
+	}
+
+	a := &lazyArena{
+		obj:     obj,
+		offsets: make([]int64, count),
+		segs:    make([]lazySegment, count),
+	}
+	off := hdrLen
+	for i := range a.segs {
+		a.offsets[i] = off
+		a.segs[i].size = int64(binary.LittleEndian.Uint32(hdr[4*i:])) * 8
+		off += a.segs[i].size
+	}
+	if off != obj.Size() {
+		return nil, validationError("segments take %d bytes, but the object has %d", off, obj.Size())
+	}
+	return a, nil
+}
+
+func (a *lazyArena) NumSegments() int64 {
+	return int64(len(a.segs))
+}
+
+// Data reads a segment, unless it was read before. Reading a segment
+// while holding the lock of a message that uses the arena blocks
+// every other read of the message, so segments that are likely slow
+// to read are fetched ahead of their first use.
+func (a *lazyArena) Data(id capnp.SegmentID) ([]byte, error) {
+	if int64(id) >= a.NumSegments() {
+		return nil, errors.New("segment out of bounds")
+	}
+
+	seg := &a.segs[id]
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+	if !seg.loaded {
+		data := make([]byte, seg.size)
+		if err := readFull(a.obj, data, a.offsets[id]); err != nil {
+			return nil, err
+		}
+		seg.data = data
+		seg.loaded = true
+	}
+	return seg.data, nil
+}
+
+func (a *lazyArena) Allocate(capnp.Size, map[capnp.SegmentID]*capnp.Segment) (capnp.SegmentID, []byte, error) {
+	return 0, nil, errors.New("vdisc messages are read-only")
+}
+
+// Close closes the object the arena reads from
+func (a *lazyArena) Close() error {
+	return a.obj.Close()
+}
+
+// readFull fills p from r at off
+func readFull(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -18,18 +18,26 @@ import (
 	"bufio"
 	"compress/gzip"
 	"context"
-	"io"
+	"fmt"
 	stdurl "net/url"
+	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	capnp "zombiezen.com/go/capnproto2"
 
+	"github.com/NVIDIA/vdisc/pkg/chunkcrypt"
 	"github.com/NVIDIA/vdisc/pkg/iso9660"
 	"github.com/NVIDIA/vdisc/pkg/safecast"
 	"github.com/NVIDIA/vdisc/pkg/storage"
 	"github.com/NVIDIA/vdisc/pkg/vdisc/types"
+	"github.com/NVIDIA/vdisc/pkg/vdisc/types/v1"
 )
 
 // Builder is an interface for building a vdisc
@@ -43,20 +51,188 @@ type Builder interface {
 	SetCopyrightFileIdentifier(string)
 	SetAbstractFileIdentifier(string)
 	SetBibliographicFileIdentifier(string)
-	AddFile(path string, url string, size int64) error
-	AddSymlink(path string, target string) error
+	AddFile(path string, url string, size int64, options ...FileOptions) error
+	AddFileRange(path string, url string, offset int64, length int64, options ...FileOptions) error
+	AddFileParts(path string, urls []string, sizes []int64, options ...FileOptions) error
+	AddSparseFile(path string, size int64, options ...FileOptions) error
+	AddHardlink(path string, existingPath string) error
+	AddSymlink(path string, target string, metadata ...Metadata) error
+	AddDirectory(path string, metadata ...Metadata) error
 	Build() (string, error)
 }
 
 // BuilderConfig is common configuration for a Builder implementation
 type BuilderConfig struct {
 	URL string
+
+	// PinVersions records the ETag or version id of every object
+	// during Build so that reads fail if an object is modified
+	// after the burn.
+	PinVersions bool
+
+	// SourceDateEpoch, when set, replaces the current time in every
+	// timestamp of the volume and orders inodes and extents by path,
+	// so that burning the same files produces byte-identical output
+	// regardless of the order they were added in.
+	SourceDateEpoch *time.Time
+
+	// Dedupe makes AddFile store some files once, as hard links to
+	// the first file added with the same content.
+	Dedupe DedupeMode
+
+	// InlineThreshold, when positive, stores files of up to this many
+	// bytes in the iso metadata object instead of referencing them,
+	// so that reading one doesn't need a request of its own.
+	InlineThreshold int64
+
+	// Streaming selects a builder whose memory use is bounded
+	// regardless of the number of files. Entries are spilled to
+	// TempDir, SpillEntries at a time, and merged during Build.
+	Streaming    bool
+	TempDir      string
+	SpillEntries int
+
+	// Layout selects how the vdisc itself is stored. PageExtents is
+	// the number of extents in each page of the paged layout.
+	Layout      Layout
+	PageExtents int
+}
+
+// pageSize returns the number of extents in each page, or zero unless
+// the vdisc uses the paged layout
+func (cfg BuilderConfig) pageSize() int {
+	if cfg.Layout != LayoutPaged {
+		return 0
+	}
+	if cfg.PageExtents <= 0 {
+		return defaultExtentPageSize
+	}
+	return cfg.PageExtents
+}
+
+const (
+	// Number of concurrent stat requests used to resolve sizes and
+	// pin object versions
+	statConcurrency = 32
+
+	// Attempts made to stat each object, and the delay before the
+	// first retry, doubled after each one
+	statAttempts     = 4
+	statRetryBackoff = 250 * time.Millisecond
+
+	// How often progress is logged while stating objects
+	statProgressInterval = 10 * time.Second
+)
+
+// DedupeMode selects which files a Builder stores only once
+type DedupeMode int
+
+const (
+	// DedupeNone gives every file its own inode and extent
+	DedupeNone DedupeMode = iota
+
+	// DedupeURL links files with the same object URL
+	DedupeURL
+
+	// DedupeChecksum links files with the same object URL or the
+	// same checksum
+	DedupeChecksum
+)
+
+// Layout is the format a vdisc is stored in
+type Layout int
+
+const (
+	// LayoutGzip stores the vdisc gzip compressed, and Load
+	// downloads all of it
+	LayoutGzip Layout = iota
+
+	// LayoutPaged stores the vdisc uncompressed with its extents in
+	// pages, which Load reads on demand, so that the time and memory
+	// it takes to mount a vdisc depend on what is read rather than on
+	// the number of files
+	LayoutPaged
+)
+
+// Metadata holds optional POSIX attributes of a file, directory or
+// symlink. Zero values keep the volume defaults: read-only permissions,
+// root ownership and the time the volume was created. Ctime defaults to
+// Mtime when only Mtime is set.
+type Metadata struct {
+	Mode  os.FileMode
+	Uid   uint32
+	Gid   uint32
+	Mtime time.Time
+	Ctime time.Time
+}
+
+func (m Metadata) equal(other Metadata) bool {
+	return m.Mode == other.Mode &&
+		m.Uid == other.Uid &&
+		m.Gid == other.Gid &&
+		m.Mtime.Equal(other.Mtime) &&
+		m.Ctime.Equal(other.Ctime)
+}
+
+func (m Metadata) apply(inode iso9660.Inode) {
+	if m.Mode&os.ModePerm != 0 {
+		inode.SetPerm(m.Mode)
+	}
+	inode.SetUid(m.Uid)
+	inode.SetGid(m.Gid)
+	if !m.Mtime.IsZero() {
+		inode.SetModified(m.Mtime)
+		inode.SetCreated(m.Mtime)
+	}
+	if !m.Ctime.IsZero() {
+		inode.SetCreated(m.Ctime)
+	}
+}
+
+// FileOptions are optional attributes of a file added to a Builder
+type FileOptions struct {
+	Metadata
+
+	// Checksum of the object content, recorded in the file's extent
+	Checksum Checksum
+
+	// Version pins the object revision, e.g. from a prior Readdir. When
+	// zero and BuilderConfig.PinVersions is set, it is looked up during
+	// Build.
+	Version storage.Version
+
+	// PartVersions pins the revision of each object of a multi-part
+	// file, as Version does for a single object. Parts it leaves zero
+	// are looked up during Build when BuilderConfig.PinVersions is set.
+	PartVersions []storage.Version
+
+	// Compression is the format of a compressed object. The file's
+	// content is the decompressed object, and its size the
+	// decompressed size, which is read from the object when negative.
+	Compression Compression
+
+	// KeyID is the id of the key the object was encrypted with by
+	// chunkcrypt. The file's content is the plaintext, and its size
+	// the plaintext size.
+	KeyID string
+
+	// Inline stores the file with the iso metadata whatever
+	// BuilderConfig.InlineThreshold is, unless it is a file that is
+	// never inlined.
+	Inline bool
+}
+
+// encoded reports whether the object must be decompressed or
+// decrypted to read the file
+func (opts FileOptions) encoded() bool {
+	return opts.Compression != CompressionNone || opts.KeyID != ""
 }
 
 type builder struct {
-	cfg      BuilderConfig
-	volume   *iso9660.Volume
-	numFiles int32
+	cfg        BuilderConfig
+	volume     *iso9660.Volume
+	byURL      map[string][]string
+	byChecksum map[string][]string
 }
 
 // NewISO9660Builder returns a Builder of POSIX portable volume
@@ -66,39 +242,390 @@ func NewISO9660Builder(cfg BuilderConfig) Builder {
 
 // NewPosixPortableISO9660Builder returns a Builder of POSIX portable volume
 func NewPosixPortableISO9660Builder(cfg BuilderConfig) Builder {
-	return &builder{
-		cfg:    cfg,
-		volume: iso9660.NewPosixPortableVolume(),
+	if cfg.Streaming {
+		return newStreamBuilder(cfg, iso9660.NewPosixPortableStreamingVolume())
 	}
+	return newBuilder(cfg, iso9660.NewPosixPortableVolume())
 }
 
 // NewExtendedISO9660Builder returns a Builder of NvidiaExtendedVolume
 func NewExtendedISO9660Builder(cfg BuilderConfig) Builder {
+	if cfg.Streaming {
+		return newStreamBuilder(cfg, iso9660.NewNvidiaExtendedStreamingVolume())
+	}
+	return newBuilder(cfg, iso9660.NewNvidiaExtendedVolume())
+}
+
+func newBuilder(cfg BuilderConfig, volume *iso9660.Volume) *builder {
+	if cfg.SourceDateEpoch != nil {
+		volume.SetTimestamp(cfg.SourceDateEpoch.UTC())
+	}
 	return &builder{
-		cfg:    cfg,
-		volume: iso9660.NewNvidiaExtendedVolume(),
+		cfg:        cfg,
+		volume:     volume,
+		byURL:      make(map[string][]string),
+		byChecksum: make(map[string][]string),
+	}
+}
+
+// AddFile adds a file to the builder. A negative size is looked up
+// during Build.
+func (b *builder) AddFile(path string, url string, size int64, options ...FileOptions) error {
+	size, err := checkZero(url, size)
+	if err != nil {
+		return err
 	}
+	return b.addFile(path, url, false, 0, size, options)
 }
 
-// AddFile adds a file to the builder
-func (b *builder) AddFile(path string, url string, size int64) error {
-	r, err := storage.OpenContextSize(context.Background(), url, size)
+// AddFileRange adds a file whose content is length bytes of the object
+// at url, starting at offset, e.g. a member of a tar archive.
+func (b *builder) AddFileRange(path string, url string, offset int64, length int64, options ...FileOptions) error {
+	if err := checkRange(url, offset, length); err != nil {
+		return err
+	}
+	return b.addFile(path, url, true, offset, length, options)
+}
+
+func (b *builder) addFile(path string, url string, ranged bool, offset int64, size int64, options []FileOptions) error {
+	var opts FileOptions
+	if len(options) > 0 {
+		opts = options[0]
+	}
+
+	if err := checkEncoding(url, ranged, opts); err != nil {
+		return err
+	}
+
+	key := url
+	if ranged {
+		key = rangeKey(url, offset, size)
+	}
+
+	// Sparse files have no object to share
+	_, zero := zeroSize(url)
+	if existing, ok := b.duplicateOf(key, opts); ok && !zero {
+		if err := b.checkDuplicate(existing, url, size); err != nil {
+			return err
+		}
+		if err := b.volume.AddHardlink(path, existing); err != nil {
+			return err
+		}
+		b.remember(existing, key, opts.Checksum)
+		return nil
+	}
+
+	r, err := storage.OpenContextSize(context.Background(), url, offset+size)
 	if err != nil {
 		return err
 	}
+	if ranged {
+		r = storage.WithURL(storage.Slice(r, offset, size), url)
+	}
+
+	err = b.volume.AddFile(path, &fileObject{
+		Object: r,
+		size:   size,
+		opts:   opts,
+		ranged: ranged,
+		offset: offset,
+	})
+	if err != nil {
+		return err
+	}
+	b.applyMetadata(path, opts.Metadata)
+	if !zero {
+		b.remember(path, key, opts.Checksum)
+	}
+	return nil
+}
+
+// AddSparseFile adds a file of size zero bytes, which is served by a
+// zero: URL rather than an object.
+func (b *builder) AddSparseFile(path string, size int64, options ...FileOptions) error {
+	if size < 0 {
+		return fmt.Errorf("invalid sparse file size %d", size)
+	}
+	return b.AddFile(path, zeroURL(size), size, options...)
+}
+
+// AddFileParts adds a file whose content is that of several objects,
+// one after another, e.g. the numbered shards of a large file. Negative
+// sizes are looked up during Build. The versions of the parts are
+// pinned by FileOptions.PartVersions or BuilderConfig.PinVersions.
+func (b *builder) AddFileParts(path string, urls []string, sizes []int64, options ...FileOptions) error {
+	var opts FileOptions
+	if len(options) > 0 {
+		opts = options[0]
+	}
 
-	err = b.volume.AddFile(path, r)
+	parts, err := newFileParts(urls, sizes, opts)
 	if err != nil {
 		return err
 	}
+	if len(parts) == 1 {
+		return b.AddFile(path, urls[0], sizes[0], opts.single(parts[0]))
+	}
+
+	key := strings.Join(urls, " ")
+	size := partsSize(parts)
+	if existing, ok := b.duplicateOf(key, opts); ok {
+		if err := b.checkDuplicate(existing, urls[0], size); err != nil {
+			return err
+		}
+		if err := b.volume.AddHardlink(path, existing); err != nil {
+			return err
+		}
+		b.remember(existing, key, opts.Checksum)
+		return nil
+	}
+
+	// The parts are opened once their sizes are known
+	fobj := &fileObject{size: size, opts: opts, parts: parts}
+	if err := b.volume.AddFile(path, fobj); err != nil {
+		return err
+	}
+	b.applyMetadata(path, opts.Metadata)
+	b.remember(path, key, opts.Checksum)
+	return nil
+}
+
+// filePart is one of the objects making up a multi-part file
+type filePart struct {
+	URL     string
+	Size    int64
+	Version storage.Version
+}
+
+func newFileParts(urls []string, sizes []int64, opts FileOptions) ([]filePart, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("a file needs at least one part")
+	}
+	if len(sizes) != len(urls) {
+		return nil, fmt.Errorf("%d sizes given for %d parts", len(sizes), len(urls))
+	}
+	if len(urls) > 1 && !opts.Version.IsZero() {
+		return nil, errors.New("versions of multi-part files are pinned by PartVersions")
+	}
+	if len(opts.PartVersions) > 0 && len(opts.PartVersions) != len(urls) {
+		return nil, fmt.Errorf("%d versions given for %d parts", len(opts.PartVersions), len(urls))
+	}
+	if len(urls) > 1 && (opts.Compression != CompressionNone || opts.KeyID != "") {
+		return nil, errors.New("multi-part files can't be compressed or encrypted")
+	}
+
+	parts := make([]filePart, len(urls))
+	for i := range urls {
+		parts[i] = filePart{URL: urls[i], Size: sizes[i]}
+		if len(opts.PartVersions) > 0 {
+			parts[i].Version = opts.PartVersions[i]
+		}
+	}
+	return parts, nil
+}
+
+// single returns the options of a file of only one part
+func (opts FileOptions) single(part filePart) FileOptions {
+	if opts.Version.IsZero() {
+		opts.Version = part.Version
+	}
+	opts.PartVersions = nil
+	return opts
+}
+
+// partsSize returns the total size of parts, or -1 if any is unknown
+func partsSize(parts []filePart) int64 {
+	var size int64
+	for _, part := range parts {
+		if part.Size < 0 {
+			return -1
+		}
+		size += part.Size
+	}
+	return size
+}
+
+// checkRange returns an error unless offset and length describe a
+// byte range
+func checkRange(url string, offset int64, length int64) error {
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("%s: invalid range of %d bytes at offset %d", url, length, offset)
+	}
+	return nil
+}
 
-	b.numFiles++
+// checkEncoding returns an error unless the object of a file can be
+// read with the compression and encryption in opts
+func checkEncoding(url string, ranged bool, opts FileOptions) error {
+	encoded := opts.Compression != CompressionNone || opts.KeyID != ""
+	if ranged && encoded {
+		return fmt.Errorf("%s: ranges of compressed or encrypted objects are not supported", url)
+	}
+	if opts.Compression != CompressionNone && opts.KeyID != "" {
+		return fmt.Errorf("%s: objects can't be both compressed and encrypted", url)
+	}
 	return nil
 }
 
+// zeroURL returns the URL of an object of size zero bytes
+func zeroURL(size int64) string {
+	return fmt.Sprintf("zero:%d", size)
+}
+
+// zeroSize returns the size of the object at a zero: URL, or false if
+// url isn't one
+func zeroSize(url string) (int64, bool) {
+	if !strings.HasPrefix(url, "zero:") {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(strings.TrimPrefix(url, "zero:"), 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// checkZero returns the size of a file, which for a zero: URL is the
+// size in the URL, so that it needn't be looked up
+func checkZero(url string, size int64) (int64, error) {
+	n, ok := zeroSize(url)
+	if !ok {
+		return size, nil
+	}
+	if size >= 0 && size != n {
+		return 0, fmt.Errorf("%s: size %d doesn't match the URL", url, size)
+	}
+	return n, nil
+}
+
+// rangeKey identifies a byte range of an object for deduplication
+func rangeKey(url string, offset int64, length int64) string {
+	return fmt.Sprintf("%s[%d,%d)", url, offset, offset+length)
+}
+
+// remember records that the file at path has the content of url, or
+// of a range of it, so that later files with the same content are
+// linked to it. Files that can't be linked to each other are each
+// remembered.
+func (b *builder) remember(path string, url string, checksum Checksum) {
+	switch b.cfg.Dedupe {
+	case DedupeChecksum:
+		if !checksum.IsZero() {
+			b.byChecksum[checksum.String()] = appendPath(b.byChecksum[checksum.String()], path)
+		}
+		fallthrough
+	case DedupeURL:
+		b.byURL[url] = appendPath(b.byURL[url], path)
+	}
+}
+
+// appendPath appends path to paths unless it is already there
+func appendPath(paths []string, path string) []string {
+	for _, p := range paths {
+		if p == path {
+			return paths
+		}
+	}
+	return append(paths, path)
+}
+
+// duplicateOf returns the path of a file previously added with the
+// same content, according to the Dedupe mode. Since a link shares the
+// inode and extent of that file, it must also have been added with the
+// same metadata, version, compression and key.
+func (b *builder) duplicateOf(url string, opts FileOptions) (string, bool) {
+	var candidates []string
+	switch b.cfg.Dedupe {
+	case DedupeChecksum:
+		if !opts.Checksum.IsZero() {
+			candidates = append(candidates, b.byChecksum[opts.Checksum.String()]...)
+		}
+		fallthrough
+	case DedupeURL:
+		candidates = append(candidates, b.byURL[url]...)
+	}
+
+	for _, existing := range candidates {
+		inode, _ := b.volume.Lookup(existing)
+		fobj, ok := inode.(*iso9660.FileInode).Object().(*fileObject)
+		if ok && fobj.opts.linkable(opts) {
+			return existing, true
+		}
+	}
+	return "", false
+}
+
+// linkable reports whether a file added with other can be a link to
+// one added with opts
+func (opts FileOptions) linkable(other FileOptions) bool {
+	if !opts.Checksum.IsZero() && !other.Checksum.IsZero() && opts.Checksum.String() != other.Checksum.String() {
+		return false
+	}
+	return opts.Metadata.equal(other.Metadata) &&
+		opts.Version == other.Version &&
+		equalVersions(opts.PartVersions, other.PartVersions) &&
+		opts.Compression == other.Compression &&
+		opts.KeyID == other.KeyID
+}
+
+func equalVersions(a, b []storage.Version) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDuplicate returns an error if the file at existing can't be
+// the same as an object of the given size
+func (b *builder) checkDuplicate(existing string, url string, size int64) error {
+	inode, _ := b.volume.Lookup(existing)
+	if fobj, ok := inode.(*iso9660.FileInode).Object().(*fileObject); ok {
+		if size >= 0 && fobj.size >= 0 && size != fobj.size {
+			return fmt.Errorf("%s: size %d does not match size %d of duplicate %s", url, size, fobj.size, existing)
+		}
+	}
+	return nil
+}
+
+// AddHardlink adds path as another name for the file at existingPath
+func (b *builder) AddHardlink(path string, existingPath string) error {
+	return b.volume.AddHardlink(path, existingPath)
+}
+
 // AddSymlink adds a symlink to the builder
-func (b *builder) AddSymlink(path string, target string) error {
-	return b.volume.AddSymlink(path, target)
+func (b *builder) AddSymlink(path string, target string, metadata ...Metadata) error {
+	if err := b.volume.AddSymlink(path, target); err != nil {
+		return err
+	}
+
+	if len(metadata) > 0 {
+		b.applyMetadata(path, metadata[0])
+	}
+	return nil
+}
+
+// AddDirectory adds a directory, which may be empty, to the builder.
+// Directories are otherwise created implicitly by AddFile and AddSymlink.
+func (b *builder) AddDirectory(path string, metadata ...Metadata) error {
+	if err := b.volume.AddDirectory(path); err != nil {
+		return err
+	}
+
+	if len(metadata) > 0 {
+		b.applyMetadata(path, metadata[0])
+	}
+	return nil
+}
+
+func (b *builder) applyMetadata(path string, metadata Metadata) {
+	if inode, ok := b.volume.Lookup(path); ok {
+		metadata.apply(inode)
+	}
 }
 
 func (b *builder) SetSystemIdentifier(val string) {
@@ -139,8 +666,30 @@ func (b *builder) SetBibliographicFileIdentifier(val string) {
 
 // Build builds the volume, returning the URL
 func (b *builder) Build() (string, error) {
+	if b.cfg.SourceDateEpoch != nil {
+		if err := b.volume.Canonicalize(); err != nil {
+			return "", errors.Wrap(err, "canonicalizing volume")
+		}
+	}
+
+	zap.L().Debug("stating objects")
+	if err := b.statObjects(); err != nil {
+		return "", errors.Wrap(err, "stating objects")
+	}
+	zap.L().Debug("done stating objects")
+
+	var numInline int
+	b.volume.VisitFileInodesInLayoutOrder(func(finode *iso9660.FileInode) error {
+		if fobj, ok := finode.Object().(*fileObject); ok && b.cfg.inlined(fobj.URL(), fobj.size, len(fobj.parts) > 0 || fobj.opts.encoded(), fobj.opts.Inline) {
+			finode.SetInline(true)
+			numInline++
+		}
+		return nil
+	})
+
 	//
-	// First, write out the iso9660 metadata to a new object
+	// First, write out the iso9660 metadata, followed by the content
+	// of inline files, to a new object
 	//
 	metadataURL := b.cfg.URL + ".isohdr"
 	meta, err := storage.Create(metadataURL)
@@ -157,6 +706,23 @@ func (b *builder) Build() (string, error) {
 		return "", errors.Wrap(err, "writing iso9660 metadata")
 	}
 
+	if numInline > 0 {
+		zap.L().Debug("writing inline files", zap.Int("count", numInline))
+		iw := newInlineWriter(metabuf)
+		b.volume.VisitFileInodesInLayoutOrder(func(finode *iso9660.FileInode) error {
+			if !finode.Inline() {
+				return nil
+			}
+			fobj := finode.Object().(*fileObject)
+			return iw.Add(fobj.URL(), fobj.offset, fobj.size, fobj.opts)
+		})
+		n, err := iw.Close()
+		if err != nil {
+			return "", errors.Wrap(err, "writing inline files")
+		}
+		metaLen += n
+	}
+
 	if err := metabuf.Flush(); err != nil {
 		return "", errors.Wrap(err, "flushing iso9660 metadata")
 	}
@@ -180,11 +746,31 @@ func (b *builder) Build() (string, error) {
 	//
 	// Then build up the inverted trie of object URLs
 	//
+	// Every file other than the inline ones has an extent. Each
+	// distinct URL, including those of the later parts of multi-part
+	// files, is numbered in the order it is first seen.
+	var finodes []*iso9660.FileInode
 	trie := NewTrieMap()
 	trie.Put(muBase.String(), 0)
-	b.volume.VisitFileInodes(func(finode *iso9660.FileInode) error {
-		obj := finode.Object()
-		trie.Put(obj.URL(), finode.Start())
+	numURLs := 1
+	putURL := func(url string) {
+		if _, ok := trie.Get(url); !ok {
+			trie.Put(url, iso9660.LogicalBlockAddress(numURLs))
+			numURLs++
+		}
+	}
+	b.volume.VisitFileInodesInLayoutOrder(func(finode *iso9660.FileInode) error {
+		if finode.Inline() {
+			return nil
+		}
+		finodes = append(finodes, finode)
+
+		putURL(finode.Object().URL())
+		if fobj, ok := finode.Object().(*fileObject); ok {
+			for _, part := range fobj.parts {
+				putURL(part.URL)
+			}
+		}
 		return nil
 	})
 
@@ -205,9 +791,9 @@ func (b *builder) Build() (string, error) {
 		return "", errors.Wrap(err, "vdisc_types.NewRootVDisc")
 	}
 
-	vdisc, err := vroot.NewV1()
+	vdisc, err := vdisc_types_v1.NewVDisc(seg)
 	if err != nil {
-		return "", errors.Wrap(err, "vroot.NewV1()")
+		return "", errors.Wrap(err, "vdisc_types_v1.NewVDisc")
 	}
 
 	vdisc.SetBlockSize(iso9660.LogicalBlockSize)
@@ -230,12 +816,14 @@ func (b *builder) Build() (string, error) {
 	//
 	// Add the extents
 	//
-	numExtents := b.numFiles + 1
+	numExtents := safecast.IntToInt32(len(finodes) + 1)
 	extents, err := vdisc.NewExtents(numExtents)
 	if err != nil {
 		return "", errors.Wrap(err, "vdisc.NewExtents")
 	}
 
+	var keys keyIndex
+	var v2 bool
 	metaBlocks := bytesToSectors(metaLen)
 	metaPadding := uint16(sectorsToBytes(metaBlocks) - metaLen)
 	entry := extents.At(0)
@@ -246,22 +834,80 @@ func (b *builder) Build() (string, error) {
 	entry.SetBlocks(metaBlocks)
 	entry.SetPadding(metaPadding)
 
-	currExtent := 1
-	b.volume.VisitFileInodes(func(finode *iso9660.FileInode) error {
+	for i, finode := range finodes {
 		obj := finode.Object()
 		blocks := bytesToSectors(obj.Size())
 		padding := uint16(sectorsToBytes(blocks) - obj.Size())
 
-		entry := extents.At(currExtent)
-		leaf := leaves[finode.Start()]
+		id, _ := trie.Get(obj.URL())
+		entry := extents.At(i + 1)
+		leaf := leaves[id]
 		entry.SetUriPrefix(safecast.IntToUint32(leaf.Parent))
 		entry.SetUriSuffix(leaf.Content)
 		entry.SetBlocks(blocks)
 		entry.SetPadding(padding)
 
-		currExtent++
-		return nil
-	})
+		if fobj, ok := obj.(*fileObject); ok {
+			if fobj.ranged || len(fobj.parts) > 1 || fobj.opts.Compression != CompressionNone || fobj.opts.KeyID != "" {
+				// v1 readers would misread the extent
+				v2 = true
+			}
+			if fobj.ranged {
+				entry.SetRanged(true)
+				entry.SetOffset(safecast.Int64ToUint64(fobj.offset))
+			}
+			key, err := keys.get(fobj.opts.KeyID)
+			if err != nil {
+				return "", err
+			}
+			entry.SetKey(key)
+			if fobj.opts.Compression != CompressionNone {
+				entry.SetCompression(fobj.opts.Compression)
+				entry.SetCompressedSize(safecast.Int64ToUint64(fobj.compressedSize))
+			}
+			if len(fobj.parts) > 1 {
+				if err := setParts(entry, fobj.parts[1:], trie, leaves); err != nil {
+					return "", errors.Wrap(err, "setting parts")
+				}
+			}
+			if !fobj.opts.Checksum.IsZero() {
+				entry.SetChecksumAlgorithm(fobj.opts.Checksum.Algorithm)
+				if err := entry.SetChecksum(fobj.opts.Checksum.Digest); err != nil {
+					return "", errors.Wrap(err, "entry.SetChecksum")
+				}
+			}
+			if fobj.opts.Version.ETag != "" {
+				if err := entry.SetEtag(fobj.opts.Version.ETag); err != nil {
+					return "", errors.Wrap(err, "entry.SetEtag")
+				}
+			}
+			if fobj.opts.Version.VersionID != "" {
+				if err := entry.SetVersionId(fobj.opts.Version.VersionID); err != nil {
+					return "", errors.Wrap(err, "entry.SetVersionId")
+				}
+			}
+		}
+	}
+
+	if len(keys.ids) > 0 {
+		keyIDs, err := vdisc.NewKeyIds(safecast.IntToInt32(len(keys.ids)))
+		if err != nil {
+			return "", errors.Wrap(err, "vdisc.NewKeyIds")
+		}
+		for i, id := range keys.ids {
+			if err := keyIDs.Set(i, id); err != nil {
+				return "", errors.Wrap(err, "keyIDs.Set")
+			}
+		}
+	}
+	if v2 {
+		err = vroot.SetV2(vdisc)
+	} else {
+		err = vroot.SetV1(vdisc)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "setting root vdisc")
+	}
 	zap.L().Debug("done building capnp message")
 
 	zap.L().Debug("writing capnp message")
@@ -274,19 +920,23 @@ func (b *builder) Build() (string, error) {
 	}
 	defer vd.Abort()
 
-	var vdw io.Writer = vd
-	vdz, err := gzip.NewWriterLevel(vd, gzip.BestCompression)
-	if err != nil {
-		return "", errors.Wrap(err, "creating gzip writer")
-	}
-	vdw = vdz
+	if pageSize := b.cfg.pageSize(); pageSize > 0 {
+		if err := writePaged(vd, vdisc, inverted, keys.ids, pageSize, b.cfg.TempDir); err != nil {
+			return "", errors.Wrap(err, "writing paged vdisc")
+		}
+	} else {
+		vdz, err := gzip.NewWriterLevel(vd, gzip.BestCompression)
+		if err != nil {
+			return "", errors.Wrap(err, "creating gzip writer")
+		}
 
-	if err := capnp.NewEncoder(vdw).Encode(msg); err != nil {
-		return "", errors.Wrap(err, "capnp encode")
-	}
+		if err := capnp.NewEncoder(vdz).Encode(msg); err != nil {
+			return "", errors.Wrap(err, "capnp encode")
+		}
 
-	if err := vdz.Close(); err != nil {
-		return "", errors.Wrap(err, "closing gzip writer")
+		if err := vdz.Close(); err != nil {
+			return "", errors.Wrap(err, "closing gzip writer")
+		}
 	}
 
 	vdiscCommitInfo, err := vd.Commit()
@@ -298,6 +948,271 @@ func (b *builder) Build() (string, error) {
 	return vdiscCommitInfo.ObjectURL(), nil
 }
 
+// statObjects resolves the size of every object added without one and,
+// with PinVersions, the revision of every object without a version.
+func (b *builder) statObjects() error {
+	var targets []statTarget
+	var parts []*fileObject
+	seen := make(map[*fileObject]bool)
+	b.volume.VisitFileInodes(func(finode *iso9660.FileInode) error {
+		fobj, ok := finode.Object().(*fileObject)
+		if !ok || seen[fobj] {
+			return nil
+		}
+		seen[fobj] = true
+
+		if len(fobj.parts) > 0 {
+			parts = append(parts, fobj)
+			for i := range fobj.parts {
+				part := &fobj.parts[i]
+				t := statTarget{url: part.URL, size: &part.Size}
+				if b.cfg.PinVersions && part.Version.IsZero() {
+					t.version = &part.Version
+				}
+				if part.Size < 0 || t.version != nil {
+					targets = append(targets, t)
+				}
+			}
+			return nil
+		}
+
+		t := statTarget{
+			url:            fobj.URL(),
+			size:           &fobj.size,
+			ranged:         fobj.ranged,
+			offset:         fobj.offset,
+			compression:    fobj.opts.Compression,
+			compressedSize: &fobj.compressedSize,
+			encrypted:      fobj.opts.KeyID != "",
+		}
+		if b.cfg.PinVersions && fobj.opts.Version.IsZero() {
+			t.version = &fobj.opts.Version
+		}
+		if fobj.size < 0 || t.version != nil || t.compression != CompressionNone {
+			targets = append(targets, t)
+		}
+		return nil
+	})
+
+	if err := statObjects(targets); err != nil {
+		return err
+	}
+
+	for _, fobj := range parts {
+		if err := fobj.openParts(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statTarget is an object to be stated by statObjects. A negative size
+// is filled in, otherwise it is checked. A ranged target's size is that
+// of the range at offset, which the object must contain. When version
+// is not nil the object's revision is recorded in it. The size of a
+// compressed target is its decompressed size, and the size of the
+// object itself is recorded in compressedSize. The size of an
+// encrypted target is that of its plaintext.
+type statTarget struct {
+	url            string
+	size           *int64
+	ranged         bool
+	offset         int64
+	version        *storage.Version
+	compression    Compression
+	compressedSize *int64
+	encrypted      bool
+}
+
+// statObjects concurrently stats every target, retrying transient
+// failures and periodically logging its progress.
+func statObjects(targets []statTarget) error {
+	if len(targets) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	work := make(chan statTarget)
+	errs := make(chan error, statConcurrency)
+	var done int64
+
+	var wg sync.WaitGroup
+	wg.Add(statConcurrency)
+	for i := 0; i < statConcurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for t := range work {
+				fi, err := statWithRetry(ctx, t.url)
+				if err != nil {
+					errs <- errors.Wrap(err, "stat "+t.url)
+					cancel()
+					return
+				}
+				size := fi.Size()
+				if t.encrypted {
+					if size, err = chunkcrypt.PlaintextSize(size); err != nil {
+						errs <- errors.Wrap(err, t.url)
+						cancel()
+						return
+					}
+				}
+				if t.compression != CompressionNone {
+					*t.compressedSize = size
+					if size, err = decompressedSize(ctx, t.url, size, t.compression); err != nil {
+						errs <- err
+						cancel()
+						return
+					}
+				}
+				if t.ranged {
+					if end := t.offset + *t.size; size < end {
+						errs <- fmt.Errorf("%s: size %d does not contain the range ending at %d", t.url, size, end)
+						cancel()
+						return
+					}
+				} else if *t.size < 0 {
+					*t.size = size
+				} else if size != *t.size {
+					errs <- fmt.Errorf("%s: size %d does not match expected size %d", t.url, size, *t.size)
+					cancel()
+					return
+				}
+				if t.version != nil {
+					*t.version = storage.FileInfoVersion(fi)
+				}
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(statProgressInterval)
+	defer ticker.Stop()
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				zap.L().Info("stating objects", zap.Int64("done", atomic.LoadInt64(&done)), zap.Int("total", len(targets)))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+feed:
+	for _, t := range targets {
+		select {
+		case work <- t:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// statWithRetry stats url, retrying with exponential backoff unless the
+// object doesn't exist
+func statWithRetry(ctx context.Context, url string) (os.FileInfo, error) {
+	backoff := statRetryBackoff
+	for attempt := 1; ; attempt++ {
+		fi, err := storage.StatContext(ctx, url)
+		if err == nil || attempt == statAttempts || os.IsNotExist(errors.Cause(err)) {
+			return fi, err
+		}
+
+		zap.L().Debug("retrying stat", zap.String("url", url), zap.Int("attempt", attempt), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// fileObject carries the FileOptions of a file through the iso9660
+// volume. Its size is negative until resolved by Build. A ranged file
+// is size bytes of its object, starting at offset, and a multi-part
+// file has no object until Build opens its parts. The size of a
+// compressed file's object is looked up by Build.
+type fileObject struct {
+	storage.Object
+	size           int64
+	opts           FileOptions
+	ranged         bool
+	offset         int64
+	parts          []filePart
+	compressedSize int64
+}
+
+func (o *fileObject) Size() int64 {
+	return o.size
+}
+
+// openParts concatenates the parts of a multi-part file once their
+// sizes are known
+func (o *fileObject) openParts() error {
+	objs := make([]storage.AnonymousObject, len(o.parts))
+	o.size = 0
+	for i, part := range o.parts {
+		ctx := context.Background()
+		if !part.Version.IsZero() {
+			ctx = storage.CtxWithVersion(ctx, part.Version)
+		}
+		obj, err := storage.OpenContextSize(ctx, part.URL, part.Size)
+		if err != nil {
+			return err
+		}
+		objs[i] = obj
+		o.size += part.Size
+	}
+
+	// The extent records the version of the first part
+	o.Object = storage.WithURL(storage.Concat(objs...), o.parts[0].URL)
+	o.opts.Version = o.parts[0].Version
+	return nil
+}
+
+// setParts records every part of a multi-part file but the first in
+// its extent
+func setParts(entry vdisc_types_v1.Extent, parts []filePart, trie *TrieMap, leaves map[iso9660.LogicalBlockAddress]InvertedTrieNode) error {
+	list, err := entry.NewParts(safecast.IntToInt32(len(parts)))
+	if err != nil {
+		return err
+	}
+
+	for i, part := range parts {
+		id, _ := trie.Get(part.URL)
+		leaf := leaves[id]
+		p := list.At(i)
+		p.SetUriPrefix(safecast.IntToUint32(leaf.Parent))
+		if err := p.SetUriSuffix(leaf.Content); err != nil {
+			return err
+		}
+		p.SetSize(safecast.Int64ToUint64(part.Size))
+		if part.Version.ETag != "" {
+			if err := p.SetEtag(part.Version.ETag); err != nil {
+				return err
+			}
+		}
+		if part.Version.VersionID != "" {
+			if err := p.SetVersionId(part.Version.VersionID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Calculates the number of sectors needed to hold bytes. Zero bytes result in one sector.
 func bytesToSectors(bytes int64) uint32 {
 	sectors := uint32(bytes / iso9660.LogicalBlockSize)
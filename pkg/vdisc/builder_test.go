@@ -0,0 +1,855 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	capnp "zombiezen.com/go/capnproto2"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/chunkcrypt"
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+	"github.com/NVIDIA/vdisc/pkg/vdisc/types"
+	"github.com/NVIDIA/vdisc/pkg/zstdseek"
+)
+
+// burnVDisc builds a vdisc with cfg from the files add adds to the
+// builder, and loads it with a memory cache and opts
+func burnVDisc(t *testing.T, cfg vdisc.BuilderConfig, add func(b vdisc.Builder), opts ...vdisc.LoadOptions) vdisc.VDisc {
+	b := vdisc.NewISO9660Builder(cfg)
+	add(b)
+	url, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slicer, err := caching.NewMemorySlicer(4096, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := vdisc.Load(url, caching.NewCache(slicer, 0, 0), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// extentsOf returns every extent of v, in order
+func extentsOf(t *testing.T, v vdisc.VDisc) []vdisc.ExtentInfo {
+	var extents []vdisc.ExtentInfo
+	err := v.VisitExtents(func(ext vdisc.ExtentInfo) error {
+		extents = append(extents, ext)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return extents
+}
+
+// extentURLs returns the base name of the URL of every extent of v
+func extentURLs(t *testing.T, v vdisc.VDisc) []string {
+	var urls []string
+	for _, ext := range extentsOf(t, v) {
+		urls = append(urls, filepath.Base(ext.URL))
+	}
+	return urls
+}
+
+// readPath returns the content of the file at pth in v
+func readPath(t *testing.T, v vdisc.VDisc, pth string) (string, error) {
+	f, err := iso9660.NewWalker(v.Image()).Open(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	return string(data), err
+}
+
+func TestUnknownSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		contents[name] = strings.Repeat("y", i*97)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, streaming := range []bool{false, true} {
+		cfg := vdisc.BuilderConfig{
+			URL:       filepath.Join(dir, fmt.Sprintf("test-%v.vdisc", streaming)),
+			Streaming: streaming,
+		}
+		v := burnVDisc(t, cfg, func(b vdisc.Builder) {
+			for name := range contents {
+				if err := b.AddFile(name, filepath.Join(dir, name), -1); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+
+		for name, content := range contents {
+			data, err := readPath(t, v, name)
+			assert.Nil(t, err)
+			assert.Equal(t, content, data)
+		}
+		v.Close()
+	}
+
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{
+		URL:       filepath.Join(dir, "missing.vdisc"),
+		Streaming: true,
+	})
+	assert.Nil(t, b.AddFile("missing", filepath.Join(dir, "missing"), -1))
+	_, err = b.Build()
+	assert.NotNil(t, err)
+}
+
+func TestHardlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("same"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checksum, err := vdisc.ParseChecksum(fmt.Sprintf("md5:%x", md5.Sum([]byte("same"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one and three share a checksum, two shares the URL of one and
+	// four that of three, and dir/five links to four
+	cfg := vdisc.BuilderConfig{
+		URL:    filepath.Join(dir, "test.vdisc"),
+		Dedupe: vdisc.DedupeChecksum,
+	}
+	v := burnVDisc(t, cfg, func(b vdisc.Builder) {
+		assert.Nil(t, b.AddFile("one", filepath.Join(dir, "a"), 4, vdisc.FileOptions{Checksum: checksum}))
+		assert.Nil(t, b.AddFile("dir/two", filepath.Join(dir, "a"), 4))
+		assert.Nil(t, b.AddFile("three", filepath.Join(dir, "b"), 4, vdisc.FileOptions{Checksum: checksum}))
+		assert.Nil(t, b.AddFile("four", filepath.Join(dir, "b"), 4))
+		assert.Nil(t, b.AddHardlink("dir/five", "four"))
+		assert.NotNil(t, b.AddHardlink("six", "dir"))
+		assert.NotNil(t, b.AddFile("seven", filepath.Join(dir, "a"), 5))
+	}, vdisc.LoadOptions{VerifyChecksums: true})
+	defer v.Close()
+
+	assert.Equal(t, []string{"test.vdisc.isohdr", "a"}, extentURLs(t, v))
+
+	links := make(map[string]uint32)
+	inos := make(map[uint32]bool)
+	w := iso9660.NewWalker(v.Image())
+	err = w.Walk("/", func(pth string, info os.FileInfo, err error) error {
+		if fi, ok := info.(*iso9660.FileInfo); ok && info.Mode().IsRegular() {
+			links[path.Join(pth, info.Name())] = fi.Nlink()
+			inos[fi.Ino()] = true
+		}
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]uint32{"/one": 5, "/dir/two": 5, "/three": 5, "/four": 5, "/dir/five": 5}, links)
+	assert.Equal(t, 1, len(inos))
+
+	four, err := w.Lstat("four")
+	if err != nil {
+		t.Fatal(err)
+	}
+	five, err := w.Lstat("dir/five")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, four.Ino(), five.Ino())
+	assert.Equal(t, four.Extent(), five.Extent())
+	data, err := readPath(t, v, "dir/five")
+	assert.Nil(t, err)
+	assert.Equal(t, "same", data)
+
+	// Without deduplication the same URL gets an extent per file
+	cfg = vdisc.BuilderConfig{URL: filepath.Join(dir, "nodedupe.vdisc")}
+	v2 := burnVDisc(t, cfg, func(b vdisc.Builder) {
+		assert.Nil(t, b.AddFile("one", filepath.Join(dir, "a"), 4))
+		assert.Nil(t, b.AddFile("two", filepath.Join(dir, "a"), 4))
+	})
+	defer v2.Close()
+
+	assert.Equal(t, []string{"nodedupe.vdisc.isohdr", "a", "a"}, extentURLs(t, v2))
+}
+
+// Files with the same object are only linked if they would also share
+// an inode and extent
+func TestDedupeDistinctFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	obj := filepath.Join(dir, "a")
+	if err := ioutil.WriteFile(obj, []byte("same"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := vdisc.BuilderConfig{
+		URL:    filepath.Join(dir, "test.vdisc"),
+		Dedupe: vdisc.DedupeURL,
+	}
+	mode := vdisc.FileOptions{Metadata: vdisc.Metadata{Mode: 0600}}
+	pinned := vdisc.FileOptions{Version: storage.Version{ETag: "etag"}}
+	v := burnVDisc(t, cfg, func(b vdisc.Builder) {
+		assert.Nil(t, b.AddFile("plain", obj, 4))
+		assert.Nil(t, b.AddFile("plain-link", obj, 4))
+		assert.Nil(t, b.AddFile("mode", obj, 4, mode))
+		assert.Nil(t, b.AddFile("mode-link", obj, 4, mode))
+		assert.Nil(t, b.AddFile("pinned", obj, 4, pinned))
+		assert.Nil(t, b.AddSparseFile("sparse1", 100))
+		assert.Nil(t, b.AddSparseFile("sparse2", 100))
+	})
+	defer v.Close()
+
+	assert.Equal(t, []string{"test.vdisc.isohdr", "a", "a", "a", "zero:100", "zero:100"}, extentURLs(t, v))
+
+	links := make(map[string]uint32)
+	perms := make(map[string]os.FileMode)
+	err = iso9660.NewWalker(v.Image()).Walk("/", func(pth string, info os.FileInfo, err error) error {
+		if fi, ok := info.(*iso9660.FileInfo); ok && info.Mode().IsRegular() {
+			links[info.Name()] = fi.Nlink()
+			perms[info.Name()] = info.Mode().Perm()
+		}
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]uint32{
+		"plain": 2, "plain-link": 2, "mode": 2, "mode-link": 2, "pinned": 1, "sparse1": 1, "sparse2": 1,
+	}, links)
+	assert.Equal(t, os.FileMode(0600), perms["mode-link"])
+	assert.Equal(t, os.FileMode(0444), perms["plain-link"])
+}
+
+func TestInlineFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		contents[name] = strings.Repeat("z", i*300)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	epoch := time.Unix(1500000000, 0).UTC()
+	var isohdrs [][]byte
+	for _, streaming := range []bool{false, true} {
+		cfg := vdisc.BuilderConfig{
+			URL:             filepath.Join(dir, fmt.Sprintf("test-%v", streaming), "test.vdisc"),
+			SourceDateEpoch: &epoch,
+			InlineThreshold: 2048,
+			Streaming:       streaming,
+		}
+		v := burnVDisc(t, cfg, func(b vdisc.Builder) {
+			b.SetVolumeIdentifier("test")
+			for name, content := range contents {
+				if err := b.AddFile(name, filepath.Join(dir, name), int64(len(content))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+		isohdrs = append(isohdrs, readFile(t, cfg.URL+".isohdr"))
+
+		// Only the files over the threshold get an extent
+		assert.Equal(t, 1+13, len(extentsOf(t, v)))
+
+		for name, content := range contents {
+			data, err := readPath(t, v, name)
+			assert.Nil(t, err)
+			assert.Equal(t, content, data)
+		}
+		v.Close()
+	}
+	assert.Equal(t, isohdrs[0], isohdrs[1])
+
+	// Inline content is checked against its checksum while burning
+	checksum, err := vdisc.ParseChecksum("md5:00000000000000000000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, streaming := range []bool{false, true} {
+		b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{
+			URL:             filepath.Join(dir, fmt.Sprintf("bad-%v.vdisc", streaming)),
+			InlineThreshold: 2048,
+			Streaming:       streaming,
+		})
+		assert.Nil(t, b.AddFile("bad", filepath.Join(dir, "file01"), 300, vdisc.FileOptions{Checksum: checksum}))
+		_, err = b.Build()
+		assert.NotNil(t, err)
+	}
+
+	// Files added with Inline are inlined whatever their size
+	for _, streaming := range []bool{false, true} {
+		cfg := vdisc.BuilderConfig{
+			URL:       filepath.Join(dir, fmt.Sprintf("forced-%v.vdisc", streaming)),
+			Streaming: streaming,
+		}
+		v := burnVDisc(t, cfg, func(b vdisc.Builder) {
+			assert.Nil(t, b.AddFile("inline", filepath.Join(dir, "file19"), -1, vdisc.FileOptions{Inline: true}))
+			assert.Nil(t, b.AddFileRange("range", filepath.Join(dir, "file19"), 100, 200, vdisc.FileOptions{Inline: true}))
+			assert.Nil(t, b.AddFile("extent", filepath.Join(dir, "file19"), -1))
+		})
+		assert.Equal(t, 1+1, len(extentsOf(t, v)))
+		for name, content := range map[string]string{"inline": contents["file19"], "range": contents["file19"][100:300], "extent": contents["file19"]} {
+			data, err := readPath(t, v, name)
+			assert.Nil(t, err)
+			assert.Equal(t, content, data, name)
+		}
+		v.Close()
+	}
+}
+
+func TestFileRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Members of a single pack object, larger than a cache block so
+	// that ranges of the same object must not share cache entries
+	members := []string{
+		strings.Repeat("a", 5000),
+		strings.Repeat("b", 7000),
+		strings.Repeat("c", 300),
+	}
+	pack := filepath.Join(dir, "pack")
+	if err := ioutil.WriteFile(pack, []byte(strings.Join(members, "")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := vdisc.ParseChecksum(fmt.Sprintf("md5:%x", md5.Sum([]byte(members[1]))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, streaming := range []bool{false, true} {
+		cfg := vdisc.BuilderConfig{
+			URL:       filepath.Join(dir, fmt.Sprintf("test-%v.vdisc", streaming)),
+			Streaming: streaming,
+		}
+		v := burnVDisc(t, cfg, func(b vdisc.Builder) {
+			var offset int64
+			for i, member := range members {
+				var opts vdisc.FileOptions
+				if i == 1 {
+					opts.Checksum = checksum
+				}
+				if err := b.AddFileRange(fmt.Sprintf("member%d", i), pack, offset, int64(len(member)), opts); err != nil {
+					t.Fatal(err)
+				}
+				offset += int64(len(member))
+			}
+			assert.NotNil(t, b.AddFileRange("negative", pack, -1, 10))
+		}, vdisc.LoadOptions{VerifyChecksums: true})
+
+		var offsets []int64
+		for _, ext := range extentsOf(t, v) {
+			if ext.Ranged {
+				offsets = append(offsets, ext.Offset)
+			}
+		}
+		assert.Equal(t, []int64{0, 5000, 12000}, offsets)
+
+		for i, member := range members {
+			data, err := readPath(t, v, fmt.Sprintf("member%d", i))
+			assert.Nil(t, err)
+			assert.Equal(t, member, data)
+		}
+		v.Close()
+	}
+
+	// The object must contain the whole range, which is checked when
+	// the object is looked up, as it is to pin its version
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{
+		URL:         filepath.Join(dir, "short.vdisc"),
+		PinVersions: true,
+	})
+	assert.Nil(t, b.AddFileRange("past-end", pack, 12000, 301))
+	_, err = b.Build()
+	assert.NotNil(t, err)
+}
+
+// Vdiscs with extents that v1 readers would misread keep their disc
+// image in the v2 field, so that those readers find none
+func TestFormatVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	obj := filepath.Join(dir, "obj")
+	if err := ioutil.WriteFile(obj, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, streaming := range []bool{false, true} {
+		for _, layout := range []vdisc.Layout{vdisc.LayoutGzip, vdisc.LayoutPaged} {
+			for _, ranged := range []bool{false, true} {
+				cfg := vdisc.BuilderConfig{
+					URL:       filepath.Join(dir, fmt.Sprintf("test-%v-%v-%v.vdisc", streaming, layout, ranged)),
+					Streaming: streaming,
+					Layout:    layout,
+				}
+				expected := "0123456789"
+				v := burnVDisc(t, cfg, func(b vdisc.Builder) {
+					var err error
+					if ranged {
+						expected = "23456"
+						err = b.AddFileRange("file", obj, 2, 5)
+					} else {
+						err = b.AddFile("file", obj, 10)
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				})
+
+				v2 := ranged || layout == vdisc.LayoutPaged
+				root := readRootVDisc(t, cfg.URL)
+				assert.Equal(t, !v2, root.HasV1())
+				assert.Equal(t, v2, root.HasV2())
+
+				data, err := readPath(t, v, "file")
+				assert.Nil(t, err)
+				assert.Equal(t, expected, data)
+				v.Close()
+			}
+		}
+	}
+}
+
+// readRootVDisc decodes the root of the message of a vdisc in either
+// layout
+func readRootVDisc(t *testing.T, url string) vdisc_types.VDisc {
+	raw := readFile(t, url)
+	var r io.Reader = bytes.NewReader(raw)
+	if bytes.HasPrefix(raw, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	msg, err := capnp.NewDecoder(r).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := vdisc_types.ReadRootVDisc(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestFileParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Parts that aren't block aligned, so reads must cross them
+	contents := []string{
+		strings.Repeat("a", 5000),
+		strings.Repeat("b", 3),
+		strings.Repeat("c", 7001),
+	}
+	var urls []string
+	for i, content := range contents {
+		url := filepath.Join(dir, fmt.Sprintf("part%d", i))
+		if err := ioutil.WriteFile(url, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, url)
+	}
+	whole := strings.Join(contents, "")
+	checksum, err := vdisc.ParseChecksum("md5:" + fmt.Sprintf("%x", md5.Sum([]byte(whole))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, streaming := range []bool{false, true} {
+		cfg := vdisc.BuilderConfig{
+			URL:       filepath.Join(dir, fmt.Sprintf("test-%v.vdisc", streaming)),
+			Streaming: streaming,
+		}
+		v := burnVDisc(t, cfg, func(b vdisc.Builder) {
+			sizes := []int64{5000, -1, 7001}
+			if err := b.AddFileParts("joined", urls, sizes, vdisc.FileOptions{Checksum: checksum}); err != nil {
+				t.Fatal(err)
+			}
+			assert.NotNil(t, b.AddFileParts("mismatched", urls, sizes[:2]))
+		}, vdisc.LoadOptions{VerifyChecksums: true})
+
+		var parts []vdisc.PartInfo
+		for _, ext := range extentsOf(t, v) {
+			if len(ext.Parts) > 0 {
+				assert.Equal(t, int64(len(whole)), ext.Size)
+				parts = ext.Parts
+			}
+		}
+		if assert.Len(t, parts, len(contents)) {
+			for i, part := range parts {
+				assert.Equal(t, urls[i], part.URL)
+				assert.Equal(t, int64(len(contents[i])), part.Size)
+			}
+		}
+
+		data, err := readPath(t, v, "joined")
+		assert.Nil(t, err)
+		assert.Equal(t, whole, data)
+		v.Close()
+	}
+}
+
+func TestSparseFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sizes := map[string]int64{
+		"placeholder": 100000,
+		"padding":     10,
+		"empty":       0,
+	}
+
+	for _, streaming := range []bool{false, true} {
+		cfg := vdisc.BuilderConfig{
+			URL:             filepath.Join(dir, fmt.Sprintf("test-%v.vdisc", streaming)),
+			InlineThreshold: 4096,
+			Streaming:       streaming,
+		}
+		v := burnVDisc(t, cfg, func(b vdisc.Builder) {
+			for name, size := range sizes {
+				if err := b.AddSparseFile(name, size); err != nil {
+					t.Fatal(err)
+				}
+			}
+			assert.NotNil(t, b.AddSparseFile("negative", -1))
+			assert.NotNil(t, b.AddFile("mismatched", "zero:10", 11))
+		})
+
+		// Small zero-filled files keep their extents rather than
+		// being inlined
+		urls := extentURLs(t, v)[1:]
+		assert.ElementsMatch(t, []string{"zero:100000", "zero:10", "zero:0"}, urls)
+
+		for name, size := range sizes {
+			data, err := readPath(t, v, name)
+			assert.Nil(t, err)
+			assert.Equal(t, string(make([]byte, size)), data)
+		}
+		v.Close()
+	}
+}
+
+func TestCompressedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Many small frames, so that reads span several of them
+	content := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1000)
+	var buf bytes.Buffer
+	w, err := zstdseek.NewWriter(&buf, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	url := filepath.Join(dir, "fox.zst")
+	if err := ioutil.WriteFile(url, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := vdisc.ParseChecksum("md5:" + fmt.Sprintf("%x", md5.Sum([]byte(content))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, streaming := range []bool{false, true} {
+		cfg := vdisc.BuilderConfig{
+			URL:       filepath.Join(dir, fmt.Sprintf("test-%v.vdisc", streaming)),
+			Streaming: streaming,
+		}
+		v := burnVDisc(t, cfg, func(b vdisc.Builder) {
+			opts := vdisc.FileOptions{Checksum: checksum, Compression: vdisc.CompressionZstdSeekable}
+			if err := b.AddFile("looked-up", url, -1, opts); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.AddFile("given", url, int64(len(content)), opts); err != nil {
+				t.Fatal(err)
+			}
+			assert.NotNil(t, b.AddFileRange("ranged", url, 0, 10, opts))
+		}, vdisc.LoadOptions{VerifyChecksums: true})
+
+		var compressed int
+		for _, ext := range extentsOf(t, v) {
+			if ext.Compression == vdisc.CompressionZstdSeekable {
+				assert.Equal(t, int64(len(content)), ext.Size)
+				assert.Equal(t, int64(buf.Len()), ext.CompressedSize)
+				compressed++
+			}
+		}
+		assert.Equal(t, 2, compressed)
+
+		for _, name := range []string{"looked-up", "given"} {
+			data, err := readPath(t, v, name)
+			assert.Nil(t, err)
+			assert.Equal(t, content, data)
+		}
+		v.Close()
+	}
+}
+
+// A file of a compressed object and one of the object as stored share
+// its URL, but not its cached blocks
+func TestCompressedAndStoredFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Content that compresses to several cache blocks
+	var content strings.Builder
+	for i := uint32(0); i < 10000; i++ {
+		fmt.Fprintf(&content, "%08x\n", i*2654435761)
+	}
+	var buf bytes.Buffer
+	w, err := zstdseek.NewWriter(&buf, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(content.String())); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	url := filepath.Join(dir, "hashes.zst")
+	if err := ioutil.WriteFile(url, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := vdisc.BuilderConfig{URL: filepath.Join(dir, "test.vdisc")}
+	v := burnVDisc(t, cfg, func(b vdisc.Builder) {
+		if err := b.AddFile("compressed", url, -1, vdisc.FileOptions{Compression: vdisc.CompressionZstdSeekable}); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.AddFile("stored", url, -1); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer v.Close()
+
+	// Whichever is read first
+	for _, name := range []string{"compressed", "stored", "compressed"} {
+		data, err := readPath(t, v, name)
+		assert.Nil(t, err)
+		if name == "stored" {
+			assert.Equal(t, buf.String(), data)
+		} else {
+			assert.Equal(t, content.String(), data)
+		}
+	}
+}
+
+func TestEncryptedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{0x42}, chunkcrypt.KeySize)
+	keyDir := filepath.Join(dir, "keys")
+	if err := os.Mkdir(keyDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(keyDir, "imaging"), []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Several chunks, the last of them partial
+	content := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 4000)
+	aead, err := chunkcrypt.NewAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := chunkcrypt.NewWriter(&buf, aead)
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	url := filepath.Join(dir, "fox.enc")
+	if err := ioutil.WriteFile(url, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := vdisc.ParseChecksum("md5:" + fmt.Sprintf("%x", md5.Sum([]byte(content))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, streaming := range []bool{false, true} {
+		cfg := vdisc.BuilderConfig{
+			URL:             filepath.Join(dir, fmt.Sprintf("test-%v.vdisc", streaming)),
+			Streaming:       streaming,
+			InlineThreshold: 1 << 20,
+		}
+		add := func(b vdisc.Builder) {
+			opts := vdisc.FileOptions{Checksum: checksum, KeyID: "imaging"}
+			if err := b.AddFile("looked-up", url, -1, opts); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.AddFile("given", url, int64(len(content)), opts); err != nil {
+				t.Fatal(err)
+			}
+			assert.NotNil(t, b.AddFileRange("ranged", url, 0, 10, opts))
+		}
+
+		for _, keys := range []vdisc.KeyProvider{vdisc.NewFileKeyProvider(keyDir), nil} {
+			v := burnVDisc(t, cfg, add, vdisc.LoadOptions{VerifyChecksums: true, Keys: keys})
+
+			var encrypted int
+			for _, ext := range extentsOf(t, v) {
+				if ext.KeyID != "" {
+					assert.Equal(t, "imaging", ext.KeyID)
+					assert.Equal(t, int64(len(content)), ext.Size)
+					encrypted++
+				}
+			}
+			assert.Equal(t, 2, encrypted)
+
+			for _, name := range []string{"looked-up", "given"} {
+				data, err := readPath(t, v, name)
+				if keys == nil {
+					assert.NotNil(t, err)
+				} else {
+					assert.Nil(t, err)
+					assert.Equal(t, content, data)
+				}
+			}
+			v.Close()
+		}
+	}
+}
+
+func TestEncryptedAndStoredFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{0x42}, chunkcrypt.KeySize)
+	keyDir := filepath.Join(dir, "keys")
+	if err := os.Mkdir(keyDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(keyDir, "imaging"), []byte(hex.EncodeToString(key)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	content := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 4000)
+	aead, err := chunkcrypt.NewAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := chunkcrypt.NewWriter(&buf, aead)
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	url := filepath.Join(dir, "fox.enc")
+	if err := ioutil.WriteFile(url, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := vdisc.BuilderConfig{URL: filepath.Join(dir, "test.vdisc")}
+	v := burnVDisc(t, cfg, func(b vdisc.Builder) {
+		if err := b.AddFile("encrypted", url, int64(len(content)), vdisc.FileOptions{KeyID: "imaging"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.AddFile("stored", url, -1); err != nil {
+			t.Fatal(err)
+		}
+	}, vdisc.LoadOptions{Keys: vdisc.NewFileKeyProvider(keyDir)})
+	defer v.Close()
+
+	// The plaintext never reaches the file that reads the object as
+	// stored, whichever is read first
+	for _, name := range []string{"encrypted", "stored", "encrypted"} {
+		data, err := readPath(t, v, name)
+		assert.Nil(t, err)
+		if name == "stored" {
+			assert.Equal(t, buf.String(), data)
+		} else {
+			assert.Equal(t, content, data)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc/types/v1"
+)
+
+// ChecksumAlgorithm identifies the digest used for a Checksum
+type ChecksumAlgorithm = vdisc_types_v1.ChecksumAlgorithm
+
+const (
+	ChecksumNone   = vdisc_types_v1.ChecksumAlgorithm_none
+	ChecksumSHA256 = vdisc_types_v1.ChecksumAlgorithm_sha256
+	ChecksumCRC32C = vdisc_types_v1.ChecksumAlgorithm_crc32c
+	ChecksumMD5    = vdisc_types_v1.ChecksumAlgorithm_md5
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Large reads keep the number of requests to remote objects down
+const checksumBufferSize = 4 * 1024 * 1024
+
+// Checksum is a digest of an object's content
+type Checksum struct {
+	Algorithm ChecksumAlgorithm
+	Digest    []byte
+}
+
+// ParseChecksum parses a checksum of the form "<algorithm>:<hex digest>".
+// When the algorithm is omitted it is inferred from the digest length.
+// An empty string yields the zero Checksum.
+func ParseChecksum(s string) (Checksum, error) {
+	if s == "" {
+		return Checksum{}, nil
+	}
+
+	var name, digest string
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		name, digest = strings.ToLower(s[:i]), s[i+1:]
+	} else {
+		digest = s
+	}
+
+	raw, err := hex.DecodeString(digest)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("invalid checksum %q: %v", s, err)
+	}
+
+	var alg ChecksumAlgorithm
+	switch name {
+	case "sha256":
+		alg = ChecksumSHA256
+	case "crc32c":
+		alg = ChecksumCRC32C
+	case "md5":
+		alg = ChecksumMD5
+	case "":
+		switch len(raw) {
+		case sha256.Size:
+			alg = ChecksumSHA256
+		case crc32.Size:
+			alg = ChecksumCRC32C
+		case md5.Size:
+			alg = ChecksumMD5
+		}
+	}
+
+	c := Checksum{alg, raw}
+	if alg == ChecksumNone || len(raw) != c.size() {
+		return Checksum{}, fmt.Errorf("invalid checksum %q", s)
+	}
+	return c, nil
+}
+
+// IsZero returns true if no checksum is recorded
+func (c Checksum) IsZero() bool {
+	return c.Algorithm == ChecksumNone
+}
+
+func (c Checksum) String() string {
+	if c.IsZero() {
+		return ""
+	}
+	return c.Algorithm.String() + ":" + hex.EncodeToString(c.Digest)
+}
+
+func (c Checksum) size() int {
+	switch c.Algorithm {
+	case ChecksumSHA256:
+		return sha256.Size
+	case ChecksumCRC32C:
+		return crc32.Size
+	case ChecksumMD5:
+		return md5.Size
+	}
+	return 0
+}
+
+func (c Checksum) newHash() hash.Hash {
+	switch c.Algorithm {
+	case ChecksumSHA256:
+		return sha256.New()
+	case ChecksumCRC32C:
+		return crc32.New(crc32cTable)
+	case ChecksumMD5:
+		return md5.New()
+	}
+	return nil
+}
+
+// Compute returns the checksum of everything read from r using the
+// same algorithm as c.
+func (c Checksum) Compute(r io.Reader) (Checksum, error) {
+	h := c.newHash()
+	if h == nil {
+		return Checksum{}, fmt.Errorf("unsupported checksum algorithm %v", c.Algorithm)
+	}
+	if _, err := io.CopyBuffer(h, r, make([]byte, checksumBufferSize)); err != nil {
+		return Checksum{}, err
+	}
+	return Checksum{c.Algorithm, h.Sum(nil)}, nil
+}
+
+// ChecksumError reports an object whose content no longer matches the
+// checksum recorded when the vdisc was burned.
+type ChecksumError struct {
+	URL      string
+	Expected Checksum
+	Actual   Checksum
+}
+
+func (e *ChecksumError) Error() string {
+	if e.Actual.IsZero() {
+		return fmt.Sprintf("checksum mismatch for %s: content changed since it was verified against %s", e.URL, e.Expected)
+	}
+	return fmt.Sprintf("checksum mismatch for %s: expected %s, got %s", e.URL, e.Expected, e.Actual)
+}
+
+// Unwrap allows callers to treat a checksum mismatch as an I/O error
+func (e *ChecksumError) Unwrap() error {
+	return syscall.EIO
+}
+
+// Reads of a verified object are checked a chunk at a time
+const checksumChunkSize = 64 * 1024
+
+// verifiedObject checks the full content of obj against a checksum
+// before serving the first read, and records a digest of each chunk of
+// it with the same algorithm. Every later read is checked against the
+// digests of the chunks it covers, so that content obj fetches again,
+// such as blocks evicted from the cache, is never served unverified. A
+// mismatch is sticky; other errors are retried on the next read. The
+// first read of an object thus reads all of it, so obj should be the
+// cached object, whose blocks later reads are then served from.
+type verifiedObject struct {
+	storage.Object
+	checksum Checksum
+	pos      int64
+
+	mu       sync.Mutex
+	verified bool
+	digests  []byte
+	err      error
+}
+
+func withVerification(obj storage.Object, checksum Checksum) storage.Object {
+	if checksum.IsZero() {
+		return obj
+	}
+	return &verifiedObject{Object: obj, checksum: checksum}
+}
+
+func (v *verifiedObject) verify() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.verified || v.err != nil {
+		return v.err
+	}
+
+	whole, chunk := v.checksum.newHash(), v.checksum.newHash()
+	if whole == nil {
+		return fmt.Errorf("unsupported checksum algorithm %v", v.checksum.Algorithm)
+	}
+
+	size := v.Object.Size()
+	var digests []byte
+	buf := make([]byte, checksumBufferSize)
+	for off := int64(0); off < size; off += checksumBufferSize {
+		n := size - off
+		if n > checksumBufferSize {
+			n = checksumBufferSize
+		}
+		if _, err := io.ReadFull(io.NewSectionReader(v.Object, off, n), buf[:n]); err != nil {
+			return err
+		}
+		whole.Write(buf[:n])
+		for start := int64(0); start < n; start += checksumChunkSize {
+			end := start + checksumChunkSize
+			if end > n {
+				end = n
+			}
+			chunk.Reset()
+			chunk.Write(buf[start:end])
+			digests = chunk.Sum(digests)
+		}
+	}
+
+	actual := Checksum{v.checksum.Algorithm, whole.Sum(nil)}
+	if !bytes.Equal(actual.Digest, v.checksum.Digest) {
+		v.err = &ChecksumError{URL: v.Object.URL(), Expected: v.checksum, Actual: actual}
+		return v.err
+	}
+	v.verified = true
+	v.digests = digests
+	return nil
+}
+
+func (v *verifiedObject) Read(p []byte) (n int, err error) {
+	n, err = v.ReadAt(p, v.pos)
+	v.pos += int64(n)
+	return
+}
+
+func (v *verifiedObject) ReadAt(p []byte, off int64) (int, error) {
+	if err := v.verify(); err != nil {
+		return 0, err
+	}
+
+	size := v.Object.Size()
+	if len(p) == 0 || off < 0 || off >= size {
+		return v.Object.ReadAt(p, off)
+	}
+
+	// Read whole chunks, so that each can be checked
+	start := off - off%checksumChunkSize
+	end := off + int64(len(p))
+	if rem := end % checksumChunkSize; rem != 0 {
+		end += checksumChunkSize - rem
+	}
+	if end > size {
+		end = size
+	}
+	buf := make([]byte, end-start)
+	if _, err := io.ReadFull(io.NewSectionReader(v.Object, start, end-start), buf); err != nil {
+		return 0, err
+	}
+
+	h := v.checksum.newHash()
+	dsize := v.checksum.size()
+	for pos := int64(0); pos < end-start; pos += checksumChunkSize {
+		n := end - start - pos
+		if n > checksumChunkSize {
+			n = checksumChunkSize
+		}
+		h.Reset()
+		h.Write(buf[pos : pos+n])
+		i := int((start + pos) / checksumChunkSize)
+		if !bytes.Equal(h.Sum(nil), v.digests[i*dsize:(i+1)*dsize]) {
+			return 0, v.changed()
+		}
+	}
+
+	n := copy(p, buf[off-start:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// changed makes the object fail every read from now on, like one that
+// failed verification
+func (v *verifiedObject) changed() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.verified = false
+	v.err = &ChecksumError{URL: v.Object.URL(), Expected: v.checksum}
+	return v.err
+}
+
+func (v *verifiedObject) Seek(offset int64, whence int) (int64, error) {
+	size := v.Object.Size()
+
+	switch whence {
+	case io.SeekCurrent:
+		v.pos = v.pos + offset
+	case io.SeekStart:
+		v.pos = offset
+	case io.SeekEnd:
+		if size < 0 {
+			return 0, errors.New("unknown length")
+		}
+		v.pos = size + offset
+	}
+
+	if v.pos < 0 {
+		v.pos = 0
+	} else if size >= 0 && v.pos > size {
+		v.pos = size
+	}
+
+	return v.pos, nil
+}
@@ -0,0 +1,263 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_test
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/storage/driver"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+func TestParseChecksum(t *testing.T) {
+	c, err := vdisc.ParseChecksum("sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+	assert.Nil(t, err)
+	assert.Equal(t, vdisc.ChecksumSHA256, c.Algorithm)
+
+	c, err = vdisc.ParseChecksum("5d41402abc4b2a76b9719d911017c592")
+	assert.Nil(t, err)
+	assert.Equal(t, vdisc.ChecksumMD5, c.Algorithm)
+	assert.Equal(t, "md5:5d41402abc4b2a76b9719d911017c592", c.String())
+
+	c, err = vdisc.ParseChecksum("CRC32C:9a71bb4c")
+	assert.Nil(t, err)
+	assert.Equal(t, vdisc.ChecksumCRC32C, c.Algorithm)
+
+	c, err = vdisc.ParseChecksum("")
+	assert.Nil(t, err)
+	assert.True(t, c.IsZero())
+
+	_, err = vdisc.ParseChecksum("sha256:5d41402abc4b2a76b9719d911017c592")
+	assert.NotNil(t, err)
+
+	_, err = vdisc.ParseChecksum("md5:zz")
+	assert.NotNil(t, err)
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	obj := filepath.Join(dir, "hello.txt")
+	if err := ioutil.WriteFile(obj, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checksum, err := vdisc.ParseChecksum("sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{URL: filepath.Join(dir, "test.vdisc")})
+	if err := b.AddFile("/hello.txt", obj, 5, vdisc.FileOptions{Checksum: checksum}); err != nil {
+		t.Fatal(err)
+	}
+	url, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readFile := func() (string, error) {
+		v, err := vdisc.Load(url, caching.NopCache, vdisc.LoadOptions{VerifyChecksums: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer v.Close()
+
+		f, err := iso9660.NewWalker(v.Image()).Open("/hello.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		return string(data), err
+	}
+
+	data, err := readFile()
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", data)
+
+	if err := ioutil.WriteFile(obj, []byte("jello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = readFile()
+	assert.True(t, errors.Is(err, syscall.EIO))
+	assert.True(t, strings.Contains(err.Error(), "checksum mismatch"))
+}
+
+// countingDriver serves local files under the counting: scheme,
+// adding the bytes read from them to countingRead
+type countingDriver struct{}
+
+var countingRead int64
+
+func (countingDriver) Name() string {
+	return "counting"
+}
+
+func (countingDriver) Open(ctx context.Context, url string, size int64) (driver.Object, error) {
+	obj, err := storage.OpenContextSize(ctx, strings.TrimPrefix(url, "counting:"), size)
+	if err != nil {
+		return nil, err
+	}
+	return &countingObject{Object: obj, url: url}, nil
+}
+
+func (countingDriver) Stat(ctx context.Context, url string) (os.FileInfo, error) {
+	return os.Stat(strings.TrimPrefix(url, "counting:"))
+}
+
+type countingObject struct {
+	storage.Object
+	url string
+}
+
+func (o *countingObject) URL() string {
+	return o.url
+}
+
+func (o *countingObject) ReadAt(p []byte, off int64) (int, error) {
+	n, err := o.Object.ReadAt(p, off)
+	atomic.AddInt64(&countingRead, int64(n))
+	return n, err
+}
+
+func init() {
+	driver.Register("counting", countingDriver{})
+}
+
+func TestVerifyThroughCache(t *testing.T) {
+	atomic.StoreInt64(&countingRead, 0)
+
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := strings.Repeat("verified ", 1000)
+	obj := filepath.Join(dir, "object")
+	if err := ioutil.WriteFile(obj, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := vdisc.ParseChecksum(fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{URL: filepath.Join(dir, "test.vdisc")})
+	if err := b.AddFile("/object", "counting:"+obj, int64(len(content)), vdisc.FileOptions{Checksum: checksum}); err != nil {
+		t.Fatal(err)
+	}
+	url, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slicer, err := caching.NewMemorySlicer(4096, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := vdisc.Load(url, caching.NewCache(slicer, 0, 0), vdisc.LoadOptions{VerifyChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	// Verification fills the cache, which serves the read itself
+	f, err := iso9660.NewWalker(v.Image()).Open("/object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Equal(t, content, string(data))
+	assert.Equal(t, int64(len(content)), atomic.LoadInt64(&countingRead))
+}
+
+func TestVerifyEvictedBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Several times the size of the cache
+	content := strings.Repeat("verified ", 50000)
+	obj := filepath.Join(dir, "object")
+	if err := ioutil.WriteFile(obj, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := vdisc.ParseChecksum(fmt.Sprintf("md5:%x", md5.Sum([]byte(content))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{URL: filepath.Join(dir, "test.vdisc")})
+	if err := b.AddFile("/object", obj, int64(len(content)), vdisc.FileOptions{Checksum: checksum}); err != nil {
+		t.Fatal(err)
+	}
+	url, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slicer, err := caching.NewMemorySlicer(4096, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := vdisc.Load(url, caching.NewCache(slicer, 0, 0), vdisc.LoadOptions{VerifyChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	f, err := iso9660.NewWalker(v.Image()).Open("/object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := make([]byte, 9)
+	_, err = f.ReadAt(head, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "verified ", string(head))
+
+	// The cache holds less than the chunk a read is checked against,
+	// so the start of the object is read again
+	if err := ioutil.WriteFile(obj, []byte(strings.Replace(content, "verified", "modified", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.ReadAt(head, 0)
+	var mismatch *vdisc.ChecksumError
+	assert.True(t, errors.As(err, &mismatch))
+}
@@ -15,11 +15,15 @@
 package vdisc_cli
 
 import (
+	"archive/tar"
 	"encoding/csv"
 	"fmt"
 	"io"
+	"path"
 	"strconv"
+	"time"
 
+	"github.com/alecthomas/units"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 
@@ -41,35 +45,84 @@ type IsoOptions struct {
 }
 
 type BurnCmd struct {
-	Url string     `short:"o" help:"VDisc output URL" required:"true"`
-	Csv string     `short:"i" help:"Path to a CSV" required:"true"`
-	Iso IsoOptions `embed prefix:"iso9660-"`
+	Url             string     `short:"o" help:"VDisc output URL" required:"true"`
+	Csv             string     `short:"i" help:"Path to a CSV"`
+	From            string     `help:"Add every object below this URL instead of reading a CSV"`
+	FromTar         string     `help:"Add every member of the tar archives matching this URL glob, e.g. s3://bucket/shards/*.tar, each in a directory named after its archive"`
+	Include         []string   `help:"With --from or --from-tar, only add paths matching this glob, where ** matches any number of directories (repeatable)" sep:"none"`
+	Exclude         []string   `help:"With --from or --from-tar, skip paths matching this glob (repeatable)" sep:"none"`
+	Rewrite         []string   `help:"With --from or --from-tar, replace leading path segments, as OLD=NEW (repeatable)" sep:"none"`
+	Concurrency     int        `help:"With --from or --from-tar, number of directories to list or archives to scan concurrently, and with --encrypt-key-id, number of files to upload concurrently" default:"32"`
+	PinVersions     bool       `help:"Record each object's ETag or version id and refuse reads if it changes"`
+	SourceDateEpoch string     `help:"Seconds since the Unix epoch to use for every timestamp, making the output reproducible" env:"SOURCE_DATE_EPOCH"`
+	Dedupe          string     `help:"Store files with the same URL, or also the same checksum, once as hard links" enum:"none,url,checksum" default:"none"`
+	InlineThreshold units.SI   `help:"Store files of up to this size, e.g. 4KiB, with the disc metadata instead of referencing them" default:"0"`
+	Streaming       bool       `help:"Spill entries to disk to bound memory use when burning very many files"`
+	TempDir         string     `help:"With --streaming, directory for spilled entries (default is the system temp dir)"`
+	Layout          string     `help:"Store the vdisc gzip compressed, to be downloaded whole when loaded, or paged, to be read as it is used" enum:"gzip,paged" default:"gzip"`
+	EncryptKeyID    string     `help:"Upload an encrypted copy of every file with this key and reference the copies instead"`
+	EncryptTo       string     `help:"With --encrypt-key-id, URL prefix to upload the encrypted copies below"`
+	SignKey         string     `help:"Sign the vdisc with the PEM encoded private key at this path"`
+	Iso             IsoOptions `embed prefix:"iso9660-"`
 }
 
 func (cmd *BurnCmd) Run(globals *Globals) error {
-	input, err := storage.Open(cmd.Csv)
-	if err != nil {
-		zap.L().Fatal("opening csv", zap.Error(err))
+	sources := 0
+	for _, src := range []string{cmd.Csv, cmd.From, cmd.FromTar} {
+		if src != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		zap.L().Fatal("exactly one of --csv, --from or --from-tar is required")
 	}
-	defer input.Close()
 
-	r := csv.NewReader(input)
-	r.ReuseRecord = true
+	cfg := vdisc.BuilderConfig{
+		URL:             cmd.Url,
+		PinVersions:     cmd.PinVersions,
+		InlineThreshold: int64(cmd.InlineThreshold),
+		Streaming:       cmd.Streaming,
+		TempDir:         cmd.TempDir,
+	}
+	switch cmd.Dedupe {
+	case "url":
+		cfg.Dedupe = vdisc.DedupeURL
+	case "checksum":
+		cfg.Dedupe = vdisc.DedupeChecksum
+	}
+	if cmd.Layout == "paged" {
+		cfg.Layout = vdisc.LayoutPaged
+	}
+	if cmd.SourceDateEpoch != "" {
+		secs, err := strconv.ParseInt(cmd.SourceDateEpoch, 10, 64)
+		if err != nil {
+			zap.L().Fatal("parsing source date epoch", zap.String("value", cmd.SourceDateEpoch), zap.Error(err))
+		}
+		epoch := time.Unix(secs, 0).UTC()
+		cfg.SourceDateEpoch = &epoch
+	}
 
 	var b vdisc.Builder
 	switch cmd.Iso.NameValidation {
 	case "portable":
-		b = vdisc.NewPosixPortableISO9660Builder(vdisc.BuilderConfig{
-			URL: cmd.Url,
-		})
+		b = vdisc.NewPosixPortableISO9660Builder(cfg)
 	case "extended":
-		b = vdisc.NewExtendedISO9660Builder(vdisc.BuilderConfig{
-			URL: cmd.Url,
-		})
+		b = vdisc.NewExtendedISO9660Builder(cfg)
 	default:
 		panic("never")
 	}
 
+	if (cmd.EncryptKeyID == "") != (cmd.EncryptTo == "") {
+		zap.L().Fatal("--encrypt-key-id and --encrypt-to must be given together")
+	}
+	if cmd.EncryptKeyID != "" {
+		eb, err := newEncryptingBuilder(b, cmd.EncryptTo, cmd.EncryptKeyID, globalKeys(globals), cmd.Concurrency)
+		if err != nil {
+			zap.L().Fatal("loading encryption key", zap.String("id", cmd.EncryptKeyID), zap.Error(err))
+		}
+		b = eb
+	}
+
 	zap.L().Info("Burning visc...")
 
 	// Set the iso9660 metadata
@@ -89,7 +142,40 @@ func (cmd *BurnCmd) Run(globals *Globals) error {
 	b.SetAbstractFileIdentifier(cmd.Iso.AbstractFileIdentifier)
 	b.SetBibliographicFileIdentifier(cmd.Iso.BibliographicFileIdentifier)
 
-	// Add all the files from the CSV
+	switch {
+	case cmd.Csv != "":
+		cmd.addFromCSV(b)
+	case cmd.From != "":
+		cmd.addFromTree(b)
+	default:
+		cmd.addFromTars(b)
+	}
+
+	url, err := b.Build()
+	if err != nil {
+		zap.L().Fatal("burning vdisc", zap.Error(err))
+	}
+
+	if cmd.SignKey != "" {
+		signVDisc(url, cmd.SignKey)
+	}
+
+	zap.L().Info("complete", zap.String("url", url))
+	return nil
+}
+
+// addFromCSV adds every row of the CSV manifest to b
+func (cmd *BurnCmd) addFromCSV(b vdisc.Builder) {
+	input, err := storage.Open(cmd.Csv)
+	if err != nil {
+		zap.L().Fatal("opening csv", zap.Error(err))
+	}
+	defer input.Close()
+
+	r := csv.NewReader(input)
+	r.ReuseRecord = true
+	r.FieldsPerRecord = -1
+
 	for {
 		record, err := r.Read()
 		if err != nil {
@@ -99,22 +185,151 @@ func (cmd *BurnCmd) Run(globals *Globals) error {
 			zap.L().Fatal("reading csv line", zap.Error(err))
 		}
 
-		size, err := strconv.ParseInt(record[2], 10, 64)
+		entry, err := parseManifestRecord(record)
 		if err != nil {
-			zap.L().Fatal("parsing size", zap.Error(err))
+			zap.L().Fatal("parsing csv line", zap.Strings("record", record), zap.Error(err))
 		}
 
-		if err := b.AddFile(record[0], record[1], size); err != nil {
-			zap.L().Fatal("adding file", zap.Error(err))
+		if err := addManifestEntry(b, entry); err != nil {
+			zap.L().Fatal("adding file", zap.String("path", entry.Path), zap.Error(err))
 		}
-		zap.L().Debug("added file", zap.String("path", record[0]), zap.String("url", record[1]), zap.Int64("size", size))
+		zap.L().Debug("added file", zap.String("path", entry.Path), zap.String("url", entry.URL), zap.Int64("size", entry.Size))
 	}
+}
 
-	url, err := b.Build()
+// addFromTree adds every object below the --from URL to b, using the
+// sizes reported by the listing
+func (cmd *BurnCmd) addFromTree(b vdisc.Builder) {
+	mapper, err := newPathMapper(cmd.Include, cmd.Exclude, cmd.Rewrite)
 	if err != nil {
-		zap.L().Fatal("burning vdisc", zap.Error(err))
+		zap.L().Fatal("parsing path options", zap.Error(err))
 	}
 
-	zap.L().Info("complete", zap.String("url", url))
-	return nil
+	add := func(obj sourceObject) error {
+		pth, ok := mapper.Map(obj.Rel)
+		if !ok {
+			return nil
+		}
+
+		var opts vdisc.FileOptions
+		if cmd.PinVersions {
+			opts.Version = storage.FileInfoVersion(obj.Info)
+		}
+
+		if err := b.AddFile(pth, obj.URL, obj.Info.Size(), opts); err != nil {
+			zap.L().Fatal("adding file", zap.String("path", pth), zap.Error(err))
+		}
+		zap.L().Debug("added file", zap.String("path", pth), zap.String("url", obj.URL), zap.Int64("size", obj.Info.Size()))
+		return nil
+	}
+
+	// The streaming builder sorts entries itself, so there is no need
+	// to hold the whole listing in memory
+	if cmd.Streaming {
+		if err := visitSource(cmd.From, cmd.Concurrency, add); err != nil {
+			zap.L().Fatal("listing objects", zap.String("url", cmd.From), zap.Error(err))
+		}
+		return
+	}
+
+	objects, err := walkSource(cmd.From, cmd.Concurrency)
+	if err != nil {
+		zap.L().Fatal("listing objects", zap.String("url", cmd.From), zap.Error(err))
+	}
+
+	for _, obj := range objects {
+		add(obj)
+	}
+}
+
+// addFromTars adds every member of the --from-tar archives to b, each
+// file referring to its data within the archive
+func (cmd *BurnCmd) addFromTars(b vdisc.Builder) {
+	mapper, err := newPathMapper(cmd.Include, cmd.Exclude, cmd.Rewrite)
+	if err != nil {
+		zap.L().Fatal("parsing path options", zap.Error(err))
+	}
+
+	archives, err := listTars(cmd.FromTar, cmd.Concurrency)
+	if err != nil {
+		zap.L().Fatal("listing archives", zap.String("url", cmd.FromTar), zap.Error(err))
+	}
+	if len(archives) == 0 {
+		zap.L().Fatal("no archives match", zap.String("url", cmd.FromTar))
+	}
+
+	err = visitTars(archives, cmd.Concurrency, func(archive sourceObject, members []tarMember) error {
+		var version storage.Version
+		if cmd.PinVersions {
+			version = storage.FileInfoVersion(archive.Info)
+		}
+
+		// As when the archive is extracted, a member replaces any
+		// earlier member of the same name
+		last := make(map[string]int)
+		for i, m := range members {
+			last[memberPath(m.Header.Name)] = i
+		}
+
+		// Hard links within the archive become another range of the
+		// same data, which --dedupe=url turns back into a link. A link
+		// refers to the member of its target name that precedes it.
+		files := make(map[string]tarMember)
+		for i, m := range members {
+			name := memberPath(m.Header.Name)
+			if name == "" {
+				continue
+			}
+
+			var target tarMember
+			isFile := !isSparse(m.Header) && (m.Header.Typeflag == tar.TypeReg || m.Header.Typeflag == tar.TypeRegA)
+			if isFile {
+				target = m
+			} else if m.Header.Typeflag == tar.TypeLink {
+				var ok bool
+				if target, ok = files[memberPath(m.Header.Linkname)]; !ok {
+					return fmt.Errorf("%s: hard link %s to unknown member %s", archive.URL, m.Header.Name, m.Header.Linkname)
+				}
+				isFile = true
+			}
+			if isFile {
+				files[name] = target
+			} else {
+				delete(files, name)
+			}
+
+			if last[name] != i {
+				zap.L().Warn("skipping member replaced by a later one", zap.String("archive", archive.URL), zap.String("name", m.Header.Name))
+				continue
+			}
+
+			pth, ok := mapper.Map(path.Join(archiveDir(archive), name))
+			if !ok {
+				continue
+			}
+
+			var err error
+			md := memberMetadata(m.Header)
+			switch {
+			case isSparse(m.Header):
+				zap.L().Warn("skipping sparse member", zap.String("archive", archive.URL), zap.String("name", m.Header.Name))
+			case isFile:
+				err = b.AddFileRange(pth, archive.URL, target.Offset, target.Header.Size, vdisc.FileOptions{Metadata: md, Version: version})
+			case m.Header.Typeflag == tar.TypeDir:
+				err = b.AddDirectory(pth, md)
+			case m.Header.Typeflag == tar.TypeSymlink:
+				err = b.AddSymlink(pth, m.Header.Linkname, md)
+			default:
+				zap.L().Warn("skipping member of unsupported type", zap.String("archive", archive.URL), zap.String("name", m.Header.Name), zap.String("type", string(m.Header.Typeflag)))
+			}
+			if err != nil {
+				return fmt.Errorf("adding %s: %v", pth, err)
+			}
+			zap.L().Debug("added member", zap.String("path", pth), zap.String("url", archive.URL), zap.Int64("offset", m.Offset), zap.Int64("size", m.Header.Size))
+		}
+		return nil
+	})
+	if err != nil {
+		zap.L().Fatal("adding archives", zap.String("url", cmd.FromTar), zap.Error(err))
+	}
 }
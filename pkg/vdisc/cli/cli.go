@@ -15,28 +15,66 @@
 package vdisc_cli
 
 import (
+	"crypto"
 	"reflect"
 
 	"github.com/alecthomas/kong"
 	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
 )
 
 type Globals struct {
-	LogLevel string      `help:"Set the logging level (debug|info|warn|error)" default:"info"`
-	Cache    CacheConfig `embed prefix:"cache-"`
+	LogLevel        string      `help:"Set the logging level (debug|info|warn|error)" default:"info"`
+	Cache           CacheConfig `embed prefix:"cache-"`
+	VerifyChecksums bool        `help:"Verify file contents against the checksums recorded in the vdisc"`
+	KeyDir          string      `help:"Read the keys of encrypted files from the files in this directory named by key id, instead of from VDISC_KEY_<ID> environment variables"`
+	VerifyKey       []string    `help:"Refuse vdiscs not signed by a public key or x509 certificate in this PEM file, or in any file of this directory (repeatable)" sep:"none"`
 }
 
 type CLI struct {
 	Globals
 
-	Burn    BurnCmd    `cmd help:"Burn creates a new vdisc"`
-	Cache   CacheCmd   `cmd help:"Cache management"`
-	Cp      CpCmd      `cmd help:"Copy a file from a vdisc to a local path"`
-	Inspect InspectCmd `cmd help:"Inspect a vdisc"`
-	Ls      LsCmd      `cmd help:"List directory contents"`
-	Mount   MountCmd   `cmd help:"Mount a vdisc"`
-	Tree    TreeCmd    `cmd help:"Print the file system hierarchy as a tree"`
-	Version VersionCmd `cmd help:"Print the client version information"`
+	Burn     BurnCmd     `cmd help:"Burn creates a new vdisc"`
+	Cache    CacheCmd    `cmd help:"Cache management"`
+	Cp       CpCmd       `cmd help:"Copy a file from a vdisc to a local path"`
+	Diff     DiffCmd     `cmd help:"Report the paths that differ between two vdiscs"`
+	Dump     DumpCmd     `cmd help:"Print every extent of a vdisc as JSON"`
+	Edit     EditCmd     `cmd help:"Burn a new vdisc from an existing one and a patch"`
+	Inspect  InspectCmd  `cmd help:"Inspect a vdisc"`
+	Ls       LsCmd       `cmd help:"List directory contents"`
+	Manifest ManifestCmd `cmd help:"Print a burn manifest of the files of a vdisc"`
+	Mount    MountCmd    `cmd help:"Mount a vdisc"`
+	Relocate RelocateCmd `cmd help:"Move the objects of a vdisc to a new URL prefix without burning it again"`
+	Restore  RestoreCmd  `cmd help:"Store a vdisc from its JSON dump"`
+	Sign     SignCmd     `cmd help:"Sign a vdisc so that it can be verified at load time"`
+	Tree     TreeCmd     `cmd help:"Print the file system hierarchy as a tree"`
+	Verify   VerifyCmd   `cmd help:"Check every extent of a vdisc against object storage"`
+	Version  VersionCmd  `cmd help:"Print the client version information"`
+}
+
+func globalLoadOptions(globals *Globals) vdisc.LoadOptions {
+	return vdisc.LoadOptions{
+		VerifyChecksums: globals.VerifyChecksums,
+		Keys:            globalKeys(globals),
+		TrustedKeys:     globalTrustedKeys(globals),
+	}
+}
+
+func globalKeys(globals *Globals) vdisc.KeyProvider {
+	if globals.KeyDir != "" {
+		return vdisc.NewFileKeyProvider(globals.KeyDir)
+	}
+	return vdisc.NewEnvKeyProvider("VDISC_KEY_")
+}
+
+func globalTrustedKeys(globals *Globals) []crypto.PublicKey {
+	keys, err := readTrustedKeys(globals.VerifyKey)
+	if err != nil {
+		zap.L().Fatal("reading trusted keys", zap.Error(err))
+	}
+	return keys
 }
 
 func UUIDDecoder(ctx *kong.DecodeContext, target reflect.Value) error {
@@ -61,3 +99,20 @@ func UUIDTypeMapper() kong.Option {
 	var u uuid.UUID
 	return kong.TypeMapper(reflect.TypeOf(u), kong.MapperFunc(UUIDDecoder))
 }
+
+// StringsDecoder appends each value of a repeatable flag whole. Kong
+// reads sep:"none" as a separator of 'n', splitting values like
+// s3://new/ apart.
+func StringsDecoder(ctx *kong.DecodeContext, target reflect.Value) error {
+	var value string
+	if err := ctx.Scan.PopValueInto("value", &value); err != nil {
+		return err
+	}
+	target.Set(reflect.Append(target, reflect.ValueOf(value)))
+	return nil
+}
+
+func StringsTypeMapper() kong.Option {
+	var s []string
+	return kong.TypeMapper(reflect.TypeOf(s), kong.MapperFunc(StringsDecoder))
+}
@@ -0,0 +1,56 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli_test
+
+import (
+	"testing"
+
+	"github.com/alecthomas/kong"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/vdisc/cli"
+)
+
+func parse(t *testing.T, args ...string) *vdisc_cli.CLI {
+	var cli vdisc_cli.CLI
+	parser, err := kong.New(&cli,
+		vdisc_cli.UUIDTypeMapper(),
+		vdisc_cli.SITypeMapper(),
+		vdisc_cli.GcThresholdTypeMapper(),
+		vdisc_cli.StringsTypeMapper(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return &cli
+}
+
+func TestRepeatableFlags(t *testing.T) {
+	cli := parse(t, "burn", "-o", "out.vdsc", "--from", "s3://bucket/",
+		"--include", "*.png", "--include", "train/n*,x",
+		"--exclude", "none",
+		"--rewrite", "old=/new")
+	assert.Equal(t, []string{"*.png", "train/n*,x"}, cli.Burn.Include)
+	assert.Equal(t, []string{"none"}, cli.Burn.Exclude)
+	assert.Equal(t, []string{"old=/new"}, cli.Burn.Rewrite)
+}
+
+func TestVerifyKeyFlag(t *testing.T) {
+	cli := parse(t, "verify", "-u", "mnist.vdsc", "--verify-key", "/etc/vdisc/keys.pem", "--verify-key", "/etc/vdisc/trusted")
+	assert.Equal(t, []string{"/etc/vdisc/keys.pem", "/etc/vdisc/trusted"}, cli.VerifyKey)
+}
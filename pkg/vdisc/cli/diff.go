@@ -0,0 +1,577 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+type DiffCmd struct {
+	Old  string `help:"URL of the old vdisc" required:"true"`
+	New  string `help:"URL of the new vdisc" required:"true"`
+	Json bool   `help:"Print the report as JSON"`
+	Csv  bool   `help:"Print the changes as CSV"`
+}
+
+// Kinds of change
+const (
+	diffAdded    = "added"
+	diffRemoved  = "removed"
+	diffModified = "modified"
+	diffRenamed  = "renamed"
+)
+
+// diffChange is a path that differs between two vdiscs. Fields lists
+// what differs for a modified or renamed path: size, url, version,
+// checksum, content, target, mode, uid, gid or mtime.
+type diffChange struct {
+	Change  string   `json:"change"`
+	Path    string   `json:"path"`
+	OldPath string   `json:"oldPath,omitempty"`
+	Type    string   `json:"type"`
+	Fields  []string `json:"fields,omitempty"`
+	Size    int64    `json:"size,omitempty"`
+	OldSize int64    `json:"oldSize,omitempty"`
+	URL     string   `json:"url,omitempty"`
+	OldURL  string   `json:"oldUrl,omitempty"`
+}
+
+type diffReport struct {
+	Old      string       `json:"old"`
+	New      string       `json:"new"`
+	Added    int          `json:"added"`
+	Removed  int          `json:"removed"`
+	Modified int          `json:"modified"`
+	Renamed  int          `json:"renamed"`
+	Changes  []diffChange `json:"changes"`
+}
+
+// diffSide is one of the vdiscs being compared. isohdrs holds the
+// URLs of the isohdr objects of both.
+type diffSide struct {
+	v       vdisc.VDisc
+	w       *iso9660.Walker
+	isohdrs map[string]bool
+}
+
+// diffEntry is a file, directory or symlink of one side
+type diffEntry struct {
+	path string
+	fi   *iso9660.FileInfo
+
+	// info describes the extent of a file, and inline is set for a
+	// file stored in the isohdr of either vdisc, inline or as a range
+	// of it, which has no object of its own
+	info   vdisc.ExtentInfo
+	inline bool
+}
+
+func (cmd *DiffCmd) Run(globals *Globals) error {
+	if cmd.Json && cmd.Csv {
+		zap.L().Fatal("at most one of --json and --csv may be given")
+	}
+
+	load := func(url string) vdisc.VDisc {
+		v, err := vdisc.Load(url, globalCache(&globals.Cache), globalLoadOptions(globals))
+		if err != nil {
+			zap.L().Fatal("loading vdisc", zap.String("url", url), zap.Error(err))
+		}
+		return v
+	}
+	oldV := load(cmd.Old)
+	defer oldV.Close()
+	newV := load(cmd.New)
+	defer newV.Close()
+
+	report, err := cmd.diff(oldV, newV)
+	if err != nil {
+		zap.L().Fatal("comparing vdiscs", zap.Error(err))
+	}
+	if err := cmd.print(os.Stdout, report); err != nil {
+		zap.L().Fatal("writing report", zap.Error(err))
+	}
+	return nil
+}
+
+// diff compares the trees of the vdiscs oldV and newV
+func (cmd *DiffCmd) diff(oldV, newV vdisc.VDisc) (*diffReport, error) {
+	isohdrs := make(map[string]bool)
+	for _, v := range []vdisc.VDisc{oldV, newV} {
+		info, err := v.StatExtent(0)
+		if err != nil {
+			return nil, err
+		}
+		isohdrs[info.URL] = true
+	}
+	d := &differ{
+		old: &diffSide{v: oldV, w: iso9660.NewWalker(oldV.Image()), isohdrs: isohdrs},
+		new: &diffSide{v: newV, w: iso9660.NewWalker(newV.Image()), isohdrs: isohdrs},
+	}
+	if err := d.diffDir("/"); err != nil {
+		return nil, err
+	}
+	changes, err := d.changes()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &diffReport{
+		Old:     cmd.Old,
+		New:     cmd.New,
+		Changes: changes,
+	}
+	for _, c := range changes {
+		switch c.Change {
+		case diffAdded:
+			report.Added++
+		case diffRemoved:
+			report.Removed++
+		case diffModified:
+			report.Modified++
+		case diffRenamed:
+			report.Renamed++
+		}
+	}
+	return report, nil
+}
+
+// print writes report to out in the format selected by cmd
+func (cmd *DiffCmd) print(out io.Writer, report *diffReport) error {
+	switch {
+	case cmd.Json:
+		jenc := json.NewEncoder(out)
+		jenc.SetIndent("", "  ")
+		return jenc.Encode(report)
+	case cmd.Csv:
+		w := csv.NewWriter(out)
+		w.Write([]string{"change", "path", "old_path", "type", "fields", "size", "old_size", "url", "old_url"})
+		for _, c := range report.Changes {
+			// An added path has no old size, and a removed one no size
+			size, oldSize := strconv.FormatInt(c.Size, 10), strconv.FormatInt(c.OldSize, 10)
+			switch c.Change {
+			case diffAdded:
+				oldSize = ""
+			case diffRemoved:
+				size = ""
+			}
+			w.Write([]string{
+				c.Change,
+				c.Path,
+				c.OldPath,
+				c.Type,
+				strings.Join(c.Fields, " "),
+				size,
+				oldSize,
+				c.URL,
+				c.OldURL,
+			})
+		}
+		w.Flush()
+		return w.Error()
+	default:
+		for _, c := range report.Changes {
+			switch c.Change {
+			case diffAdded:
+				fmt.Fprintf(out, "A %s\n", c.Path)
+			case diffRemoved:
+				fmt.Fprintf(out, "D %s\n", c.Path)
+			case diffModified:
+				fmt.Fprintf(out, "M %s (%s)\n", c.Path, strings.Join(c.Fields, ", "))
+			case diffRenamed:
+				if len(c.Fields) > 0 {
+					fmt.Fprintf(out, "R %s -> %s (%s)\n", c.OldPath, c.Path, strings.Join(c.Fields, ", "))
+				} else {
+					fmt.Fprintf(out, "R %s -> %s\n", c.OldPath, c.Path)
+				}
+			}
+		}
+		_, err := fmt.Fprintf(out, "%d added, %d removed, %d modified, %d renamed\n", report.Added, report.Removed, report.Modified, report.Renamed)
+		return err
+	}
+}
+
+// differ walks two vdiscs in parallel, collecting the paths only one
+// of them has and the changes to those both have
+type differ struct {
+	old, new *diffSide
+
+	added    []*diffEntry
+	removed  []*diffEntry
+	modified []diffChange
+}
+
+// diffDir compares the directory dir, which both vdiscs have
+func (d *differ) diffDir(dir string) error {
+	olds, err := d.old.readDir(dir)
+	if err != nil {
+		return err
+	}
+	news, err := d.new.readDir(dir)
+	if err != nil {
+		return err
+	}
+
+	i, j := 0, 0
+	for i < len(olds) || j < len(news) {
+		switch {
+		case j == len(news) || (i < len(olds) && olds[i].Name() < news[j].Name()):
+			if err := d.old.collect(dir, olds[i], &d.removed); err != nil {
+				return err
+			}
+			i++
+		case i == len(olds) || news[j].Name() < olds[i].Name():
+			if err := d.new.collect(dir, news[j], &d.added); err != nil {
+				return err
+			}
+			j++
+		default:
+			if err := d.diffPath(path.Join(dir, olds[i].Name()), olds[i], news[j]); err != nil {
+				return err
+			}
+			i++
+			j++
+		}
+	}
+	return nil
+}
+
+// diffPath compares pth, which both vdiscs have
+func (d *differ) diffPath(pth string, ofi, nfi *iso9660.FileInfo) error {
+	if entryType(ofi) != entryType(nfi) {
+		dir := path.Dir(pth)
+		if err := d.old.collect(dir, ofi, &d.removed); err != nil {
+			return err
+		}
+		return d.new.collect(dir, nfi, &d.added)
+	}
+
+	o, err := d.old.entry(pth, ofi)
+	if err != nil {
+		return err
+	}
+	n, err := d.new.entry(pth, nfi)
+	if err != nil {
+		return err
+	}
+	if c, err := d.compare(o, n); err != nil {
+		return err
+	} else if len(c.Fields) > 0 {
+		c.Change = diffModified
+		d.modified = append(d.modified, c)
+	}
+
+	if ofi.IsDir() {
+		return d.diffDir(pth)
+	}
+	return nil
+}
+
+// compare describes the differences between o and n
+func (d *differ) compare(o, n *diffEntry) (diffChange, error) {
+	c := diffChange{
+		Path:    n.path,
+		Type:    entryType(n.fi),
+		Size:    n.fi.Size(),
+		OldSize: o.fi.Size(),
+		URL:     n.info.URL,
+		OldURL:  o.info.URL,
+	}
+	if o.path != n.path {
+		c.OldPath = o.path
+	}
+
+	if !o.fi.IsDir() && o.fi.Size() != n.fi.Size() {
+		c.Fields = append(c.Fields, "size")
+	}
+	if entryType(o.fi) == "file" {
+		if o.inline || n.inline {
+			// Files stored in an isohdr have no object of their own,
+			// so their content is compared instead
+			if same, err := d.sameContent(o, n); err != nil {
+				return c, err
+			} else if !same {
+				c.Fields = append(c.Fields, "content")
+			}
+		} else {
+			if extentRange(o.info) != extentRange(n.info) {
+				c.Fields = append(c.Fields, "url")
+			}
+			if extentVersion(o.info) != extentVersion(n.info) {
+				c.Fields = append(c.Fields, "version")
+			}
+		}
+		if o.info.Checksum.String() != n.info.Checksum.String() {
+			c.Fields = append(c.Fields, "checksum")
+		}
+	}
+	if o.fi.Target() != n.fi.Target() {
+		c.Fields = append(c.Fields, "target")
+	}
+
+	if o.fi.Mode()&os.ModePerm != n.fi.Mode()&os.ModePerm {
+		c.Fields = append(c.Fields, "mode")
+	}
+	if o.fi.Uid() != n.fi.Uid() {
+		c.Fields = append(c.Fields, "uid")
+	}
+	if o.fi.Gid() != n.fi.Gid() {
+		c.Fields = append(c.Fields, "gid")
+	}
+
+	// A directory's mtime changes with its contents, which are
+	// compared themselves
+	if !o.fi.IsDir() && !o.fi.ModTime().Equal(n.fi.ModTime()) {
+		c.Fields = append(c.Fields, "mtime")
+	}
+	return c, nil
+}
+
+// sameContent reports whether the files o and n hold the same bytes
+func (d *differ) sameContent(o, n *diffEntry) (bool, error) {
+	if o.fi.Size() != n.fi.Size() {
+		return false, nil
+	}
+
+	ob, err := d.old.read(o)
+	if err != nil {
+		return false, err
+	}
+	nb, err := d.new.read(n)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ob, nb), nil
+}
+
+// changes pairs removed and added files with the same object, or the
+// same content for files stored in an isohdr, as renames, and returns
+// every change sorted by path
+func (d *differ) changes() ([]diffChange, error) {
+	removed := make(map[string][]*diffEntry)
+	for _, e := range d.removed {
+		key, err := d.old.renameKey(e)
+		if err != nil {
+			return nil, err
+		}
+		if key != "" {
+			removed[key] = append(removed[key], e)
+		}
+	}
+
+	changes := d.modified
+	renamed := make(map[*diffEntry]bool)
+	for _, n := range d.added {
+		key, err := d.new.renameKey(n)
+		if err != nil {
+			return nil, err
+		}
+		candidates := removed[key]
+		if key == "" || len(candidates) == 0 {
+			continue
+		}
+		o := candidates[0]
+		removed[key] = candidates[1:]
+		renamed[o] = true
+		renamed[n] = true
+
+		c, err := d.compare(o, n)
+		if err != nil {
+			return nil, err
+		}
+		c.Change = diffRenamed
+		changes = append(changes, c)
+	}
+
+	for _, e := range d.removed {
+		if !renamed[e] {
+			changes = append(changes, diffChange{
+				Change:  diffRemoved,
+				Path:    e.path,
+				Type:    entryType(e.fi),
+				OldSize: e.fi.Size(),
+				OldURL:  e.info.URL,
+			})
+		}
+	}
+	for _, e := range d.added {
+		if !renamed[e] {
+			changes = append(changes, diffChange{
+				Change: diffAdded,
+				Path:   e.path,
+				Type:   entryType(e.fi),
+				Size:   e.fi.Size(),
+				URL:    e.info.URL,
+			})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// readDir lists dir sorted by name, without its "." and ".." entries.
+// The walker lists directories in the order of their iso9660 records,
+// which isn't that of their Rock Ridge names.
+func (s *diffSide) readDir(dir string) ([]*iso9660.FileInfo, error) {
+	infos, err := s.w.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*iso9660.FileInfo, 0, len(infos))
+	for _, fi := range infos {
+		if name := fi.Name(); name != "." && name != ".." {
+			entries = append(entries, fi)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// entry describes the file fi at pth
+func (s *diffSide) entry(pth string, fi *iso9660.FileInfo) (*diffEntry, error) {
+	e := &diffEntry{path: pth, fi: fi}
+	if entryType(fi) != "file" {
+		return e, nil
+	}
+
+	var err error
+	if e.info, err = s.v.StatExtent(fi.Extent()); err != nil {
+		return nil, fmt.Errorf("%s: %v", pth, err)
+	}
+	e.inline = e.info.Index == 0 || s.isohdrs[e.info.URL]
+	return e, nil
+}
+
+// read returns the content of the file e
+func (s *diffSide) read(e *diffEntry) ([]byte, error) {
+	f, err := s.w.Open(e.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// collect appends fi, in dir, and everything below it to entries
+func (s *diffSide) collect(dir string, fi *iso9660.FileInfo, entries *[]*diffEntry) error {
+	pth := path.Join(dir, fi.Name())
+	e, err := s.entry(pth, fi)
+	if err != nil {
+		return err
+	}
+	*entries = append(*entries, e)
+
+	if !fi.IsDir() {
+		return nil
+	}
+	children, err := s.readDir(pth)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := s.collect(pth, child, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryType names the type of fi
+func entryType(fi *iso9660.FileInfo) string {
+	switch {
+	case fi.IsDir():
+		return "directory"
+	case fi.Mode()&os.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "file"
+	}
+}
+
+// extentKey identifies the objects backing an extent, the range of
+// them it covers and the revisions it is pinned to
+func extentKey(info vdisc.ExtentInfo) string {
+	return extentRange(info) + " " + extentVersion(info)
+}
+
+// extentRange identifies the objects backing an extent, and the range
+// of them it covers
+func extentRange(info vdisc.ExtentInfo) string {
+	if len(info.Parts) > 0 {
+		urls := make([]string, len(info.Parts))
+		for i, part := range info.Parts {
+			urls[i] = part.URL
+		}
+		return strings.Join(urls, " ")
+	}
+	if info.Ranged {
+		return fmt.Sprintf("%s[%d,%d)", info.URL, info.Offset, info.Offset+info.Size)
+	}
+	return info.URL
+}
+
+// extentVersion describes the revisions of the objects backing an
+// extent it is pinned to
+func extentVersion(info vdisc.ExtentInfo) string {
+	versions := []storage.Version{info.Version}
+	if len(info.Parts) > 0 {
+		versions = versions[:0]
+		for _, part := range info.Parts {
+			versions = append(versions, part.Version)
+		}
+	}
+	return fmt.Sprintf("%q", versions)
+}
+
+// renameKey returns the key a removed file is matched to an added one
+// by, or "" if the file can't be matched. Files stored in an isohdr are
+// matched by a digest of their content, since they have no object to
+// match by, and sparse files are never matched. A file pinned to
+// another revision of its object is a different file.
+func (s *diffSide) renameKey(e *diffEntry) (string, error) {
+	if entryType(e.fi) != "file" || strings.HasPrefix(e.info.URL, "zero:") {
+		return "", nil
+	}
+	if e.inline {
+		data, err := s.read(e)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", e.path, err)
+		}
+		return fmt.Sprintf("content %x", sha256.Sum256(data)), nil
+	}
+	return extentKey(e.info), nil
+}
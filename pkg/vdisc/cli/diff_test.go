@@ -0,0 +1,249 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+func TestDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		pth := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(pth, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return pth
+	}
+	same := write("same", "same")
+	removed := write("removed", "removed")
+	added := write("added", "added")
+	moved := write("moved", "moved")
+	pinned := write("pinned", "pinned")
+	repinned := write("repinned", "repinned")
+	v1 := storage.Version{ETag: "1"}
+	v2 := storage.Version{ETag: "2"}
+
+	type file struct {
+		path string
+		url  string
+		opts vdisc.FileOptions
+	}
+	burn := func(name string, files []file) vdisc.VDisc {
+		b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{URL: filepath.Join(dir, name)})
+		for _, f := range files {
+			fi, err := os.Stat(f.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := b.AddFile(f.path, f.url, fi.Size(), f.opts); err != nil {
+				t.Fatal(err)
+			}
+		}
+		url, err := b.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := vdisc.Load(url, caching.NopCache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	oldV := burn("old.vdisc", []file{
+		{path: "same", url: same},
+		{path: "removed", url: removed},
+		{path: "modified", url: same},
+		{path: "old/moved", url: moved},
+		{path: "pinned", url: pinned, opts: vdisc.FileOptions{Version: v1}},
+		{path: "repinned", url: repinned, opts: vdisc.FileOptions{Version: v1}},
+	})
+	defer oldV.Close()
+	newV := burn("new.vdisc", []file{
+		{path: "same", url: same},
+		{path: "added", url: added},
+		{path: "modified", url: removed, opts: vdisc.FileOptions{Metadata: vdisc.Metadata{Mode: 0600}}},
+		{path: "new/moved", url: moved},
+		{path: "pinned", url: pinned, opts: vdisc.FileOptions{Version: v2}},
+		{path: "moved-repinned", url: repinned, opts: vdisc.FileOptions{Version: v2}},
+	})
+	defer newV.Close()
+
+	cmd := &DiffCmd{Old: "old.vdisc", New: "new.vdisc"}
+	report, err := cmd.diff(oldV, newV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file pinned to another revision of its object isn't a rename
+	expected := []diffChange{
+		{Change: diffAdded, Path: "/added", Type: "file", Size: 5, URL: added},
+		{Change: diffModified, Path: "/modified", Type: "file", Fields: []string{"size", "url", "mode"}, Size: 7, OldSize: 4, URL: removed, OldURL: same},
+		{Change: diffAdded, Path: "/moved-repinned", Type: "file", Size: 8, URL: repinned},
+		{Change: diffAdded, Path: "/new", Type: "directory", Size: 2048},
+		{Change: diffRenamed, Path: "/new/moved", OldPath: "/old/moved", Type: "file", Size: 5, OldSize: 5, URL: moved, OldURL: moved},
+		{Change: diffRemoved, Path: "/old", Type: "directory", OldSize: 2048},
+		{Change: diffModified, Path: "/pinned", Type: "file", Fields: []string{"version"}, Size: 6, OldSize: 6, URL: pinned, OldURL: pinned},
+		{Change: diffRemoved, Path: "/removed", Type: "file", OldSize: 7, OldURL: removed},
+		{Change: diffRemoved, Path: "/repinned", Type: "file", OldSize: 8, OldURL: repinned},
+	}
+	assert.Equal(t, expected, report.Changes)
+	assert.Equal(t, 3, report.Added)
+	assert.Equal(t, 3, report.Removed)
+	assert.Equal(t, 2, report.Modified)
+	assert.Equal(t, 1, report.Renamed)
+
+	var out bytes.Buffer
+	cmd.Json = true
+	if err := cmd.print(&out, report); err != nil {
+		t.Fatal(err)
+	}
+	var decoded diffReport
+	if assert.Nil(t, json.Unmarshal(out.Bytes(), &decoded)) {
+		assert.Equal(t, *report, decoded)
+	}
+
+	out.Reset()
+	cmd.Json, cmd.Csv = false, true
+	if err := cmd.print(&out, report); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, len(expected)+1, len(records)) {
+		assert.Equal(t, []string{"change", "path", "old_path", "type", "fields", "size", "old_size", "url", "old_url"}, records[0])
+		assert.Equal(t, []string{diffModified, "/modified", "", "file", "size url mode", "7", "4", removed, same}, records[2])
+		assert.Equal(t, []string{diffRenamed, "/new/moved", "/old/moved", "file", "", "5", "5", moved, moved}, records[5])
+	}
+}
+
+func TestDiffInlineRenames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		pth := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(pth, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return pth
+	}
+	load := func(b vdisc.Builder, steps ...error) vdisc.VDisc {
+		for _, err := range steps {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		url, err := b.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := vdisc.Load(url, caching.NopCache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	md := vdisc.FileOptions{Metadata: vdisc.Metadata{Mode: 0644, Mtime: time.Unix(1500000000, 0).UTC()}}
+
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{URL: filepath.Join(dir, "old.vdisc"), InlineThreshold: 16})
+	oldV := load(b,
+		b.AddFile("old/inline", write("inline", "inline"), -1, md),
+		b.AddFile("old/ranged", write("ranged", "ranged"), -1, md),
+		b.AddFile("old/gone", write("gone", "gone"), -1, md),
+	)
+	defer oldV.Close()
+
+	// One file is inlined again, and the other a range of the old
+	// isohdr, as edit used to burn them
+	fi, err := iso9660.NewWalker(oldV.Image()).Lstat("old/ranged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := oldV.StatExtent(fi.Extent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = vdisc.NewISO9660Builder(vdisc.BuilderConfig{URL: filepath.Join(dir, "new.vdisc")})
+	inline := md
+	inline.Inline = true
+	newV := load(b,
+		b.AddFile("new/inline", write("inline", "inline"), -1, inline),
+		b.AddFileRange("new/ranged", info.URL, info.Offset, fi.Size(), md),
+	)
+	defer newV.Close()
+
+	cmd := &DiffCmd{Old: "old.vdisc", New: "new.vdisc"}
+	report, err := cmd.diff(oldV, newV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := make(map[string]string)
+	for _, c := range report.Changes {
+		if c.Change == diffRenamed {
+			renamed[c.OldPath] = c.Path
+			assert.Empty(t, c.Fields, c.Path)
+		}
+	}
+	assert.Equal(t, map[string]string{"/old/inline": "/new/inline", "/old/ranged": "/new/ranged"}, renamed)
+	assert.Equal(t, 2, report.Renamed)
+	assert.Equal(t, 2, report.Removed)
+	assert.Equal(t, 1, report.Added)
+
+	// Removed paths have no size, and added ones no old size
+	var out bytes.Buffer
+	cmd.Json = true
+	if err := cmd.print(&out, report); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Changes []map[string]interface{} `json:"changes"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range decoded.Changes {
+		_, size := c["size"]
+		_, oldSize := c["oldSize"]
+		assert.Equal(t, c["change"] != diffRemoved, size, c["path"])
+		assert.Equal(t, c["change"] != diffAdded, oldSize, c["path"])
+	}
+}
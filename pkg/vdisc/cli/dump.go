@@ -0,0 +1,82 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+type DumpCmd struct {
+	Url   string `short:"u" help:"The URL of the vdisc" required:"true"`
+	Lines bool   `help:"Print JSON lines, the vdisc followed by one line per extent, instead of a single document"`
+}
+
+func (cmd *DumpCmd) Run(globals *Globals) error {
+	v, err := vdisc.Load(cmd.Url, caching.NopCache, vdisc.LoadOptions{TrustedKeys: globalTrustedKeys(globals)})
+	if err != nil {
+		zap.L().Fatal("loading vdisc", zap.Error(err))
+	}
+	defer v.Close()
+
+	out := bufio.NewWriterSize(os.Stdout, 1024*1024)
+	if err := vdisc.WriteDump(out, v, cmd.Lines); err != nil {
+		zap.L().Fatal("dumping vdisc", zap.Error(err))
+	}
+	if err := out.Flush(); err != nil {
+		zap.L().Fatal("writing dump", zap.Error(err))
+	}
+	return nil
+}
+
+type RestoreCmd struct {
+	Input   string `short:"i" help:"Path to a JSON or JSON lines dump, or - for stdin" default:"-"`
+	Url     string `short:"o" help:"VDisc output URL" required:"true"`
+	TempDir string `help:"Directory for spooled extents (default is the system temp dir)"`
+}
+
+func (cmd *RestoreCmd) Run(globals *Globals) error {
+	var in io.Reader = os.Stdin
+	if cmd.Input != "-" {
+		obj, err := storage.Open(cmd.Input)
+		if err != nil {
+			zap.L().Fatal("opening dump", zap.Error(err))
+		}
+		defer obj.Close()
+		in = obj
+	}
+
+	url, err := vdisc.Restore(bufio.NewReaderSize(in, 1024*1024), cmd.Url, vdisc.RestoreOptions{TempDir: cmd.TempDir})
+	if err != nil {
+		zap.L().Fatal("restoring vdisc", zap.Error(err))
+	}
+
+	// Loading the result validates it
+	v, err := vdisc.Load(url, caching.NopCache)
+	if err != nil {
+		zap.L().Fatal("loading restored vdisc", zap.String("url", url), zap.Error(err))
+	}
+	v.Close()
+
+	zap.L().Info("complete", zap.String("url", url))
+	return nil
+}
@@ -0,0 +1,537 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/units"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+type EditCmd struct {
+	Base            string   `help:"URL of the vdisc to start from" required:"true"`
+	Patch           string   `help:"Path to a CSV of add, remove, rename and set rows to apply" required:"true"`
+	Url             string   `short:"o" help:"VDisc output URL" required:"true"`
+	NameValidation  string   `name:"iso9660-name-validation" help:"Restrictions on file names" enum:"portable,extended" default:"portable"`
+	InlineThreshold units.SI `help:"Store files of up to this size, e.g. 4KiB, with the disc metadata instead of referencing them" default:"0"`
+	Streaming       bool     `help:"Spill entries to disk to bound memory use when burning very many files"`
+	TempDir         string   `help:"With --streaming, directory for spilled entries (default is the system temp dir)"`
+	Layout          string   `help:"Store the vdisc gzip compressed, to be downloaded whole when loaded, or paged, to be read as it is used" enum:"gzip,paged" default:"gzip"`
+	SignKey         string   `help:"Sign the vdisc with the PEM encoded private key at this path"`
+}
+
+// Patch operations, the first column of each patch row. An add row is
+// followed by a burn manifest row and replaces any file at its path. A
+// remove row names a path to delete, with everything below it. A
+// rename row names a path and its new path. A set row names a path,
+// followed by the mode, uid, gid, mtime and ctime columns of a burn
+// manifest, any of which may be empty to keep the current value.
+const (
+	patchAdd    = "add"
+	patchRemove = "remove"
+	patchRename = "rename"
+	patchSet    = "set"
+)
+
+// editNode is a file, directory or symlink of the edited tree
+type editNode struct {
+	// children is not nil for a directory
+	children map[string]*editNode
+	target   string
+
+	// md is shared by the hard links of a file of the base vdisc, so
+	// setting it through any of them sets it for all
+	md *vdisc.Metadata
+
+	// A file of the base vdisc is found by its inode and extent, and a
+	// file added by the patch by its manifest row
+	base  bool
+	ino   uint32
+	lba   iso9660.LogicalBlockAddress
+	size  int64
+	entry *manifestEntry
+}
+
+func newEditDir(md vdisc.Metadata) *editNode {
+	return &editNode{children: make(map[string]*editNode), md: &md}
+}
+
+func (cmd *EditCmd) Run(globals *Globals) error {
+	v, err := vdisc.Load(cmd.Base, globalCache(&globals.Cache), globalLoadOptions(globals))
+	if err != nil {
+		zap.L().Fatal("loading vdisc", zap.String("url", cmd.Base), zap.Error(err))
+	}
+	defer v.Close()
+
+	url, e, err := cmd.edit(v)
+	if err != nil {
+		zap.L().Fatal("editing vdisc", zap.String("url", cmd.Base), zap.Error(err))
+	}
+
+	if cmd.SignKey != "" {
+		signVDisc(url, cmd.SignKey)
+	}
+
+	zap.L().Info("complete", zap.String("url", url), zap.Int("reused", e.reused), zap.Int("added", e.added))
+	return nil
+}
+
+// edit burns the tree of v with the patch applied, returning the URL
+// of the new vdisc and the emitter that added its files
+func (cmd *EditCmd) edit(v vdisc.VDisc) (string, *treeEmitter, error) {
+	if v.FsType() != "iso9660" {
+		return "", nil, fmt.Errorf("unsupported file system type %q", v.FsType())
+	}
+
+	w := iso9660.NewWalker(v.Image())
+	fi, err := w.Lstat("/")
+	if err != nil {
+		return "", nil, fmt.Errorf("reading vdisc: %v", err)
+	}
+	root := newEditDir(editMetadata(fi))
+	if err := readEditTree(w, "/", root, make(map[uint32]*vdisc.Metadata)); err != nil {
+		return "", nil, fmt.Errorf("reading vdisc: %v", err)
+	}
+
+	if err := cmd.applyPatch(root); err != nil {
+		return "", nil, fmt.Errorf("applying patch %s: %v", cmd.Patch, err)
+	}
+
+	cfg := vdisc.BuilderConfig{
+		URL:             cmd.Url,
+		InlineThreshold: int64(cmd.InlineThreshold),
+		Streaming:       cmd.Streaming,
+		TempDir:         cmd.TempDir,
+	}
+	if cmd.Layout == "paged" {
+		cfg.Layout = vdisc.LayoutPaged
+	}
+
+	var b vdisc.Builder
+	switch cmd.NameValidation {
+	case "portable":
+		b = vdisc.NewPosixPortableISO9660Builder(cfg)
+	case "extended":
+		b = vdisc.NewExtendedISO9660Builder(cfg)
+	default:
+		panic("never")
+	}
+
+	// The new volume keeps the identifiers of the base volume, but is
+	// identified by its own URL
+	var pvd iso9660.PrimaryVolumeDescriptor
+	sector := io.NewSectionReader(v.Image(), 16*iso9660.LogicalBlockSize, iso9660.LogicalBlockSize)
+	if err := iso9660.DecodePrimaryVolumeDescriptor(sector, &pvd); err != nil {
+		return "", nil, fmt.Errorf("reading primary volume descriptor: %v", err)
+	}
+	id := uuid.NewSHA1(uuid.Nil, []byte(cmd.Url))
+	b.SetVolumeIdentifier(fmt.Sprintf("%x", id))
+	b.SetSystemIdentifier(pvd.SystemIdentifier)
+	b.SetVolumeSetIdentifier(pvd.VolumeSetIdentifier)
+	b.SetPublisherIdentifier(pvd.PublisherIdentifier)
+	b.SetDataPreparerIdentifier(pvd.DataPreparerIdentifier)
+	b.SetApplicationIdentifier(pvd.ApplicationIdentifier)
+	b.SetCopyrightFileIdentifier(pvd.CopyrightFileIdentifier)
+	b.SetAbstractFileIdentifier(pvd.AbstractFileIdentifier)
+	b.SetBibliographicFileIdentifier(pvd.BibliographicFileIdentifier)
+
+	e := &treeEmitter{
+		b:         b,
+		v:         v,
+		streaming: cmd.Streaming,
+		primaries: make(map[uint32]string),
+	}
+	if err := b.AddDirectory("/", *root.md); err != nil {
+		return "", nil, fmt.Errorf("adding root directory: %v", err)
+	}
+	if err := e.emitDir("/", root); err != nil {
+		return "", nil, err
+	}
+	for _, link := range e.links {
+		if err := b.AddHardlink(link[0], link[1]); err != nil {
+			return "", nil, fmt.Errorf("adding hard link %s to %s: %v", link[0], link[1], err)
+		}
+	}
+
+	url, err := b.Build()
+	if err != nil {
+		return "", nil, fmt.Errorf("burning vdisc: %v", err)
+	}
+	return url, e, nil
+}
+
+// editMetadata returns the metadata of a file of the base vdisc
+func editMetadata(fi *iso9660.FileInfo) vdisc.Metadata {
+	return vdisc.Metadata{
+		Mode:  fi.Mode() & os.ModePerm,
+		Uid:   fi.Uid(),
+		Gid:   fi.Gid(),
+		Mtime: fi.ModTime(),
+		Ctime: fi.Created(),
+	}
+}
+
+// readEditTree adds everything below the directory dir of the base
+// vdisc to node. inodes holds the metadata of the files read so far by
+// inode, for their other hard links to share.
+func readEditTree(w *iso9660.Walker, dir string, node *editNode, inodes map[uint32]*vdisc.Metadata) error {
+	infos, err := w.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range infos {
+		name := fi.Name()
+		if name == "." || name == ".." {
+			continue
+		}
+
+		md := editMetadata(fi)
+		switch {
+		case fi.IsDir():
+			child := newEditDir(md)
+			if err := readEditTree(w, path.Join(dir, name), child, inodes); err != nil {
+				return err
+			}
+			node.children[name] = child
+		case fi.Mode()&os.ModeSymlink != 0:
+			node.children[name] = &editNode{md: &md, target: fi.Target()}
+		default:
+			shared, ok := inodes[fi.Ino()]
+			if !ok {
+				shared = &md
+				inodes[fi.Ino()] = shared
+			}
+			node.children[name] = &editNode{md: shared, base: true, ino: fi.Ino(), lba: fi.Extent(), size: fi.Size()}
+		}
+	}
+	return nil
+}
+
+// applyPatch applies every row of the patch to the tree at root, in
+// order
+func (cmd *EditCmd) applyPatch(root *editNode) error {
+	input, err := storage.Open(cmd.Patch)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	r := csv.NewReader(input)
+	r.FieldsPerRecord = -1
+
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := applyPatchRecord(root, record); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+}
+
+func applyPatchRecord(root *editNode, record []string) error {
+	if len(record) < 2 {
+		return fmt.Errorf("expected at least 2 fields, got %d", len(record))
+	}
+
+	switch op := strings.TrimSpace(record[0]); op {
+	case patchAdd:
+		entry, err := parseManifestRecord(record[1:])
+		if err != nil {
+			return err
+		}
+
+		parent, name, err := lookupParent(root, entry.Path, true)
+		if err != nil {
+			return err
+		}
+		if entry.Type == manifestDirectory {
+			if existing, ok := parent.children[name]; ok && existing.children != nil {
+				existing.md = &entry.Options.Metadata
+				return nil
+			}
+			parent.children[name] = newEditDir(entry.Options.Metadata)
+			return nil
+		}
+		if existing, ok := parent.children[name]; ok && existing.children != nil {
+			return fmt.Errorf("%s is a directory", entry.Path)
+		}
+		if entry.Type == manifestHardlink {
+			entry.Target = cleanPath(entry.Target)
+		}
+		parent.children[name] = &editNode{md: &entry.Options.Metadata, entry: entry}
+		return nil
+
+	case patchRemove:
+		parent, name, err := lookupParent(root, record[1], false)
+		if err != nil {
+			return err
+		}
+		if _, ok := parent.children[name]; !ok {
+			return fmt.Errorf("%s: no such file or directory", record[1])
+		}
+		delete(parent.children, name)
+		return nil
+
+	case patchRename:
+		if len(record) < 3 {
+			return fmt.Errorf("expected 3 fields, got %d", len(record))
+		}
+		from, to := cleanPath(record[1]), cleanPath(record[2])
+		if to == from || strings.HasPrefix(to, from+"/") {
+			return fmt.Errorf("can't move %s into itself", from)
+		}
+
+		parent, name, err := lookupParent(root, from, false)
+		if err != nil {
+			return err
+		}
+		node, ok := parent.children[name]
+		if !ok {
+			return fmt.Errorf("%s: no such file or directory", from)
+		}
+		toParent, toName, err := lookupParent(root, to, true)
+		if err != nil {
+			return err
+		}
+		if _, ok := toParent.children[toName]; ok {
+			return fmt.Errorf("%s already exists", to)
+		}
+		delete(parent.children, name)
+		toParent.children[toName] = node
+		return nil
+
+	case patchSet:
+		parent, name, err := lookupParent(root, record[1], false)
+		if err != nil {
+			return err
+		}
+		node, ok := parent.children[name]
+		if !ok {
+			return fmt.Errorf("%s: no such file or directory", record[1])
+		}
+		return setMetadata(node.md, record[2:])
+
+	default:
+		return fmt.Errorf("unknown operation %q", op)
+	}
+}
+
+// setMetadata updates md with the mode, uid, gid, mtime and ctime
+// fields that aren't empty
+func setMetadata(md *vdisc.Metadata, fields []string) error {
+	field := func(i int) string {
+		if i < len(fields) {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+
+	if s := field(0); s != "" {
+		mode, err := strconv.ParseUint(s, 8, 32)
+		if err != nil {
+			return fmt.Errorf("parsing mode: %v", err)
+		}
+		md.Mode = os.FileMode(mode) & os.ModePerm
+	}
+	if s := field(1); s != "" {
+		uid, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return fmt.Errorf("parsing uid: %v", err)
+		}
+		md.Uid = uint32(uid)
+	}
+	if s := field(2); s != "" {
+		gid, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return fmt.Errorf("parsing gid: %v", err)
+		}
+		md.Gid = uint32(gid)
+	}
+	if s := field(3); s != "" {
+		mtime, err := parseManifestTime(s)
+		if err != nil {
+			return fmt.Errorf("parsing mtime: %v", err)
+		}
+		md.Mtime = mtime
+	}
+	if s := field(4); s != "" {
+		ctime, err := parseManifestTime(s)
+		if err != nil {
+			return fmt.Errorf("parsing ctime: %v", err)
+		}
+		md.Ctime = ctime
+	}
+	return nil
+}
+
+// cleanPath returns the absolute, clean form of a path in the vdisc
+func cleanPath(pth string) string {
+	return path.Clean("/" + strings.TrimSpace(pth))
+}
+
+// lookupParent returns the directory containing pth and the name of pth
+// within it. With create, missing directories are added.
+func lookupParent(root *editNode, pth string, create bool) (*editNode, string, error) {
+	pth = cleanPath(pth)
+	if pth == "/" {
+		return nil, "", fmt.Errorf("can't edit the root directory")
+	}
+
+	dir, name := path.Split(pth)
+	node := root
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		child, ok := node.children[part]
+		if !ok && create {
+			child = newEditDir(vdisc.Metadata{})
+			node.children[part] = child
+		} else if !ok {
+			return nil, "", fmt.Errorf("%s: no such file or directory", pth)
+		}
+		if child.children == nil {
+			return nil, "", fmt.Errorf("%s: %s is not a directory", pth, part)
+		}
+		node = child
+	}
+	return node, name, nil
+}
+
+// treeEmitter adds an edited tree to a builder
+type treeEmitter struct {
+	b         vdisc.Builder
+	v         vdisc.VDisc
+	streaming bool
+
+	// primaries maps the inode of each file of the base vdisc to the
+	// first path it was added at, which later paths link to
+	primaries map[uint32]string
+
+	// links holds the path and target of each hard link, which are
+	// added once their targets have been
+	links [][2]string
+
+	reused int
+	added  int
+}
+
+func (e *treeEmitter) emitDir(dir string, node *editNode) error {
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := node.children[name]
+		pth := path.Join(dir, name)
+
+		var err error
+		switch {
+		case child.children != nil:
+			if err = e.b.AddDirectory(pth, *child.md); err == nil {
+				err = e.emitDir(pth, child)
+			}
+		case child.entry != nil:
+			err = e.emitEntry(pth, child)
+		case child.base:
+			err = e.emitBaseFile(pth, child)
+		default:
+			err = e.b.AddSymlink(pth, child.target, *child.md)
+		}
+		if err != nil {
+			return fmt.Errorf("adding %s: %v", pth, err)
+		}
+	}
+	return nil
+}
+
+// emitEntry adds a file added by the patch
+func (e *treeEmitter) emitEntry(pth string, node *editNode) error {
+	entry := *node.entry
+	entry.Path = pth
+	entry.Options.Metadata = *node.md
+	if entry.Type == manifestHardlink {
+		e.links = append(e.links, [2]string{pth, entry.Target})
+		return nil
+	}
+
+	e.added++
+	return addManifestEntry(e.b, &entry)
+}
+
+// emitBaseFile adds a file of the base vdisc, referencing the same
+// objects as its extent. Files stored inline in the base vdisc are
+// inlined again from its isohdr object, so that the new vdisc never
+// refers to the old one.
+func (e *treeEmitter) emitBaseFile(pth string, node *editNode) error {
+	if primary, ok := e.primaries[node.ino]; ok && !e.streaming {
+		e.links = append(e.links, [2]string{pth, primary})
+		return nil
+	}
+	e.primaries[node.ino] = pth
+
+	info, err := e.v.StatExtent(node.lba)
+	if err != nil {
+		return err
+	}
+
+	e.reused++
+	opts := vdisc.FileOptions{
+		Metadata:    *node.md,
+		Checksum:    info.Checksum,
+		Version:     info.Version,
+		Compression: info.Compression,
+		KeyID:       info.KeyID,
+		Inline:      info.Index == 0,
+	}
+	switch {
+	case len(info.Parts) > 0:
+		urls := make([]string, len(info.Parts))
+		sizes := make([]int64, len(info.Parts))
+		opts.PartVersions = make([]storage.Version, len(info.Parts))
+		for i, part := range info.Parts {
+			urls[i] = part.URL
+			sizes[i] = part.Size
+			opts.PartVersions[i] = part.Version
+		}
+		opts.Version = storage.Version{}
+		return e.b.AddFileParts(pth, urls, sizes, opts)
+	case info.Ranged:
+		return e.b.AddFileRange(pth, info.URL, info.Offset, node.size, opts)
+	default:
+		return e.b.AddFile(pth, info.URL, node.size, opts)
+	}
+}
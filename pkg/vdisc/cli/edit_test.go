@@ -0,0 +1,187 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+func TestEdit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		pth := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(pth, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return pth
+	}
+
+	mtime := time.Unix(1500000000, 0).UTC()
+	ctime := time.Unix(1600000000, 0).UTC()
+	md := vdisc.Metadata{Mode: 0600, Uid: 1, Gid: 2, Mtime: mtime, Ctime: ctime}
+	versions := []storage.Version{{ETag: "one"}, {ETag: "two"}}
+
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{
+		URL:             filepath.Join(dir, "base.vdisc"),
+		InlineThreshold: 8,
+	})
+	steps := []error{
+		b.AddDirectory("/", vdisc.Metadata{Mode: 0750, Uid: 5, Gid: 6, Mtime: mtime, Ctime: ctime}),
+		b.AddFile("keep", write("keep", "keep this file"), -1, vdisc.FileOptions{Metadata: md}),
+		b.AddFile("inline", write("inline", "tiny"), -1, vdisc.FileOptions{Metadata: md}),
+		b.AddFileParts("parts", []string{write("part1", "first part, "), write("part2", "second part")}, []int64{12, 11}, vdisc.FileOptions{Metadata: md, PartVersions: versions}),
+		b.AddFile("gone", write("gone", "removed by the patch"), -1),
+		b.AddFile("old", write("old", "renamed by the patch"), -1),
+		b.AddFile("link1", write("link", "linked file"), -1, vdisc.FileOptions{Metadata: md}),
+		b.AddHardlink("link2", "link1"),
+	}
+	for _, err := range steps {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	base, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := "add,added," + write("added", "added by the patch") + ",,,0644\n" +
+		"remove,gone\n" +
+		"rename,old,dir/new\n" +
+		"set,keep,0640,,,,\n" +
+		"set,link2,0444,9,,,\n"
+	cmd := &EditCmd{
+		Base:           base,
+		Patch:          write("patch.csv", patch),
+		Url:            filepath.Join(dir, "edited.vdisc"),
+		NameValidation: "portable",
+		Layout:         "gzip",
+	}
+
+	v, err := vdisc.Load(base, caching.NopCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	url, e, err := cmd.edit(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, e.added)
+
+	edited, err := vdisc.Load(url, caching.NopCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer edited.Close()
+
+	w := iso9660.NewWalker(edited.Image())
+	expected := map[string]string{
+		"keep":    "keep this file",
+		"inline":  "tiny",
+		"parts":   "first part, second part",
+		"added":   "added by the patch",
+		"dir/new": "renamed by the patch",
+		"link1":   "linked file",
+		"link2":   "linked file",
+	}
+	for name, content := range expected {
+		f, err := w.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		assert.Nil(t, err)
+		assert.Equal(t, content, string(data), name)
+	}
+	for _, name := range []string{"gone", "old"} {
+		_, err := w.Lstat(name)
+		assert.NotNil(t, err, name)
+	}
+
+	fi, err := w.Lstat("/")
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0750), fi.Mode()&os.ModePerm)
+		assert.Equal(t, uint32(5), fi.Uid())
+		assert.Equal(t, uint32(6), fi.Gid())
+		assert.Equal(t, ctime, fi.Created())
+	}
+
+	fi, err = w.Lstat("keep")
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0640), fi.Mode()&os.ModePerm)
+		assert.Equal(t, uint32(1), fi.Uid())
+		assert.Equal(t, mtime, fi.ModTime())
+		assert.Equal(t, ctime, fi.Created())
+	}
+
+	// Setting metadata through one hard link sets it for both
+	link1, err := w.Lstat("link1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link2, err := w.Lstat("link2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, link1.Ino(), link2.Ino())
+	for _, fi := range []*iso9660.FileInfo{link1, link2} {
+		assert.Equal(t, os.FileMode(0444), fi.Mode()&os.ModePerm)
+		assert.Equal(t, uint32(9), fi.Uid())
+		assert.Equal(t, uint32(2), fi.Gid())
+	}
+
+	// The inline file is inlined again rather than referring to the
+	// base vdisc
+	fi, err = w.Lstat("inline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := edited.StatExtent(fi.Extent())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, info.Index)
+	baseInfo, err := v.StatExtent(0)
+	assert.Nil(t, err)
+	assert.NotEqual(t, baseInfo.URL, info.URL)
+
+	var parts []vdisc.PartInfo
+	err = edited.VisitExtents(func(ext vdisc.ExtentInfo) error {
+		if len(ext.Parts) > 0 {
+			parts = ext.Parts
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(parts)) {
+		assert.Equal(t, versions[0], parts[0].Version)
+		assert.Equal(t, versions[1], parts[1].Version)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"context"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/NVIDIA/vdisc/pkg/chunkcrypt"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+// encryptingBuilder uploads an encrypted copy of every file below a
+// prefix and adds the copy to the inner Builder in its place. Since a
+// Builder may open an object as soon as it is added, every addition is
+// held back and replayed in order by Build, once the uploads are done.
+type encryptingBuilder struct {
+	vdisc.Builder
+	prefix string
+	keyID  string
+	aead   cipher.AEAD
+	adds   []func() error
+
+	work chan encryptJob
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	errs []error
+}
+
+// encryptJob copies the plaintext of a file to dest
+type encryptJob struct {
+	dest  string
+	open  func() (io.ReadCloser, error)
+	label string
+}
+
+func newEncryptingBuilder(b vdisc.Builder, prefix string, keyID string, keys vdisc.KeyProvider, concurrency int) (*encryptingBuilder, error) {
+	key, err := keys.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chunkcrypt.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	eb := &encryptingBuilder{
+		Builder: b,
+		prefix:  strings.TrimSuffix(prefix, "/"),
+		keyID:   keyID,
+		aead:    aead,
+		work:    make(chan encryptJob),
+	}
+	eb.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer eb.wg.Done()
+			for job := range eb.work {
+				if err := eb.upload(job); err != nil {
+					eb.mu.Lock()
+					eb.errs = append(eb.errs, fmt.Errorf("encrypting %s: %v", job.label, err))
+					eb.mu.Unlock()
+				}
+			}
+		}()
+	}
+	return eb, nil
+}
+
+func (eb *encryptingBuilder) upload(job encryptJob) error {
+	src, err := job.open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := storage.Create(job.dest)
+	if err != nil {
+		return err
+	}
+	defer dst.Abort()
+
+	cw := chunkcrypt.NewWriter(dst, eb.aead)
+	if _, err := io.Copy(cw, src); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if _, err := dst.Commit(); err != nil {
+		return err
+	}
+	zap.L().Debug("encrypted file", zap.String("src", job.label), zap.String("dest", job.dest))
+	return nil
+}
+
+// add records the encrypted copy of a file with the inner Builder and
+// queues its upload
+func (eb *encryptingBuilder) add(pth string, size int64, label string, open func() (io.ReadCloser, error), options []vdisc.FileOptions) error {
+	var opts vdisc.FileOptions
+	if len(options) > 0 {
+		opts = options[0]
+	}
+	if opts.Compression != vdisc.CompressionNone {
+		return fmt.Errorf("%s: compressed objects can't be encrypted", label)
+	}
+	if opts.KeyID != "" {
+		return fmt.Errorf("%s: already encrypted", label)
+	}
+
+	// The source version no longer applies to the copy
+	opts.Version = storage.Version{}
+	opts.KeyID = eb.keyID
+
+	dest := eb.prefix + "/" + strings.TrimPrefix(pth, "/")
+	eb.adds = append(eb.adds, func() error {
+		return eb.Builder.AddFile(pth, dest, size, opts)
+	})
+	eb.work <- encryptJob{dest: dest, open: open, label: label}
+	return nil
+}
+
+func (eb *encryptingBuilder) AddFile(pth string, url string, size int64, options ...vdisc.FileOptions) error {
+	var version storage.Version
+	if len(options) > 0 {
+		version = options[0].Version
+	}
+	return eb.add(pth, size, url, func() (io.ReadCloser, error) {
+		return openVersion(url, version)
+	}, options)
+}
+
+func (eb *encryptingBuilder) AddFileRange(pth string, url string, offset int64, length int64, options ...vdisc.FileOptions) error {
+	var version storage.Version
+	if len(options) > 0 {
+		version = options[0].Version
+	}
+	return eb.add(pth, length, url, func() (io.ReadCloser, error) {
+		obj, err := openVersion(url, version)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(obj, offset, length), obj}, nil
+	}, options)
+}
+
+func (eb *encryptingBuilder) AddFileParts(pth string, urls []string, sizes []int64, options ...vdisc.FileOptions) error {
+	if len(urls) != len(sizes) {
+		return fmt.Errorf("%s: %d parts but %d sizes", pth, len(urls), len(sizes))
+	}
+	var size int64
+	for _, s := range sizes {
+		size += s
+	}
+	return eb.add(pth, size, urls[0], func() (io.ReadCloser, error) {
+		parts := make([]storage.AnonymousObject, 0, len(urls))
+		for i, url := range urls {
+			obj, err := storage.OpenSize(url, sizes[i])
+			if err != nil {
+				for _, p := range parts {
+					p.Close()
+				}
+				return nil, err
+			}
+			parts = append(parts, obj)
+		}
+		return storage.Concat(parts...), nil
+	}, options)
+}
+
+func (eb *encryptingBuilder) AddSparseFile(pth string, size int64, options ...vdisc.FileOptions) error {
+	eb.adds = append(eb.adds, func() error {
+		return eb.Builder.AddSparseFile(pth, size, options...)
+	})
+	return nil
+}
+
+func (eb *encryptingBuilder) AddHardlink(pth string, existingPath string) error {
+	eb.adds = append(eb.adds, func() error {
+		return eb.Builder.AddHardlink(pth, existingPath)
+	})
+	return nil
+}
+
+func (eb *encryptingBuilder) AddSymlink(pth string, target string, metadata ...vdisc.Metadata) error {
+	eb.adds = append(eb.adds, func() error {
+		return eb.Builder.AddSymlink(pth, target, metadata...)
+	})
+	return nil
+}
+
+func (eb *encryptingBuilder) AddDirectory(pth string, metadata ...vdisc.Metadata) error {
+	eb.adds = append(eb.adds, func() error {
+		return eb.Builder.AddDirectory(pth, metadata...)
+	})
+	return nil
+}
+
+// Build waits for every upload to finish, then adds everything to the
+// inner Builder and builds the vdisc
+func (eb *encryptingBuilder) Build() (string, error) {
+	close(eb.work)
+	eb.wg.Wait()
+	if len(eb.errs) > 0 {
+		for _, err := range eb.errs[1:] {
+			zap.L().Error("encrypting file", zap.Error(err))
+		}
+		return "", eb.errs[0]
+	}
+
+	for _, add := range eb.adds {
+		if err := add(); err != nil {
+			return "", err
+		}
+	}
+	return eb.Builder.Build()
+}
+
+// openVersion opens url, failing if it no longer has the given version
+func openVersion(url string, version storage.Version) (storage.Object, error) {
+	if version.IsZero() {
+		return storage.Open(url)
+	}
+	return storage.OpenContextSize(storage.CtxWithVersion(context.Background(), version), url, -1)
+}
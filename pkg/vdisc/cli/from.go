@@ -0,0 +1,206 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/NVIDIA/vdisc/pkg/storage"
+)
+
+// sourceObject is an object found while walking a --from URL
+type sourceObject struct {
+	Rel  string
+	URL  string
+	Info os.FileInfo
+}
+
+// sourceVisitor calls fn for every regular object below root
+type sourceVisitor struct {
+	root        string
+	concurrency int
+	mu          sync.Mutex
+	fn          func(sourceObject) error
+}
+
+func (sv *sourceVisitor) VisitDir(baseURL string, files []os.FileInfo) error {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		url := baseURL + "/" + fi.Name()
+		err := sv.fn(sourceObject{
+			Rel:  strings.TrimPrefix(url, sv.root+"/"),
+			URL:  url,
+			Info: fi,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sv *sourceVisitor) Concurrency() int {
+	return sv.concurrency
+}
+
+// visitSource calls fn for every regular object below root, in the
+// order they are listed. Calls to fn are serialized.
+func visitSource(root string, concurrency int, fn func(sourceObject) error) error {
+	sv := &sourceVisitor{
+		root:        strings.TrimSuffix(root, "/"),
+		concurrency: concurrency,
+		fn:          fn,
+	}
+	return storage.Visit(sv.root, sv)
+}
+
+// walkSource lists every regular object below root, sorted by path
+func walkSource(root string, concurrency int) ([]sourceObject, error) {
+	var objects []sourceObject
+	err := visitSource(root, concurrency, func(obj sourceObject) error {
+		objects = append(objects, obj)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Rel < objects[j].Rel
+	})
+	return objects, nil
+}
+
+type pathRewrite struct {
+	from string
+	to   string
+}
+
+// pathMapper selects objects by glob and maps their relative paths to
+// paths in the disc image
+type pathMapper struct {
+	include  []string
+	exclude  []string
+	rewrites []pathRewrite
+}
+
+func newPathMapper(include, exclude, rewrites []string) (*pathMapper, error) {
+	pm := &pathMapper{
+		include: include,
+		exclude: exclude,
+	}
+
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", pattern, err)
+		}
+	}
+
+	for _, rw := range rewrites {
+		idx := strings.Index(rw, "=")
+		if idx < 0 {
+			return nil, fmt.Errorf("invalid rewrite %q: expected OLD=NEW", rw)
+		}
+		// A prefix is a whole number of path segments, with or
+		// without a trailing slash
+		from, to := strings.TrimSuffix(rw[:idx], "/"), strings.TrimSuffix(rw[idx+1:], "/")
+		if from == "" {
+			return nil, fmt.Errorf("invalid rewrite %q: empty prefix", rw)
+		}
+		pm.rewrites = append(pm.rewrites, pathRewrite{from, to})
+	}
+
+	return pm, nil
+}
+
+// Map returns the path in the disc image for an object at rel, or
+// false if the object should be skipped.
+func (pm *pathMapper) Map(rel string) (string, bool) {
+	if len(pm.include) > 0 && !matchAny(pm.include, rel) {
+		return "", false
+	}
+	if matchAny(pm.exclude, rel) {
+		return "", false
+	}
+
+	for _, rw := range pm.rewrites {
+		if rel == rw.from {
+			rel = rw.to
+			break
+		}
+		if strings.HasPrefix(rel, rw.from+"/") {
+			rel = path.Join(rw.to, rel[len(rw.from)+1:])
+			break
+		}
+	}
+	return rel, true
+}
+
+// matchAny reports whether rel matches any of the patterns. Patterns
+// without a slash are matched against the base name, like rsync.
+// Others are matched a segment at a time, where a "**" segment matches
+// any number of segments, so "tmp/*" matches the objects directly
+// below tmp and "tmp/**" every object below it.
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+				return true
+			}
+			continue
+		}
+		if matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments reports whether the segments of a path match those of
+// a pattern
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// A trailing one only matches what is below the directory
+			if len(pattern) == 1 {
+				return len(segments) > 0
+			}
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
@@ -0,0 +1,117 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPathMapper(t *testing.T) {
+	for _, tc := range []struct {
+		include, exclude, rewrites []string
+		valid                      bool
+	}{
+		{nil, nil, nil, true},
+		{[]string{"*.jpg", "img/**"}, []string{"tmp/*"}, []string{"train=data", "raw/=data/", "old="}, true},
+		{[]string{"[a-"}, nil, nil, false},
+		{nil, []string{"tmp/[a-"}, nil, false},
+		{nil, nil, []string{"no-equals"}, false},
+		{nil, nil, []string{"=data"}, false},
+		{nil, nil, []string{"/=data"}, false},
+	} {
+		_, err := newPathMapper(tc.include, tc.exclude, tc.rewrites)
+		assert.Equal(t, tc.valid, err == nil, "%v %v %v", tc.include, tc.exclude, tc.rewrites)
+	}
+}
+
+func TestPathMapperMap(t *testing.T) {
+	pm, err := newPathMapper(nil, []string{"*.tmp", "cache/**"}, []string{"train=data", "raw/=data/raw/", "old=", "a/b=c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for rel, expected := range map[string]string{
+		"train/x":      "data/x",
+		"train/y/z":    "data/y/z",
+		"train":        "data",
+		"training/x":   "training/x",
+		"trains":       "trains",
+		"raw/x":        "data/raw/x",
+		"rawer/x":      "rawer/x",
+		"old/x/y":      "x/y",
+		"a/b/c":        "c/c",
+		"a/bc/d":       "a/bc/d",
+		"x/train/y":    "x/train/y",
+		"keep.txt":     "keep.txt",
+		"skip.tmp":     "",
+		"dir/skip.tmp": "",
+		"cache/a":      "",
+		"cache/a/b":    "",
+		"cached/a":     "cached/a",
+	} {
+		mapped, ok := pm.Map(rel)
+		assert.Equal(t, expected != "", ok, rel)
+		assert.Equal(t, expected, mapped, rel)
+	}
+
+	pm, err = newPathMapper([]string{"*.jpg", "labels/*"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rel, included := range map[string]bool{
+		"a.jpg":          true,
+		"img/a.jpg":      true,
+		"labels/a.txt":   true,
+		"labels/x/a.txt": false,
+		"a.png":          false,
+	} {
+		_, ok := pm.Map(rel)
+		assert.Equal(t, included, ok, rel)
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		rel     string
+		match   bool
+	}{
+		{"*.tmp", "a.tmp", true},
+		{"*.tmp", "x/y/a.tmp", true},
+		{"*.tmp", "a.tmp/b", false},
+		{"tmp/*", "tmp/a", true},
+		{"tmp/*", "tmp/a/b", false},
+		{"tmp/*", "x/tmp/a", false},
+		{"tmp/**", "tmp/a", true},
+		{"tmp/**", "tmp/a/b/c", true},
+		{"tmp/**", "tmp", false},
+		{"tmp/**", "tmpx/a", false},
+		{"**/tmp/*", "tmp/a", true},
+		{"**/tmp/*", "x/y/tmp/a", true},
+		{"**/tmp/*", "x/tmp/a/b", false},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/y/c", false},
+		{"a/**/*.jpg", "a/x/y.jpg", true},
+		{"a/**/*.jpg", "b/x/y.jpg", false},
+	} {
+		assert.Equal(t, tc.match, matchAny([]string{tc.pattern}, tc.rel), "%s %s", tc.pattern, tc.rel)
+	}
+
+	assert.False(t, matchAny(nil, "a"))
+	assert.True(t, matchAny([]string{"b", "a"}, "a"))
+}
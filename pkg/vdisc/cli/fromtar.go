@@ -0,0 +1,248 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+// Bytes fetched by each ranged read while scanning a tar. Members
+// smaller than this are skipped without another request.
+const tarScanWindow = 64 * 1024
+
+// tarMember is a member of a tar archive, with the position of its
+// data within the archive object
+type tarMember struct {
+	Header *tar.Header
+	Offset int64
+}
+
+// tarScan is the result of scanning a single archive
+type tarScan struct {
+	archive sourceObject
+	members []tarMember
+	err     error
+	done    chan struct{}
+}
+
+// listTars returns the archives matching a URL glob, sorted by path.
+// The glob may only contain wildcards after the last directory that
+// has none, e.g. s3://bucket/shards/*.tar. The Rel of each archive is
+// relative to that directory.
+func listTars(glob string, concurrency int) ([]sourceObject, error) {
+	meta := strings.IndexAny(glob, "*?[")
+	if meta < 0 {
+		fi, err := storage.Stat(glob)
+		if err != nil {
+			return nil, err
+		}
+		return []sourceObject{{Rel: path.Base(glob), URL: glob, Info: fi}}, nil
+	}
+
+	dir := glob[:strings.LastIndex(glob[:meta], "/")+1]
+	pattern := strings.TrimPrefix(glob, dir)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %v", glob, err)
+	}
+
+	objects, err := walkSource(dir, concurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []sourceObject
+	for _, obj := range objects {
+		if ok, _ := path.Match(pattern, obj.Rel); ok {
+			archives = append(archives, obj)
+		}
+	}
+	return archives, nil
+}
+
+// visitTars scans archives concurrently and calls fn with each one's
+// members, in the order of archives. Calls to fn are serialized.
+func visitTars(archives []sourceObject, concurrency int, fn func(sourceObject, []tarMember) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	work := make(chan *tarScan)
+	order := make(chan *tarScan, concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for scan := range work {
+				scan.members, scan.err = scanTar(ctx, scan.archive)
+				close(scan.done)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(work)
+		defer close(order)
+		for _, archive := range archives {
+			scan := &tarScan{archive: archive, done: make(chan struct{})}
+			select {
+			case order <- scan:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case work <- scan:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for scan := range order {
+		<-scan.done
+		if scan.err != nil {
+			return fmt.Errorf("scanning %s: %v", scan.archive.URL, scan.err)
+		}
+		if err := fn(scan.archive, scan.members); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanTar reads the headers of every member of a tar archive, seeking
+// over member data rather than downloading it
+func scanTar(ctx context.Context, archive sourceObject) ([]tarMember, error) {
+	obj, err := storage.OpenContextSize(ctx, archive.URL, archive.Info.Size())
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	rr := &rangeReader{obj: obj, size: archive.Info.Size()}
+	tr := tar.NewReader(rr)
+
+	var members []tarMember
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		} else if err != nil {
+			return nil, err
+		}
+		members = append(members, tarMember{hdr, rr.pos})
+	}
+}
+
+// rangeReader reads an object through a window of ranged reads,
+// seeking over anything the reader skips
+type rangeReader struct {
+	obj    storage.AnonymousObject
+	size   int64
+	pos    int64
+	buf    []byte
+	bufOff int64
+}
+
+func (rr *rangeReader) Read(p []byte) (int, error) {
+	if rr.pos >= rr.size {
+		return 0, io.EOF
+	}
+
+	if rr.pos < rr.bufOff || rr.pos >= rr.bufOff+int64(len(rr.buf)) {
+		if rr.buf == nil {
+			rr.buf = make([]byte, tarScanWindow)
+		}
+		rr.buf = rr.buf[:cap(rr.buf)]
+		if remaining := rr.size - rr.pos; remaining < int64(len(rr.buf)) {
+			rr.buf = rr.buf[:remaining]
+		}
+		n, err := rr.obj.ReadAt(rr.buf, rr.pos)
+		rr.buf = rr.buf[:n]
+		rr.bufOff = rr.pos
+		if n == 0 {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+
+	n := copy(p, rr.buf[rr.pos-rr.bufOff:])
+	rr.pos += int64(n)
+	return n, nil
+}
+
+func (rr *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += rr.pos
+	case io.SeekEnd:
+		offset += rr.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid offset %d", offset)
+	}
+	rr.pos = offset
+	return offset, nil
+}
+
+// archiveDir returns the directory an archive's members are placed in
+func archiveDir(archive sourceObject) string {
+	return strings.TrimSuffix(archive.Rel, ".tar")
+}
+
+// memberPath returns the path of a member relative to its archive, or
+// "" for the archive root
+func memberPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// memberMetadata returns the POSIX attributes recorded for a member
+func memberMetadata(hdr *tar.Header) vdisc.Metadata {
+	return vdisc.Metadata{
+		Mode:  os.FileMode(hdr.Mode) & os.ModePerm,
+		Uid:   uint32(hdr.Uid),
+		Gid:   uint32(hdr.Gid),
+		Mtime: hdr.ModTime,
+		Ctime: hdr.ChangeTime,
+	}
+}
+
+// isSparse reports whether a member's data is stored in pieces, which
+// can't be described by a single range of the archive
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
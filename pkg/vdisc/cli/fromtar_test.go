@@ -0,0 +1,148 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+func TestFromTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The long name needs a PAX header of two blocks, which is placed
+	// across the second scan window boundary
+	longName := strings.Repeat("long/", 140) + "name"
+	members := []struct {
+		name     string
+		content  string
+		typeflag byte
+		linkname string
+		pax      map[string]string
+	}{
+		{name: "small", content: "hello"},
+		{name: "big", content: strings.Repeat("b", 70000)},
+		{name: "filler", content: strings.Repeat("f", 130048-72192)},
+		{name: longName, content: "long"},
+		{name: "xattr", content: "pax", pax: map[string]string{"SCHILY.xattr.user.test": "value"}},
+		{name: "dup", content: "first"},
+		{name: "link", typeflag: tar.TypeLink, linkname: "dup"},
+		{name: "dup", content: "second"},
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/symlink", typeflag: tar.TypeSymlink, linkname: "../small"},
+	}
+
+	archive := filepath.Join(dir, "test.tar")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	for _, m := range members {
+		hdr := &tar.Header{
+			Name:       m.name,
+			Mode:       0640,
+			Size:       int64(len(m.content)),
+			ModTime:    time.Unix(1500000000, 0),
+			Typeflag:   m.typeflag,
+			Linkname:   m.linkname,
+			PAXRecords: m.pax,
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(m.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Members are found where the windows split their headers and data
+	archives, err := listTars(archive, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanned, err := scanTar(context.Background(), archives[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, len(members), len(scanned)) {
+		assert.Equal(t, longName, scanned[3].Header.Name)
+		assert.True(t, scanned[1].Offset < tarScanWindow && scanned[1].Offset+scanned[1].Header.Size > tarScanWindow)
+		assert.Equal(t, int64(130048+512+1024+512), scanned[3].Offset)
+		assert.Equal(t, "value", scanned[4].Header.PAXRecords["SCHILY.xattr.user.test"])
+	}
+
+	url := filepath.Join(dir, "test.vdisc")
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{URL: url})
+	cmd := &BurnCmd{FromTar: archive, Concurrency: 2}
+	cmd.addFromTars(b)
+	if _, err := b.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := vdisc.Load(url, caching.NopCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	w := iso9660.NewWalker(v.Image())
+	expected := map[string]string{
+		"small":  "hello",
+		"big":    members[1].content,
+		"filler": members[2].content,
+		longName: "long",
+		"xattr":  "pax",
+		"dup":    "second",
+		"link":   "first",
+	}
+	for name, content := range expected {
+		f, err := w.Open("test/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		assert.Nil(t, err)
+		assert.Equal(t, content, string(data), name)
+	}
+
+	fi, err := w.Lstat("test/dir/symlink")
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.ModeSymlink, fi.Mode()&os.ModeSymlink)
+	}
+}
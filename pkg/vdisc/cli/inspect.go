@@ -31,7 +31,7 @@ type InspectCmd struct {
 }
 
 func (cmd *InspectCmd) Run(globals *Globals) error {
-	v, err := vdisc.Load(cmd.Url, globalCache(&globals.Cache))
+	v, err := vdisc.Load(cmd.Url, globalCache(&globals.Cache), globalLoadOptions(globals))
 	if err != nil {
 		zap.L().Fatal("loading vdisc", zap.Error(err))
 	}
@@ -35,7 +35,7 @@ type LsCmd struct {
 }
 
 func (cmd *LsCmd) Run(globals *Globals) error {
-	v, err := vdisc.Load(cmd.Url, globalCache(&globals.Cache))
+	v, err := vdisc.Load(cmd.Url, globalCache(&globals.Cache), globalLoadOptions(globals))
 	if err != nil {
 		zap.L().Fatal("loading vdisc", zap.Error(err))
 	}
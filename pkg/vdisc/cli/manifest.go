@@ -0,0 +1,462 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+type ManifestCmd struct {
+	Url string `short:"u" help:"The URL of the vdisc" required:"true"`
+	Out string `short:"o" help:"Output file" default:"-"`
+}
+
+func (cmd *ManifestCmd) Run(globals *Globals) error {
+	v, err := vdisc.Load(cmd.Url, globalCache(&globals.Cache), globalLoadOptions(globals))
+	if err != nil {
+		zap.L().Fatal("loading vdisc", zap.Error(err))
+	}
+	defer v.Close()
+
+	var out io.Writer = os.Stdout
+	if cmd.Out != "-" {
+		f, err := os.Create(cmd.Out)
+		if err != nil {
+			zap.L().Fatal("creating out", zap.Error(err))
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if err := writeManifest(v, out); err != nil {
+		zap.L().Fatal("writing manifest", zap.Error(err))
+	}
+	return nil
+}
+
+// writeManifest writes a burn manifest for the files of v to out
+func writeManifest(v vdisc.VDisc, out io.Writer) error {
+	mw := &manifestWriter{
+		v:     v,
+		w:     iso9660.NewWalker(v.Image()),
+		csv:   csv.NewWriter(out),
+		links: make(map[iso9660.LogicalBlockAddress]string),
+	}
+	if err := mw.writeDir("/"); err != nil {
+		return err
+	}
+	mw.csv.Flush()
+	return mw.csv.Error()
+}
+
+// Manifest columns, all but the first two of which are optional
+const (
+	manifestPath = iota
+	manifestURL
+	manifestSize
+	manifestChecksum
+	manifestMode
+	manifestUid
+	manifestGid
+	manifestMtime
+	manifestCtime
+	manifestOffset
+	manifestVersion
+	manifestKeyID
+)
+
+const (
+	symlinkPrefix  = "symlink:"
+	hardlinkPrefix = "hardlink:"
+	partsPrefix    = "parts:"
+	zeroURL        = "zero:"
+	zstdPrefix     = "zstd:"
+)
+
+type manifestEntryType int
+
+const (
+	manifestFile manifestEntryType = iota
+	manifestDirectory
+	manifestSymlink
+	manifestHardlink
+	manifestParts
+	manifestSparse
+)
+
+// manifestEntry is a single row of a burn manifest. Directory rows
+// have a path ending in "/" and no URL; symlink rows have a URL of
+// the form "symlink:<target>" and hard link rows one of the form
+// "hardlink:<path of an earlier file>". Multi-part file rows have a URL
+// of the form "parts:<url> <url>...", with one size per part, also
+// separated by spaces, or none. A URL of "zero:" makes a file of the
+// given size filled with zeros, as does "zero:<size>". A file URL
+// prefixed by "zstd:" is a seekable zstd object, and the size is that
+// of its decompressed content. A file with an offset is the range of
+// its object of the given size starting there.
+type manifestEntry struct {
+	Type    manifestEntryType
+	Path    string
+	URL     string
+	Size    int64
+	Ranged  bool
+	Offset  int64
+	Target  string
+	Parts   []string
+	Sizes   []int64
+	Options vdisc.FileOptions
+}
+
+func parseManifestRecord(record []string) (*manifestEntry, error) {
+	if len(record) < manifestURL+1 {
+		return nil, fmt.Errorf("expected at least 2 fields, got %d", len(record))
+	}
+
+	field := func(i int) string {
+		if i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	entry := &manifestEntry{
+		Path: record[manifestPath],
+		URL:  field(manifestURL),
+	}
+
+	var err error
+	switch {
+	case strings.HasSuffix(entry.Path, "/") && entry.URL == "":
+		entry.Type = manifestDirectory
+	case strings.HasPrefix(entry.URL, symlinkPrefix):
+		entry.Type = manifestSymlink
+		entry.Target = strings.TrimPrefix(entry.URL, symlinkPrefix)
+	case strings.HasPrefix(entry.URL, hardlinkPrefix):
+		entry.Type = manifestHardlink
+		entry.Target = strings.TrimPrefix(entry.URL, hardlinkPrefix)
+	case strings.HasPrefix(entry.URL, partsPrefix):
+		entry.Type = manifestParts
+		entry.Parts = strings.Fields(strings.TrimPrefix(entry.URL, partsPrefix))
+		if len(entry.Parts) == 0 {
+			return nil, fmt.Errorf("no parts given")
+		}
+		sizes := strings.Fields(field(manifestSize))
+		if len(sizes) > 0 && len(sizes) != len(entry.Parts) {
+			return nil, fmt.Errorf("expected %d part sizes, got %d", len(entry.Parts), len(sizes))
+		}
+		for i := range entry.Parts {
+			size := int64(-1)
+			if len(sizes) > 0 {
+				if size, err = strconv.ParseInt(sizes[i], 10, 64); err != nil {
+					return nil, fmt.Errorf("parsing size: %v", err)
+				}
+			}
+			entry.Sizes = append(entry.Sizes, size)
+		}
+		if entry.Options.Checksum, err = vdisc.ParseChecksum(field(manifestChecksum)); err != nil {
+			return nil, err
+		}
+	case entry.URL == zeroURL:
+		entry.Type = manifestSparse
+		if entry.Size, err = strconv.ParseInt(field(manifestSize), 10, 64); err != nil {
+			return nil, fmt.Errorf("parsing size: %v", err)
+		}
+		if entry.Options.Checksum, err = vdisc.ParseChecksum(field(manifestChecksum)); err != nil {
+			return nil, err
+		}
+	default:
+		entry.Type = manifestFile
+		if strings.HasPrefix(entry.URL, zstdPrefix) {
+			entry.URL = strings.TrimPrefix(entry.URL, zstdPrefix)
+			entry.Options.Compression = vdisc.CompressionZstdSeekable
+		}
+		entry.Size = -1
+		if s := field(manifestSize); s != "" {
+			if entry.Size, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return nil, fmt.Errorf("parsing size: %v", err)
+			}
+		}
+		if entry.Options.Checksum, err = vdisc.ParseChecksum(field(manifestChecksum)); err != nil {
+			return nil, err
+		}
+	}
+
+	md := &entry.Options.Metadata
+	if s := field(manifestMode); s != "" {
+		mode, err := strconv.ParseUint(s, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parsing mode: %v", err)
+		}
+		md.Mode = os.FileMode(mode) & os.ModePerm
+	}
+	if s := field(manifestUid); s != "" {
+		uid, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parsing uid: %v", err)
+		}
+		md.Uid = uint32(uid)
+	}
+	if s := field(manifestGid); s != "" {
+		gid, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parsing gid: %v", err)
+		}
+		md.Gid = uint32(gid)
+	}
+	if md.Mtime, err = parseManifestTime(field(manifestMtime)); err != nil {
+		return nil, fmt.Errorf("parsing mtime: %v", err)
+	}
+	if md.Ctime, err = parseManifestTime(field(manifestCtime)); err != nil {
+		return nil, fmt.Errorf("parsing ctime: %v", err)
+	}
+
+	if s := field(manifestOffset); s != "" {
+		if entry.Type != manifestFile {
+			return nil, fmt.Errorf("only single object files can be ranges")
+		}
+		if entry.Offset, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, fmt.Errorf("parsing offset: %v", err)
+		}
+		if entry.Size < 0 {
+			return nil, fmt.Errorf("a range needs a size")
+		}
+		entry.Ranged = true
+	}
+	if s := field(manifestVersion); s != "" {
+		versions := strings.Fields(s)
+		switch {
+		case entry.Type == manifestParts && len(versions) == len(entry.Parts):
+			for _, version := range versions {
+				entry.Options.PartVersions = append(entry.Options.PartVersions, parseManifestVersion(version))
+			}
+		case entry.Type == manifestFile && len(versions) == 1:
+			entry.Options.Version = parseManifestVersion(versions[0])
+		case entry.Type == manifestParts:
+			return nil, fmt.Errorf("expected %d part versions, got %d", len(entry.Parts), len(versions))
+		default:
+			return nil, fmt.Errorf("only files with objects can be pinned to a version")
+		}
+	}
+	entry.Options.KeyID = field(manifestKeyID)
+
+	return entry, nil
+}
+
+// parseManifestVersion parses a version written by formatManifestVersion
+func parseManifestVersion(s string) storage.Version {
+	if i := strings.Index(s, "/"); i >= 0 {
+		return storage.Version{ETag: s[:i], VersionID: s[i+1:]}
+	}
+	return storage.Version{ETag: s}
+}
+
+// formatManifestVersion formats v as its ETag, followed by a "/" and
+// its version id if it has one. A zero version is written as "/".
+func formatManifestVersion(v storage.Version) string {
+	if v.VersionID == "" && v.ETag != "" {
+		return v.ETag
+	}
+	return v.ETag + "/" + v.VersionID
+}
+
+// parseManifestTime accepts either whole seconds since the Unix epoch
+// or an RFC 3339 timestamp. Directory records hold whole seconds from
+// 1900 to 2155, so fractional seconds and years outside that range are
+// refused rather than truncated or wrapped.
+func parseManifestTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	var t time.Time
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		t = time.Unix(secs, 0).UTC()
+	} else if t, err = time.Parse(time.RFC3339, s); err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither seconds since the Unix epoch nor an RFC 3339 timestamp", s)
+	}
+
+	if t.Nanosecond() != 0 {
+		return time.Time{}, fmt.Errorf("%q has fractional seconds", s)
+	}
+	if year := t.UTC().Year(); year < 1900 || year > 2155 {
+		return time.Time{}, fmt.Errorf("%q is outside the years 1900 to 2155", s)
+	}
+	return t, nil
+}
+
+// addManifestEntry adds entry to b according to its type
+func addManifestEntry(b vdisc.Builder, entry *manifestEntry) error {
+	switch entry.Type {
+	case manifestDirectory:
+		return b.AddDirectory(entry.Path, entry.Options.Metadata)
+	case manifestSymlink:
+		return b.AddSymlink(entry.Path, entry.Target, entry.Options.Metadata)
+	case manifestHardlink:
+		return b.AddHardlink(entry.Path, entry.Target)
+	case manifestParts:
+		return b.AddFileParts(entry.Path, entry.Parts, entry.Sizes, entry.Options)
+	case manifestSparse:
+		return b.AddSparseFile(entry.Path, entry.Size, entry.Options)
+	case manifestFile:
+		if entry.Ranged {
+			return b.AddFileRange(entry.Path, entry.URL, entry.Offset, entry.Size, entry.Options)
+		}
+		return b.AddFile(entry.Path, entry.URL, entry.Size, entry.Options)
+	default:
+		return b.AddFile(entry.Path, entry.URL, entry.Size, entry.Options)
+	}
+}
+
+// manifestWriter writes a burn manifest for the files of a vdisc
+type manifestWriter struct {
+	v   vdisc.VDisc
+	w   *iso9660.Walker
+	csv *csv.Writer
+
+	// links maps the extent of each file written to its path, which
+	// later names of the same file are hard links to
+	links map[iso9660.LogicalBlockAddress]string
+}
+
+// writeDir writes a row for every directory, file and symlink below dir
+func (mw *manifestWriter) writeDir(dir string) error {
+	infos, err := mw.w.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range infos {
+		name := fi.Name()
+		if name == "." || name == ".." {
+			continue
+		}
+
+		pth := path.Join(dir, name)
+		switch {
+		case fi.IsDir():
+			err = mw.write(pth+"/", "", fi)
+			if err == nil {
+				err = mw.writeDir(pth)
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			err = mw.write(pth, symlinkPrefix+fi.Target(), fi)
+		default:
+			err = mw.writeFile(pth, fi)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", pth, err)
+		}
+	}
+	return nil
+}
+
+// writeFile writes the row of a file. Files stored inline in the vdisc
+// are written as ranges of its isohdr object.
+func (mw *manifestWriter) writeFile(pth string, fi *iso9660.FileInfo) error {
+	row := mw.row(pth, fi)
+	if first, ok := mw.links[fi.Extent()]; ok {
+		row[manifestURL] = hardlinkPrefix + first
+		return mw.csv.Write(trimManifestRow(row))
+	}
+	mw.links[fi.Extent()] = pth
+
+	info, err := mw.v.StatExtent(fi.Extent())
+	if err != nil {
+		return err
+	}
+
+	row[manifestURL] = info.URL
+	row[manifestSize] = strconv.FormatInt(fi.Size(), 10)
+	if !info.Checksum.IsZero() {
+		row[manifestChecksum] = info.Checksum.String()
+	}
+	if info.Ranged {
+		row[manifestOffset] = strconv.FormatInt(info.Offset, 10)
+	}
+	if !info.Version.IsZero() {
+		row[manifestVersion] = formatManifestVersion(info.Version)
+	}
+	row[manifestKeyID] = info.KeyID
+
+	switch {
+	case len(info.Parts) > 0:
+		urls := make([]string, len(info.Parts))
+		sizes := make([]string, len(info.Parts))
+		versions := make([]string, len(info.Parts))
+		pinned := false
+		for i, part := range info.Parts {
+			urls[i] = part.URL
+			sizes[i] = strconv.FormatInt(part.Size, 10)
+			versions[i] = formatManifestVersion(part.Version)
+			pinned = pinned || !part.Version.IsZero()
+		}
+		row[manifestURL] = partsPrefix + strings.Join(urls, " ")
+		row[manifestSize] = strings.Join(sizes, " ")
+		row[manifestVersion] = ""
+		if pinned {
+			row[manifestVersion] = strings.Join(versions, " ")
+		}
+	case info.Compression == vdisc.CompressionZstdSeekable:
+		row[manifestURL] = zstdPrefix + info.URL
+	}
+	return mw.csv.Write(trimManifestRow(row))
+}
+
+// write writes a row with the metadata of fi
+func (mw *manifestWriter) write(pth, url string, fi *iso9660.FileInfo) error {
+	row := mw.row(pth, fi)
+	row[manifestURL] = url
+	return mw.csv.Write(trimManifestRow(row))
+}
+
+// row returns a row of every column with the path and metadata of fi
+func (mw *manifestWriter) row(pth string, fi *iso9660.FileInfo) []string {
+	row := make([]string, manifestKeyID+1)
+	row[manifestPath] = pth
+	row[manifestMode] = fmt.Sprintf("%04o", fi.Mode()&os.ModePerm)
+	row[manifestUid] = strconv.FormatUint(uint64(fi.Uid()), 10)
+	row[manifestGid] = strconv.FormatUint(uint64(fi.Gid()), 10)
+	row[manifestMtime] = formatManifestTime(fi.ModTime())
+	row[manifestCtime] = formatManifestTime(fi.Created())
+	return row
+}
+
+// trimManifestRow drops the empty columns after the ctime, which only
+// some files need
+func trimManifestRow(row []string) []string {
+	for len(row) > manifestCtime+1 && row[len(row)-1] == "" {
+		row = row[:len(row)-1]
+	}
+	return row
+}
+
+// formatManifestTime formats t as seconds since the Unix epoch, as
+// parseManifestTime accepts it
+func formatManifestTime(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
@@ -0,0 +1,229 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+func TestManifestReburn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		pth := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(pth, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return pth
+	}
+	checksum, err := vdisc.ParseChecksum(fmt.Sprintf("md5:%x", md5.Sum([]byte("plain"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md := vdisc.Metadata{
+		Mode:  0640,
+		Uid:   1,
+		Gid:   2,
+		Mtime: time.Unix(1500000000, 0).UTC(),
+		Ctime: time.Unix(1600000000, 0).UTC(),
+	}
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{
+		URL:             filepath.Join(dir, "original.vdisc"),
+		InlineThreshold: 4,
+	})
+	steps := []error{
+		b.AddDirectory("dir", md),
+		b.AddFile("plain", write("plain", "plain"), 5, vdisc.FileOptions{
+			Metadata: md,
+			Checksum: checksum,
+			Version:  storage.Version{ETag: "etag", VersionID: "id"},
+		}),
+		b.AddFileRange("dir/range", write("archive", "...a range of an archive"), 3, 7, vdisc.FileOptions{
+			Metadata: md,
+			Version:  storage.Version{ETag: "archive"},
+		}),
+		b.AddFile("inline", write("inline", "tiny"), 4, vdisc.FileOptions{Metadata: md}),
+		b.AddFile("secret", write("secret", "encrypted"), 9, vdisc.FileOptions{Metadata: md, KeyID: "key"}),
+		b.AddFileParts("parts", []string{write("part1", "first "), write("part2", "second")}, []int64{6, 6}, vdisc.FileOptions{
+			Metadata:     md,
+			PartVersions: []storage.Version{{ETag: "one"}, {}},
+		}),
+		b.AddHardlink("link", "plain"),
+		b.AddSymlink("symlink", "plain", md),
+	}
+	for _, err := range steps {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	url, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := vdisc.Load(url, caching.NopCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer original.Close()
+
+	var manifest bytes.Buffer
+	if err := writeManifest(original, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "manifest.csv"), manifest.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b = vdisc.NewISO9660Builder(vdisc.BuilderConfig{URL: filepath.Join(dir, "reburned.vdisc")})
+	cmd := &BurnCmd{Csv: filepath.Join(dir, "manifest.csv")}
+	cmd.addFromCSV(b)
+	url, err = b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reburned, err := vdisc.Load(url, caching.NopCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reburned.Close()
+
+	// The inline file is now a range of the original isohdr, which is
+	// written as it was
+	var again bytes.Buffer
+	if err := writeManifest(reburned, &again); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, manifest.String(), again.String())
+
+	ow := iso9660.NewWalker(original.Image())
+	rw := iso9660.NewWalker(reburned.Image())
+	for _, pth := range []string{"dir", "plain", "dir/range", "inline", "secret", "parts", "link", "symlink"} {
+		ofi, err := ow.Lstat(pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rfi, err := rw.Lstat(pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, ofi.Mode(), rfi.Mode(), pth)
+		assert.Equal(t, ofi.Uid(), rfi.Uid(), pth)
+		assert.Equal(t, ofi.Gid(), rfi.Gid(), pth)
+		assert.Equal(t, ofi.ModTime(), rfi.ModTime(), pth)
+		assert.Equal(t, md.Ctime, rfi.Created(), pth)
+		assert.Equal(t, ofi.Size(), rfi.Size(), pth)
+		assert.Equal(t, ofi.Target(), rfi.Target(), pth)
+		if ofi.IsDir() || ofi.Target() != "" || pth == "inline" {
+			continue
+		}
+
+		oinfo, err := original.StatExtent(ofi.Extent())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rinfo, err := reburned.StatExtent(rfi.Extent())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, oinfo.URL, rinfo.URL, pth)
+		assert.Equal(t, oinfo.Size, rinfo.Size, pth)
+		assert.Equal(t, oinfo.Ranged, rinfo.Ranged, pth)
+		assert.Equal(t, oinfo.Offset, rinfo.Offset, pth)
+		assert.Equal(t, oinfo.Checksum, rinfo.Checksum, pth)
+		assert.Equal(t, oinfo.Version, rinfo.Version, pth)
+		assert.Equal(t, oinfo.KeyID, rinfo.KeyID, pth)
+		assert.Equal(t, oinfo.Parts, rinfo.Parts, pth)
+	}
+
+	plain, err := rw.Lstat("plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := rw.Lstat("link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, plain.Ino(), link.Ino())
+
+	for _, pth := range []string{"inline", "dir/range", "parts"} {
+		f, err := rw.Open(pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		assert.Nil(t, err)
+		expected := map[string]string{"inline": "tiny", "dir/range": "a range", "parts": "first second"}[pth]
+		assert.Equal(t, expected, string(data), pth)
+	}
+}
+
+func TestParseManifestTime(t *testing.T) {
+	for s, expected := range map[string]time.Time{
+		"":                          {},
+		"0":                         time.Unix(0, 0).UTC(),
+		"1500000000":                time.Unix(1500000000, 0).UTC(),
+		"-2208988800":               time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC),
+		"2017-07-14T02:40:00Z":      time.Unix(1500000000, 0).UTC(),
+		"2017-07-14T04:40:00+02:00": time.Unix(1500000000, 0).UTC(),
+		"2155-12-31T23:59:59Z":      time.Date(2155, 12, 31, 23, 59, 59, 0, time.UTC),
+	} {
+		actual, err := parseManifestTime(s)
+		assert.Nil(t, err, s)
+		assert.True(t, expected.Equal(actual), s)
+		if s != "" {
+			again, err := parseManifestTime(formatManifestTime(actual))
+			assert.Nil(t, err, s)
+			assert.True(t, actual.Equal(again), s)
+		}
+	}
+
+	for _, s := range []string{
+		"NaN",
+		"-inf",
+		"+Inf",
+		"1e9",
+		"1500000000.5",
+		"2017-07-14T02:40:00.5Z",
+		"-2208988801",
+		"1899-12-31T23:59:59Z",
+		"2156-01-01T00:00:00Z",
+		"99999999999",
+		"yesterday",
+	} {
+		_, err := parseManifestTime(s)
+		assert.NotNil(t, err, s)
+	}
+}
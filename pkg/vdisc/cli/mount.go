@@ -37,7 +37,7 @@ type MountCmd struct {
 }
 
 func (cmd *MountCmd) Run(globals *Globals) error {
-	v, err := vdisc.Load(cmd.Url, globalCache(&globals.Cache))
+	v, err := vdisc.Load(cmd.Url, globalCache(&globals.Cache), globalLoadOptions(globals))
 	if err != nil {
 		zap.L().Fatal("loading vdisc", zap.Error(err))
 	}
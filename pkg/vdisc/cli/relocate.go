@@ -0,0 +1,253 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+type RelocateCmd struct {
+	Url         string   `short:"u" help:"The URL of the vdisc to relocate" required:"true"`
+	Out         string   `short:"o" help:"VDisc output URL" required:"true"`
+	Map         []string `help:"Move the objects below a URL prefix, as OLD=NEW (repeatable)" sep:"none" required:"true"`
+	Copy        bool     `help:"Copy the objects to their new URLs, server side where the storage supports it"`
+	Concurrency int      `help:"Number of objects to copy and check concurrently" default:"32"`
+	TempDir     string   `help:"Directory for spooled extents (default is the system temp dir)"`
+	SignKey     string   `help:"Sign the vdisc with the PEM encoded private key at this path"`
+}
+
+// relocatedObject is an object moved to a new URL
+type relocatedObject struct {
+	src     string
+	version storage.Version
+
+	// The first extent of the object, for reporting
+	extent int
+	lba    uint32
+
+	// The exact size the object must have, or -1, and the size it
+	// must have at least
+	size int64
+	end  int64
+
+	// The version found at the new URL, if the object was pinned
+	pin storage.Version
+}
+
+func (cmd *RelocateCmd) Run(globals *Globals) error {
+	var rewrites []pathRewrite
+	for _, m := range cmd.Map {
+		idx := strings.Index(m, "=")
+		if idx <= 0 {
+			zap.L().Fatal("invalid map: expected OLD=NEW", zap.String("map", m))
+		}
+		rewrites = append(rewrites, pathRewrite{m[:idx], m[idx+1:]})
+	}
+
+	v, err := vdisc.Load(cmd.Url, globalCache(&globals.Cache), globalLoadOptions(globals))
+	if err != nil {
+		zap.L().Fatal("loading vdisc", zap.Error(err))
+	}
+	defer v.Close()
+
+	objects := make(map[string]*relocatedObject)
+	err = v.VisitExtents(func(info vdisc.ExtentInfo) error {
+		for _, o := range extentObjects(info) {
+			dst, ok := relocateURL(rewrites, o.URL)
+			if !ok {
+				continue
+			}
+
+			obj, ok := objects[dst]
+			if !ok {
+				obj = &relocatedObject{
+					src:     o.URL,
+					version: o.Version,
+					extent:  info.Index,
+					lba:     uint32(info.LBA),
+					size:    -1,
+				}
+				objects[dst] = obj
+			} else if obj.src != o.URL {
+				return fmt.Errorf("both %s and %s would move to %s", obj.src, o.URL, dst)
+			}
+
+			if !info.Ranged {
+				obj.size = o.Size
+			} else if end := info.Offset + o.Size; end > obj.end {
+				obj.end = end
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		zap.L().Fatal("mapping objects", zap.Error(err))
+	}
+	if len(objects) == 0 {
+		zap.L().Fatal("no objects match the map")
+	}
+
+	// Every object must be in place before the vdisc referencing it
+	// is written
+	if problems := cmd.moveObjects(objects); len(problems) > 0 {
+		printProblems(problems)
+		zap.L().Fatal("objects unavailable at their new URLs", zap.Int("problems", len(problems)), zap.Int("objects", len(objects)))
+	}
+
+	url, err := vdisc.Relocate(v, cmd.Out, func(info *vdisc.ExtentInfo) error {
+		if dst, ok := relocateURL(rewrites, info.URL); ok {
+			info.URL, info.Version = dst, objects[dst].pin
+		}
+		for i := 1; i < len(info.Parts); i++ {
+			part := &info.Parts[i]
+			if dst, ok := relocateURL(rewrites, part.URL); ok {
+				part.URL, part.Version = dst, objects[dst].pin
+			}
+		}
+		return nil
+	}, vdisc.RestoreOptions{TempDir: cmd.TempDir})
+	if err != nil {
+		zap.L().Fatal("relocating vdisc", zap.Error(err))
+	}
+
+	// Loading the result validates it
+	rv, err := vdisc.Load(url, caching.NopCache)
+	if err != nil {
+		zap.L().Fatal("loading relocated vdisc", zap.String("url", url), zap.Error(err))
+	}
+	rv.Close()
+
+	if cmd.SignKey != "" {
+		signVDisc(url, cmd.SignKey)
+	}
+
+	zap.L().Info("complete", zap.String("url", url), zap.Int("moved", len(objects)))
+	return nil
+}
+
+// moveObjects copies the objects to their new URLs if asked to, and
+// checks that they exist there with the expected size, returning the
+// problems found. Pinned objects are pinned to the version found.
+func (cmd *RelocateCmd) moveObjects(objects map[string]*relocatedObject) []verifyProblem {
+	concurrency := cmd.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var problems []verifyProblem
+	var wg sync.WaitGroup
+	work := make(chan string)
+
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for dst := range work {
+				if problem := cmd.moveObject(dst, objects[dst]); problem != nil {
+					mu.Lock()
+					problems = append(problems, *problem)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for dst := range objects {
+		work <- dst
+	}
+	close(work)
+	wg.Wait()
+
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].Extent != problems[j].Extent {
+			return problems[i].Extent < problems[j].Extent
+		}
+		return problems[i].URL < problems[j].URL
+	})
+	return problems
+}
+
+// moveObject moves a single object, returning the problem found, if any
+func (cmd *RelocateCmd) moveObject(dst string, obj *relocatedObject) *verifyProblem {
+	problem := func(kind string) *verifyProblem {
+		return &verifyProblem{
+			Extent:  obj.extent,
+			LBA:     obj.lba,
+			URL:     dst,
+			Problem: kind,
+		}
+	}
+
+	if cmd.Copy {
+		ctx := context.Background()
+		if !obj.version.IsZero() {
+			ctx = storage.CtxWithVersion(ctx, obj.version)
+		}
+		if err := storage.CopyContext(ctx, obj.src, dst); err != nil {
+			p := problem("error")
+			p.Error = fmt.Sprintf("copying %s: %v", obj.src, err)
+			return p
+		}
+	}
+
+	fi, err := storage.Stat(dst)
+	if os.IsNotExist(err) {
+		return problem("missing")
+	} else if err != nil {
+		p := problem("error")
+		p.Error = err.Error()
+		return p
+	}
+
+	if obj.size >= 0 && fi.Size() != obj.size {
+		p := problem("size")
+		p.Expected = fmt.Sprintf("%d", obj.size)
+		p.Actual = fmt.Sprintf("%d", fi.Size())
+		return p
+	} else if fi.Size() < obj.end {
+		p := problem("size")
+		p.Expected = fmt.Sprintf(">= %d", obj.end)
+		p.Actual = fmt.Sprintf("%d", fi.Size())
+		return p
+	}
+
+	if !obj.version.IsZero() {
+		obj.pin = storage.FileInfoVersion(fi)
+	}
+	return nil
+}
+
+// relocateURL returns the new URL of the object at url, or false if
+// no rewrite matches it. The first matching rewrite wins.
+func relocateURL(rewrites []pathRewrite, url string) (string, bool) {
+	for _, rw := range rewrites {
+		if strings.HasPrefix(url, rw.from) {
+			return rw.to + strings.TrimPrefix(url, rw.from), true
+		}
+	}
+	return "", false
+}
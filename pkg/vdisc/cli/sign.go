@@ -0,0 +1,98 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+type SignCmd struct {
+	Url string `short:"u" help:"The URL of the vdisc" required:"true"`
+	Key string `short:"k" help:"Path to a PEM encoded ed25519, ECDSA or RSA private key" required:"true"`
+}
+
+func (cmd *SignCmd) Run(globals *Globals) error {
+	signVDisc(cmd.Url, cmd.Key)
+	return nil
+}
+
+// signVDisc signs the vdisc at url with the private key at keyPath
+func signVDisc(url string, keyPath string) {
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		zap.L().Fatal("reading signing key", zap.Error(err))
+	}
+	key, err := vdisc.ParsePrivateKey(data)
+	if err != nil {
+		zap.L().Fatal("parsing signing key", zap.String("path", keyPath), zap.Error(err))
+	}
+
+	if err := vdisc.Sign(url, key); err != nil {
+		zap.L().Fatal("signing vdisc", zap.String("url", url), zap.Error(err))
+	}
+
+	sig, err := vdisc.ReadSignature(url)
+	if err != nil {
+		zap.L().Fatal("reading signature", zap.String("url", url), zap.Error(err))
+	}
+	zap.L().Info("signed", zap.String("url", url+vdisc.SignatureSuffix), zap.String("vdisc_sha256", sig.VDiscSHA256), zap.String("isohdr_sha256", sig.IsohdrSHA256))
+}
+
+// readTrustedKeys reads the public keys and certificates in each path,
+// which may be a PEM file or a directory of them
+func readTrustedKeys(paths []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, pth := range paths {
+		files := []string{pth}
+		if fi, err := os.Stat(pth); err != nil {
+			return nil, err
+		} else if fi.IsDir() {
+			infos, err := ioutil.ReadDir(pth)
+			if err != nil {
+				return nil, err
+			}
+			files = nil
+			for _, info := range infos {
+				if info.Mode().IsRegular() {
+					files = append(files, filepath.Join(pth, info.Name()))
+				}
+			}
+			if len(files) == 0 {
+				return nil, fmt.Errorf("%s: no trusted keys", pth)
+			}
+		}
+
+		for _, fname := range files {
+			data, err := ioutil.ReadFile(fname)
+			if err != nil {
+				return nil, err
+			}
+			parsed, err := vdisc.ParsePublicKeys(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", fname, err)
+			}
+			keys = append(keys, parsed...)
+		}
+	}
+	return keys, nil
+}
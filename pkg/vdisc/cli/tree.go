@@ -32,7 +32,7 @@ type TreeCmd struct {
 }
 
 func (cmd *TreeCmd) Run(globals *Globals) error {
-	v, err := vdisc.Load(cmd.Url, globalCache(&globals.Cache))
+	v, err := vdisc.Load(cmd.Url, globalCache(&globals.Cache), globalLoadOptions(globals))
 	if err != nil {
 		zap.L().Fatal("loading vdisc", zap.Error(err))
 	}
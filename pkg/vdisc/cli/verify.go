@@ -0,0 +1,290 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/chunkcrypt"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+type VerifyCmd struct {
+	Url         string `short:"u" help:"The URL of the vdisc" required:"true"`
+	Deep        bool   `help:"Read every object and compare it against its recorded checksum"`
+	Json        bool   `help:"Print the report as JSON"`
+	Concurrency int    `help:"Number of objects to check concurrently" default:"32"`
+}
+
+type verifyProblem struct {
+	Extent   int    `json:"extent"`
+	LBA      uint32 `json:"lba"`
+	URL      string `json:"url"`
+	Problem  string `json:"problem"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type verifyReport struct {
+	URL      string          `json:"url"`
+	Extents  int             `json:"extents"`
+	Checked  int             `json:"checked"`
+	Problems []verifyProblem `json:"problems"`
+}
+
+func (cmd *VerifyCmd) Run(globals *Globals) error {
+	v, err := vdisc.Load(cmd.Url, caching.NopCache, vdisc.LoadOptions{Keys: globalKeys(globals), TrustedKeys: globalTrustedKeys(globals)})
+	if err != nil {
+		zap.L().Fatal("loading vdisc", zap.Error(err))
+	}
+	defer v.Close()
+
+	report, err := cmd.verify(v)
+	if err != nil {
+		zap.L().Fatal("reading extents", zap.Error(err))
+	}
+
+	if cmd.Json {
+		jenc := json.NewEncoder(os.Stdout)
+		jenc.SetIndent("", "  ")
+		if err := jenc.Encode(report); err != nil {
+			zap.L().Fatal("serializing report", zap.Error(err))
+		}
+	} else {
+		printProblems(report.Problems)
+		fmt.Printf("%d extents, %d objects checked, %d problems\n", report.Extents, report.Checked, len(report.Problems))
+	}
+
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%d of %d extents failed verification", len(report.Problems), report.Extents)
+	}
+	return nil
+}
+
+// verify checks every extent of v, returning a report of the problems
+// found, or an error if the extents can't be read
+func (cmd *VerifyCmd) verify(v vdisc.VDisc) (*verifyReport, error) {
+	concurrency := cmd.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	report := verifyReport{
+		URL:      cmd.Url,
+		Problems: []verifyProblem{},
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan vdisc.ExtentInfo)
+
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for info := range work {
+				problem := cmd.verifyExtent(v, info)
+				mu.Lock()
+				report.Checked++
+				if problem != nil {
+					report.Problems = append(report.Problems, *problem)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err := v.VisitExtents(func(info vdisc.ExtentInfo) error {
+		report.Extents++
+		if info.Blocks > 0 {
+			work <- info
+		}
+		return nil
+	})
+	close(work)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Extent < report.Problems[j].Extent
+	})
+	return &report, nil
+}
+
+// printProblems prints one line per problem
+func printProblems(problems []verifyProblem) {
+	for _, p := range problems {
+		fmt.Printf("%s\textent %d (lba %d)\t%s", p.Problem, p.Extent, p.LBA, p.URL)
+		if p.Expected != "" || p.Actual != "" {
+			fmt.Printf("\texpected %s, got %s", p.Expected, p.Actual)
+		}
+		if p.Error != "" {
+			fmt.Printf("\t%s", p.Error)
+		}
+		fmt.Println()
+	}
+}
+
+// extentObjects returns the objects of an extent, sized as they are
+// stored. A ranged extent only needs its object to be at least Offset
+// plus Size bytes long.
+func extentObjects(info vdisc.ExtentInfo) []vdisc.PartInfo {
+	// The parts of a multi-part extent start with its own object
+	if len(info.Parts) > 0 {
+		return info.Parts
+	}
+
+	objects := []vdisc.PartInfo{{URL: info.URL, Size: info.Size, Version: info.Version}}
+	if info.Compression != vdisc.CompressionNone {
+		// The object itself holds the compressed content
+		objects[0].Size = info.CompressedSize
+	} else if info.KeyID != "" {
+		objects[0].Size = chunkcrypt.CiphertextSize(info.Size)
+	}
+	return objects
+}
+
+// versionChange compares the version an object is pinned to with the
+// one it has, field by field, skipping fields either side doesn't
+// know. It returns the first pair of values that differ.
+func versionChange(pinned, actual storage.Version) (string, string, bool) {
+	if pinned.ETag != "" && actual.ETag != "" && pinned.ETag != actual.ETag {
+		return pinned.ETag, actual.ETag, true
+	}
+	if pinned.VersionID != "" && actual.VersionID != "" && pinned.VersionID != actual.VersionID {
+		return "version " + pinned.VersionID, "version " + actual.VersionID, true
+	}
+	return "", "", false
+}
+
+// verifyExtent checks a single extent, returning the problem found, if any
+func (cmd *VerifyCmd) verifyExtent(v vdisc.VDisc, info vdisc.ExtentInfo) *verifyProblem {
+	problem := func(url string, kind string) *verifyProblem {
+		return &verifyProblem{
+			Extent:  info.Index,
+			LBA:     uint32(info.LBA),
+			URL:     url,
+			Problem: kind,
+		}
+	}
+
+	var readers []io.Reader
+	for _, o := range extentObjects(info) {
+		ctx := context.Background()
+		if !o.Version.IsZero() {
+			ctx = storage.CtxWithVersion(ctx, o.Version)
+		}
+
+		fi, err := storage.StatContext(ctx, o.URL)
+		if os.IsNotExist(err) {
+			return problem(o.URL, "missing")
+		} else if err != nil {
+			p := problem(o.URL, "error")
+			p.Error = err.Error()
+			return p
+		}
+
+		// A ranged extent only needs its object to be large enough
+		if end := info.Offset + o.Size; info.Ranged && fi.Size() < end {
+			p := problem(o.URL, "size")
+			p.Expected = fmt.Sprintf(">= %d", end)
+			p.Actual = fmt.Sprintf("%d", fi.Size())
+			return p
+		} else if !info.Ranged && fi.Size() != o.Size {
+			p := problem(o.URL, "size")
+			p.Expected = fmt.Sprintf("%d", o.Size)
+			p.Actual = fmt.Sprintf("%d", fi.Size())
+			return p
+		}
+
+		if expected, actual, changed := versionChange(o.Version, storage.FileInfoVersion(fi)); changed {
+			p := problem(o.URL, "changed")
+			p.Expected = expected
+			p.Actual = actual
+			return p
+		}
+
+		if !cmd.Deep || info.Checksum.IsZero() || info.KeyID != "" {
+			continue
+		}
+
+		obj, err := storage.OpenContextSize(ctx, o.URL, fi.Size())
+		if err != nil {
+			p := problem(o.URL, "error")
+			p.Error = err.Error()
+			return p
+		}
+		defer obj.Close()
+
+		var r io.ReaderAt = obj
+		size := o.Size
+		if info.Compression != vdisc.CompressionNone {
+			d, err := vdisc.Decompress(obj, fi.Size(), info.Compression)
+			if err != nil {
+				p := problem(o.URL, "error")
+				p.Error = err.Error()
+				return p
+			}
+			r, size = d, d.Size()
+		}
+		readers = append(readers, io.NewSectionReader(r, info.Offset, size))
+	}
+
+	if !cmd.Deep || info.Checksum.IsZero() {
+		return nil
+	}
+
+	// Encrypted content is checked through the extent, which decrypts it
+	if info.KeyID != "" {
+		r, err := v.OpenExtent(info.LBA)
+		if err != nil {
+			p := problem(info.URL, "error")
+			p.Error = err.Error()
+			return p
+		}
+		defer r.Close()
+		readers = []io.Reader{io.NewSectionReader(r, 0, info.Size)}
+	}
+
+	actual, err := info.Checksum.Compute(io.MultiReader(readers...))
+	if err != nil {
+		p := problem(info.URL, "error")
+		p.Error = err.Error()
+		return p
+	}
+
+	if !bytes.Equal(actual.Digest, info.Checksum.Digest) {
+		p := problem(info.URL, "checksum")
+		p.Expected = info.Checksum.String()
+		p.Actual = actual.String()
+		return p
+	}
+
+	return nil
+}
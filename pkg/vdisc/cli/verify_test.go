@@ -0,0 +1,171 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_cli
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/storage/driver"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+// versionedDriver serves local files under the versioned: scheme, with
+// the md5 of their content as both their ETag and version id
+type versionedDriver struct{}
+
+func (versionedDriver) Name() string {
+	return "versioned"
+}
+
+func (versionedDriver) Open(ctx context.Context, url string, size int64) (driver.Object, error) {
+	obj, err := storage.OpenContextSize(ctx, strings.TrimPrefix(url, "versioned:"), size)
+	if err != nil {
+		return nil, err
+	}
+	return storage.WithURL(obj, url), nil
+}
+
+func (versionedDriver) Stat(ctx context.Context, url string) (os.FileInfo, error) {
+	pth := strings.TrimPrefix(url, "versioned:")
+	fi, err := os.Stat(pth)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, err
+	}
+	return versionedFileInfo{fi, fmt.Sprintf("%x", md5.Sum(data))}, nil
+}
+
+type versionedFileInfo struct {
+	os.FileInfo
+	etag string
+}
+
+func (fi versionedFileInfo) Sys() interface{} {
+	return fi
+}
+
+func (fi versionedFileInfo) ETag() string {
+	return fi.etag
+}
+
+func (fi versionedFileInfo) Version() string {
+	return "v" + fi.etag
+}
+
+func init() {
+	driver.Register("versioned", versionedDriver{})
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		pth := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(pth, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return pth
+	}
+	md5sum := func(content string) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(content)))
+	}
+	checksum := func(content string) vdisc.Checksum {
+		c, err := vdisc.ParseChecksum("md5:" + md5sum(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	files := []struct {
+		name    string
+		url     string
+		opts    vdisc.FileOptions
+		problem string
+	}{
+		{"ok", write("ok", "hello"), vdisc.FileOptions{Checksum: checksum("hello")}, ""},
+		{"missing", write("missing", "hello"), vdisc.FileOptions{}, "missing"},
+		{"size", write("size", "hello"), vdisc.FileOptions{}, "size"},
+		{"etag", "versioned:" + write("etag", "hello"), vdisc.FileOptions{Version: storage.Version{ETag: md5sum("hello")}}, "changed"},
+		{"version", "versioned:" + write("version", "hello"), vdisc.FileOptions{Version: storage.Version{VersionID: "v" + md5sum("hello")}}, "changed"},
+		{"checksum", write("checksum", "hello"), vdisc.FileOptions{Checksum: checksum("world")}, "checksum"},
+	}
+
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{URL: filepath.Join(dir, "test.vdisc")})
+	for _, f := range files {
+		if err := b.AddFile(f.name, f.url, 5, f.opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	url, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Remove(filepath.Join(dir, "missing"))
+	write("size", "hello, world")
+	write("etag", "HELLO")
+	write("version", "HELLO")
+
+	v, err := vdisc.Load(url, caching.NopCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	cmd := &VerifyCmd{Url: url, Deep: true, Concurrency: 4}
+	report, err := cmd.verify(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(files)+1, report.Extents)
+	assert.Equal(t, len(files)+1, report.Checked)
+
+	problems := make(map[string]verifyProblem)
+	for _, p := range report.Problems {
+		problems[filepath.Base(p.URL)] = p
+	}
+	for _, f := range files {
+		p, found := problems[f.name]
+		assert.Equal(t, f.problem != "", found, f.name)
+		assert.Equal(t, f.problem, p.Problem, f.name)
+	}
+	assert.Equal(t, "5", problems["size"].Expected)
+	assert.Equal(t, "12", problems["size"].Actual)
+	assert.Equal(t, md5sum("hello"), problems["etag"].Expected)
+	assert.Equal(t, md5sum("HELLO"), problems["etag"].Actual)
+	assert.Equal(t, "version v"+md5sum("hello"), problems["version"].Expected)
+	assert.Equal(t, "version v"+md5sum("HELLO"), problems["version"].Actual)
+	assert.Equal(t, "md5:"+md5sum("world"), problems["checksum"].Expected)
+	assert.Equal(t, "md5:"+md5sum("hello"), problems["checksum"].Actual)
+}
@@ -0,0 +1,91 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc/types/v1"
+	"github.com/NVIDIA/vdisc/pkg/zstdseek"
+)
+
+// Compression identifies the format of a compressed object
+type Compression = vdisc_types_v1.Compression
+
+const (
+	CompressionNone         = vdisc_types_v1.Compression_none
+	CompressionZstdSeekable = vdisc_types_v1.Compression_zstdSeekable
+)
+
+// Decompress returns the decompressed content of a compressed object
+// of size bytes
+func Decompress(r io.ReaderAt, size int64, compression Compression) (*io.SectionReader, error) {
+	switch compression {
+	case CompressionNone:
+		return io.NewSectionReader(r, 0, size), nil
+	case CompressionZstdSeekable:
+		table, err := zstdseek.ReadSeekTable(r, size)
+		if err != nil {
+			return nil, err
+		}
+		zr := zstdseek.NewReader(r, table)
+		return io.NewSectionReader(zr, 0, zr.Size()), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %v", compression)
+	}
+}
+
+// decompressedSize returns the size of the content of a compressed
+// object of size bytes
+func decompressedSize(ctx context.Context, url string, size int64, compression Compression) (int64, error) {
+	obj, err := storage.OpenContextSize(ctx, url, size)
+	if err != nil {
+		return -1, err
+	}
+	defer obj.Close()
+
+	r, err := Decompress(obj, size, compression)
+	if err != nil {
+		return -1, fmt.Errorf("%s: %v", url, err)
+	}
+	return r.Size(), nil
+}
+
+// seekTable holds the seek table of a compressed extent once read, so
+// that later reads only fetch the frames they need
+type seekTable struct {
+	mu    sync.Mutex
+	table *zstdseek.SeekTable
+}
+
+// get returns the seek table of r, reading it on first use. Failures
+// aren't remembered, so a transient error is retried by the next read.
+func (st *seekTable) get(r io.ReaderAt, size int64) (*zstdseek.SeekTable, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.table == nil {
+		table, err := zstdseek.ReadSeekTable(r, size)
+		if err != nil {
+			return nil, err
+		}
+		st.table = table
+	}
+	return st.table, nil
+}
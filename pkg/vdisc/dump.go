@@ -0,0 +1,427 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc/types/v1"
+)
+
+// Layouts as named in a Dump
+const (
+	dumpLayoutGzip  = "gzip"
+	dumpLayoutPaged = "paged"
+)
+
+// Dump is the JSON form of a vdisc. Every URL is resolved, so a dump
+// restored elsewhere still refers to the same objects.
+type Dump struct {
+	FsType         string   `json:"fsType"`
+	BlockSize      uint16   `json:"blockSize"`
+	Layout         string   `json:"layout,omitempty"`
+	ExtentPageSize int      `json:"extentPageSize,omitempty"`
+	KeyIDs         []string `json:"keyIds,omitempty"`
+
+	// Trie describes the trie the URLs are stored in. It is
+	// informative, and ignored by Restore.
+	Trie *TrieStats `json:"trie,omitempty"`
+
+	Extents []DumpExtent `json:"extents,omitempty"`
+}
+
+// TrieStats describes the inverted trie of a vdisc's URL prefixes
+type TrieStats struct {
+	Nodes        int `json:"nodes"`
+	Roots        int `json:"roots"`
+	MaxDepth     int `json:"maxDepth"`
+	ContentBytes int `json:"contentBytes"`
+}
+
+// DumpExtent is the JSON form of an extent. LBA is informative, and
+// Restore lays extents out in order regardless of it.
+type DumpExtent struct {
+	LBA            uint32     `json:"lba"`
+	URI            string     `json:"uri"`
+	Blocks         uint32     `json:"num_blocks"`
+	Padding        uint16     `json:"padding"`
+	Checksum       string     `json:"checksum,omitempty"`
+	ETag           string     `json:"etag,omitempty"`
+	VersionID      string     `json:"versionId,omitempty"`
+	Ranged         bool       `json:"ranged,omitempty"`
+	Offset         int64      `json:"offset,omitempty"`
+	Compression    string     `json:"compression,omitempty"`
+	CompressedSize int64      `json:"compressedSize,omitempty"`
+	KeyID          string     `json:"keyId,omitempty"`
+	Parts          []DumpPart `json:"parts,omitempty"`
+}
+
+// DumpPart is the JSON form of an object following that of a
+// multi-part extent
+type DumpPart struct {
+	URI       string `json:"uri"`
+	Size      int64  `json:"size"`
+	ETag      string `json:"etag,omitempty"`
+	VersionID string `json:"versionId,omitempty"`
+}
+
+// WriteDump writes the Dump of v to w as an indented JSON document, or
+// with lines, as JSON lines: the Dump without its extents followed by
+// one line per extent. Only the latter is written without holding
+// every extent in memory.
+func WriteDump(w io.Writer, v VDisc, lines bool) error {
+	vd, ok := v.(*vdisc)
+	if !ok {
+		return fmt.Errorf("unsupported vdisc type %T", v)
+	}
+
+	dump, err := vd.dumpHeader()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	if lines {
+		if err := enc.Encode(dump); err != nil {
+			return err
+		}
+		return v.VisitExtents(func(info ExtentInfo) error {
+			return enc.Encode(dumpExtent(info))
+		})
+	}
+
+	err = v.VisitExtents(func(info ExtentInfo) error {
+		dump.Extents = append(dump.Extents, dumpExtent(info))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	enc.SetIndent("", "  ")
+	return enc.Encode(dump)
+}
+
+// dumpHeader returns the Dump of v without its extents
+func (v *vdisc) dumpHeader() (*Dump, error) {
+	v1, err := readRoot(v.msg)
+	if err != nil {
+		return nil, err
+	}
+
+	dump := &Dump{
+		FsType:    v.fsType,
+		BlockSize: v.blockSize,
+		Layout:    dumpLayoutGzip,
+		KeyIDs:    v.keys.ids,
+		Trie:      v.trieStats(),
+	}
+	if v1.HasExtentPages() {
+		dump.Layout = dumpLayoutPaged
+		dump.ExtentPageSize = v.pageSize
+	}
+	return dump, nil
+}
+
+// trieStats describes the uris trie, which has been validated
+func (v *vdisc) trieStats() *TrieStats {
+	n := v.uris.Len()
+	stats := &TrieStats{Nodes: n}
+
+	depths := make([]int, n)
+	var path []int
+	for start := 0; start < n; start++ {
+		path = path[:0]
+		node := start
+		for depths[node] == 0 {
+			path = append(path, node)
+			parent := int(v.uris.At(node).Parent())
+			if parent == node {
+				break
+			}
+			node = parent
+		}
+
+		depth := depths[node]
+		for i := len(path) - 1; i >= 0; i-- {
+			depth++
+			depths[path[i]] = depth
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		trie := v.uris.At(i)
+		if int(trie.Parent()) == i {
+			stats.Roots++
+		}
+		if depths[i] > stats.MaxDepth {
+			stats.MaxDepth = depths[i]
+		}
+		content, _ := trie.Content()
+		stats.ContentBytes += len(content)
+	}
+	return stats
+}
+
+func dumpExtent(info ExtentInfo) DumpExtent {
+	e := DumpExtent{
+		LBA:       uint32(info.LBA),
+		URI:       info.URL,
+		Blocks:    info.Blocks,
+		Padding:   info.Padding,
+		ETag:      info.Version.ETag,
+		VersionID: info.Version.VersionID,
+		Ranged:    info.Ranged,
+		Offset:    info.Offset,
+		KeyID:     info.KeyID,
+	}
+	if !info.Checksum.IsZero() {
+		e.Checksum = info.Checksum.String()
+	}
+	if info.Compression != CompressionNone {
+		e.Compression = info.Compression.String()
+		e.CompressedSize = info.CompressedSize
+	}
+
+	// The first part is the extent's own object
+	for i := 1; i < len(info.Parts); i++ {
+		part := info.Parts[i]
+		e.Parts = append(e.Parts, DumpPart{
+			URI:       part.URL,
+			Size:      part.Size,
+			ETag:      part.Version.ETag,
+			VersionID: part.Version.VersionID,
+		})
+	}
+	return e
+}
+
+// RestoreOptions are optional settings for Restore
+type RestoreOptions struct {
+	// TempDir is the directory extents are spooled to while the vdisc
+	// is encoded, the system temp dir by default
+	TempDir string
+}
+
+// Restore encodes a vdisc from a Dump read from r, in either of the
+// forms WriteDump writes, and stores it at url. It returns the URL of
+// the stored vdisc.
+func Restore(r io.Reader, url string, options ...RestoreOptions) (string, error) {
+	var opts RestoreOptions
+	if len(options) > 0 {
+		opts = options[0]
+	}
+
+	dump, err := readDump(r)
+	if err != nil {
+		return "", err
+	}
+	if err := dump.check(); err != nil {
+		return "", err
+	}
+	return dump.store(url, opts)
+}
+
+// store encodes the vdisc described by dump and stores it at url
+func (dump *Dump) store(url string, opts RestoreOptions) (string, error) {
+	pageSize := 0
+	switch dump.Layout {
+	case "", dumpLayoutGzip:
+	case dumpLayoutPaged:
+		if pageSize = dump.ExtentPageSize; pageSize == 0 {
+			pageSize = defaultExtentPageSize
+		}
+	default:
+		return "", fmt.Errorf("unknown layout %q", dump.Layout)
+	}
+
+	// Every URL is split into a prefix, stored once in the trie, and
+	// the rest, stored in the extent
+	prefixes := make(map[string]iso9660.LogicalBlockAddress)
+	addPrefix := func(url string) {
+		prefix, _ := splitURL(url)
+		if _, ok := prefixes[prefix]; !ok {
+			prefixes[prefix] = iso9660.LogicalBlockAddress(len(prefixes))
+		}
+	}
+	for _, e := range dump.Extents {
+		addPrefix(e.URI)
+		for _, part := range e.Parts {
+			addPrefix(part.URI)
+		}
+	}
+	trie := NewTrieMap()
+	for prefix, id := range prefixes {
+		trie.Put(prefix, id)
+	}
+	inverted, leaves := trie.Invert()
+
+	split := func(url string) (uint32, string) {
+		prefix, rest := splitURL(url)
+		leaf := leaves[prefixes[prefix]]
+		return uint32(leaf.Parent), leaf.Content + rest
+	}
+
+	extents, err := newExtentWriter(opts.TempDir, pageSize)
+	if err != nil {
+		return "", err
+	}
+	defer extents.Close()
+
+	var keys keyIndex
+	for _, id := range dump.KeyIDs {
+		if _, err := keys.get(id); err != nil {
+			return "", err
+		}
+	}
+
+	for i := range dump.Extents {
+		e := &dump.Extents[i]
+		entry := &extentEntry{
+			blocks:  e.Blocks,
+			padding: e.Padding,
+			version: storage.Version{ETag: e.ETag, VersionID: e.VersionID},
+			ranged:  e.Ranged,
+			offset:  e.Offset,
+
+			compressedSize: e.CompressedSize,
+		}
+		entry.uriPrefix, entry.uriSuffix = split(e.URI)
+		if entry.checksum, err = ParseChecksum(e.Checksum); err != nil {
+			return "", fmt.Errorf("extent %d: %v", i, err)
+		}
+		if e.Compression != "" {
+			entry.compression = vdisc_types_v1.CompressionFromString(e.Compression)
+		}
+		if entry.key, err = keys.get(e.KeyID); err != nil {
+			return "", err
+		}
+		for _, part := range e.Parts {
+			p := extentPart{
+				size:    part.Size,
+				version: storage.Version{ETag: part.ETag, VersionID: part.VersionID},
+			}
+			p.uriPrefix, p.uriSuffix = split(part.URI)
+			entry.parts = append(entry.parts, p)
+		}
+
+		if i == 0 {
+			err = extents.SetFirst(entry)
+		} else {
+			err = extents.Append(entry)
+		}
+		if err != nil {
+			return "", fmt.Errorf("extent %d: %v", i, err)
+		}
+	}
+
+	vd, err := storage.Create(url)
+	if err != nil {
+		return "", err
+	}
+	defer vd.Abort()
+
+	if pageSize > 0 {
+		if _, err := extents.WriteTo(vd, dump.BlockSize, dump.FsType, inverted, keys.ids); err != nil {
+			return "", err
+		}
+	} else {
+		vdz, err := gzip.NewWriterLevel(vd, gzip.BestCompression)
+		if err != nil {
+			return "", err
+		}
+		if _, err := extents.WriteTo(vdz, dump.BlockSize, dump.FsType, inverted, keys.ids); err != nil {
+			return "", err
+		}
+		if err := vdz.Close(); err != nil {
+			return "", err
+		}
+	}
+
+	info, err := vd.Commit()
+	if err != nil {
+		return "", err
+	}
+	return info.ObjectURL(), nil
+}
+
+// readDump reads a Dump, either whole or followed by its extents one
+// per line
+func readDump(r io.Reader) (*Dump, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	var dump Dump
+	if err := dec.Decode(&dump); err != nil {
+		return nil, fmt.Errorf("reading dump: %v", err)
+	}
+	for {
+		var e DumpExtent
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading extent %d: %v", len(dump.Extents), err)
+		}
+		dump.Extents = append(dump.Extents, e)
+	}
+	return &dump, nil
+}
+
+// check catches the mistakes a hand edited dump is likely to have.
+// Load validates the restored vdisc in full.
+func (dump *Dump) check() error {
+	if dump.FsType == "" {
+		return errors.New("fsType is empty")
+	}
+	if dump.BlockSize == 0 {
+		return errors.New("blockSize is zero")
+	}
+	if len(dump.Extents) == 0 {
+		return errors.New("no extents")
+	}
+
+	var blocks uint64
+	for i, e := range dump.Extents {
+		if e.URI == "" {
+			return fmt.Errorf("extent %d: uri is empty", i)
+		}
+		if e.Padding > dump.BlockSize || uint64(e.Padding) > uint64(e.Blocks)*uint64(dump.BlockSize) {
+			return fmt.Errorf("extent %d: padding %d out of range", i, e.Padding)
+		}
+		if e.Offset < 0 || e.CompressedSize < 0 || (e.Offset != 0 && !e.Ranged) {
+			return fmt.Errorf("extent %d: invalid offset or compressed size", i)
+		}
+		if e.Compression != "" && vdisc_types_v1.CompressionFromString(e.Compression).String() != e.Compression {
+			return fmt.Errorf("extent %d: unknown compression %q", i, e.Compression)
+		}
+		for j, part := range e.Parts {
+			if part.URI == "" || part.Size < 0 {
+				return fmt.Errorf("extent %d: part %d: invalid uri or size", i, j+1)
+			}
+		}
+
+		blocks += uint64(e.Blocks)
+		if blocks > math.MaxUint32 {
+			return fmt.Errorf("extents exceed %d blocks", uint64(math.MaxUint32))
+		}
+	}
+	return nil
+}
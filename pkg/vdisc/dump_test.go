@@ -0,0 +1,114 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+func TestDumpRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var urls []string
+	for i := 0; i < 3; i++ {
+		url := filepath.Join(dir, fmt.Sprintf("object%d", i))
+		if err := ioutil.WriteFile(url, []byte(strings.Repeat(fmt.Sprint(i), 3000+i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, url)
+	}
+	checksum, err := vdisc.ParseChecksum(fmt.Sprintf("md5:%x", md5.Sum(readFile(t, urls[0]))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, layout := range []vdisc.Layout{vdisc.LayoutGzip, vdisc.LayoutPaged} {
+		b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{
+			URL:         filepath.Join(dir, fmt.Sprintf("%d.vdisc", layout)),
+			Layout:      layout,
+			PageExtents: 2,
+		})
+		assert.Nil(t, b.AddFile("a", urls[0], -1, vdisc.FileOptions{Checksum: checksum}))
+		assert.Nil(t, b.AddFileRange("b", urls[1], 100, 200))
+		assert.Nil(t, b.AddFileParts("c", urls[1:], []int64{-1, -1}))
+		assert.Nil(t, b.AddSparseFile("d", 5000))
+		url, err := b.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := vdisc.Load(url, caching.NopCache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected []vdisc.ExtentInfo
+		assert.Nil(t, v.VisitExtents(func(info vdisc.ExtentInfo) error {
+			expected = append(expected, info)
+			return nil
+		}))
+
+		for _, lines := range []bool{false, true} {
+			var dump bytes.Buffer
+			assert.Nil(t, vdisc.WriteDump(&dump, v, lines))
+
+			restored, err := vdisc.Restore(&dump, filepath.Join(dir, fmt.Sprintf("restored-%d-%v.vdisc", layout, lines)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rv, err := vdisc.Load(restored, caching.NopCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var actual []vdisc.ExtentInfo
+			assert.Nil(t, rv.VisitExtents(func(info vdisc.ExtentInfo) error {
+				actual = append(actual, info)
+				return nil
+			}))
+			assert.Equal(t, expected, actual)
+
+			w := iso9660.NewWalker(rv.Image())
+			f, err := w.Open("c")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(f)
+			assert.Nil(t, err)
+			assert.Equal(t, append(readFile(t, urls[1]), readFile(t, urls[2])...), data)
+			rv.Close()
+		}
+		v.Close()
+	}
+
+	_, err = vdisc.Restore(strings.NewReader(`{"fsType":"iso9660","blockSize":2048,"extents":[{"uri":"x","num_blocks":1,"padding":2049}]}`), filepath.Join(dir, "invalid.vdisc"))
+	assert.NotNil(t, err)
+}
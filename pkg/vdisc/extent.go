@@ -22,9 +22,11 @@ import (
 	"os"
 	"strings"
 
+	"github.com/NVIDIA/vdisc/pkg/chunkcrypt"
 	"github.com/NVIDIA/vdisc/pkg/safecast"
 	"github.com/NVIDIA/vdisc/pkg/storage"
 	"github.com/NVIDIA/vdisc/pkg/vdisc/types/v1"
+	"github.com/NVIDIA/vdisc/pkg/zstdseek"
 )
 
 type extent struct {
@@ -32,9 +34,36 @@ type extent struct {
 	baseURL   *stdurl.URL
 	uris      vdisc_types_v1.ITrie_List
 	extents   vdisc_types_v1.Extent_List
+	keys      *keyring
 	idx       int
 	pos       int64
 	closed    bool
+
+	// containing reads a ranged extent's object from the start up to
+	// the end of the range, so that every range of the object can
+	// share its cache blocks
+	containing bool
+
+	// ciphertext reads an encrypted extent's object as stored, so that
+	// the cache only ever holds ciphertext
+	ciphertext bool
+
+	// table caches the seek table of a compressed extent between reads
+	table *seekTable
+
+	// url and parts are looked up once by resolve when the extent is
+	// opened, rather than in the uris trie on every read
+	resolved bool
+	url      string
+	parts    []PartInfo
+}
+
+// resolve looks up the URL and parts of the extent. It must be called
+// before the extent is shared, since reads don't synchronize with it.
+func (e *extent) resolve() {
+	e.url = e.URL()
+	e.parts = e.Parts()
+	e.resolved = true
 }
 
 func (e *extent) Close() error {
@@ -43,13 +72,22 @@ func (e *extent) Close() error {
 }
 
 func (e *extent) URL() string {
+	if e.resolved {
+		return e.url
+	}
+
 	extent := e.extents.At(e.idx)
 	uri, err := extent.UriSuffix()
 	if err != nil {
 		panic(err)
 	}
 
-	parent := extent.UriPrefix()
+	return e.resolveURL(extent.UriPrefix(), uri)
+}
+
+// resolveURL rebuilds a URL from its suffix and the index of its
+// prefix in the uris inverted trie
+func (e *extent) resolveURL(parent uint32, uri string) string {
 	for {
 		node := e.uris.At(safecast.Uint32ToInt(parent))
 		prefix, err := node.Content()
@@ -64,10 +102,11 @@ func (e *extent) URL() string {
 		parent = node.Parent()
 	}
 
-	// Possibly evaluate relative to baseURL
+	// Possibly evaluate relative to baseURL. A URL that doesn't parse
+	// is left as is, so that opening it fails.
 	u, err := stdurl.Parse(uri)
 	if err != nil {
-		panic(err)
+		return uri
 	}
 
 	resolved := e.baseURL.ResolveReference(u)
@@ -79,6 +118,17 @@ func (e *extent) URL() string {
 }
 
 func (e *extent) Size() int64 {
+	if e.containing {
+		return e.Offset() + e.length()
+	}
+	if e.ciphertext {
+		return chunkcrypt.CiphertextSize(e.length())
+	}
+	return e.length()
+}
+
+// length returns the size of the extent content
+func (e *extent) length() int64 {
 	ext := e.extents.At(e.idx)
 	blocks := ext.Blocks()
 	padding := ext.Padding()
@@ -89,6 +139,106 @@ func (e *extent) Size() int64 {
 	return int64(blocks)*int64(e.blockSize) - int64(padding)
 }
 
+// Ranged reports whether the extent is a byte range of its object
+// rather than the whole object
+func (e *extent) Ranged() bool {
+	return e.extents.At(e.idx).Ranged()
+}
+
+// Offset returns the position of the extent within its object
+func (e *extent) Offset() int64 {
+	return safecast.Uint64ToInt64(e.extents.At(e.idx).Offset())
+}
+
+// Compression returns the format of the extent's object
+func (e *extent) Compression() Compression {
+	return e.extents.At(e.idx).Compression()
+}
+
+// CompressedSize returns the size of a compressed extent's object
+func (e *extent) CompressedSize() int64 {
+	return safecast.Uint64ToInt64(e.extents.At(e.idx).CompressedSize())
+}
+
+// KeyID returns the id of the key the extent's object is encrypted
+// with, or "" if it isn't encrypted
+func (e *extent) KeyID() string {
+	return e.keys.id(e.extents.At(e.idx).Key())
+}
+
+// Checksum returns the checksum recorded for this extent, if any
+func (e *extent) Checksum() Checksum {
+	ext := e.extents.At(e.idx)
+	digest, err := ext.Checksum()
+	if err != nil || ext.ChecksumAlgorithm() == ChecksumNone {
+		return Checksum{}
+	}
+
+	// digest points into the memory mapped vdisc, so copy it out
+	return Checksum{ext.ChecksumAlgorithm(), append([]byte(nil), digest...)}
+}
+
+// Parts returns every object of a multi-part extent, starting with
+// its own, or nil if the extent is backed by a single object
+func (e *extent) Parts() []PartInfo {
+	if e.resolved {
+		return e.parts
+	}
+
+	list, err := e.extents.At(e.idx).Parts()
+	if err != nil || list.Len() == 0 {
+		return nil
+	}
+
+	// The extent's own object holds whatever the other parts don't
+	parts := make([]PartInfo, 1, list.Len()+1)
+	first := e.length()
+	for i := 0; i < list.Len(); i++ {
+		part := list.At(i)
+		suffix, err := part.UriSuffix()
+		if err != nil {
+			panic(err)
+		}
+		etag, _ := part.Etag()
+		versionID, _ := part.VersionId()
+
+		size := safecast.Uint64ToInt64(part.Size())
+		first -= size
+		parts = append(parts, PartInfo{
+			URL:     e.resolveURL(part.UriPrefix(), suffix),
+			Size:    size,
+			Version: storage.Version{ETag: etag, VersionID: versionID},
+		})
+	}
+	parts[0] = PartInfo{URL: e.URL(), Size: first, Version: e.Version()}
+	return parts
+}
+
+// Version returns the object revision pinned at burn time, if any
+func (e *extent) Version() storage.Version {
+	ext := e.extents.At(e.idx)
+	etag, err := ext.Etag()
+	if err != nil {
+		return storage.Version{}
+	}
+	versionID, err := ext.VersionId()
+	if err != nil {
+		return storage.Version{}
+	}
+
+	return storage.Version{ETag: etag, VersionID: versionID}
+}
+
+// Encoding returns the format a compressed extent's object is
+// decompressed from, which keeps its cached content apart from that of
+// the object as stored
+func (e *extent) Encoding() string {
+	if compression := e.Compression(); compression != CompressionNone {
+		return compression.String()
+	}
+	return ""
+}
+
 func (e *extent) Read(p []byte) (n int, err error) {
 	n, err = e.ReadAt(p, e.pos)
 	e.pos += int64(n)
@@ -101,13 +251,77 @@ func (e *extent) ReadAt(p []byte, off int64) (n int, err error) {
 		return
 	}
 
+	if parts := e.Parts(); parts != nil {
+		objs := make([]storage.AnonymousObject, len(parts))
+		for i, part := range parts {
+			objs[i] = openPart(part)
+		}
+		return storage.Concat(objs...).ReadAt(p, off)
+	}
+
+	ctx := context.Background()
+	if version := e.Version(); !version.IsZero() {
+		ctx = storage.CtxWithVersion(ctx, version)
+	}
+
+	if key := e.extents.At(e.idx).Key(); key != 0 {
+		return e.readEncrypted(ctx, key, p, off)
+	}
+
+	if compression := e.Compression(); compression != CompressionNone {
+		return e.readCompressed(ctx, compression, p, off)
+	}
+
+	offset, length := e.Offset(), e.length()
 	var obj storage.Object
-	obj, err = storage.OpenContextSize(context.Background(), e.URL(), e.Size())
+	obj, err = storage.OpenContextSize(ctx, e.URL(), offset+length)
 	if err != nil {
 		return
 	}
 	defer obj.Close()
-	return obj.ReadAt(p, off)
+	if e.containing {
+		return obj.ReadAt(p, off)
+	}
+	return storage.Slice(obj, offset, length).ReadAt(p, off)
+}
+
+// readEncrypted decrypts the extent's object with the key at index
+// key, or reads it as stored if e.ciphertext is set
+func (e *extent) readEncrypted(ctx context.Context, key uint8, p []byte, off int64) (int, error) {
+	length := e.length()
+	obj, err := storage.OpenContextSize(ctx, e.URL(), chunkcrypt.CiphertextSize(length))
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Close()
+	if e.ciphertext {
+		return obj.ReadAt(p, off)
+	}
+	return decrypter{e.keys, key, obj, length}.ReadAt(p, off)
+}
+
+// readCompressed reads the decompressed content of the extent's object
+func (e *extent) readCompressed(ctx context.Context, compression Compression, p []byte, off int64) (int, error) {
+	size := e.CompressedSize()
+	obj, err := storage.OpenContextSize(ctx, e.URL(), size)
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Close()
+
+	if compression != CompressionZstdSeekable || e.table == nil {
+		r, err := Decompress(obj, size, compression)
+		if err != nil {
+			return 0, err
+		}
+		return r.ReadAt(p, off)
+	}
+
+	table, err := e.table.get(obj, size)
+	if err != nil {
+		return 0, err
+	}
+	return zstdseek.NewReader(obj, table).ReadAt(p, off)
 }
 
 func (e *extent) Seek(offset int64, whence int) (int64, error) {
@@ -137,3 +351,80 @@ func (e *extent) Seek(offset int64, whence int) (int64, error) {
 
 	return e.pos, nil
 }
+
+// partObject is one of the objects of a multi-part extent, opened
+// afresh for every read like the extent itself
+type partObject struct {
+	*io.SectionReader
+	url     string
+	version storage.Version
+}
+
+func openPart(part PartInfo) storage.Object {
+	return &partObject{io.NewSectionReader(partReader(part), 0, part.Size), part.URL, part.Version}
+}
+
+func (po *partObject) URL() string {
+	return po.url
+}
+
+// Version returns the revision the part is pinned to, if any
+func (po *partObject) Version() storage.Version {
+	return po.version
+}
+
+func (po *partObject) Close() error {
+	return nil
+}
+
+type partReader PartInfo
+
+func (pr partReader) ReadAt(p []byte, off int64) (int, error) {
+	ctx := context.Background()
+	if !pr.Version.IsZero() {
+		ctx = storage.CtxWithVersion(ctx, pr.Version)
+	}
+
+	obj, err := storage.OpenContextSize(ctx, pr.URL, pr.Size)
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Close()
+	return obj.ReadAt(p, off)
+}
+
+// decryptedObject is the content of an encrypted extent, decrypted on
+// every read from its object as stored, which may be cached
+type decryptedObject struct {
+	*io.SectionReader
+	url        string
+	ciphertext storage.Object
+}
+
+func openDecrypted(e *extent, key uint8, ciphertext storage.Object) storage.Object {
+	d := decrypter{e.keys, key, ciphertext, e.length()}
+	return &decryptedObject{io.NewSectionReader(d, 0, e.length()), e.URL(), ciphertext}
+}
+
+func (do *decryptedObject) URL() string {
+	return do.url
+}
+
+func (do *decryptedObject) Close() error {
+	return do.ciphertext.Close()
+}
+
+type decrypter struct {
+	keys       *keyring
+	key        uint8
+	ciphertext io.ReaderAt
+	length     int64
+}
+
+func (d decrypter) ReadAt(p []byte, off int64) (int, error) {
+	aead, err := d.keys.aead(d.key)
+	if err != nil {
+		return 0, err
+	}
+	return chunkcrypt.NewReader(d.ciphertext, d.length, aead).ReadAt(p, off)
+}
@@ -0,0 +1,598 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/NVIDIA/vdisc/pkg/storage"
+)
+
+// The extentWriter assembles a capnp message equivalent to the one
+// built with vdisc_types by the in-memory builder, without holding the
+// extents in memory. The message is laid out as
+//
+//   segment 0:  the root VDisc, the V1 struct, fsType and the uris
+//   segment 1:  the extents list, reached by a far pointer
+//   segment 2+: the text, data and parts of every extent, each
+//               preceded by a landing pad for the far pointer that
+//               refers to it
+//
+// or, in the paged layout, as
+//
+//   segment 0:  the root VDisc, the V1 struct, fsType, the uris and
+//               the list of extent pages
+//   segment 1+: one page of extents, reached by a far pointer, then
+//               the text, data and parts of those extents
+//
+// so that each page can be read without the rest of the message. The
+// V1 struct is in the v2 field of the root in the paged layout, and
+// whenever an extent uses a feature v1 readers would misread.
+// Extents are spooled to temporary files and copied into the message
+// by WriteTo once all of them are known.
+
+const (
+	// Words in each of the structs written by hand. These must agree
+	// with the schema in types/v1/vdisc_v1.capnp.
+	extentDataWords = 4
+	extentPtrWords  = 5
+	extentWords     = extentDataWords + extentPtrWords
+	partDataWords   = 2
+	partPtrWords    = 3
+	partWords       = partDataWords + partPtrWords
+	itrieDataWords  = 1
+	itriePtrWords   = 1
+	rootPtrWords    = 2
+	v1DataWords     = 1
+	v1PtrWords      = 5
+	pageDataWords   = 1
+	pagePtrWords    = 1
+
+	// Text segments are split at this size
+	maxTextSegmentWords = 1 << 28
+
+	// Extents in each page of the paged layout, unless configured
+	defaultExtentPageSize = 4096
+)
+
+// A single extent, as it will be encoded in the message
+type extentEntry struct {
+	uriPrefix uint32
+	uriSuffix string
+	blocks    uint32
+	padding   uint16
+	checksum  Checksum
+	version   storage.Version
+	ranged    bool
+	offset    int64
+	parts     []extentPart
+
+	compression    Compression
+	compressedSize int64
+	key            uint8
+}
+
+// needsV2 reports whether v1 readers would misread the extent
+func (e *extentEntry) needsV2() bool {
+	return e.ranged || len(e.parts) > 0 || e.compression != CompressionNone || e.key != 0
+}
+
+// A part of a multi-part extent, other than the first
+type extentPart struct {
+	uriPrefix uint32
+	uriSuffix string
+	size      int64
+	version   storage.Version
+}
+
+type extentWriter struct {
+	list     *os.File
+	listBuf  *bufio.Writer
+	text     *os.File
+	textBuf  *bufio.Writer
+	textSegs []uint32
+	count    int
+	first    []byte
+	v2       bool
+
+	// In the paged layout, the extents of a page are held until it is
+	// full, and then spooled as a whole segment. The first page is
+	// held until WriteTo, since it starts with the first extent.
+	pageSize   int
+	page       []*extentEntry
+	firstPage  []*extentEntry
+	firstEntry *extentEntry
+	pageSegs   []uint32
+
+	// blocks counts the blocks of every extent but the first, and
+	// pageBlocks the blocks before each page
+	blocks     uint64
+	pageBlocks []uint64
+}
+
+// newExtentWriter spools extents to temporary files in dir. The first
+// extent, which describes the iso metadata, is set separately with
+// SetFirst because it is only known once everything else is written.
+// If pageSize is positive, the message uses the paged layout with
+// pageSize extents per page.
+func newExtentWriter(dir string, pageSize int) (*extentWriter, error) {
+	list, err := ioutil.TempFile(dir, "extents.")
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := ioutil.TempFile(dir, "text.")
+	if err != nil {
+		list.Close()
+		return nil, err
+	}
+
+	w := &extentWriter{
+		list:     list,
+		listBuf:  bufio.NewWriterSize(list, 1024*1024),
+		text:     text,
+		textBuf:  bufio.NewWriterSize(text, 1024*1024),
+		textSegs: []uint32{0},
+		count:    1,
+		pageSize: pageSize,
+	}
+	if pageSize > 0 {
+		// The first extent takes the first slot of the first page
+		w.page = make([]*extentEntry, 1, pageSize)
+		w.pageBlocks = []uint64{0}
+	}
+	return w, nil
+}
+
+// Close removes the temporary files
+func (w *extentWriter) Close() error {
+	w.list.Close()
+	w.text.Close()
+	os.Remove(w.list.Name())
+	return os.Remove(w.text.Name())
+}
+
+// Append adds an extent after every extent written so far
+func (w *extentWriter) Append(e *extentEntry) error {
+	if w.pageSize > 0 {
+		if len(w.page) == w.pageSize {
+			if err := w.flushPage(); err != nil {
+				return err
+			}
+			w.pageBlocks = append(w.pageBlocks, w.blocks)
+		}
+		w.page = append(w.page, e)
+		w.blocks += uint64(e.blocks)
+		w.count++
+		return nil
+	}
+	w.v2 = w.v2 || e.needsV2()
+
+	buf, err := w.encode(e)
+	if err != nil {
+		return err
+	}
+	if _, err := w.listBuf.Write(buf); err != nil {
+		return err
+	}
+	w.count++
+	return nil
+}
+
+// SetFirst sets the extent at index 0
+func (w *extentWriter) SetFirst(e *extentEntry) (err error) {
+	w.v2 = w.v2 || e.needsV2()
+	if w.pageSize > 0 {
+		w.firstEntry = e
+		return nil
+	}
+	w.first, err = w.encode(e)
+	return
+}
+
+// flushPage spools the current page, unless it is the first
+func (w *extentWriter) flushPage() error {
+	if w.firstPage == nil {
+		w.firstPage = w.page
+	} else {
+		seg, err := encodePage(w.page)
+		if err != nil {
+			return err
+		}
+		if _, err := w.listBuf.Write(seg); err != nil {
+			return err
+		}
+		w.pageSegs = append(w.pageSegs, uint32(len(seg)/8))
+	}
+	w.page = make([]*extentEntry, 0, w.pageSize)
+	return nil
+}
+
+func (w *extentWriter) encode(e *extentEntry) ([]byte, error) {
+	buf := encodeExtentData(e)
+	for i, f := range extentFields(e) {
+		if f.body == nil {
+			continue
+		}
+		ptr, err := w.writeFar(f.pad, f.body)
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(buf[(extentDataWords+i)*8:], ptr)
+	}
+	return buf, nil
+}
+
+// encodePage encodes a page of extents as a segment of its own: a
+// landing pad for the far pointer that refers to the page, the extents
+// list and then the text, data and parts of the extents, reached by
+// near pointers
+func encodePage(entries []*extentEntry) ([]byte, error) {
+	listWords := len(entries) * extentWords
+	seg := make([]byte, (2+listWords)*8)
+	binary.LittleEndian.PutUint64(seg[0:], listPointer(0, 7, uint32(listWords)))
+	binary.LittleEndian.PutUint64(seg[8:], structPointer(int32(len(entries)), extentDataWords, extentPtrWords))
+
+	for i, e := range entries {
+		elem := 2 + i*extentWords
+		copy(seg[elem*8:], encodeExtentData(e)[:extentDataWords*8])
+		for j, f := range extentFields(e) {
+			if f.body == nil {
+				continue
+			}
+			ptr := elem + extentDataWords + j
+			idx := len(seg) / 8
+			seg = append(seg, f.body...)
+			binary.LittleEndian.PutUint64(seg[ptr*8:], f.pad|uint64(uint32(idx-ptr-1)<<2))
+		}
+	}
+
+	if len(seg)/8 >= 1<<29 {
+		// Near pointer offsets are 30 bit signed words
+		return nil, fmt.Errorf("extent page of %d words is too large", len(seg)/8)
+	}
+	return seg, nil
+}
+
+// encodeExtentData returns an encoded extent with its data section set
+// and null pointers
+func encodeExtentData(e *extentEntry) []byte {
+	buf := make([]byte, extentWords*8)
+	binary.LittleEndian.PutUint32(buf[0:], e.uriPrefix)
+	binary.LittleEndian.PutUint32(buf[4:], e.blocks)
+	binary.LittleEndian.PutUint16(buf[8:], e.padding)
+
+	if !e.checksum.IsZero() {
+		binary.LittleEndian.PutUint16(buf[10:], uint16(e.checksum.Algorithm))
+	}
+	if e.ranged {
+		buf[12] = 1
+		binary.LittleEndian.PutUint64(buf[16:], uint64(e.offset))
+	}
+	if e.compression != CompressionNone {
+		binary.LittleEndian.PutUint16(buf[14:], uint16(e.compression))
+		binary.LittleEndian.PutUint64(buf[24:], uint64(e.compressedSize))
+	}
+	buf[13] = e.key
+	return buf
+}
+
+// A pointer field of an extent: its body, a whole number of words, and
+// the list pointer to it, less the offset, which is also its landing
+// pad. The body is nil for a null pointer.
+type extentField struct {
+	pad  uint64
+	body []byte
+}
+
+// extentFields returns the pointer fields of e in schema order
+func extentFields(e *extentEntry) []extentField {
+	var digest []byte
+	if !e.checksum.IsZero() {
+		digest = e.checksum.Digest
+	}
+
+	return []extentField{
+		blobField([]byte(e.uriSuffix), true),
+		blobField(digest, false),
+		blobField([]byte(e.version.ETag), true),
+		blobField([]byte(e.version.VersionID), true),
+		partsField(e.parts),
+	}
+}
+
+// blobField encodes text or data, or a null pointer if content is
+// empty
+func blobField(content []byte, text bool) extentField {
+	if len(content) == 0 {
+		return extentField{}
+	}
+
+	n := len(content)
+	if text {
+		n++ // NUL terminator
+	}
+	body := make([]byte, (n+7)/8*8)
+	copy(body, content)
+	return extentField{listPointer(0, 2, uint32(n)), body}
+}
+
+// partsField encodes the list of parts followed by their text, which
+// is reached by near pointers, or a null pointer if there are no parts
+func partsField(parts []extentPart) extentField {
+	if len(parts) == 0 {
+		return extentField{}
+	}
+
+	body := make([]byte, (1+len(parts)*partWords)*8)
+	binary.LittleEndian.PutUint64(body, structPointer(int32(len(parts)), partDataWords, partPtrWords))
+	for i, part := range parts {
+		elem := 1 + i*partWords
+		binary.LittleEndian.PutUint32(body[elem*8:], part.uriPrefix)
+		binary.LittleEndian.PutUint64(body[(elem+1)*8:], uint64(part.size))
+
+		for j, text := range []string{part.uriSuffix, part.version.ETag, part.version.VersionID} {
+			if text == "" {
+				continue
+			}
+			ptr := elem + partDataWords + j
+			idx := len(body) / 8
+			n := len(text) + 1
+			body = append(body, make([]byte, (n+7)/8*8)...)
+			copy(body[idx*8:], text)
+			binary.LittleEndian.PutUint64(body[ptr*8:], listPointer(int32(idx-ptr-1), 2, uint32(n)))
+		}
+	}
+	return extentField{listPointer(0, 7, uint32(len(parts)*partWords)), body}
+}
+
+// writeFar appends a landing pad followed by body, a whole number of
+// words, to the current text segment, starting a new segment if it
+// doesn't fit. It returns a far pointer to the landing pad.
+func (w *extentWriter) writeFar(pad uint64, body []byte) (uint64, error) {
+	words := uint32(len(body) / 8)
+	if uint64(1+words) > maxTextSegmentWords {
+		return 0, fmt.Errorf("extent data of %d words is too large", words)
+	}
+
+	seg := len(w.textSegs) - 1
+	if uint64(w.textSegs[seg])+1+uint64(words) > maxTextSegmentWords {
+		w.textSegs = append(w.textSegs, 0)
+		seg++
+	}
+	padOffset := w.textSegs[seg]
+
+	var hdr [8]byte
+	binary.LittleEndian.PutUint64(hdr[:], pad)
+	if _, err := w.textBuf.Write(hdr[:]); err != nil {
+		return 0, err
+	}
+	if _, err := w.textBuf.Write(body); err != nil {
+		return 0, err
+	}
+	w.textSegs[seg] += 1 + words
+
+	return farPointer(uint32(seg)+2, padOffset), nil
+}
+
+// WriteTo writes the complete message in the capnp stream framing
+func (w *extentWriter) WriteTo(out io.Writer, blockSize uint16, fsType string, uris []InvertedTrieNode, keyIDs []string) (int64, error) {
+	if w.first == nil && w.firstEntry == nil {
+		return 0, fmt.Errorf("first extent not set")
+	}
+
+	// The leading segments are built in memory and followed by the
+	// spooled ones
+	var head [][]byte
+	var sizes []uint32
+	var spooled []*os.File
+	if w.pageSize > 0 {
+		if w.firstPage == nil {
+			w.firstPage = w.page
+		} else if err := w.flushPage(); err != nil {
+			return 0, err
+		}
+		w.firstPage[0] = w.firstEntry
+
+		blocks := uint64(w.firstEntry.blocks) + w.blocks
+		if blocks > math.MaxUint32 {
+			return 0, fmt.Errorf("extents exceed %d blocks", uint64(math.MaxUint32))
+		}
+		lbas := make([]uint32, len(w.pageBlocks))
+		for i, b := range w.pageBlocks[1:] {
+			lbas[i+1] = uint32(uint64(w.firstEntry.blocks) + b)
+		}
+
+		page0, err := encodePage(w.firstPage)
+		if err != nil {
+			return 0, err
+		}
+		seg0 := buildRootSegment(blockSize, fsType, uris, keyIDs, true, uint32(w.pageSize), lbas)
+		head = [][]byte{seg0, page0}
+		sizes = append([]uint32{uint32(len(seg0) / 8), uint32(len(page0) / 8)}, w.pageSegs...)
+		spooled = []*os.File{w.list}
+	} else {
+		listWords := uint64(w.count) * extentWords
+		if listWords >= 1<<29 {
+			// The word count of a composite list pointer is 29 bits
+			return 0, fmt.Errorf("too many extents for a single vdisc: %d", w.count)
+		}
+
+		// Segment 1 starts with the landing pad for the extents far
+		// pointer, followed by the composite list tag
+		seg1 := make([]byte, 16, 16+len(w.first))
+		binary.LittleEndian.PutUint64(seg1[0:], listPointer(0, 7, uint32(listWords)))
+		binary.LittleEndian.PutUint64(seg1[8:], structPointer(int32(w.count), extentDataWords, extentPtrWords))
+		seg1 = append(seg1, w.first...)
+
+		seg0 := buildRootSegment(blockSize, fsType, uris, keyIDs, w.v2, 0, nil)
+		head = [][]byte{seg0, seg1}
+		sizes = append([]uint32{uint32(len(seg0) / 8), uint32(2 + listWords)}, w.textSegs...)
+		spooled = []*os.File{w.list, w.text}
+	}
+
+	if err := w.listBuf.Flush(); err != nil {
+		return 0, err
+	}
+	if err := w.textBuf.Flush(); err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriterSize(out, 1024*1024)
+	var written int64
+	put := func(p []byte) error {
+		n, err := bw.Write(p)
+		written += int64(n)
+		return err
+	}
+
+	// Stream framing: segment count - 1, then each segment size,
+	// padded to a whole word
+	hdr := make([]byte, 4*(len(sizes)+1))
+	binary.LittleEndian.PutUint32(hdr, uint32(len(sizes)-1))
+	for i, sz := range sizes {
+		binary.LittleEndian.PutUint32(hdr[4*(i+1):], sz)
+	}
+	if len(hdr)%8 != 0 {
+		hdr = append(hdr, 0, 0, 0, 0)
+	}
+	if err := put(hdr); err != nil {
+		return written, err
+	}
+
+	for _, seg := range head {
+		if err := put(seg); err != nil {
+			return written, err
+		}
+	}
+
+	for _, f := range spooled {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return written, err
+		}
+		if err := bw.Flush(); err != nil {
+			return written, err
+		}
+		n, err := io.Copy(out, f)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// buildRootSegment encodes the VDisc root, V1 struct, fsType, the uris
+// inverted trie and the key ids, all with near pointers. The V1 struct
+// is in the v2 field of the root if v2 is set. Without pageLBAs, the
+// extents are in segment 1, otherwise each page of the paged layout
+// starts at pageLBAs and is in a segment of its own.
+func buildRootSegment(blockSize uint16, fsType string, uris []InvertedTrieNode, keyIDs []string, v2 bool, pageSize uint32, pageLBAs []uint32) []byte {
+	var seg []byte
+	alloc := func(words int) int {
+		idx := len(seg) / 8
+		seg = append(seg, make([]byte, words*8)...)
+		return idx
+	}
+	setWord := func(idx int, v uint64) {
+		binary.LittleEndian.PutUint64(seg[idx*8:], v)
+	}
+	// offset from the word after the pointer at ptrIdx to target
+	offset := func(ptrIdx, target int) int32 {
+		return int32(target - ptrIdx - 1)
+	}
+	setText := func(ptrIdx int, s string) {
+		if s == "" {
+			return
+		}
+		n := len(s) + 1
+		idx := alloc((n + 7) / 8)
+		copy(seg[idx*8:], s)
+		setWord(ptrIdx, listPointer(offset(ptrIdx, idx), 2, uint32(n)))
+	}
+
+	rootPtr := alloc(1)
+	vdisc := alloc(rootPtrWords)
+	v1 := alloc(v1DataWords + v1PtrWords)
+	setWord(rootPtr, structPointer(offset(rootPtr, vdisc), 0, rootPtrWords))
+	field := vdisc
+	if v2 {
+		field++
+	}
+	setWord(field, structPointer(offset(field, v1), v1DataWords, v1PtrWords))
+
+	binary.LittleEndian.PutUint16(seg[v1*8:], blockSize)
+	fsTypePtr := v1 + v1DataWords
+	urisPtr := fsTypePtr + 1
+	extentsPtr := fsTypePtr + 2
+	keyIDsPtr := fsTypePtr + 3
+	pagesPtr := fsTypePtr + 4
+
+	setText(fsTypePtr, fsType)
+
+	elemWords := itrieDataWords + itriePtrWords
+	tag := alloc(1 + len(uris)*elemWords)
+	setWord(urisPtr, listPointer(offset(urisPtr, tag), 7, uint32(len(uris)*elemWords)))
+	setWord(tag, structPointer(int32(len(uris)), itrieDataWords, itriePtrWords))
+	for i, node := range uris {
+		elem := tag + 1 + i*elemWords
+		binary.LittleEndian.PutUint32(seg[elem*8:], uint32(node.Parent))
+		setText(elem+itrieDataWords, node.Content)
+	}
+
+	if len(keyIDs) > 0 {
+		list := alloc(len(keyIDs))
+		setWord(keyIDsPtr, listPointer(offset(keyIDsPtr, list), 6, uint32(len(keyIDs))))
+		for i, id := range keyIDs {
+			setText(list+i, id)
+		}
+	}
+
+	if pageLBAs == nil {
+		setWord(extentsPtr, farPointer(1, 0))
+		return seg
+	}
+
+	binary.LittleEndian.PutUint32(seg[v1*8+4:], pageSize)
+	elemWords = pageDataWords + pagePtrWords
+	tag = alloc(1 + len(pageLBAs)*elemWords)
+	setWord(pagesPtr, listPointer(offset(pagesPtr, tag), 7, uint32(len(pageLBAs)*elemWords)))
+	setWord(tag, structPointer(int32(len(pageLBAs)), pageDataWords, pagePtrWords))
+	for i, lba := range pageLBAs {
+		elem := tag + 1 + i*elemWords
+		binary.LittleEndian.PutUint32(seg[elem*8:], lba)
+		setWord(elem+pageDataWords, farPointer(uint32(i)+1, 0))
+	}
+	return seg
+}
+
+func structPointer(offset int32, dataWords, ptrWords uint16) uint64 {
+	return uint64(uint32(offset)<<2) | uint64(dataWords)<<32 | uint64(ptrWords)<<48
+}
+
+func listPointer(offset int32, elemSize uint8, count uint32) uint64 {
+	return 1 | uint64(uint32(offset)<<2) | uint64(elemSize)<<32 | uint64(count)<<35
+}
+
+func farPointer(segment uint32, padOffset uint32) uint64 {
+	return 2 | uint64(padOffset)<<3 | uint64(segment)<<32
+}
@@ -0,0 +1,160 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+)
+
+// maxOpenExtents bounds the number of extents the image keeps open.
+// An open extent keeps its read-ahead state, seek table and checksum
+// verification between reads. It holds no file handle or goroutine
+// between reads, as each read opens and closes its objects, so the
+// bound is one of memory: a few hundred bytes per extent, plus 16 bytes
+// per frame of the seek table of a compressed object.
+const maxOpenExtents = 16 * 1024
+
+// image reads the blocks of a vdisc from the extents that cover them,
+// finding each through the pages and opening it when it is first read,
+// so that its memory use follows the extents in use rather than the
+// size of the vdisc
+type image struct {
+	v    *vdisc
+	open *lru.Cache
+	pos  int64
+}
+
+func newImage(v *vdisc) *image {
+	open, err := lru.New(maxOpenExtents)
+	if err != nil {
+		panic(err)
+	}
+	return &image{v: v, open: open}
+}
+
+// extent returns the open extent at index i of a page. Extents that
+// fall out of use are dropped without being closed, since a concurrent
+// read may still be using them. Closing one would only mark it closed,
+// so a dropped extent is left to the garbage collector.
+func (img *image) extent(page *extentPage, i int) storage.Object {
+	key := page.index + i
+	if obj, ok := img.open.Get(key); ok {
+		return obj.(storage.Object)
+	}
+
+	obj := img.v.openExtent(page, i)
+	img.open.Add(key, obj)
+	return obj
+}
+
+func (img *image) Size() int64 {
+	return int64(img.v.blocks) * int64(img.v.blockSize)
+}
+
+func (img *image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+
+	size := img.Size()
+	bs := int64(img.v.blockSize)
+	n := 0
+	for n < len(p) && off < size {
+		page, i, err := img.v.locate(iso9660.LogicalBlockAddress(off / bs))
+		if err != nil {
+			return n, err
+		}
+		ext := page.extents.At(page.offset + i)
+		start := int64(page.starts[i]) * bs
+		end := start + int64(ext.Blocks())*bs
+		if end <= off {
+			return n, fmt.Errorf("no extent covers block %d", off/bs)
+		}
+
+		chunk := p[n:]
+		if int64(len(chunk)) > end-off {
+			chunk = chunk[:end-off]
+		}
+
+		// The extent's content is followed by zero padding up to
+		// the end of its last block
+		content := end - int64(ext.Padding()) - off
+		if content > int64(len(chunk)) {
+			content = int64(len(chunk))
+		} else if content < 0 {
+			content = 0
+		}
+		if content > 0 {
+			k, err := img.extent(page, i).ReadAt(chunk[:content], off-start)
+			if int64(k) < content {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return n + k, err
+			}
+			if err != nil && err != io.EOF {
+				return n + k, err
+			}
+		}
+		for j := content; j < int64(len(chunk)); j++ {
+			chunk[j] = 0
+		}
+
+		n += len(chunk)
+		off += int64(len(chunk))
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (img *image) Read(p []byte) (int, error) {
+	n, err := img.ReadAt(p, img.pos)
+	img.pos += int64(n)
+	return n, err
+}
+
+func (img *image) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += img.pos
+	case io.SeekEnd:
+		offset += img.Size()
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	img.pos = offset
+	return offset, nil
+}
+
+// Close forgets the open extents, which are then free to be collected
+func (img *image) Close() error {
+	img.open.Purge()
+	return nil
+}
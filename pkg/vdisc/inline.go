@@ -0,0 +1,201 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/NVIDIA/vdisc/pkg/storage"
+)
+
+// Number of inline files fetched ahead of the one being written
+const inlineWindow = 4 * statConcurrency
+
+// inlineJob is a file whose content is stored with the iso metadata
+type inlineJob struct {
+	url    string
+	offset int64
+	size   int64
+	opts   FileOptions
+	data   []byte
+	err    error
+	done   chan struct{}
+}
+
+// inlineWriter fetches the content of inline files concurrently and
+// writes it to w in the order the files were added, each padded to a
+// whole sector.
+type inlineWriter struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	w       io.Writer
+	work    chan *inlineJob
+	order   chan *inlineJob
+	workers sync.WaitGroup
+	writer  sync.WaitGroup
+	closed  sync.Once
+	written int64
+	err     error
+}
+
+func newInlineWriter(w io.Writer) *inlineWriter {
+	ctx, cancel := context.WithCancel(context.Background())
+	iw := &inlineWriter{
+		ctx:    ctx,
+		cancel: cancel,
+		w:      w,
+		work:   make(chan *inlineJob),
+		order:  make(chan *inlineJob, inlineWindow),
+	}
+
+	iw.workers.Add(statConcurrency)
+	for i := 0; i < statConcurrency; i++ {
+		go func() {
+			defer iw.workers.Done()
+			for job := range iw.work {
+				job.data, job.err = fetchInline(iw.ctx, job)
+				close(job.done)
+			}
+		}()
+	}
+
+	iw.writer.Add(1)
+	go func() {
+		defer iw.writer.Done()
+		for job := range iw.order {
+			<-job.done
+			if iw.err != nil {
+				continue
+			}
+			if job.err != nil {
+				iw.fail(job.err)
+				continue
+			}
+			if err := iw.write(job.data); err != nil {
+				iw.fail(err)
+			}
+		}
+	}()
+
+	return iw
+}
+
+func (iw *inlineWriter) fail(err error) {
+	iw.err = err
+	iw.cancel()
+}
+
+func (iw *inlineWriter) write(data []byte) error {
+	n, err := iw.w.Write(data)
+	iw.written += int64(n)
+	if err != nil {
+		return err
+	}
+
+	padding := sectorsToBytes(bytesToSectors(int64(len(data)))) - int64(len(data))
+	n, err = iw.w.Write(make([]byte, padding))
+	iw.written += int64(n)
+	return err
+}
+
+// Add queues a file of size bytes at offset in the object at url, to
+// be written after every file added before it
+func (iw *inlineWriter) Add(url string, offset int64, size int64, opts FileOptions) error {
+	job := &inlineJob{
+		url:    url,
+		offset: offset,
+		size:   size,
+		opts:   opts,
+		done:   make(chan struct{}),
+	}
+
+	select {
+	case iw.order <- job:
+	case <-iw.ctx.Done():
+		return errors.New("inlining files failed")
+	}
+
+	select {
+	case iw.work <- job:
+	case <-iw.ctx.Done():
+		job.err = iw.ctx.Err()
+		close(job.done)
+	}
+	return nil
+}
+
+// Close waits for every file to be written and returns the number of
+// bytes written
+func (iw *inlineWriter) Close() (int64, error) {
+	iw.closed.Do(func() {
+		close(iw.work)
+		close(iw.order)
+		iw.workers.Wait()
+		iw.writer.Wait()
+		iw.cancel()
+	})
+	return iw.written, iw.err
+}
+
+// fetchInline reads the whole of a small file, checking it against the
+// expected size and checksum
+func fetchInline(ctx context.Context, job *inlineJob) ([]byte, error) {
+	if !job.opts.Version.IsZero() {
+		ctx = storage.CtxWithVersion(ctx, job.opts.Version)
+	}
+
+	obj, err := storage.OpenContextSize(ctx, job.url, job.offset+job.size)
+	if err != nil {
+		return nil, errors.Wrap(err, "open "+job.url)
+	}
+	defer obj.Close()
+
+	data, err := ioutil.ReadAll(io.NewSectionReader(obj, job.offset, job.size))
+	if err != nil {
+		return nil, errors.Wrap(err, "read "+job.url)
+	}
+	if int64(len(data)) != job.size {
+		return nil, fmt.Errorf("%s: read %d bytes, expected %d", job.url, len(data), job.size)
+	}
+
+	if !job.opts.Checksum.IsZero() {
+		actual, err := job.opts.Checksum.Compute(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(actual.Digest, job.opts.Checksum.Digest) {
+			return nil, fmt.Errorf("%s: checksum mismatch: expected %s, got %s", job.url, job.opts.Checksum, actual)
+		}
+	}
+	return data, nil
+}
+
+// inlined reports whether a file of size is stored with the metadata,
+// either because it is small or because inline is set. Zero-filled
+// files are never inlined, since reading them is free, nor are
+// multi-part or compressed ones, whose content is assembled.
+func (cfg *BuilderConfig) inlined(url string, size int64, assembled, inline bool) bool {
+	if _, ok := zeroSize(url); ok || assembled || size < 0 {
+		return false
+	}
+	return inline || (cfg.InlineThreshold > 0 && size <= cfg.InlineThreshold)
+}
@@ -0,0 +1,184 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/NVIDIA/vdisc/pkg/chunkcrypt"
+)
+
+// The most keys a single vdisc may use, since extents refer to them
+// by a one byte index
+const maxKeys = 255
+
+// KeyProvider supplies the keys of encrypted extents
+type KeyProvider interface {
+	// Key returns the AES-256 key with the given id
+	Key(id string) ([]byte, error)
+}
+
+// NewFileKeyProvider returns a KeyProvider reading each key from the
+// file in dir named by its id
+func NewFileKeyProvider(dir string) KeyProvider {
+	return fileKeyProvider(dir)
+}
+
+type fileKeyProvider string
+
+func (dir fileKeyProvider) Key(id string) ([]byte, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return nil, fmt.Errorf("invalid key id %q", id)
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(string(dir), id))
+	if err != nil {
+		return nil, err
+	}
+	return parseKey(id, raw)
+}
+
+// NewEnvKeyProvider returns a KeyProvider reading each key from the
+// environment variable named by prefix and its id, upper cased and with
+// anything other than letters and digits replaced by underscores
+func NewEnvKeyProvider(prefix string) KeyProvider {
+	return envKeyProvider(prefix)
+}
+
+type envKeyProvider string
+
+func (prefix envKeyProvider) Key(id string) ([]byte, error) {
+	name := string(prefix) + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, id)
+
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("key %q: %s is not set", id, name)
+	}
+	return parseKey(id, []byte(value))
+}
+
+// parseKey accepts a key as raw bytes or hex, ignoring surrounding
+// white space
+func parseKey(id string, raw []byte) ([]byte, error) {
+	if len(raw) == chunkcrypt.KeySize {
+		return raw, nil
+	}
+	trimmed := bytes.TrimSpace(raw)
+	key := make([]byte, hex.DecodedLen(len(trimmed)))
+	if _, err := hex.Decode(key, trimmed); err != nil || len(key) != chunkcrypt.KeySize {
+		return nil, fmt.Errorf("key %q is not %d bytes, raw or in hex", id, chunkcrypt.KeySize)
+	}
+	return key, nil
+}
+
+// keyring holds the key ids of a vdisc, in the order of its keyIds,
+// and looks up their ciphers on first use, so that a vdisc can be
+// listed without its keys
+type keyring struct {
+	ids      []string
+	provider KeyProvider
+
+	mu    sync.Mutex
+	aeads []cipher.AEAD
+}
+
+func newKeyring(ids []string, provider KeyProvider) *keyring {
+	return &keyring{
+		ids:      ids,
+		provider: provider,
+		aeads:    make([]cipher.AEAD, len(ids)),
+	}
+}
+
+// id returns the id of the key an extent refers to, or "" for none
+func (kr *keyring) id(key uint8) string {
+	if key == 0 || int(key) > len(kr.ids) {
+		return ""
+	}
+	return kr.ids[key-1]
+}
+
+// aead returns the cipher of the key an extent refers to. Failures
+// aren't remembered, so a key can be supplied after a failed read.
+func (kr *keyring) aead(key uint8) (cipher.AEAD, error) {
+	if key == 0 || int(key) > len(kr.ids) {
+		return nil, fmt.Errorf("invalid key index %d", key)
+	}
+	id := kr.ids[key-1]
+	if kr.provider == nil {
+		return nil, fmt.Errorf("no key provider for key %q", id)
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if kr.aeads[key-1] == nil {
+		k, err := kr.provider.Key(id)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := chunkcrypt.NewAEAD(k)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", id, err)
+		}
+		kr.aeads[key-1] = aead
+	}
+	return kr.aeads[key-1], nil
+}
+
+// keyIndex numbers key ids in the order extents first use them, as
+// recorded in an extent's key
+type keyIndex struct {
+	ids     []string
+	indices map[string]uint8
+}
+
+// get returns the key of an extent encrypted with the key id, or zero
+// if id is empty
+func (ki *keyIndex) get(id string) (uint8, error) {
+	if id == "" {
+		return 0, nil
+	}
+	if key, ok := ki.indices[id]; ok {
+		return key, nil
+	}
+	if len(ki.ids) == maxKeys {
+		return 0, fmt.Errorf("too many keys for a single vdisc: %d", maxKeys+1)
+	}
+	if ki.indices == nil {
+		ki.indices = make(map[string]uint8)
+	}
+
+	ki.ids = append(ki.ids, id)
+	key := uint8(len(ki.ids))
+	ki.indices[id] = key
+	return key, nil
+}
@@ -18,7 +18,11 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"math"
@@ -43,107 +47,287 @@ type VDisc interface {
 	Image() storage.AnonymousObject
 	OpenExtent(lba iso9660.LogicalBlockAddress) (storage.Object, error)
 	ExtentURL(lba iso9660.LogicalBlockAddress) (string, error)
+	StatExtent(lba iso9660.LogicalBlockAddress) (ExtentInfo, error)
+	VisitExtents(visit func(ExtentInfo) error) error
 }
 
-func Load(url string, cache caching.Cache) (VDisc, error) {
+// ExtentInfo describes a single extent of a vdisc
+type ExtentInfo struct {
+	Index    int
+	LBA      iso9660.LogicalBlockAddress
+	URL      string
+	Blocks   uint32
+	Padding  uint16
+	Size     int64
+	Ranged   bool
+	Offset   int64
+	Checksum Checksum
+	Version  storage.Version
+
+	// Compression is the format of a compressed object, whose size
+	// is CompressedSize. Size is that of its decompressed content.
+	Compression    Compression
+	CompressedSize int64
+
+	// KeyID is the id of the key an encrypted object is encrypted
+	// with. Size is that of its plaintext.
+	KeyID string
+
+	// Parts lists every object of a multi-part extent, starting with
+	// the one at URL. It is empty for an extent with a single object.
+	Parts []PartInfo
+}
+
+// PartInfo describes one of the objects of a multi-part extent
+type PartInfo struct {
+	URL     string
+	Size    int64
+	Version storage.Version
+}
+
+// LoadOptions are optional settings for Load
+type LoadOptions struct {
+	// VerifyChecksums checks each extent against its recorded
+	// checksum before serving reads, failing with EIO on a mismatch.
+	VerifyChecksums bool
+
+	// Keys supplies the keys of encrypted extents, each looked up on
+	// its first read. Without it, reads of encrypted extents fail.
+	Keys KeyProvider
+
+	// TrustedKeys, when not empty, makes Load refuse a vdisc unless
+	// it is signed by one of these keys and unchanged since. The
+	// message and the isohdr of such a vdisc are read whole and
+	// verified before they are parsed, and then served from memory.
+	TrustedKeys []crypto.PublicKey
+
+	// whole reads the message and the isohdr into memory, so that
+	// their digests cover exactly the bytes served
+	whole bool
+}
+
+func Load(url string, cache caching.Cache, options ...LoadOptions) (VDisc, error) {
+	var opts LoadOptions
+	if len(options) > 0 {
+		opts = options[0]
+	}
+
 	baseURL, err := stdurl.Parse(url)
 	if err != nil {
 		return nil, err
 	}
 
-	raw, mmapHandle, err := downloadMemoryMapped(url)
-	if err != nil {
-		return nil, err
+	var sig *Signature
+	var key crypto.PublicKey
+	if len(opts.TrustedKeys) > 0 {
+		if sig, key, err = readTrustedSignature(url, opts.TrustedKeys); err != nil {
+			return nil, err
+		}
+		opts.whole = true
 	}
 
-	msg, err := capnp.Unmarshal(raw)
+	obj, err := storage.Open(url)
 	if err != nil {
-		mmapHandle.Close()
 		return nil, err
 	}
-	msg.TraverseLimit = math.MaxUint64
 
-	root, err := vdisc_types.ReadRootVDisc(msg)
-	if err != nil {
-		mmapHandle.Close()
+	// A gzip compressed vdisc is downloaded whole, and any other is
+	// read a segment at a time unless it is loaded whole
+	var hdr [4]byte
+	if err := readFull(obj, hdr[:], 0); err != nil {
+		obj.Close()
 		return nil, err
 	}
 
-	v1, err := root.V1()
-	if err != nil {
-		mmapHandle.Close()
-		return nil, err
+	v := &vdisc{
+		cache:   cache,
+		baseURL: baseURL,
+		verify:  opts.VerifyChecksums,
 	}
+	var msg *capnp.Message
+	if gzipped := bytes.Equal(hdr[:], gzipHeader); gzipped || opts.whole {
+		var h hash.Hash
+		if opts.whole {
+			h = sha256.New()
+		}
+		raw, mmapHandle, err := downloadMemoryMapped(obj, gzipped, h)
+		obj.Close()
+		if err != nil {
+			return nil, err
+		}
+		v.raw = raw
+		v.msgCloser = mmapHandle
 
-	fstype, err := v1.FsType()
-	if err != nil {
-		mmapHandle.Close()
+		// Nothing of a signed vdisc is parsed before its message is
+		// known to be the one signed
+		if opts.whole {
+			v.messageDigest = h.Sum(nil)
+		}
+		if sig != nil {
+			if err := sig.verify(url, key, v.messageDigest); err != nil {
+				mmapHandle.Close()
+				return nil, err
+			}
+		}
+
+		if gzipped {
+			msg, err = capnp.Unmarshal(raw)
+		} else {
+			// The paged layout has more segments than Unmarshal
+			// accepts
+			var arena *lazyArena
+			if arena, err = newLazyArena(newMemoryObject(raw)); err == nil {
+				v.arena = arena
+				msg = &capnp.Message{Arena: arena}
+			}
+		}
+		if err != nil {
+			mmapHandle.Close()
+			return nil, err
+		}
+		msg.TraverseLimit = validationReadFactor * uint64(len(raw))
+	} else {
+		arena, err := newLazyArena(cache.WithCaching(obj))
+		if err != nil {
+			obj.Close()
+			return nil, err
+		}
+		v.arena = arena
+		v.msgCloser = arena
+
+		msg = &capnp.Message{
+			Arena:         arena,
+			TraverseLimit: validationReadFactor * uint64(obj.Size()),
+		}
+	}
+	v.msg = msg
+
+	if err := v.load(opts.Keys); err != nil {
+		v.msgCloser.Close()
 		return nil, err
 	}
 
-	blockSize := v1.BlockSize()
+	// Extents are read again on every access from now on, which would
+	// eventually exhaust any fixed limit, and the validated message
+	// can't amplify reads
+	msg.ReadLimiter().Reset(math.MaxUint64)
+
+	if opts.whole {
+		if err := v.loadIsohdr(); err != nil {
+			v.Close()
+			return nil, err
+		}
+		if sig != nil && hex.EncodeToString(v.isohdrDigest) != sig.IsohdrSHA256 {
+			v.Close()
+			return nil, fmt.Errorf("%s does not match its signature", url)
+		}
+	}
+
+	if v.fsType == "iso9660" {
+		if err := checkVolumeSize(v.image, v.blockSize, v.blocks); err != nil {
+			v.Close()
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
 
-	var parts []storage.AnonymousObject
+// loadIsohdr reads the isohdr object, which holds the directories and
+// inline files, into memory, where the image serves it from
+func (v *vdisc) loadIsohdr() error {
+	ext := v.newExtent(v.pages[0], 0)
+	defer ext.Close()
 
-	uris, err := v1.Uris()
+	h := sha256.New()
+	data, closer, err := downloadMemoryMapped(ext, false, h)
 	if err != nil {
-		mmapHandle.Close()
-		return nil, err
+		return fmt.Errorf("reading %s: %v", ext.URL(), err)
+	}
+	if int64(len(data)) != ext.Size() {
+		closer.Close()
+		return fmt.Errorf("reading %s: %d bytes, expected %d", ext.URL(), len(data), ext.Size())
 	}
+	v.isohdr = data
+	v.isohdrCloser = closer
+	v.isohdrDigest = h.Sum(nil)
+	return nil
+}
 
-	extents, err := v1.Extents()
+// load reads and validates the message of a vdisc, and the pages of
+// extents it needs right away
+func (v *vdisc) load(keyProvider KeyProvider) error {
+	v1, err := readRoot(v.msg)
 	if err != nil {
-		mmapHandle.Close()
-		return nil, err
+		return err
 	}
 
-	extentIndices := make(map[iso9660.LogicalBlockAddress]int)
-	pos := iso9660.LogicalBlockAddress(0)
-	for i := 0; i < extents.Len(); i++ {
-		extentIndices[pos] = i
+	if v.fsType, err = v1.FsType(); err != nil {
+		return err
+	}
 
-		ext := extents.At(i)
-		blocks := ext.Blocks()
-		padding := ext.Padding()
-		if blocks == 0 {
-			continue
-		}
+	v.blockSize = v1.BlockSize()
 
-		var obj storage.Object
-		obj = &extent{
-			blockSize: blockSize,
-			baseURL:   baseURL,
-			uris:      uris,
-			extents:   extents,
-			idx:       i,
-		}
+	if v.uris, err = v1.Uris(); err != nil {
+		return err
+	}
 
-		obj = cache.WithCaching(obj)
+	keyIDs, err := loadKeyIDs(v1)
+	if err != nil {
+		return err
+	}
+	v.keys = newKeyring(keyIDs, keyProvider)
 
-		parts = append(parts, obj)
-		if padding > 0 {
-			padObj, err := storage.Open(fmt.Sprintf("zero:%d", padding))
-			if err != nil {
-				mmapHandle.Close()
-				return nil, err
-			}
-			parts = append(parts, padObj)
+	if v.validator, err = newValidator(v.blockSize, v.uris, keyIDs); err != nil {
+		return err
+	}
+
+	if v1.HasExtentPages() {
+		err = v.loadPages(v1)
+	} else {
+		var extents vdisc_types_v1.Extent_List
+		if extents, err = v1.Extents(); err == nil {
+			err = v.splitPages(extents, defaultExtentPageSize)
 		}
+	}
+	if err != nil {
+		return err
+	}
 
-		pos += iso9660.LogicalBlockAddress(blocks)
+	if first := v.pages[0]; first.count > 0 {
+		v.metaBlocks = first.extents.At(first.offset).Blocks()
 	}
+	v.image = newImage(v)
+	return nil
+}
 
-	return &vdisc{
-		cache:         cache,
-		baseURL:       baseURL,
-		fsType:        fstype,
-		blockSize:     blockSize,
-		image:         storage.Concat(parts...),
-		uris:          uris,
-		extents:       extents,
-		extentIndices: extentIndices,
-		mmapHandle:    mmapHandle,
-	}, nil
+// readRoot returns the disc image of a vdisc message, which is in the
+// v2 field if it uses features that v1 readers would misread
+func readRoot(msg *capnp.Message) (vdisc_types_v1.VDisc, error) {
+	root, err := vdisc_types.ReadRootVDisc(msg)
+	if err != nil {
+		return vdisc_types_v1.VDisc{}, err
+	}
+	if root.HasV2() {
+		return root.V2()
+	}
+	return root.V1()
+}
+
+// loadKeyIDs reads the ids of the keys of a vdisc's encrypted extents
+func loadKeyIDs(v1 vdisc_types_v1.VDisc) ([]string, error) {
+	list, err := v1.KeyIds()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, list.Len())
+	for i := range ids {
+		if ids[i], err = list.At(i); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
 }
 
 type mmapCloser struct {
@@ -164,29 +348,24 @@ func (mc *mmapCloser) Close() error {
 	return syscall.Munmap(data)
 }
 
-func downloadMemoryMapped(url string) ([]byte, io.Closer, error) {
-	res, err := storage.Open(url)
-	if err != nil {
-		return nil, nil, err
-	}
+var gzipHeader = []byte{0x1f, 0x8b, 0x08, 0x00}
 
+// downloadMemoryMapped copies an object, decompressing it if it is
+// gzip compressed, to a temporary file and maps it into memory. If h
+// isn't nil, the copy is also written to h.
+func downloadMemoryMapped(res storage.AnonymousObject, gzipped bool, h hash.Hash) ([]byte, io.Closer, error) {
 	r := io.NewSectionReader(res, 0, res.Size())
 
 	brSize := res.Size()
 	if brSize > 67108864 {
 		brSize = 67108864
 	}
-	br := bufio.NewReaderSize(r, int(brSize))
-	hdr, err := br.Peek(4)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	var src io.Reader
-	if bytes.Equal(hdr, []byte{0x1f, 0x8b, 0x08, 0x00}) {
-		src, _ = gzip.NewReader(br)
-	} else {
-		src = br
+	var src io.Reader = bufio.NewReaderSize(r, int(brSize))
+	if gzipped {
+		var err error
+		if src, err = gzip.NewReader(src); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	dst, err := ioutil.TempFile("", "vdisc.")
@@ -196,10 +375,17 @@ func downloadMemoryMapped(url string) ([]byte, io.Closer, error) {
 	defer dst.Close()
 	os.Remove(dst.Name())
 
-	n, err := io.Copy(dst, src)
+	var w io.Writer = dst
+	if h != nil {
+		w = io.MultiWriter(dst, h)
+	}
+	n, err := io.Copy(w, io.LimitReader(src, maxMessageSize+1))
 	if err != nil {
 		return nil, nil, err
 	}
+	if n > maxMessageSize {
+		return nil, nil, validationError("larger than %d bytes", int64(maxMessageSize))
+	}
 
 	data, err := syscall.Mmap(int(dst.Fd()), 0, int(n), syscall.PROT_READ, syscall.MAP_SHARED)
 	if err != nil {
@@ -210,23 +396,52 @@ func downloadMemoryMapped(url string) ([]byte, io.Closer, error) {
 }
 
 type vdisc struct {
-	cache         caching.Cache
-	baseURL       *stdurl.URL
-	fsType        string
-	blockSize     uint16
-	image         storage.AnonymousObject
-	uris          vdisc_types_v1.ITrie_List
-	extents       vdisc_types_v1.Extent_List
-	extentIndices map[iso9660.LogicalBlockAddress]int
-	mmapHandle    io.Closer
+	cache     caching.Cache
+	baseURL   *stdurl.URL
+	fsType    string
+	blockSize uint16
+	blocks    uint32
+	image     *image
+	uris      vdisc_types_v1.ITrie_List
+	keys      *keyring
+	validator *validator
+	verify    bool
+
+	// pages holds the extents in order. Pages of the paged layout
+	// are loaded on first use, and the extents of any other vdisc
+	// are split into pages once loaded.
+	pages      []*extentPage
+	pageSize   int
+	metaBlocks uint32
+
+	// The message is either read into raw or read lazily through
+	// arena, or both if the paged layout is loaded whole
+	msg       *capnp.Message
+	raw       []byte
+	arena     *lazyArena
+	msgCloser io.Closer
+
+	// A vdisc loaded whole also holds its isohdr in memory, and the
+	// digests of both
+	isohdr        []byte
+	isohdrCloser  io.Closer
+	messageDigest []byte
+	isohdrDigest  []byte
 }
 
 func (v *vdisc) Close() error {
-	if err := v.image.Close(); err != nil {
-		return err
+	if v.image != nil {
+		if err := v.image.Close(); err != nil {
+			return err
+		}
+	}
+	if v.isohdrCloser != nil {
+		if err := v.isohdrCloser.Close(); err != nil {
+			return err
+		}
 	}
 
-	return v.mmapHandle.Close()
+	return v.msgCloser.Close()
 }
 
 func (v *vdisc) FsType() string {
@@ -240,36 +455,235 @@ func (v *vdisc) Image() storage.AnonymousObject {
 	return v.image
 }
 
+// newExtent returns the extent at index idx of a loaded page
+func (v *vdisc) newExtent(page *extentPage, idx int) *extent {
+	return &extent{
+		blockSize: v.blockSize,
+		baseURL:   v.baseURL,
+		uris:      v.uris,
+		extents:   page.extents,
+		keys:      v.keys,
+		idx:       page.offset + idx,
+	}
+}
+
+// lookup finds the extent that starts at lba, returning a nil page if
+// there is none
+func (v *vdisc) lookup(lba iso9660.LogicalBlockAddress) (*extentPage, int, error) {
+	page, idx, err := v.locate(lba)
+	if err != nil || page == nil || idx < 0 || page.starts[idx] != uint32(lba) {
+		return nil, 0, err
+	}
+	return page, idx, nil
+}
+
 func (v *vdisc) OpenExtent(lba iso9660.LogicalBlockAddress) (storage.Object, error) {
-	idx, ok := v.extentIndices[lba]
-	if !ok {
+	page, idx, err := v.lookup(lba)
+	if err != nil {
+		return nil, err
+	}
+	if page == nil {
+		// Inline files are read through the image, so they share
+		// the cache or in-memory copy of the metadata extent
+		if v.isInline(lba) {
+			first := v.pages[0]
+			meta := first.extents.At(first.offset)
+			end := int64(meta.Blocks())*int64(v.blockSize) - int64(meta.Padding())
+			off := int64(lba) * int64(v.blockSize)
+			url, _ := v.ExtentURL(0)
+			return storage.WithURL(storage.Slice(nopCloser{v.image}, off, end-off), url), nil
+		}
 		return nil, fmt.Errorf("unable to open file: invalid extent - %d", lba)
 	}
 
-	var obj storage.Object
-	obj = &extent{
-		blockSize: v.blockSize,
-		baseURL:   v.baseURL,
-		uris:      v.uris,
-		extents:   v.extents,
-		idx:       idx,
+	return v.openExtent(page, idx), nil
+}
+
+// openExtent opens the extent at index idx of a loaded page. The
+// isohdr of a vdisc loaded whole is served from memory.
+func (v *vdisc) openExtent(page *extentPage, idx int) storage.Object {
+	e := v.newExtent(page, idx)
+	if v.isohdr != nil && page.index+idx == 0 {
+		return storage.WithURL(newMemoryObject(v.isohdr), e.URL())
+	}
+	return openExtent(e, v.cache, v.verify)
+}
+
+// openExtent applies caching and, if verify is set, checksum
+// verification to e. The cache is keyed on the object URL and pinned
+// version, so a ranged extent caches its object as a whole and reads
+// the range from that, and a multi-part extent caches each part.
+// Zero-filled objects are never cached, compressed ones are cached
+// decompressed, apart from the object as stored, and encrypted ones are
+// cached as ciphertext and decrypted above the cache. Checksums are
+// verified above the cache, so verifying an extent fills the cache
+// with it.
+func openExtent(e *extent, cache caching.Cache, verify bool) storage.Object {
+	e.resolve()
+	if parts := e.Parts(); parts != nil {
+		// Each part is cached under its own URL
+		objs := make([]storage.AnonymousObject, len(parts))
+		for i, part := range parts {
+			obj := openPart(part)
+			if _, zero := zeroSize(part.URL); !zero {
+				obj = cache.WithCaching(obj)
+			}
+			objs[i] = obj
+		}
+		obj := storage.WithURL(storage.Concat(objs...), e.URL())
+		if verify {
+			obj = withVerification(obj, e.Checksum())
+		}
+		return obj
+	}
+
+	if key := e.extents.At(e.idx).Key(); key != 0 {
+		stored := *e
+		stored.ciphertext = true
+		obj := openDecrypted(e, key, cache.WithCaching(&stored))
+		if verify {
+			obj = withVerification(obj, e.Checksum())
+		}
+		return obj
+	}
+
+	if e.Compression() != CompressionNone {
+		e.table = &seekTable{}
+	}
+
+	_, zero := zeroSize(e.URL())
+	if zero || !e.Ranged() {
+		var obj storage.Object = e
+		if !zero {
+			obj = cache.WithCaching(obj)
+		}
+		if verify {
+			obj = withVerification(obj, e.Checksum())
+		}
+		return obj
 	}
 
-	return v.cache.WithCaching(obj), nil
+	containing := *e
+	containing.containing = true
+	cached := cache.WithCaching(&containing)
+	obj := storage.WithURL(storage.Slice(cached, e.Offset(), e.Size()), e.URL())
+	if verify {
+		obj = withVerification(obj, e.Checksum())
+	}
+	return obj
 }
 
 func (v *vdisc) ExtentURL(lba iso9660.LogicalBlockAddress) (string, error) {
-	idx, ok := v.extentIndices[lba]
-	if !ok {
-		return "", fmt.Errorf("unable to open file: invalid extent - %d", lba)
+	page, idx, err := v.lookup(lba)
+	if err != nil {
+		return "", err
+	}
+	if page == nil {
+		if !v.isInline(lba) {
+			return "", fmt.Errorf("unable to open file: invalid extent - %d", lba)
+		}
+		page = v.pages[0]
 	}
+	return v.newExtent(page, idx).URL(), nil
+}
 
-	ext := &extent{
-		blockSize: v.blockSize,
-		baseURL:   v.baseURL,
-		uris:      v.uris,
-		extents:   v.extents,
-		idx:       idx,
+// StatExtent describes the extent that starts at lba. The extent of an
+// inline file is the range of the metadata extent from lba on.
+func (v *vdisc) StatExtent(lba iso9660.LogicalBlockAddress) (ExtentInfo, error) {
+	page, idx, err := v.lookup(lba)
+	if err != nil {
+		return ExtentInfo{}, err
+	}
+	if page != nil {
+		return v.extentInfo(page, idx, lba), nil
+	}
+	if !v.isInline(lba) {
+		return ExtentInfo{}, fmt.Errorf("unable to open file: invalid extent - %d", lba)
+	}
+
+	meta := v.extentInfo(v.pages[0], 0, 0)
+	off := int64(lba) * int64(v.blockSize)
+	return ExtentInfo{
+		LBA:     lba,
+		URL:     meta.URL,
+		Blocks:  meta.Blocks - uint32(lba),
+		Padding: meta.Padding,
+		Size:    meta.Size - off,
+		Ranged:  true,
+		Offset:  off,
+		Version: meta.Version,
+	}, nil
+}
+
+// extentInfo describes the extent at index idx of a loaded page, which
+// starts at lba
+func (v *vdisc) extentInfo(page *extentPage, idx int, lba iso9660.LogicalBlockAddress) ExtentInfo {
+	ext := v.newExtent(page, idx)
+	entry := page.extents.At(page.offset + idx)
+	return ExtentInfo{
+		Index:    page.index + idx,
+		LBA:      lba,
+		URL:      ext.URL(),
+		Blocks:   entry.Blocks(),
+		Padding:  entry.Padding(),
+		Size:     ext.Size(),
+		Ranged:   ext.Ranged(),
+		Offset:   ext.Offset(),
+		Checksum: ext.Checksum(),
+		Version:  ext.Version(),
+		Parts:    ext.Parts(),
+
+		Compression:    ext.Compression(),
+		CompressedSize: ext.CompressedSize(),
+		KeyID:          ext.KeyID(),
+	}
+}
+
+// isInline reports whether lba is within the metadata extent, where
+// the builder stores inline files
+func (v *vdisc) isInline(lba iso9660.LogicalBlockAddress) bool {
+	return uint32(lba) < v.metaBlocks
+}
+
+// memoryObject serves an object held in memory
+type memoryObject struct {
+	*bytes.Reader
+}
+
+func newMemoryObject(data []byte) storage.AnonymousObject {
+	return memoryObject{bytes.NewReader(data)}
+}
+
+func (memoryObject) Close() error {
+	return nil
+}
+
+// nopCloser keeps the image open when a file read through it is closed
+type nopCloser struct {
+	storage.AnonymousObject
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// VisitExtents calls visit for every extent in the vdisc in LBA order
+func (v *vdisc) VisitExtents(visit func(ExtentInfo) error) error {
+	for p := range v.pages {
+		page, err := v.loadPage(p, false)
+		if err != nil {
+			return err
+		}
+
+		pos := page.lba
+		for i := 0; i < page.count; i++ {
+			info := v.extentInfo(page, i, pos)
+			if err := visit(info); err != nil {
+				return err
+			}
+
+			pos += iso9660.LogicalBlockAddress(info.Blocks)
+		}
 	}
-	return ext.URL(), nil
+	return nil
 }
@@ -0,0 +1,341 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+
+	capnp "zombiezen.com/go/capnproto2"
+
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+	"github.com/NVIDIA/vdisc/pkg/vdisc/types/v1"
+)
+
+// extentPage is a run of consecutive extents, the first of which has
+// index index and starts at lba. Its extents start at offset in the
+// list they are stored in.
+type extentPage struct {
+	lba    iso9660.LogicalBlockAddress
+	blocks uint32
+	index  int
+
+	mu      sync.Mutex
+	loaded  bool
+	extents vdisc_types_v1.Extent_List
+	offset  int
+	count   int
+
+	// starts holds the address of each extent, from their block
+	// counts, once the page is used
+	starts []uint32
+}
+
+// splitPages divides the extents of a vdisc without pages into pages
+// of pageSize, validating each as it goes. Every page is loaded, and
+// indexed on first use.
+func (v *vdisc) splitPages(extents vdisc_types_v1.Extent_List, pageSize int) error {
+	v.pageSize = pageSize
+
+	var lba uint64
+	for offset := 0; offset == 0 || offset < extents.Len(); offset += pageSize {
+		count := extents.Len() - offset
+		if count > pageSize {
+			count = pageSize
+		}
+
+		blocks, err := v.validator.checkExtents(extents, offset, count, offset)
+		if err != nil {
+			return err
+		}
+
+		v.pages = append(v.pages, &extentPage{
+			lba:     iso9660.LogicalBlockAddress(lba),
+			blocks:  blocks,
+			index:   offset,
+			loaded:  true,
+			extents: extents,
+			offset:  offset,
+			count:   count,
+		})
+
+		lba += uint64(blocks)
+		if lba > math.MaxUint32 {
+			return validationError("extents exceed %d blocks", uint64(math.MaxUint32))
+		}
+	}
+	v.blocks = uint32(lba)
+	return nil
+}
+
+// loadPages reads the list of pages of a vdisc in the paged layout. The
+// first page, which holds the metadata extent, and the last, which
+// ends the volume, are loaded right away and every other page on
+// first use.
+func (v *vdisc) loadPages(v1 vdisc_types_v1.VDisc) error {
+	list, err := v1.ExtentPages()
+	if err != nil {
+		return err
+	}
+	if list.Len() == 0 {
+		return validationError("no extent pages")
+	}
+	if v.pageSize = int(v1.ExtentPageSize()); v.pageSize == 0 {
+		return validationError("extent page size is zero")
+	}
+
+	v.pages = make([]*extentPage, list.Len())
+	for p := range v.pages {
+		lba := list.At(p).FirstLba()
+		if p == 0 && lba != 0 {
+			return validationError("extent page 0 starts at block %d", lba)
+		}
+		if p > 0 {
+			prev := v.pages[p-1]
+			if lba < uint32(prev.lba) {
+				return validationError("extent page %d starts before extent page %d", p, p-1)
+			}
+			prev.blocks = lba - uint32(prev.lba)
+		}
+		v.pages[p] = &extentPage{
+			lba:   iso9660.LogicalBlockAddress(lba),
+			index: p * v.pageSize,
+		}
+	}
+
+	last := v.pages[len(v.pages)-1]
+	if _, err := v.page(len(v.pages) - 1); err != nil {
+		return err
+	}
+	v.blocks = uint32(last.lba) + last.blocks
+
+	_, err = v.page(0)
+	return err
+}
+
+// page returns a page of extents, loading and indexing it on first use
+func (v *vdisc) page(p int) (*extentPage, error) {
+	return v.loadPage(p, true)
+}
+
+// loadPage returns a page of extents, loading it on first use, and
+// indexing it too if index is set
+func (v *vdisc) loadPage(p int, index bool) (*extentPage, error) {
+	page := v.pages[p]
+	page.mu.Lock()
+	defer page.mu.Unlock()
+
+	if !page.loaded {
+		extents, err := v.readPage(p)
+		if err != nil {
+			return nil, err
+		}
+		page.extents = extents
+		page.count = extents.Len()
+		page.loaded = true
+	}
+
+	if index && page.starts == nil {
+		page.starts = make([]uint32, page.count)
+		pos := uint32(page.lba)
+		for i := range page.starts {
+			page.starts[i] = pos
+			pos += page.extents.At(page.offset + i).Blocks()
+		}
+	}
+	return page, nil
+}
+
+// readPage reads and validates a page of the paged layout
+func (v *vdisc) readPage(p int) (vdisc_types_v1.Extent_List, error) {
+	page := v.pages[p]
+
+	// The page is read before the message needs it, since the
+	// message is locked while it reads a segment
+	root, err := v.msg.Arena.Data(0)
+	if err != nil {
+		return vdisc_types_v1.Extent_List{}, err
+	}
+	data, err := v.msg.Arena.Data(capnp.SegmentID(p + 1))
+	if err != nil {
+		return vdisc_types_v1.Extent_List{}, fmt.Errorf("reading extent page %d: %v", p, err)
+	}
+
+	// It is validated through a message of its own, so that its read
+	// limit doesn't depend on reads of other pages
+	check := &capnp.Message{
+		Arena:         v.msg.Arena,
+		TraverseLimit: validationReadFactor * uint64(len(root)+len(data)),
+	}
+	extents, err := pageExtents(check, p)
+	if err != nil {
+		return vdisc_types_v1.Extent_List{}, validationError("extent page %d: %v", p, err)
+	}
+
+	isLast := p == len(v.pages)-1
+	n := extents.Len()
+	if n > v.pageSize || (!isLast && n != v.pageSize) {
+		return vdisc_types_v1.Extent_List{}, validationError("extent page %d has %d extents, expected %d", p, n, v.pageSize)
+	}
+
+	blocks, err := v.validator.checkExtents(extents, 0, n, page.index)
+	if err != nil {
+		return vdisc_types_v1.Extent_List{}, err
+	}
+	if isLast {
+		if uint64(page.lba)+uint64(blocks) > math.MaxUint32 {
+			return vdisc_types_v1.Extent_List{}, validationError("extents exceed %d blocks", uint64(math.MaxUint32))
+		}
+		page.blocks = blocks
+	} else if blocks != page.blocks {
+		return vdisc_types_v1.Extent_List{}, validationError("extent page %d has %d blocks, expected %d", p, blocks, page.blocks)
+	}
+
+	return pageExtents(v.msg, p)
+}
+
+// pageExtents reads the extents of page p from msg
+func pageExtents(msg *capnp.Message, p int) (vdisc_types_v1.Extent_List, error) {
+	v1, err := readRoot(msg)
+	if err != nil {
+		return vdisc_types_v1.Extent_List{}, err
+	}
+	pages, err := v1.ExtentPages()
+	if err != nil {
+		return vdisc_types_v1.Extent_List{}, err
+	}
+	return pages.At(p).Extents()
+}
+
+// locate finds the page and the index within it of the last extent
+// that starts at or before lba, which is the extent that covers lba
+// unless lba is past the end of the volume
+func (v *vdisc) locate(lba iso9660.LogicalBlockAddress) (*extentPage, int, error) {
+	p := sort.Search(len(v.pages), func(i int) bool {
+		return v.pages[i].lba > lba
+	}) - 1
+	if p < 0 {
+		return nil, -1, nil
+	}
+
+	page, err := v.page(p)
+	if err != nil {
+		return nil, -1, err
+	}
+	i := sort.Search(len(page.starts), func(i int) bool {
+		return page.starts[i] > uint32(lba)
+	}) - 1
+	return page, i, nil
+}
+
+// writePaged writes the vdisc v1 in the paged layout, with pageSize
+// extents per page. uris and keyIDs are those of v1, as the builder
+// holds them.
+func writePaged(out io.Writer, v1 vdisc_types_v1.VDisc, uris []InvertedTrieNode, keyIDs []string, pageSize int, tmpDir string) error {
+	fsType, err := v1.FsType()
+	if err != nil {
+		return err
+	}
+	extents, err := v1.Extents()
+	if err != nil {
+		return err
+	}
+
+	w, err := newExtentWriter(tmpDir, pageSize)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	for i := 0; i < extents.Len(); i++ {
+		e, err := entryFromExtent(extents.At(i))
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			err = w.SetFirst(e)
+		} else {
+			err = w.Append(e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.WriteTo(out, v1.BlockSize(), fsType, uris, keyIDs)
+	return err
+}
+
+// entryFromExtent decodes an extent to be encoded again by an
+// extentWriter
+func entryFromExtent(ext vdisc_types_v1.Extent) (*extentEntry, error) {
+	e := &extentEntry{
+		uriPrefix:      ext.UriPrefix(),
+		blocks:         ext.Blocks(),
+		padding:        ext.Padding(),
+		ranged:         ext.Ranged(),
+		offset:         int64(ext.Offset()),
+		compression:    ext.Compression(),
+		compressedSize: int64(ext.CompressedSize()),
+		key:            ext.Key(),
+	}
+
+	var err error
+	if e.uriSuffix, err = ext.UriSuffix(); err != nil {
+		return nil, err
+	}
+	if e.version, err = readVersion(ext.Etag, ext.VersionId); err != nil {
+		return nil, err
+	}
+	if alg := ext.ChecksumAlgorithm(); alg != ChecksumNone {
+		digest, err := ext.Checksum()
+		if err != nil {
+			return nil, err
+		}
+		e.checksum = Checksum{Algorithm: alg, Digest: append([]byte(nil), digest...)}
+	}
+
+	parts, err := ext.Parts()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < parts.Len(); i++ {
+		part := parts.At(i)
+		p := extentPart{
+			uriPrefix: part.UriPrefix(),
+			size:      int64(part.Size()),
+		}
+		if p.uriSuffix, err = part.UriSuffix(); err != nil {
+			return nil, err
+		}
+		if p.version, err = readVersion(part.Etag, part.VersionId); err != nil {
+			return nil, err
+		}
+		e.parts = append(e.parts, p)
+	}
+	return e, nil
+}
+
+func readVersion(etag, versionID func() (string, error)) (v storage.Version, err error) {
+	if v.ETag, err = etag(); err != nil {
+		return
+	}
+	v.VersionID, err = versionID()
+	return
+}
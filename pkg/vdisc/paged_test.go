@@ -0,0 +1,266 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_test
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+func TestPagedLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var paths, urls []string
+	for i := 0; i < 30; i++ {
+		url := filepath.Join(dir, "objects", fmt.Sprintf("file%02d", i))
+		if err := os.MkdirAll(filepath.Dir(url), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(url, []byte(strings.Repeat("x", i*300)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, fmt.Sprintf("d%d/file%02d", i%3, i))
+		urls = append(urls, url)
+	}
+	joined := string(readFile(t, urls[7])) + string(readFile(t, urls[8]))
+	checksum, err := vdisc.ParseChecksum(fmt.Sprintf("md5:%x", md5.Sum([]byte(joined))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	epoch := time.Unix(1500000000, 0).UTC()
+	burn := func(name string, layout vdisc.Layout, streaming bool) string {
+		b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{
+			URL:             filepath.Join(dir, name+".vdisc"),
+			SourceDateEpoch: &epoch,
+			Streaming:       streaming,
+			Layout:          layout,
+			PageExtents:     4,
+		})
+		for i := range urls {
+			if err := b.AddFile(paths[i], urls[i], -1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.AddFileParts("joined", urls[7:9], []int64{-1, -1}, vdisc.FileOptions{Checksum: checksum}); err != nil {
+			t.Fatal(err)
+		}
+		url, err := b.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return url
+	}
+
+	extents := func(v vdisc.VDisc) ([]string, error) {
+		var result []string
+		err := v.VisitExtents(func(ext vdisc.ExtentInfo) error {
+			url := strings.TrimPrefix(ext.URL, dir)
+			result = append(result, fmt.Sprintf("%d %d %s %d %d %v %d", ext.Index, ext.LBA, url, ext.Blocks, ext.Padding, ext.Checksum, len(ext.Parts)))
+			return nil
+		})
+		return result, err
+	}
+
+	gz, err := vdisc.Load(burn("gzip", vdisc.LayoutGzip, false), caching.NopCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gz.Close()
+	expected, err := extents(gz)
+	assert.Nil(t, err)
+
+	var lazy string
+	for _, streaming := range []bool{false, true} {
+		url := burn(fmt.Sprintf("paged-%v", streaming), vdisc.LayoutPaged, streaming)
+		lazy = url
+
+		slicer, err := caching.NewMemorySlicer(4096, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := vdisc.Load(url, caching.NewCache(slicer, 0, 0), vdisc.LoadOptions{VerifyChecksums: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := extents(v)
+		assert.Nil(t, err)
+		// Only the URL of the metadata extent differs
+		assert.Equal(t, expected[1:], actual[1:])
+
+		w := iso9660.NewWalker(v.Image())
+		for i, pth := range append(paths, "joined") {
+			f, err := w.Open(pth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(f)
+			assert.Nil(t, err)
+			if i < len(urls) {
+				assert.Equal(t, readFile(t, urls[i]), data)
+			} else {
+				assert.Equal(t, joined, string(data))
+			}
+		}
+		v.Close()
+	}
+
+	// Pages are only read when used, so a damaged page is only noticed
+	// by reads of its extents
+	raw := readFile(t, lazy)
+	count := int(binary.LittleEndian.Uint32(raw)) + 1
+	off := (4*(count+1) + 7) / 8 * 8
+	for seg := 0; seg < 3; seg++ {
+		off += int(binary.LittleEndian.Uint32(raw[4*(seg+1):])) * 8
+	}
+	for i := 0; i < 16; i++ {
+		raw[off+i] = 0xff
+	}
+	if err := ioutil.WriteFile(lazy, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := vdisc.Load(lazy, caching.NopCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	var lbas []iso9660.LogicalBlockAddress
+	err = gz.VisitExtents(func(ext vdisc.ExtentInfo) error {
+		lbas = append(lbas, ext.LBA)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	_, err = v.OpenExtent(lbas[5])
+	assert.Nil(t, err)
+	_, err = v.OpenExtent(lbas[9])
+	assert.NotNil(t, err)
+	_, err = extents(v)
+	assert.NotNil(t, err)
+}
+
+func TestExtentIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	url := filepath.Join(dir, "object")
+	content := []byte(strings.Repeat("0123456789", 1000))
+	if err := ioutil.WriteFile(url, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough extents for several pages, each with an index of its own
+	const files = 9000
+	for _, layout := range []vdisc.Layout{vdisc.LayoutGzip, vdisc.LayoutPaged} {
+		b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{
+			URL:    filepath.Join(dir, fmt.Sprintf("test-%d.vdisc", layout)),
+			Layout: layout,
+		})
+		for i := 0; i < files; i++ {
+			if err := b.AddSparseFile(fmt.Sprintf("d%d/sparse%04d", i%7, i), int64(i%3000)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.AddFile("d3/object", url, int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+		burned, err := b.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := vdisc.Load(burned, caching.NopCache)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The whole image, read a little at a time across extents
+		// and their padding
+		img, err := ioutil.ReadAll(v.Image())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var count int
+		err = v.VisitExtents(func(ext vdisc.ExtentInfo) error {
+			assert.Equal(t, count, ext.Index)
+			count++
+			if ext.URL != url {
+				return nil
+			}
+
+			start := int64(ext.LBA) * iso9660.LogicalBlockSize
+			blocks := img[start : start+int64(ext.Blocks)*iso9660.LogicalBlockSize]
+			assert.Equal(t, content, blocks[:ext.Size])
+			assert.Equal(t, make([]byte, ext.Padding), blocks[ext.Size:])
+
+			obj, err := v.OpenExtent(ext.LBA)
+			if assert.Nil(t, err) {
+				data, err := ioutil.ReadAll(obj)
+				assert.Nil(t, err)
+				assert.Equal(t, content, data)
+			}
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, files+2, count)
+
+		w := iso9660.NewWalker(v.Image())
+		for _, i := range []int{0, 1, 4095, 4096, 8999} {
+			f, err := w.Open(fmt.Sprintf("d%d/sparse%04d", i%7, i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(f)
+			assert.Nil(t, err)
+			assert.Equal(t, make([]byte, i%3000), data)
+		}
+
+		_, err = v.OpenExtent(iso9660.LogicalBlockAddress(len(img) / iso9660.LogicalBlockSize))
+		assert.NotNil(t, err)
+		v.Close()
+	}
+}
+
+func readFile(t *testing.T, pth string) []byte {
+	data, err := ioutil.ReadFile(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,57 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc
+
+import (
+	"fmt"
+)
+
+// Relocate stores a copy of v at url, with the objects of its extents
+// moved by relocate. relocate is called with each extent in turn, and
+// may change the URL and Version of the extent and those of its
+// Parts other than the first, which is the extent itself. The rest of
+// the extent, and so the content of the disc image, is kept. It
+// returns the URL of the stored vdisc.
+func Relocate(v VDisc, url string, relocate func(info *ExtentInfo) error, options ...RestoreOptions) (string, error) {
+	var opts RestoreOptions
+	if len(options) > 0 {
+		opts = options[0]
+	}
+
+	vd, ok := v.(*vdisc)
+	if !ok {
+		return "", fmt.Errorf("unsupported vdisc type %T", v)
+	}
+
+	dump, err := vd.dumpHeader()
+	if err != nil {
+		return "", err
+	}
+
+	err = v.VisitExtents(func(info ExtentInfo) error {
+		if err := relocate(&info); err != nil {
+			return err
+		}
+		dump.Extents = append(dump.Extents, dumpExtent(info))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := dump.check(); err != nil {
+		return "", err
+	}
+	return dump.store(url, opts)
+}
@@ -0,0 +1,116 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+func TestRelocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir := filepath.Join(dir, "old")
+	newDir := filepath.Join(dir, "new")
+	for _, d := range []string{oldDir, newDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var contents [][]byte
+	for i := 0; i < 3; i++ {
+		data := []byte(strings.Repeat(fmt.Sprint(i), 3000+i))
+		for _, d := range []string{oldDir, newDir} {
+			if err := ioutil.WriteFile(filepath.Join(d, fmt.Sprintf("object%d", i)), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		contents = append(contents, data)
+	}
+
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{URL: filepath.Join(dir, "v1.vdisc")})
+	assert.Nil(t, b.AddFile("a", filepath.Join(oldDir, "object0"), -1))
+	assert.Nil(t, b.AddFileRange("b", filepath.Join(oldDir, "object1"), 100, 200))
+	assert.Nil(t, b.AddFileParts("c", []string{filepath.Join(oldDir, "object1"), filepath.Join(oldDir, "object2")}, []int64{-1, -1}))
+	url, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := vdisc.Load(url, caching.NopCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	move := func(url string) string {
+		return strings.Replace(url, oldDir, newDir, 1)
+	}
+	relocated, err := vdisc.Relocate(v, filepath.Join(dir, "v2.vdisc"), func(info *vdisc.ExtentInfo) error {
+		info.URL = move(info.URL)
+		for i := range info.Parts {
+			info.Parts[i].URL = move(info.Parts[i].URL)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, os.RemoveAll(oldDir))
+
+	rv, err := vdisc.Load(relocated, caching.NopCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rv.Close()
+
+	assert.Nil(t, rv.VisitExtents(func(info vdisc.ExtentInfo) error {
+		assert.NotContains(t, info.URL, oldDir)
+		for _, part := range info.Parts {
+			assert.NotContains(t, part.URL, oldDir)
+		}
+		return nil
+	}))
+
+	w := iso9660.NewWalker(rv.Image())
+	for name, expected := range map[string][]byte{
+		"a": contents[0],
+		"b": contents[1][100:300],
+		"c": append(append([]byte{}, contents[1]...), contents[2]...),
+	} {
+		f, err := w.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, data, name)
+	}
+}
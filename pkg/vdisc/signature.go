@@ -0,0 +1,268 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+)
+
+// SignatureSuffix is appended to the URL of a vdisc to find its
+// signature
+const SignatureSuffix = ".sig"
+
+// signatureDomain prefixes the signed digests, so a vdisc signature
+// can't be mistaken for a signature over anything else
+const signatureDomain = "vdisc signature v1\x00"
+
+// Signature is the content of a vdisc's signature object. It signs the
+// digest of the decompressed vdisc message together with the digest of
+// the isohdr object, which holds the directories and inline files.
+type Signature struct {
+	Algorithm    string `json:"algorithm"`
+	PublicKey    []byte `json:"publicKey"`
+	VDiscSHA256  string `json:"vdiscSha256"`
+	IsohdrSHA256 string `json:"isohdrSha256"`
+	Signature    []byte `json:"signature"`
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS #8, PKCS #1 or EC private
+// key, which may be ed25519, ECDSA or RSA
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if _, err := signatureAlgorithm(signer.Public()); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// ParsePublicKeys parses every PEM encoded public key or x509
+// certificate in data. A certificate's key is trusted as is; its chain
+// isn't validated.
+func ParsePublicKeys(data []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key crypto.PublicKey
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			key = cert.PublicKey
+		case "PUBLIC KEY":
+			var err error
+			if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+				return nil, err
+			}
+		default:
+			continue
+		}
+
+		if _, err := signatureAlgorithm(key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no public key or certificate found")
+	}
+	return keys, nil
+}
+
+// signatureAlgorithm names the algorithm used to sign with key
+func signatureAlgorithm(key crypto.PublicKey) (string, error) {
+	switch key.(type) {
+	case ed25519.PublicKey:
+		return "ed25519", nil
+	case *ecdsa.PublicKey:
+		return "ecdsa-sha256", nil
+	case *rsa.PublicKey:
+		return "rsa-pkcs1v15-sha256", nil
+	default:
+		return "", fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// Sign signs the vdisc at url with key, writing the signature next to
+// it
+func Sign(url string, key crypto.Signer) error {
+	// The digests are of the bytes a verified Load serves
+	v, err := Load(url, caching.NopCache, LoadOptions{whole: true})
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+	vdiscDigest, isohdrDigest := v.(*vdisc).messageDigest, v.(*vdisc).isohdrDigest
+
+	algorithm, err := signatureAlgorithm(key.Public())
+	if err != nil {
+		return err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+
+	payload := signedPayload(vdiscDigest, isohdrDigest)
+	var sig []byte
+	if algorithm == "ed25519" {
+		sig, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(payload)
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(&Signature{
+		Algorithm:    algorithm,
+		PublicKey:    pub,
+		VDiscSHA256:  hex.EncodeToString(vdiscDigest),
+		IsohdrSHA256: hex.EncodeToString(isohdrDigest),
+		Signature:    sig,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	w, err := storage.Create(url + SignatureSuffix)
+	if err != nil {
+		return err
+	}
+	defer w.Abort()
+
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	_, err = w.Commit()
+	return err
+}
+
+// ReadSignature reads the signature of the vdisc at url
+func ReadSignature(url string) (*Signature, error) {
+	obj, err := storage.Open(url + SignatureSuffix)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s is not signed", url)
+	} else if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	var sig Signature
+	if err := json.NewDecoder(obj).Decode(&sig); err != nil {
+		return nil, fmt.Errorf("reading signature of %s: %v", url, err)
+	}
+	return &sig, nil
+}
+
+// readTrustedSignature reads the signature of the vdisc at url and
+// finds the trusted key it claims to be made with
+func readTrustedSignature(url string, trusted []crypto.PublicKey) (*Signature, crypto.PublicKey, error) {
+	sig, err := ReadSignature(url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, t := range trusted {
+		pub, err := x509.MarshalPKIXPublicKey(t)
+		if err == nil && bytes.Equal(pub, sig.PublicKey) {
+			return sig, t, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%s is not signed by a trusted key", url)
+}
+
+// verify checks that sig was made with key over the digest of the
+// message of the vdisc at url and the isohdr digest it names. The
+// caller checks the digest of the isohdr against it.
+func (sig *Signature) verify(url string, key crypto.PublicKey, vdiscDigest []byte) error {
+	isohdrDigest, err := hex.DecodeString(sig.IsohdrSHA256)
+	if err != nil || len(isohdrDigest) != sha256.Size {
+		return fmt.Errorf("reading signature of %s: invalid isohdr digest", url)
+	}
+	payload := signedPayload(vdiscDigest, isohdrDigest)
+	digest := sha256.Sum256(payload)
+
+	var valid bool
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, payload, sig.Signature)
+	case *ecdsa.PublicKey:
+		var rs struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(sig.Signature, &rs); err == nil && len(rest) == 0 {
+			valid = ecdsa.Verify(key, digest[:], rs.R, rs.S)
+		}
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig.Signature) == nil
+	}
+	if !valid {
+		return fmt.Errorf("%s does not match its signature", url)
+	}
+	return nil
+}
+
+func signedPayload(vdiscDigest, isohdrDigest []byte) []byte {
+	payload := []byte(signatureDomain)
+	payload = append(payload, vdiscDigest...)
+	return append(payload, isohdrDigest...)
+}
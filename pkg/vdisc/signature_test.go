@@ -0,0 +1,205 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+func TestSignatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "hello"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{URL: filepath.Join(dir, "test.vdisc")})
+	if err := b.AddFile("hello", filepath.Join(dir, "hello"), -1); err != nil {
+		t.Fatal(err)
+	}
+	url, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(trusted ...crypto.PublicKey) error {
+		v, err := vdisc.Load(url, caching.NopCache, vdisc.LoadOptions{TrustedKeys: trusted})
+		if err == nil {
+			v.Close()
+		}
+		return err
+	}
+
+	// Unsigned discs are refused once any key is trusted
+	assert.Nil(t, load())
+	assert.NotNil(t, load(edKey.Public()))
+
+	for i, key := range []crypto.Signer{edKey, ecKey, rsaKey} {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := vdisc.ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := vdisc.Sign(url, parsed); err != nil {
+			t.Fatal(err)
+		}
+
+		der, err = x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted, err := vdisc.ParsePublicKeys(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Nil(t, load(trusted...))
+		assert.Nil(t, load(rsaKey.Public(), key.Public()))
+		if i > 0 {
+			assert.NotNil(t, load(edKey.Public()))
+		}
+	}
+
+	// Tampering with the isohdr, which the vdisc only refers to, is
+	// caught as well
+	isohdr, err := ioutil.ReadFile(url + ".isohdr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	isohdr[len(isohdr)-1] ^= 1
+	if err := ioutil.WriteFile(url+".isohdr", isohdr, 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, load(rsaKey.Public()))
+}
+
+func TestSignedBytesServed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, layout := range []vdisc.Layout{vdisc.LayoutGzip, vdisc.LayoutPaged} {
+		b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{
+			URL:             filepath.Join(dir, fmt.Sprintf("%d.vdisc", layout)),
+			Layout:          layout,
+			InlineThreshold: 1024,
+		})
+		assert.Nil(t, b.AddFile("hello", "data:,hello", 5))
+		url, err := b.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := vdisc.Sign(url, key); err != nil {
+			t.Fatal(err)
+		}
+
+		signed, err := ioutil.ReadFile(url + ".isohdr")
+		if err != nil {
+			t.Fatal(err)
+		}
+		swapped := append([]byte{}, signed...)
+		swapped[len(swapped)-1] ^= 1
+
+		// Fill a cache with a swapped isohdr, then put the signed one
+		// back
+		slicer, err := caching.NewMemorySlicer(4096, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache := caching.NewCache(slicer, 0, 0)
+		if err := ioutil.WriteFile(url+".isohdr", swapped, 0644); err != nil {
+			t.Fatal(err)
+		}
+		v, err := vdisc.Load(url, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(ioutil.Discard, v.Image())
+		assert.Nil(t, err)
+		v.Close()
+
+		_, err = vdisc.Load(url, caching.NopCache, vdisc.LoadOptions{TrustedKeys: []crypto.PublicKey{key.Public()}})
+		assert.NotNil(t, err, "swapped isohdr")
+
+		// The stale cache entry isn't served
+		if err := ioutil.WriteFile(url+".isohdr", signed, 0644); err != nil {
+			t.Fatal(err)
+		}
+		v, err = vdisc.Load(url, cache, vdisc.LoadOptions{TrustedKeys: []crypto.PublicKey{key.Public()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		served := make([]byte, len(signed))
+		_, err = v.Image().ReadAt(served, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, signed, served)
+		v.Close()
+
+		// Nor is a vdisc changed after signing
+		data, err := ioutil.ReadFile(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)-1] ^= 1
+		if err := ioutil.WriteFile(url, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err = vdisc.Load(url, caching.NopCache, vdisc.LoadOptions{TrustedKeys: []crypto.PublicKey{key.Public()}})
+		assert.NotNil(t, err, "changed vdisc")
+	}
+}
@@ -0,0 +1,736 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc
+
+import (
+	"bufio"
+	"compress/gzip"
+	"container/heap"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdurl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/storage"
+)
+
+// Default number of entries a streaming builder holds before spilling,
+// a few hundred bytes each
+const defaultSpillEntries = 1 << 18
+
+// streamRecord is an entry added to a streamBuilder, as spilled to disk
+type streamRecord struct {
+	Key      string
+	Seq      uint64
+	Path     string
+	Type     iso9660.InodeType
+	URL      string
+	Size     int64
+	Ranged   bool
+	Offset   int64
+	Parts    []filePart
+	Target   string
+	Implicit bool
+	Options  FileOptions
+
+	// CompressedSize is the size of a compressed file's object
+	CompressedSize int64
+}
+
+func (r *streamRecord) less(other *streamRecord) bool {
+	if r.Key != other.Key {
+		return r.Key < other.Key
+	}
+	return r.Seq < other.Seq
+}
+
+// streamBuilder is a Builder whose memory use doesn't grow with the
+// number of files. Entries are buffered, sorted into level order and
+// spilled to temporary files. Build merges the spilled runs twice,
+// once to plan the iso9660 layout and again to write it out along
+// with the extents.
+type streamBuilder struct {
+	cfg        BuilderConfig
+	volume     *iso9660.StreamingVolume
+	tmpDir     string
+	buf        []*streamRecord
+	runs       []string
+	seq        uint64
+	lastParent string
+}
+
+func newStreamBuilder(cfg BuilderConfig, volume *iso9660.StreamingVolume) *streamBuilder {
+	if cfg.SourceDateEpoch != nil {
+		volume.SetTimestamp(cfg.SourceDateEpoch.UTC())
+	}
+	if cfg.SpillEntries <= 0 {
+		cfg.SpillEntries = defaultSpillEntries
+	}
+	return &streamBuilder{
+		cfg:    cfg,
+		volume: volume,
+	}
+}
+
+// AddFile adds a file to the builder
+func (b *streamBuilder) AddFile(pth string, url string, size int64, options ...FileOptions) error {
+	if b.cfg.Dedupe != DedupeNone {
+		return errors.New("deduplication is not supported by the streaming builder")
+	}
+	size, err := checkZero(url, size)
+	if err != nil {
+		return err
+	}
+
+	var opts FileOptions
+	if len(options) > 0 {
+		opts = options[0]
+	}
+	if err := checkEncoding(url, false, opts); err != nil {
+		return err
+	}
+	return b.add(&streamRecord{
+		Path:    pth,
+		Type:    iso9660.InodeTypeFile,
+		URL:     url,
+		Size:    size,
+		Options: opts,
+	})
+}
+
+// AddFileRange adds a file whose content is length bytes of the object
+// at url, starting at offset
+func (b *streamBuilder) AddFileRange(pth string, url string, offset int64, length int64, options ...FileOptions) error {
+	if b.cfg.Dedupe != DedupeNone {
+		return errors.New("deduplication is not supported by the streaming builder")
+	}
+	if err := checkRange(url, offset, length); err != nil {
+		return err
+	}
+
+	var opts FileOptions
+	if len(options) > 0 {
+		opts = options[0]
+	}
+	if err := checkEncoding(url, true, opts); err != nil {
+		return err
+	}
+	return b.add(&streamRecord{
+		Path:    pth,
+		Type:    iso9660.InodeTypeFile,
+		URL:     url,
+		Size:    length,
+		Ranged:  true,
+		Offset:  offset,
+		Options: opts,
+	})
+}
+
+// AddSparseFile adds a file of size zero bytes, served by a zero: URL
+func (b *streamBuilder) AddSparseFile(pth string, size int64, options ...FileOptions) error {
+	if size < 0 {
+		return fmt.Errorf("invalid sparse file size %d", size)
+	}
+	return b.AddFile(pth, zeroURL(size), size, options...)
+}
+
+// AddFileParts adds a file whose content is that of several objects,
+// one after another
+func (b *streamBuilder) AddFileParts(pth string, urls []string, sizes []int64, options ...FileOptions) error {
+	if b.cfg.Dedupe != DedupeNone {
+		return errors.New("deduplication is not supported by the streaming builder")
+	}
+
+	var opts FileOptions
+	if len(options) > 0 {
+		opts = options[0]
+	}
+
+	parts, err := newFileParts(urls, sizes, opts)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 1 {
+		return b.AddFile(pth, urls[0], sizes[0], opts.single(parts[0]))
+	}
+
+	return b.add(&streamRecord{
+		Path:    pth,
+		Type:    iso9660.InodeTypeFile,
+		URL:     urls[0],
+		Size:    partsSize(parts),
+		Parts:   parts,
+		Options: opts,
+	})
+}
+
+// AddHardlink is not supported by the streaming builder, since linking
+// a file requires knowing where its first name ends up in the image
+func (b *streamBuilder) AddHardlink(pth string, existingPath string) error {
+	return errors.New("hard links are not supported by the streaming builder")
+}
+
+// AddSymlink adds a symlink to the builder
+func (b *streamBuilder) AddSymlink(pth string, target string, metadata ...Metadata) error {
+	if len(target) < 1 {
+		return errors.New("symlink target cannot be empty")
+	}
+
+	rec := &streamRecord{
+		Path:   pth,
+		Type:   iso9660.InodeTypeSymlink,
+		Target: target,
+	}
+	if len(metadata) > 0 {
+		rec.Options.Metadata = metadata[0]
+	}
+	return b.add(rec)
+}
+
+// AddDirectory adds a directory, which may be empty, to the builder
+func (b *streamBuilder) AddDirectory(pth string, metadata ...Metadata) error {
+	rec := &streamRecord{
+		Path: pth,
+		Type: iso9660.InodeTypeDirectory,
+	}
+	if len(metadata) > 0 {
+		rec.Options.Metadata = metadata[0]
+	}
+	return b.add(rec)
+}
+
+func (b *streamBuilder) add(rec *streamRecord) error {
+	rec.Path = path.Clean("/" + rec.Path)[1:]
+	if rec.Path == "" && rec.Type != iso9660.InodeTypeDirectory {
+		return errors.New("Path may not be the root directory")
+	}
+
+	// Parent directories are added implicitly. Consecutive entries
+	// usually share a parent, so only add them when it changes;
+	// duplicates are merged by Build.
+	if parent := path.Dir(rec.Path); parent != "." && parent != b.lastParent {
+		b.lastParent = parent
+		for dir := parent; dir != "."; dir = path.Dir(dir) {
+			b.push(&streamRecord{
+				Path:     dir,
+				Type:     iso9660.InodeTypeDirectory,
+				Implicit: true,
+			})
+		}
+	}
+
+	b.push(rec)
+	if len(b.buf) >= b.cfg.SpillEntries {
+		return b.spill()
+	}
+	return nil
+}
+
+func (b *streamBuilder) push(rec *streamRecord) {
+	rec.Key = iso9660.LevelOrderKey(rec.Path)
+	rec.Seq = b.seq
+	b.seq++
+	b.buf = append(b.buf, rec)
+}
+
+// spill sorts the buffered entries and writes them to a new run
+func (b *streamBuilder) spill() error {
+	if b.tmpDir == "" {
+		dir, err := ioutil.TempDir(b.cfg.TempDir, "vdisc-burn.")
+		if err != nil {
+			return err
+		}
+		b.tmpDir = dir
+	}
+
+	// Sizes and versions are resolved before the entries leave memory
+	var targets []statTarget
+	for _, rec := range b.buf {
+		if rec.Type != iso9660.InodeTypeFile {
+			continue
+		}
+		if len(rec.Parts) > 0 {
+			for i := range rec.Parts {
+				part := &rec.Parts[i]
+				t := statTarget{url: part.URL, size: &part.Size}
+				if b.cfg.PinVersions && part.Version.IsZero() {
+					t.version = &part.Version
+				}
+				if part.Size < 0 || t.version != nil {
+					targets = append(targets, t)
+				}
+			}
+			continue
+		}
+		t := statTarget{
+			url:            rec.URL,
+			size:           &rec.Size,
+			ranged:         rec.Ranged,
+			offset:         rec.Offset,
+			compression:    rec.Options.Compression,
+			compressedSize: &rec.CompressedSize,
+			encrypted:      rec.Options.KeyID != "",
+		}
+		if b.cfg.PinVersions && rec.Options.Version.IsZero() {
+			t.version = &rec.Options.Version
+		}
+		if rec.Size < 0 || t.version != nil || t.compression != CompressionNone {
+			targets = append(targets, t)
+		}
+	}
+	if err := statObjects(targets); err != nil {
+		return errors.Wrap(err, "stating objects")
+	}
+	for _, rec := range b.buf {
+		if len(rec.Parts) > 0 {
+			rec.Size = partsSize(rec.Parts)
+			rec.Options.Version = rec.Parts[0].Version
+		}
+	}
+
+	sort.Slice(b.buf, func(i, j int) bool {
+		return b.buf[i].less(b.buf[j])
+	})
+
+	f, err := os.Create(filepath.Join(b.tmpDir, fmt.Sprintf("run.%d", len(b.runs))))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriterSize(f, 1024*1024)
+	enc := gob.NewEncoder(bw)
+	for _, rec := range b.buf {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	zap.L().Debug("spilled entries", zap.Int("count", len(b.buf)), zap.String("run", f.Name()))
+	b.runs = append(b.runs, f.Name())
+	b.buf = b.buf[:0]
+	return nil
+}
+
+func (b *streamBuilder) SetSystemIdentifier(val string) {
+	b.volume.SetSystemIdentifier(val)
+}
+
+func (b *streamBuilder) SetVolumeIdentifier(val string) {
+	b.volume.SetVolumeIdentifier(val)
+}
+
+func (b *streamBuilder) SetVolumeSetIdentifier(val string) {
+	b.volume.SetVolumeSetIdentifier(val)
+}
+
+func (b *streamBuilder) SetPublisherIdentifier(val string) {
+	b.volume.SetPublisherIdentifier(val)
+}
+
+func (b *streamBuilder) SetDataPreparerIdentifier(val string) {
+	b.volume.SetDataPreparerIdentifier(val)
+}
+
+func (b *streamBuilder) SetApplicationIdentifier(val string) {
+	b.volume.SetApplicationIdentifier(val)
+}
+
+func (b *streamBuilder) SetCopyrightFileIdentifier(val string) {
+	b.volume.SetCopyrightFileIdentifier(val)
+}
+
+func (b *streamBuilder) SetAbstractFileIdentifier(val string) {
+	b.volume.SetAbstractFileIdentifier(val)
+}
+
+func (b *streamBuilder) SetBibliographicFileIdentifier(val string) {
+	b.volume.SetBibliographicFileIdentifier(val)
+}
+
+// Build builds the volume, returning the URL
+func (b *streamBuilder) Build() (string, error) {
+	if err := b.spill(); err != nil {
+		return "", errors.Wrap(err, "spilling entries")
+	}
+	defer os.RemoveAll(b.tmpDir)
+
+	//
+	// First, plan the iso9660 layout, collecting the distinct URL
+	// prefixes along the way
+	//
+	zap.L().Debug("planning iso9660 layout")
+	prefixes := make(map[string]iso9660.LogicalBlockAddress)
+	err := b.withEntries(func(it *streamIterator) error {
+		it.onFile = func(rec *streamRecord) {
+			if b.inlined(rec) {
+				return
+			}
+			addPrefix := func(url string) {
+				prefix, _ := splitURL(url)
+				if _, ok := prefixes[prefix]; !ok {
+					prefixes[prefix] = iso9660.LogicalBlockAddress(len(prefixes))
+				}
+			}
+			addPrefix(rec.URL)
+			for _, part := range rec.Parts {
+				addPrefix(part.URL)
+			}
+		}
+		return b.volume.Plan(it)
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "planning iso9660 layout")
+	}
+
+	trie := NewTrieMap()
+	for prefix, id := range prefixes {
+		trie.Put(prefix, id)
+	}
+	inverted, leaves := trie.Invert()
+	zap.L().Debug("done planning iso9660 layout", zap.Int("prefixes", len(prefixes)))
+
+	//
+	// Then write out the iso9660 metadata, spooling an extent for
+	// every file as its address is assigned. The content of inline
+	// files is spooled too, and follows the metadata.
+	//
+	pageSize := b.cfg.pageSize()
+	extents, err := newExtentWriter(b.tmpDir, pageSize)
+	if err != nil {
+		return "", errors.Wrap(err, "creating extent writer")
+	}
+	var keys keyIndex
+	defer extents.Close()
+
+	inlineSpool, err := ioutil.TempFile(b.tmpDir, "inline.")
+	if err != nil {
+		return "", errors.Wrap(err, "creating inline spool")
+	}
+	defer inlineSpool.Close()
+
+	inlineBuf := bufio.NewWriterSize(inlineSpool, 1024*1024)
+	iw := newInlineWriter(inlineBuf)
+	defer iw.Close()
+
+	metadataURL := b.cfg.URL + ".isohdr"
+	meta, err := storage.Create(metadataURL)
+	if err != nil {
+		return "", errors.Wrap(err, "creating "+metadataURL)
+	}
+	defer meta.Abort()
+
+	metabuf := bufio.NewWriterSize(meta, 1024*1024)
+
+	zap.L().Debug("writing metadata")
+	var metaLen int64
+	err = b.withEntries(func(it *streamIterator) error {
+		var err error
+		metaLen, err = b.volume.WriteMetadataTo(metabuf, it, func(e *iso9660.StreamEntry, start iso9660.LogicalBlockAddress) error {
+			rec := e.Sys.(*streamRecord)
+			if e.Inline {
+				return iw.Add(rec.URL, rec.Offset, rec.Size, rec.Options)
+			}
+
+			prefix, rest := splitURL(rec.URL)
+			leaf := leaves[prefixes[prefix]]
+
+			var parts []extentPart
+			if len(rec.Parts) > 1 {
+				for _, part := range rec.Parts[1:] {
+					prefix, rest := splitURL(part.URL)
+					leaf := leaves[prefixes[prefix]]
+					parts = append(parts, extentPart{
+						uriPrefix: uint32(leaf.Parent),
+						uriSuffix: leaf.Content + rest,
+						size:      part.Size,
+						version:   part.Version,
+					})
+				}
+			}
+
+			key, err := keys.get(rec.Options.KeyID)
+			if err != nil {
+				return err
+			}
+
+			blocks := bytesToSectors(rec.Size)
+			return extents.Append(&extentEntry{
+				uriPrefix: uint32(leaf.Parent),
+				uriSuffix: leaf.Content + rest,
+				blocks:    blocks,
+				padding:   uint16(sectorsToBytes(blocks) - rec.Size),
+				checksum:  rec.Options.Checksum,
+				version:   rec.Options.Version,
+				ranged:    rec.Ranged,
+				offset:    rec.Offset,
+				parts:     parts,
+
+				compression:    rec.Options.Compression,
+				compressedSize: rec.CompressedSize,
+				key:            key,
+			})
+		})
+		return err
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "writing iso9660 metadata")
+	}
+
+	inlineLen, err := iw.Close()
+	if err != nil {
+		return "", errors.Wrap(err, "writing inline files")
+	}
+	if err := inlineBuf.Flush(); err != nil {
+		return "", errors.Wrap(err, "flushing inline files")
+	}
+	if _, err := inlineSpool.Seek(0, io.SeekStart); err != nil {
+		return "", errors.Wrap(err, "rewinding inline files")
+	}
+	if _, err := io.Copy(metabuf, inlineSpool); err != nil {
+		return "", errors.Wrap(err, "copying inline files")
+	}
+	metaLen += inlineLen
+
+	if err := metabuf.Flush(); err != nil {
+		return "", errors.Wrap(err, "flushing iso9660 metadata")
+	}
+
+	metaCommitInfo, err := meta.Commit()
+	if err != nil {
+		return "", errors.Wrap(err, "closing "+metadataURL)
+	}
+	zap.L().Debug("done writing metadata")
+
+	mu, err := stdurl.Parse(metaCommitInfo.ObjectURL())
+	if err != nil {
+		return "", errors.Wrap(err, "parsing "+metaCommitInfo.ObjectURL())
+	}
+
+	var muBase stdurl.URL
+	muBase.Path = path.Base(mu.Path)
+	muBase.RawQuery = mu.RawQuery
+
+	// The metadata URL is stored whole, beneath the empty root of the
+	// inverted trie, since it isn't known until the trie is built
+	metaBlocks := bytesToSectors(metaLen)
+	err = extents.SetFirst(&extentEntry{
+		uriSuffix: muBase.String(),
+		blocks:    metaBlocks,
+		padding:   uint16(sectorsToBytes(metaBlocks) - metaLen),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "encoding metadata extent")
+	}
+
+	zap.L().Debug("writing capnp message")
+	//
+	// Finally, store the vdisc object
+	//
+	vd, err := storage.Create(b.cfg.URL)
+	if err != nil {
+		return "", errors.Wrap(err, "creating "+b.cfg.URL)
+	}
+	defer vd.Abort()
+
+	if pageSize > 0 {
+		if _, err := extents.WriteTo(vd, iso9660.LogicalBlockSize, "iso9660", inverted, keys.ids); err != nil {
+			return "", errors.Wrap(err, "writing capnp message")
+		}
+	} else {
+		vdz, err := gzip.NewWriterLevel(vd, gzip.BestCompression)
+		if err != nil {
+			return "", errors.Wrap(err, "creating gzip writer")
+		}
+
+		if _, err := extents.WriteTo(vdz, iso9660.LogicalBlockSize, "iso9660", inverted, keys.ids); err != nil {
+			return "", errors.Wrap(err, "writing capnp message")
+		}
+
+		if err := vdz.Close(); err != nil {
+			return "", errors.Wrap(err, "closing gzip writer")
+		}
+	}
+
+	vdiscCommitInfo, err := vd.Commit()
+	if err != nil {
+		return "", errors.Wrap(err, "closing "+b.cfg.URL)
+	}
+	zap.L().Debug("done writing capnp message")
+
+	return vdiscCommitInfo.ObjectURL(), nil
+}
+
+// inlined reports whether a record is a file stored with the metadata
+func (b *streamBuilder) inlined(rec *streamRecord) bool {
+	return rec.Type == iso9660.InodeTypeFile && b.cfg.inlined(rec.URL, rec.Size, len(rec.Parts) > 0 || rec.Options.encoded(), rec.Options.Inline)
+}
+
+// withEntries calls fn with an iterator over every entry in level
+// order, merged from the spilled runs
+func (b *streamBuilder) withEntries(fn func(it *streamIterator) error) error {
+	it := &streamIterator{inlined: b.inlined}
+	defer it.close()
+
+	for _, run := range b.runs {
+		f, err := os.Open(run)
+		if err != nil {
+			return err
+		}
+		it.files = append(it.files, f)
+
+		c := &runCursor{dec: gob.NewDecoder(bufio.NewReaderSize(f, 256*1024))}
+		if err := c.advance(); err == io.EOF {
+			continue
+		} else if err != nil {
+			return err
+		}
+		it.cursors = append(it.cursors, c)
+	}
+	heap.Init(&it.cursors)
+
+	return fn(it)
+}
+
+// splitURL splits url after its last slash so that objects in the same
+// directory share a node of the inverted trie
+func splitURL(url string) (prefix string, rest string) {
+	idx := strings.LastIndex(url, "/")
+	return url[:idx+1], url[idx+1:]
+}
+
+// runCursor reads a single sorted run
+type runCursor struct {
+	dec  *gob.Decoder
+	head *streamRecord
+}
+
+func (c *runCursor) advance() error {
+	var rec streamRecord
+	if err := c.dec.Decode(&rec); err != nil {
+		return err
+	}
+	c.head = &rec
+	return nil
+}
+
+type runHeap []*runCursor
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return h[i].head.less(h[j].head) }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runCursor)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// streamIterator merges sorted runs into a single sequence of
+// iso9660.StreamEntry, combining the records added for each path
+type streamIterator struct {
+	files   []*os.File
+	cursors runHeap
+	onFile  func(*streamRecord)
+	inlined func(*streamRecord) bool
+}
+
+func (it *streamIterator) close() {
+	for _, f := range it.files {
+		f.Close()
+	}
+}
+
+func (it *streamIterator) pop() (*streamRecord, error) {
+	if len(it.cursors) == 0 {
+		return nil, io.EOF
+	}
+
+	c := it.cursors[0]
+	rec := c.head
+	if err := c.advance(); err == io.EOF {
+		heap.Pop(&it.cursors)
+	} else if err != nil {
+		return nil, err
+	} else {
+		heap.Fix(&it.cursors, 0)
+	}
+	return rec, nil
+}
+
+func (it *streamIterator) Next() (*iso9660.StreamEntry, error) {
+	rec, err := it.pop()
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge every record for the same path. Directories may be added
+	// any number of times, explicitly or as the parent of another
+	// entry, and the last explicit one wins. Anything else is a
+	// collision.
+	for len(it.cursors) > 0 && it.cursors[0].head.Key == rec.Key {
+		dup, err := it.pop()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case rec.Type != iso9660.InodeTypeDirectory || dup.Type != iso9660.InodeTypeDirectory:
+			if rec.Implicit || dup.Implicit {
+				return nil, fmt.Errorf("%s: Path segment exists and is not a directory", rec.Path)
+			}
+			return nil, fmt.Errorf("%s: Directory entry collision", rec.Path)
+		case !dup.Implicit:
+			rec = dup
+		}
+	}
+
+	if rec.Type == iso9660.InodeTypeFile && it.onFile != nil {
+		it.onFile(rec)
+	}
+
+	md := rec.Options.Metadata
+	e := &iso9660.StreamEntry{
+		Path:     rec.Path,
+		Type:     rec.Type,
+		Size:     rec.Size,
+		Inline:   it.inlined(rec),
+		Target:   rec.Target,
+		Perm:     md.Mode,
+		Uid:      md.Uid,
+		Gid:      md.Gid,
+		Created:  md.Mtime,
+		Modified: md.Mtime,
+		Sys:      rec,
+	}
+	if !md.Ctime.IsZero() {
+		e.Created = md.Ctime
+	}
+	return e, nil
+}
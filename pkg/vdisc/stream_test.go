@@ -0,0 +1,158 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+)
+
+func TestStreamingBuilder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type object struct {
+		path string
+		url  string
+		size int64
+	}
+	var objects []object
+	for i := 0; i < 40; i++ {
+		pth := fmt.Sprintf("d%d/sub%d/file%02d.txt", i%3, i%2, i)
+		url := filepath.Join(dir, "objects", fmt.Sprintf("%d", i%4), fmt.Sprintf("file%02d.txt", i))
+		content := strings.Repeat("x", i*100)
+		if err := os.MkdirAll(filepath.Dir(url), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(url, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, object{pth, url, int64(len(content))})
+	}
+
+	epoch := time.Unix(1500000000, 0).UTC()
+	mtime := time.Unix(1400000000, 0).UTC()
+	burn := func(name string, streaming bool, reverse bool) string {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{
+			URL:             filepath.Join(dir, name, "test.vdisc"),
+			SourceDateEpoch: &epoch,
+			Streaming:       streaming,
+			SpillEntries:    7,
+		})
+		b.SetVolumeIdentifier("test")
+
+		for i := range objects {
+			obj := objects[i]
+			if reverse {
+				obj = objects[len(objects)-1-i]
+			}
+			if err := b.AddFile(obj.path, obj.url, obj.size); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.AddDirectory("d1/sub0", vdisc.Metadata{Mode: 0750, Uid: 10, Mtime: mtime}); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.AddDirectory("empty"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.AddSymlink("d0/link", "sub0/file00.txt", vdisc.Metadata{Uid: 20}); err != nil {
+			t.Fatal(err)
+		}
+
+		url, err := b.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return url
+	}
+
+	readAll := func(pth string) []byte {
+		data, err := ioutil.ReadFile(pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	expected := burn("memory", false, false)
+	actual := burn("streaming", true, true)
+	assert.Equal(t, readAll(expected+".isohdr"), readAll(actual+".isohdr"))
+
+	extents := func(url string) []string {
+		v, err := vdisc.Load(url, caching.NopCache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer v.Close()
+
+		var result []string
+		err = v.VisitExtents(func(ext vdisc.ExtentInfo) error {
+			rel := strings.TrimPrefix(ext.URL, filepath.Dir(url))
+			result = append(result, fmt.Sprintf("%d %s %d %d", ext.LBA, rel, ext.Blocks, ext.Padding))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	assert.Equal(t, extents(expected), extents(actual))
+
+	v, err := vdisc.Load(actual, caching.NopCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	w := iso9660.NewWalker(v.Image())
+	for _, obj := range objects {
+		f, err := w.Open(obj.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		assert.Nil(t, err)
+		assert.Equal(t, readAll(obj.url), data)
+	}
+
+	// Files can't collide with each other, or with directories
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{
+		URL:          filepath.Join(dir, "collision.vdisc"),
+		Streaming:    true,
+		SpillEntries: 1,
+	})
+	assert.Nil(t, b.AddFile("a/b", objects[0].url, objects[0].size))
+	assert.Nil(t, b.AddFile("a/b/c", objects[1].url, objects[1].size))
+	_, err = b.Build()
+	assert.NotNil(t, err)
+}
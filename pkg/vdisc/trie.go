@@ -15,6 +15,7 @@
 package vdisc
 
 import (
+	"sort"
 	"unicode/utf8"
 
 	"github.com/badgerodon/collections/queue"
@@ -200,11 +201,19 @@ func (t *TrieMap) Invert() ([]InvertedTrieNode, map[iso9660.LogicalBlockAddress]
 				Content: tnode.node.content,
 			})
 
-			for _, child := range tnode.node.children {
+			// Visit children in a fixed order so the inverted trie is
+			// the same every time for the same set of keys
+			runes := make([]rune, 0, len(tnode.node.children))
+			for r := range tnode.node.children {
+				runes = append(runes, r)
+			}
+			sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+
+			for _, r := range runes {
 				q.Enqueue(&traversalNode{
 					prefix:      tnode.prefix + tnode.node.content,
 					parentIndex: idx,
-					node:        child,
+					node:        tnode.node.children[r],
 				})
 			}
 		}
@@ -14,12 +14,12 @@ type VDisc struct{ capnp.Struct }
 const VDisc_TypeID = 0xedec5a16c6a1a062
 
 func NewVDisc(s *capnp.Segment) (VDisc, error) {
-	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 3})
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 5})
 	return VDisc{st}, err
 }
 
 func NewRootVDisc(s *capnp.Segment) (VDisc, error) {
-	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 3})
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 5})
 	return VDisc{st}, err
 }
 
@@ -110,12 +110,70 @@ func (s VDisc) NewExtents(n int32) (Extent_List, error) {
 	return l, err
 }
 
+func (s VDisc) KeyIds() (capnp.TextList, error) {
+	p, err := s.Struct.Ptr(3)
+	return capnp.TextList{List: p.List()}, err
+}
+
+func (s VDisc) HasKeyIds() bool {
+	p, err := s.Struct.Ptr(3)
+	return p.IsValid() || err != nil
+}
+
+func (s VDisc) SetKeyIds(v capnp.TextList) error {
+	return s.Struct.SetPtr(3, v.List.ToPtr())
+}
+
+// NewKeyIds sets the keyIds field to a newly
+// allocated capnp.TextList, preferring placement in s's segment.
+func (s VDisc) NewKeyIds(n int32) (capnp.TextList, error) {
+	l, err := capnp.NewTextList(s.Struct.Segment(), n)
+	if err != nil {
+		return capnp.TextList{}, err
+	}
+	err = s.Struct.SetPtr(3, l.List.ToPtr())
+	return l, err
+}
+
+func (s VDisc) ExtentPages() (ExtentPage_List, error) {
+	p, err := s.Struct.Ptr(4)
+	return ExtentPage_List{List: p.List()}, err
+}
+
+func (s VDisc) HasExtentPages() bool {
+	p, err := s.Struct.Ptr(4)
+	return p.IsValid() || err != nil
+}
+
+func (s VDisc) SetExtentPages(v ExtentPage_List) error {
+	return s.Struct.SetPtr(4, v.List.ToPtr())
+}
+
+// NewExtentPages sets the extentPages field to a newly
+// allocated ExtentPage_List, preferring placement in s's segment.
+func (s VDisc) NewExtentPages(n int32) (ExtentPage_List, error) {
+	l, err := NewExtentPage_List(s.Struct.Segment(), n)
+	if err != nil {
+		return ExtentPage_List{}, err
+	}
+	err = s.Struct.SetPtr(4, l.List.ToPtr())
+	return l, err
+}
+
+func (s VDisc) ExtentPageSize() uint32 {
+	return s.Struct.Uint32(4)
+}
+
+func (s VDisc) SetExtentPageSize(v uint32) {
+	s.Struct.SetUint32(4, v)
+}
+
 // VDisc_List is a list of VDisc.
 type VDisc_List struct{ capnp.List }
 
 // NewVDisc creates a new list of VDisc.
 func NewVDisc_List(s *capnp.Segment, sz int32) (VDisc_List, error) {
-	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 8, PointerCount: 3}, sz)
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 8, PointerCount: 5}, sz)
 	return VDisc_List{l}, err
 }
 
@@ -136,6 +194,90 @@ func (p VDisc_Promise) Struct() (VDisc, error) {
 	return VDisc{s}, err
 }
 
+type ExtentPage struct{ capnp.Struct }
+
+// ExtentPage_TypeID is the unique identifier for the type ExtentPage.
+const ExtentPage_TypeID = 0x9f49dadac9473555
+
+func NewExtentPage(s *capnp.Segment) (ExtentPage, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 1})
+	return ExtentPage{st}, err
+}
+
+func NewRootExtentPage(s *capnp.Segment) (ExtentPage, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 1})
+	return ExtentPage{st}, err
+}
+
+func ReadRootExtentPage(msg *capnp.Message) (ExtentPage, error) {
+	root, err := msg.RootPtr()
+	return ExtentPage{root.Struct()}, err
+}
+
+func (s ExtentPage) String() string {
+	str, _ := text.Marshal(0x9f49dadac9473555, s.Struct)
+	return str
+}
+
+func (s ExtentPage) FirstLba() uint32 {
+	return s.Struct.Uint32(0)
+}
+
+func (s ExtentPage) SetFirstLba(v uint32) {
+	s.Struct.SetUint32(0, v)
+}
+
+func (s ExtentPage) Extents() (Extent_List, error) {
+	p, err := s.Struct.Ptr(0)
+	return Extent_List{List: p.List()}, err
+}
+
+func (s ExtentPage) HasExtents() bool {
+	p, err := s.Struct.Ptr(0)
+	return p.IsValid() || err != nil
+}
+
+func (s ExtentPage) SetExtents(v Extent_List) error {
+	return s.Struct.SetPtr(0, v.List.ToPtr())
+}
+
+// NewExtents sets the extents field to a newly
+// allocated Extent_List, preferring placement in s's segment.
+func (s ExtentPage) NewExtents(n int32) (Extent_List, error) {
+	l, err := NewExtent_List(s.Struct.Segment(), n)
+	if err != nil {
+		return Extent_List{}, err
+	}
+	err = s.Struct.SetPtr(0, l.List.ToPtr())
+	return l, err
+}
+
+// ExtentPage_List is a list of ExtentPage.
+type ExtentPage_List struct{ capnp.List }
+
+// NewExtentPage creates a new list of ExtentPage.
+func NewExtentPage_List(s *capnp.Segment, sz int32) (ExtentPage_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 8, PointerCount: 1}, sz)
+	return ExtentPage_List{l}, err
+}
+
+func (s ExtentPage_List) At(i int) ExtentPage { return ExtentPage{s.List.Struct(i)} }
+
+func (s ExtentPage_List) Set(i int, v ExtentPage) error { return s.List.SetStruct(i, v.Struct) }
+
+func (s ExtentPage_List) String() string {
+	str, _ := text.MarshalList(0x9f49dadac9473555, s.List)
+	return str
+}
+
+// ExtentPage_Promise is a wrapper for a ExtentPage promised by a client call.
+type ExtentPage_Promise struct{ *capnp.Pipeline }
+
+func (p ExtentPage_Promise) Struct() (ExtentPage, error) {
+	s, err := p.Pipeline.Struct()
+	return ExtentPage{s}, err
+}
+
 type ITrie struct{ capnp.Struct }
 
 // ITrie_TypeID is the unique identifier for the type ITrie.
@@ -220,12 +362,12 @@ type Extent struct{ capnp.Struct }
 const Extent_TypeID = 0xa4d7434c98251eb9
 
 func NewExtent(s *capnp.Segment) (Extent, error) {
-	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 16, PointerCount: 1})
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 32, PointerCount: 5})
 	return Extent{st}, err
 }
 
 func NewRootExtent(s *capnp.Segment) (Extent, error) {
-	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 16, PointerCount: 1})
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 32, PointerCount: 5})
 	return Extent{st}, err
 }
 
@@ -282,12 +424,137 @@ func (s Extent) SetPadding(v uint16) {
 	s.Struct.SetUint16(8, v)
 }
 
+func (s Extent) ChecksumAlgorithm() ChecksumAlgorithm {
+	return ChecksumAlgorithm(s.Struct.Uint16(10))
+}
+
+func (s Extent) SetChecksumAlgorithm(v ChecksumAlgorithm) {
+	s.Struct.SetUint16(10, uint16(v))
+}
+
+func (s Extent) Checksum() ([]byte, error) {
+	p, err := s.Struct.Ptr(1)
+	return []byte(p.Data()), err
+}
+
+func (s Extent) HasChecksum() bool {
+	p, err := s.Struct.Ptr(1)
+	return p.IsValid() || err != nil
+}
+
+func (s Extent) SetChecksum(v []byte) error {
+	return s.Struct.SetData(1, v)
+}
+
+func (s Extent) Etag() (string, error) {
+	p, err := s.Struct.Ptr(2)
+	return p.Text(), err
+}
+
+func (s Extent) HasEtag() bool {
+	p, err := s.Struct.Ptr(2)
+	return p.IsValid() || err != nil
+}
+
+func (s Extent) EtagBytes() ([]byte, error) {
+	p, err := s.Struct.Ptr(2)
+	return p.TextBytes(), err
+}
+
+func (s Extent) SetEtag(v string) error {
+	return s.Struct.SetText(2, v)
+}
+
+func (s Extent) VersionId() (string, error) {
+	p, err := s.Struct.Ptr(3)
+	return p.Text(), err
+}
+
+func (s Extent) HasVersionId() bool {
+	p, err := s.Struct.Ptr(3)
+	return p.IsValid() || err != nil
+}
+
+func (s Extent) VersionIdBytes() ([]byte, error) {
+	p, err := s.Struct.Ptr(3)
+	return p.TextBytes(), err
+}
+
+func (s Extent) SetVersionId(v string) error {
+	return s.Struct.SetText(3, v)
+}
+
+func (s Extent) Ranged() bool {
+	return s.Struct.Bit(96)
+}
+
+func (s Extent) SetRanged(v bool) {
+	s.Struct.SetBit(96, v)
+}
+
+func (s Extent) Offset() uint64 {
+	return s.Struct.Uint64(16)
+}
+
+func (s Extent) SetOffset(v uint64) {
+	s.Struct.SetUint64(16, v)
+}
+
+func (s Extent) Parts() (Part_List, error) {
+	p, err := s.Struct.Ptr(4)
+	return Part_List{List: p.List()}, err
+}
+
+func (s Extent) HasParts() bool {
+	p, err := s.Struct.Ptr(4)
+	return p.IsValid() || err != nil
+}
+
+func (s Extent) SetParts(v Part_List) error {
+	return s.Struct.SetPtr(4, v.List.ToPtr())
+}
+
+// NewParts sets the parts field to a newly
+// allocated Part_List, preferring placement in s's segment.
+func (s Extent) NewParts(n int32) (Part_List, error) {
+	l, err := NewPart_List(s.Struct.Segment(), n)
+	if err != nil {
+		return Part_List{}, err
+	}
+	err = s.Struct.SetPtr(4, l.List.ToPtr())
+	return l, err
+}
+
+func (s Extent) Compression() Compression {
+	return Compression(s.Struct.Uint16(14))
+}
+
+func (s Extent) SetCompression(v Compression) {
+	s.Struct.SetUint16(14, uint16(v))
+}
+
+func (s Extent) CompressedSize() uint64 {
+	return s.Struct.Uint64(24)
+}
+
+func (s Extent) SetCompressedSize(v uint64) {
+	s.Struct.SetUint64(24, v)
+}
+
+func (s Extent) Key() uint8 {
+	return s.Struct.Uint8(13)
+}
+
+func (s Extent) SetKey(v uint8) {
+	s.Struct.SetUint8(13, v)
+}
+
 // Extent_List is a list of Extent.
 type Extent_List struct{ capnp.List }
 
 // NewExtent creates a new list of Extent.
 func NewExtent_List(s *capnp.Segment, sz int32) (Extent_List, error) {
-	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 16, PointerCount: 1}, sz)
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 32, PointerCount: 5}, sz)
 	return Extent_List{l}, err
 }
 
@@ -308,36 +575,336 @@ func (p Extent_Promise) Struct() (Extent, error) {
 	return Extent{s}, err
 }
 
-const schema_ad3f2ae443d613d9 = "x\xda\x8c\x92\xcfk\x13A\x1c\xc5\xdf\xfbNb\"\x14" +
-	"\xed\x92(\x08\xeaA\x14\xb4\x10\xd3\xa0\xa7^\"\xad\x1e" +
-	"\x14\x0f\x19[<x\xd1t\xb3\xa9C\xe3f\xba\xbb\x89" +
-	"\xa9TK\xc1?\xa2'\x7f\x80\x17\x0f\x1e=x\xf2\xa6" +
-	"\xff\x81\xe2\xcd\x83\xd0\x8b\xfe\x0d+\xb3\xe9\xa6%\xa7\xdc" +
-	"v\x1f\x1f\x98\xf7>3\x8be\xde\x92F\xb1/\x80>" +
-	"_<\x91~\xb9xe\xff\xfe\xca\xcf\x0f\xd0\x97(\xe9" +
-	"\xaf\xca\x8f\x95?\x0b\xcdO(\xb2\x04\xdc\xb8\xc0{\xac" +
-	"4\xdcg\xa5\xc6\x030}\xf5\xf6\xe3\xf7\xaf\xbf\xdf|" +
-	"v4\xa7\xe9\x93\xb2\xcc\xca9q\xf4\x19y\x0e\xa6\xeb" +
-	"\xef\xde\x7f;\xfb\xe8\xef\xbfiZ9z\xcb\xd1{\x19" +
-	"\xfdR\x0ePK\xed\xe6F}\xd81q\xc1\xaf'\xdb" +
-	"6\x88\xeb\xc3F\xf6\xef?\x1e6\xae\xfbm\x1b\xda\xa5" +
-	";\xa3$\x08\x13\xa0E\xeayU\x00\x0a\x04\xbc\xf6\x03" +
-	"@?Q\xd4=!Y\xa5\xcb\x8c\xcb\x9e*\xeaD\xe8" +
-	"\x09\xab\x14\xc0\xdbZ\x02tOQ\x8f\x84\x9e*T\xa9" +
-	"\x00o\xb0\x0ch\xab\xa8w\x84\xe9 2\xad(\xe8\x1a" +
-	"p\xc42\x84ed\xd9\xea\xa0;\xce\xe6 \x9c\x03\x9b" +
-	"\xeb\xbd\xbe\xbf\x19\xe7\xc8\xaemw:&\xdc`\x09\xc2" +
-	"\x128\xcb\x94\xbbk\x91\x09\xb2!\xe5\xc9\x90k\xae\xdf" +
-	"eE\xbdx4\xa4\xe6\xea]U\xd47\x85M\xdb\x8e" +
-	"\x820\x99\x1c\xeb\xf7C\xe7#o5\xcb\xb1\x0fo\x9b" +
-	"\xd8\x9f\xc5\x9f\xab\xd2Q\xd4\xf6\x98\xbfg\x0b\x87R_" +
-	";\x7f2\xf6\xb7\xe7\x0a\xee(\xea}a\x9ayY5" +
-	"/\xc0 \x97\xd1\xec\xc6k\xdb6\xc8K\x9e\x1eD&" +
-	"\xe6)\xb0\xa5\xc8\xf9\xa3\x07\x05\xbap7\xc8n\xf8\x18" +
-	"0y\x9fc\xe0\x7f\x00\x00\x00\xff\xff\x04\x96\xa0a"
+type Part struct{ capnp.Struct }
+
+// Part_TypeID is the unique identifier for the type Part.
+const Part_TypeID = 0x9ffd2d461edc1218
+
+func NewPart(s *capnp.Segment) (Part, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 16, PointerCount: 3})
+	return Part{st}, err
+}
+
+func NewRootPart(s *capnp.Segment) (Part, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 16, PointerCount: 3})
+	return Part{st}, err
+}
+
+func ReadRootPart(msg *capnp.Message) (Part, error) {
+	root, err := msg.RootPtr()
+	return Part{root.Struct()}, err
+}
+
+func (s Part) String() string {
+	str, _ := text.Marshal(0x9ffd2d461edc1218, s.Struct)
+	return str
+}
+
+func (s Part) UriPrefix() uint32 {
+	return s.Struct.Uint32(0)
+}
+
+func (s Part) SetUriPrefix(v uint32) {
+	s.Struct.SetUint32(0, v)
+}
+
+func (s Part) UriSuffix() (string, error) {
+	p, err := s.Struct.Ptr(0)
+	return p.Text(), err
+}
+
+func (s Part) HasUriSuffix() bool {
+	p, err := s.Struct.Ptr(0)
+	return p.IsValid() || err != nil
+}
+
+func (s Part) UriSuffixBytes() ([]byte, error) {
+	p, err := s.Struct.Ptr(0)
+	return p.TextBytes(), err
+}
+
+func (s Part) SetUriSuffix(v string) error {
+	return s.Struct.SetText(0, v)
+}
+
+func (s Part) Size() uint64 {
+	return s.Struct.Uint64(8)
+}
+
+func (s Part) SetSize(v uint64) {
+	s.Struct.SetUint64(8, v)
+}
+
+func (s Part) Etag() (string, error) {
+	p, err := s.Struct.Ptr(1)
+	return p.Text(), err
+}
+
+func (s Part) HasEtag() bool {
+	p, err := s.Struct.Ptr(1)
+	return p.IsValid() || err != nil
+}
+
+func (s Part) EtagBytes() ([]byte, error) {
+	p, err := s.Struct.Ptr(1)
+	return p.TextBytes(), err
+}
+
+func (s Part) SetEtag(v string) error {
+	return s.Struct.SetText(1, v)
+}
+
+func (s Part) VersionId() (string, error) {
+	p, err := s.Struct.Ptr(2)
+	return p.Text(), err
+}
+
+func (s Part) HasVersionId() bool {
+	p, err := s.Struct.Ptr(2)
+	return p.IsValid() || err != nil
+}
+
+func (s Part) VersionIdBytes() ([]byte, error) {
+	p, err := s.Struct.Ptr(2)
+	return p.TextBytes(), err
+}
+
+func (s Part) SetVersionId(v string) error {
+	return s.Struct.SetText(2, v)
+}
+
+// Part_List is a list of Part.
+type Part_List struct{ capnp.List }
+
+// NewPart creates a new list of Part.
+func NewPart_List(s *capnp.Segment, sz int32) (Part_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 16, PointerCount: 3}, sz)
+	return Part_List{l}, err
+}
+
+func (s Part_List) At(i int) Part { return Part{s.List.Struct(i)} }
+
+func (s Part_List) Set(i int, v Part) error { return s.List.SetStruct(i, v.Struct) }
+
+func (s Part_List) String() string {
+	str, _ := text.MarshalList(0x9ffd2d461edc1218, s.List)
+	return str
+}
+
+// Part_Promise is a wrapper for a Part promised by a client call.
+type Part_Promise struct{ *capnp.Pipeline }
+
+func (p Part_Promise) Struct() (Part, error) {
+	s, err := p.Pipeline.Struct()
+	return Part{s}, err
+}
+
+type ChecksumAlgorithm uint16
+
+// ChecksumAlgorithm_TypeID is the unique identifier for the type ChecksumAlgorithm.
+const ChecksumAlgorithm_TypeID = 0x828e7c8c4af46eb5
+
+// Values of ChecksumAlgorithm.
+const (
+	ChecksumAlgorithm_none   ChecksumAlgorithm = 0
+	ChecksumAlgorithm_sha256 ChecksumAlgorithm = 1
+	ChecksumAlgorithm_crc32c ChecksumAlgorithm = 2
+	ChecksumAlgorithm_md5    ChecksumAlgorithm = 3
+)
+
+// String returns the enum's constant name.
+func (c ChecksumAlgorithm) String() string {
+	switch c {
+	case ChecksumAlgorithm_none:
+		return "none"
+	case ChecksumAlgorithm_sha256:
+		return "sha256"
+	case ChecksumAlgorithm_crc32c:
+		return "crc32c"
+	case ChecksumAlgorithm_md5:
+		return "md5"
+
+	default:
+		return ""
+	}
+}
+
+// ChecksumAlgorithmFromString returns the enum value with a name,
+// or the zero value if there's no such value.
+func ChecksumAlgorithmFromString(c string) ChecksumAlgorithm {
+	switch c {
+	case "none":
+		return ChecksumAlgorithm_none
+	case "sha256":
+		return ChecksumAlgorithm_sha256
+	case "crc32c":
+		return ChecksumAlgorithm_crc32c
+	case "md5":
+		return ChecksumAlgorithm_md5
+
+	default:
+		return 0
+	}
+}
+
+type ChecksumAlgorithm_List struct{ capnp.List }
+
+func NewChecksumAlgorithm_List(s *capnp.Segment, sz int32) (ChecksumAlgorithm_List, error) {
+	l, err := capnp.NewUInt16List(s, sz)
+	return ChecksumAlgorithm_List{l.List}, err
+}
+
+func (l ChecksumAlgorithm_List) At(i int) ChecksumAlgorithm {
+	ul := capnp.UInt16List{List: l.List}
+	return ChecksumAlgorithm(ul.At(i))
+}
+
+func (l ChecksumAlgorithm_List) Set(i int, v ChecksumAlgorithm) {
+	ul := capnp.UInt16List{List: l.List}
+	ul.Set(i, uint16(v))
+}
+
+type Compression uint16
+
+// Compression_TypeID is the unique identifier for the type Compression.
+const Compression_TypeID = 0x9b5b315c9e9ffb38
+
+// Values of Compression.
+const (
+	Compression_none         Compression = 0
+	Compression_zstdSeekable Compression = 1
+)
+
+// String returns the enum's constant name.
+func (c Compression) String() string {
+	switch c {
+	case Compression_none:
+		return "none"
+	case Compression_zstdSeekable:
+		return "zstdSeekable"
+
+	default:
+		return ""
+	}
+}
+
+// CompressionFromString returns the enum value with a name,
+// or the zero value if there's no such value.
+func CompressionFromString(c string) Compression {
+	switch c {
+	case "none":
+		return Compression_none
+	case "zstdSeekable":
+		return Compression_zstdSeekable
+
+	default:
+		return 0
+	}
+}
+
+type Compression_List struct{ capnp.List }
+
+func NewCompression_List(s *capnp.Segment, sz int32) (Compression_List, error) {
+	l, err := capnp.NewUInt16List(s, sz)
+	return Compression_List{l.List}, err
+}
+
+func (l Compression_List) At(i int) Compression {
+	ul := capnp.UInt16List{List: l.List}
+	return Compression(ul.At(i))
+}
+
+func (l Compression_List) Set(i int, v Compression) {
+	ul := capnp.UInt16List{List: l.List}
+	ul.Set(i, uint16(v))
+}
+
+const schema_ad3f2ae443d613d9 = "x\xda\x94V]hT\xd7\x16^\xdf>3Y\x13M" +
+	"n\xdcw\x0f\xf7\xde\x87\x1b5\xc1\x80\xc9\xd5\xab1\xa6" +
+	"\x95\xa10i\xac\xad\x09>\xcc\xc9\xb1\xa5\xbf\xb4\x93\x99" +
+	"\x93\xc9\x183\x99\xce\x99\xa4&h\xff\xa0\xa0\xa0m-" +
+	"\x0aJ\xfd-\x16\xf4\xa1o\x15*XZA[\x85J" +
+	"\xedK[\xc5\x82\x82\x82\x01}(\xd4\x87R\xca)\xeb" +
+	"d29\x89m1\x0f\x0b\xe6\xeco\xaf\xb3\xbe\xb3\xf6" +
+	"\xf7\xad=\xab\xef\xab.\xd5\x1e\xfd\xd6\"\xb2WDk" +
+	"\xfc\xd3\x85_zwo\x7f\xf7m\xd2\xcd\xca\xbfj\xbe" +
+	"_\x7f\xab-\xf9\x09\x11:.\xe3#\x98\xdb\xe0J\xe4" +
+	"\x88L\xbbb\x7f\xddoG\x8f\xbc\xd8\xfe\xc2\x87\x0f\xec" +
+	"oT%\xc8\x8eJ<Jd\x9eS\xec?\xdd\xf9\xd4" +
+	"\xa5k\xd7z\x8e\x92\xdd\x0c\xcc$D\xc1D\x1d\x1b\xd4" +
+	"\x16\xc8\xaeJ\xbcFd~V\xec\xff\xe7\x9f\xd7\x17?" +
+	"\xb9\xf2\xf7 'T$jI\xceO*\x01sO\xb1" +
+	"D\xc7=\xb5\x04D\xa63\xc2\xfe\x99\xc5-\x076\xad" +
+	"\xff\xe1\x84$EBIQIj\x8a\xf4BvIt" +
+	"tF\xfem\x11\x99_\x99\xfd\xd7\x8f\x9e\xfa\xfa\x8b\x1b" +
+	"GN\xff)\xbb\xdb\xdc\x0ds\x9f\xb9\x12\xc2\xee\xd5\x18" +
+	"\xfb\xfd\xc7\x8e\x7f\xf5\xaf\xe7\xef\xde\x9b\x9b\x13\x14z)" +
+	"\xd6\x0d3\x1cc\x89\x8e\xe1\xd8{\xc2n\xcf\x02\xa6\xff" +
+	"\xf9\xc5\xa1\xdc\xaa\xb1l\xde\x8bfV\x95\xc7\x8b\xae\xb7" +
+	"j\xac=x\xce\xbc<\xd6\xfe\xffL\xbaX(&\xd6" +
+	"\x0f\xba\x99!ot\xf8\xf1\xad\xb9\x91R\x9e\xcb\x83\xc3" +
+	") \x05e/\x82\"\xd2\xadm\xba\x95\x01\xdd\x92\xd0" +
+	"-\x0c\xa5\x9b\x12\xba\x89a\xe9\xc6f\xdd\xc8\x0d\x85\x91" +
+	"\x82\x9b\x82Jz\x83\xe95\x9d\x8f\xc8\xafL)\xd3\xb1" +
+	"&\x93\x82\xe2\xe1lg\x0a\xaa\x0bU\x12\x91\xbf!1" +
+	"2\\,\xb9K</?R\xa8\x94\x8f\x05\xe5u\x9b" +
+	"\xd6R\xbe~\x8b\xd6\xd5r\xfe\x84W\xce:\xae;D" +
+	"\x0d\xe9\xfe\xad\xeeCW\xd9\xb0\xad\xec\x16\xca\x0d\xa9t" +
+	"\xce\x9d.bE\x88\"\x90\xef\xec\xd5+\xd9^a\xc1" +
+	"^\xa7\x00\xc4!\x8b\x9d\xdd\xba\x93\xed\xb5\x16\xecg\x15" +
+	"\xfc\x81|\xc9+o\xeaO\x13Q\x0a\x0a1\x92\xc0\x1b" +
+	"n\xf0VO\x96\xfeAHY\xc0\xa2\x19]\x10uA" +
+	"\x83S\x0a\x02\x86hZ\x7fE3YL\xa4\xd2\xa5r" +
+	"\x85`\xbcJpG\x9f~\x8b\xed7-\xd8\xbbg\x08" +
+	"\xee\xea\xd3{\xd8\xdem\xc1>\xa0\xa0\x15\xe2A\xd3\xf6" +
+	"\xb7\xe9\xfdl\xef\xb3`\x1fS\xd0\x16\xe2\xb0\x88\xf4\xe1" +
+	"6}\x98\xedC\x16\xec\x93\x0a:\xa2\xe2\x88\x10\xe9\x8f" +
+	"\xfb\xf4)\xb6OZ\xb0?U\xf0GK\xf9T\xc9\x1d" +
+	"\xc8\x13\xb6\x85>Q\x96\x9d\xd1\x81\xear\x1dI\xa0\xc1" +
+	"\xcbOH\xf3QK\x12hp\xcb\xe9\\\x08\xf7\xc7\xdc" +
+	"\x92\x1ch\x0f!\x1bZ\x9e\xcfY\x11U\xfa\xb0n\xba" +
+	"\x0ff\x1c}f\x07\xd8\xd9\x0e\x0b\xceNT{a\xde" +
+	"A\x9f\xd9\x05vv\x0a\xb0\x0f3\xfd0{\x910{" +
+	"\xc1\xce\xfb\x82\x1c\x12\xc4\x8a\x04=1\x07\xd1m\x0e\x82" +
+	"\x9d\x03\x82\x9c\x10$\x12\x0d\xfab\x8e\xe3\x03s\x0a\xec" +
+	"\x9c\x14\xe4\xac Q\xc4\x11%2g\xd0k>\x07;" +
+	"g\x05\xb9(H\x8d\x8a\xa3\x86\xc8\\@\x9b\xb9\x00v" +
+	"\xce\x0brE\x10\xb6\xe2`\"s\x19}\xe6;\xb0s" +
+	"E\x90\xeb\x82\xc4^\x89#Fd\xae\"a\xae\x82\x9d" +
+	"\x1f\x05\xb9%H\xad\x8a\xa3\x96\xc8\xdcD\xc2\xdc\x04;" +
+	"7\x04\xb9+\xc8\x82H\x1c\x0b\x88\xcc$\xd6\x98I\xb0" +
+	"sG\x90:\xa5\xa0\x17r\x1c\x0b\x89L\xad\xea7\xf5" +
+	"\x8a\x9d:e\xc1Y*H\x9d\x15G\x1d\x91iT\x13" +
+	"\xa6I\xb1\xb3T\x90\x15\x82\xd4\xd7\xc7QOdZU" +
+	"\xb3iU\xec,\x17d\xad\x9a\xaf\x0a\x92\xfd[G2" +
+	"C^\xd8\x11\xc5t6\x9b/\x04R`\x92\x80\x9f\xa9" +
+	"L\x19L\x8d\x99\xf2 \x86\x05n\x98\xb9\x0aBNi" +
+	"\x08%T\xccVO\x12\x0f+\xb1d)]\xc8\xb9\xc1" +
+	"\x0aH\x02\xc9\x91\x81\x01\xcf-\x87\xd4\xba\xa4\x98.\xcd" +
+	"qm\xf5\x0a\x98\xedZ?\x13L'\xcf#\x0e\xc6\x93" +
+	"\xd0\xae\xdeHsiOoM\xbaYg\xb6=x\xc8" +
+	"\x1d\x97\xc7\x1a\x92xH\x1b\xf4l.\xe5]zpZ" +
+	"%t+\xdb\xcb-\xd8kg\x86A{\xb7ng{" +
+	"\xb5\x05\xfb1\x85d1]r\x0b\xe5\xf0\xb1dF\x0a" +
+	"\xe5\xca\xd2\xbc\xac\xf8\xcc\x13y/3\xcd\xe1\xbfU\x0e" +
+	"\xa7\xfb\xf4\x19\xb6?\xb3`\x9f\x9f\xe1p.\xa1\xcf\xb1" +
+	"\xfd\xa5\x05\xfb\x9b\xd0@\xba\xd4\xa6/\xb1}\xd1\x82}" +
+	"W\xcc\xa7\xa6\x06\xd2d\xb7\x9ed\xfb\x8eh8p\x9e" +
+	"5\xe5\xbcZ$L-\xd8\x89\x89\xba\x97\x05\xce\x8bL" +
+	"9\xaf\x09\xfd\xa6\x05\xec,\x13dc\xe0<L9o" +
+	"\x03&L\x0f\xd8\xd9(\xc8f(\xf8\x81*\x9d\xfc\x04" +
+	"\xc1\x0d\xe909\xe0m\x1e/\xba\xe1!6Z\xca\xcf" +
+	"VA\xf5z\x9e\xad\x82\xf9\xcc\xf9\xe4\x90;\xde\x93\x0d" +
+	"o\x95j\"\xa5\xa9\x97\xa4\xd2\xc49w\xf6\xab\xaa\xff" +
+	"Y\xe6\x88\xaf\x9a\x91\xcc\xb9\xd3\x8a\xaa\x9ch\x17\xfe\x18" +
+	"\x00\x07O\x0e%"
 
 func init() {
 	schemas.Register(schema_ad3f2ae443d613d9,
+		0x828e7c8c4af46eb5,
+		0x9b5b315c9e9ffb38,
+		0x9f49dadac9473555,
+		0x9ffd2d461edc1218,
 		0xa4d7434c98251eb9,
 		0xb59ee0bfc7a99f7e,
 		0xedec5a16c6a1a062)
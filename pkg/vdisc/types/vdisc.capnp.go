@@ -15,12 +15,12 @@ type VDisc struct{ capnp.Struct }
 const VDisc_TypeID = 0x8eca7be395a515b4
 
 func NewVDisc(s *capnp.Segment) (VDisc, error) {
-	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 1})
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 2})
 	return VDisc{st}, err
 }
 
 func NewRootVDisc(s *capnp.Segment) (VDisc, error) {
-	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 1})
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 2})
 	return VDisc{st}, err
 }
 
@@ -59,12 +59,37 @@ func (s VDisc) NewV1() (vdisc_types_v1.VDisc, error) {
 	return ss, err
 }
 
+func (s VDisc) V2() (vdisc_types_v1.VDisc, error) {
+	p, err := s.Struct.Ptr(1)
+	return vdisc_types_v1.VDisc{Struct: p.Struct()}, err
+}
+
+func (s VDisc) HasV2() bool {
+	p, err := s.Struct.Ptr(1)
+	return p.IsValid() || err != nil
+}
+
+func (s VDisc) SetV2(v vdisc_types_v1.VDisc) error {
+	return s.Struct.SetPtr(1, v.Struct.ToPtr())
+}
+
+// NewV2 sets the v2 field to a newly
+// allocated vdisc_types_v1.VDisc struct, preferring placement in s's segment.
+func (s VDisc) NewV2() (vdisc_types_v1.VDisc, error) {
+	ss, err := vdisc_types_v1.NewVDisc(s.Struct.Segment())
+	if err != nil {
+		return vdisc_types_v1.VDisc{}, err
+	}
+	err = s.Struct.SetPtr(1, ss.Struct.ToPtr())
+	return ss, err
+}
+
 // VDisc_List is a list of VDisc.
 type VDisc_List struct{ capnp.List }
 
 // NewVDisc creates a new list of VDisc.
 func NewVDisc_List(s *capnp.Segment, sz int32) (VDisc_List, error) {
-	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 0, PointerCount: 1}, sz)
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 0, PointerCount: 2}, sz)
 	return VDisc_List{l}, err
 }
 
@@ -89,16 +114,23 @@ func (p VDisc_Promise) V1() vdisc_types_v1.VDisc_Promise {
 	return vdisc_types_v1.VDisc_Promise{Pipeline: p.Pipeline.GetPipeline(0)}
 }
 
-const schema_c6455bc28c9de795 = "x\xda\x12\xa8u`2d\x95gf`\x08Tae" +
-	"\xfb\xbfEt\xe9\xd4\xc7\xd5\xa7\xfa\x18\x04e\x18\xffO" +
-	"}>\xb7\xe7P\xb4\xeb1\x06VFv\x06\x06\xe3R" +
-	"F!F\xe1V\x10S\xb8\x91\xd1\x9e!\xf2\x7fAv" +
-	"\xba~YJf1s\xb2~IeAj1\x98\x93" +
-	"\xac\x97\x9cX\x90W`\x15\xe6\x92Y\xcc\x98\x1c\xc0\xc8" +
-	"\x18\xc8\xc2\xcc\xc2\xc0\xc0\xc2\xc8\xc0 \xc8+\xc5\xc0\x10" +
-	"\xc8\xc1\xcc\x18(\xc2\xc4\xc8\\f\xc8(\xf0?i\xc1" +
-	"\xc2cbQo\xde2002\x0a00\x02\x02\x00" +
-	"\x00\xff\xffH\xa2%\xab"
+func (p VDisc_Promise) V2() vdisc_types_v1.VDisc_Promise {
+	return vdisc_types_v1.VDisc_Promise{Pipeline: p.Pipeline.GetPipeline(1)}
+}
+
+const schema_c6455bc28c9de795 = "x\xda\x128\xe0\xc0d\xc8Z\xcf\xc2\xc0\x10h\xc2\xca" +
+	"\xf6\x7f\x8b\xe8\xd2\xa9\x8f\xabO\xf51\x08\xca0\xfe\x9f" +
+	"\xfa|n\xcf\xa1h\xd7c\x0c\xacL\xec\x0c\x0c\xc6\xaa" +
+	"LB\x8c\xc2\xa6L\xecP\\\xce\xc0 |\x90\x89\x9d" +
+	"\xa1\xf9\x7fAv\xba~YJf1s\xb2~Ie" +
+	"Aj1\x98\x93\xac\x97\x9cX\x90W`\x15\xe6\x92Y" +
+	"\xcc\x98\x1c\xc0\xc8\x18\xc0\xc8\x14\xc8\xc1\xcc\xc2\xc0\xc0\xc2" +
+	"\xc8\xc0 \xa8)%\xa8\xc9\x1e\xa8\xc1\xcc\x18h\xc3\xc4" +
+	"(\xc8\xc8(\xc2\x08\x12\xb5\x94\x12\xb4d\x0f\xb4`f" +
+	"\x0c\xf4abd.3\x0c`db\x14\xf8\x9f\xb4`" +
+	"\xe11\xb1\xa87o\x19\x18\x18\x1c\x18\x05\x19\xd9\x03\x98" +
+	"\x18\x19\x05\x18\x18\x99\xcb\x8c\xf0\xca;0\x02\x06\x00E" +
+	"O2\xcd"
 
 func init() {
 	schemas.Register(schema_c6455bc28c9de795,
@@ -0,0 +1,266 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/NVIDIA/vdisc/pkg/iso9660"
+	"github.com/NVIDIA/vdisc/pkg/vdisc/types/v1"
+)
+
+const (
+	// maxMessageSize bounds the decompressed size of a vdisc, well
+	// above the most extents a vdisc can hold
+	maxMessageSize = 16 << 30
+
+	// maxURLLength bounds the URL an extent or part may resolve to
+	maxURLLength = 64 * 1024
+
+	// validationReadFactor bounds how many bytes Load may read while
+	// validating a vdisc, as a multiple of its size. A well formed
+	// vdisc is read about once; a message whose pointers share data
+	// to amplify reads fails instead.
+	validationReadFactor = 4
+)
+
+// validationError reports a malformed vdisc
+func validationError(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid vdisc: "+format, args...)
+}
+
+// validator checks every index, size and pointer of a vdisc before it
+// is used, so that Load fails with a descriptive error instead of
+// panicking or looping on a malformed or malicious vdisc
+type validator struct {
+	blockSize uint16
+	uris      vdisc_types_v1.ITrie_List
+	keyIDs    []string
+
+	// prefixLengths holds the length of the URL prefix each trie node
+	// resolves to
+	prefixLengths []int
+}
+
+// newValidator checks the block size, keys and uris of a vdisc, which
+// its extents are then checked against
+func newValidator(blockSize uint16, uris vdisc_types_v1.ITrie_List, keyIDs []string) (*validator, error) {
+	if blockSize == 0 {
+		return nil, validationError("block size is zero")
+	}
+	if len(keyIDs) > maxKeys {
+		return nil, validationError("%d keys, at most %d are supported", len(keyIDs), maxKeys)
+	}
+
+	vv := &validator{
+		blockSize: blockSize,
+		uris:      uris,
+		keyIDs:    keyIDs,
+	}
+	if err := vv.checkTrie(); err != nil {
+		return nil, err
+	}
+	return vv, nil
+}
+
+// checkExtents checks count extents from offset in extents, the first
+// of which has index first in the vdisc, and returns the number of
+// blocks they take
+func (vv *validator) checkExtents(extents vdisc_types_v1.Extent_List, offset, count, first int) (uint32, error) {
+	var blocks uint64
+	for i := 0; i < count; i++ {
+		ext := extents.At(offset + i)
+		if err := vv.checkExtent(ext); err != nil {
+			return 0, validationError("extent %d: %v", first+i, err)
+		}
+		blocks += uint64(ext.Blocks())
+		if blocks > math.MaxUint32 {
+			return 0, validationError("extents exceed %d blocks", uint64(math.MaxUint32))
+		}
+	}
+	return uint32(blocks), nil
+}
+
+// checkTrie checks that every parent index is in range and that
+// following parents always ends at a root, which points to itself
+func (vv *validator) checkTrie() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	n := vv.uris.Len()
+	state := make([]uint8, n)
+	vv.prefixLengths = make([]int, n)
+
+	var path []int
+	for start := 0; start < n; start++ {
+		// Walk up to the root or a node already measured, then
+		// measure the nodes on the way back down
+		path = path[:0]
+		for node := start; state[node] != visited; {
+			if state[node] == visiting {
+				return validationError("uri trie node %d is part of a cycle", node)
+			}
+			state[node] = visiting
+			path = append(path, node)
+
+			parent := int(vv.uris.At(node).Parent())
+			if parent >= n {
+				return validationError("uri trie node %d has parent %d, out of range of %d nodes", node, parent, n)
+			}
+			if parent == node {
+				break
+			}
+			node = parent
+		}
+
+		for i := len(path) - 1; i >= 0; i-- {
+			node := path[i]
+			trie := vv.uris.At(node)
+			content, err := trie.Content()
+			if err != nil {
+				return validationError("uri trie node %d: %v", node, err)
+			}
+
+			length := len(content)
+			if parent := int(trie.Parent()); parent != node {
+				length += vv.prefixLengths[parent]
+			}
+			if length > maxURLLength {
+				return validationError("uri trie node %d is longer than %d bytes", node, maxURLLength)
+			}
+			vv.prefixLengths[node] = length
+			state[node] = visited
+		}
+	}
+	return nil
+}
+
+// checkURL checks the prefix index and suffix of a URL
+func (vv *validator) checkURL(prefix uint32, suffix string) error {
+	if int64(prefix) >= int64(vv.uris.Len()) {
+		return fmt.Errorf("uri prefix %d out of range of %d nodes", prefix, vv.uris.Len())
+	}
+	if vv.prefixLengths[prefix]+len(suffix) > maxURLLength {
+		return fmt.Errorf("url is longer than %d bytes", maxURLLength)
+	}
+	return nil
+}
+
+func (vv *validator) checkExtent(ext vdisc_types_v1.Extent) error {
+	suffix, err := ext.UriSuffix()
+	if err != nil {
+		return err
+	}
+	if err := vv.checkURL(ext.UriPrefix(), suffix); err != nil {
+		return err
+	}
+
+	// An empty file still takes a block, all of it padding. Extents are
+	// located by their first block, so each must have one.
+	if ext.Blocks() == 0 {
+		return fmt.Errorf("extent has no blocks")
+	}
+	length := int64(ext.Blocks())*int64(vv.blockSize) - int64(ext.Padding())
+	if length < 0 || ext.Padding() > vv.blockSize {
+		return fmt.Errorf("padding %d out of range", ext.Padding())
+	}
+
+	if ext.Ranged() && ext.Offset() > uint64(math.MaxInt64-length) {
+		return fmt.Errorf("range at %d overflows", ext.Offset())
+	}
+
+	if digest, err := ext.Checksum(); err != nil {
+		return err
+	} else if alg := ext.ChecksumAlgorithm(); alg != ChecksumNone {
+		if c := (Checksum{Algorithm: alg}); c.size() == 0 || len(digest) != c.size() {
+			return fmt.Errorf("invalid %v checksum", alg)
+		}
+	}
+
+	if _, err := ext.Etag(); err != nil {
+		return err
+	}
+	if _, err := ext.VersionId(); err != nil {
+		return err
+	}
+
+	switch ext.Compression() {
+	case CompressionNone:
+	case CompressionZstdSeekable:
+		if ext.CompressedSize() > math.MaxInt64 {
+			return fmt.Errorf("compressed size %d out of range", ext.CompressedSize())
+		}
+	default:
+		return fmt.Errorf("unsupported compression %v", ext.Compression())
+	}
+
+	if key := ext.Key(); int(key) > len(vv.keyIDs) {
+		return fmt.Errorf("key %d out of range of %d keys", key, len(vv.keyIDs))
+	}
+
+	parts, err := ext.Parts()
+	if err != nil {
+		return err
+	}
+	remaining := uint64(length)
+	for i := 0; i < parts.Len(); i++ {
+		part := parts.At(i)
+		suffix, err := part.UriSuffix()
+		if err != nil {
+			return fmt.Errorf("part %d: %v", i+1, err)
+		}
+		if err := vv.checkURL(part.UriPrefix(), suffix); err != nil {
+			return fmt.Errorf("part %d: %v", i+1, err)
+		}
+		if part.Size() > remaining {
+			return fmt.Errorf("parts exceed the extent's %d bytes", length)
+		}
+		remaining -= part.Size()
+
+		if _, err := part.Etag(); err != nil {
+			return fmt.Errorf("part %d: %v", i+1, err)
+		}
+		if _, err := part.VersionId(); err != nil {
+			return fmt.Errorf("part %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// checkVolumeSize checks that the extents of an iso9660 vdisc cover
+// exactly the volume its primary volume descriptor describes
+func checkVolumeSize(image io.ReaderAt, blockSize uint16, blocks uint32) error {
+	if blockSize != iso9660.LogicalBlockSize {
+		return validationError("iso9660 block size is %d, expected %d", blockSize, iso9660.LogicalBlockSize)
+	}
+	if blocks <= 16 {
+		return validationError("%d blocks leave no room for a primary volume descriptor", blocks)
+	}
+
+	var pvd iso9660.PrimaryVolumeDescriptor
+	sector := io.NewSectionReader(image, 16*iso9660.LogicalBlockSize, iso9660.LogicalBlockSize)
+	if err := iso9660.DecodePrimaryVolumeDescriptor(sector, &pvd); err != nil {
+		return validationError("reading primary volume descriptor: %v", err)
+	}
+	if pvd.VolumeSpaceSize != blocks {
+		return validationError("extents cover %d blocks but the volume has %d", blocks, pvd.VolumeSpaceSize)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdisc_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	capnp "zombiezen.com/go/capnproto2"
+
+	"github.com/NVIDIA/vdisc/pkg/caching"
+	"github.com/NVIDIA/vdisc/pkg/vdisc"
+	"github.com/NVIDIA/vdisc/pkg/vdisc/types"
+	"github.com/NVIDIA/vdisc/pkg/vdisc/types/v1"
+)
+
+func TestMalformedVDiscs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vdisc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := vdisc.NewISO9660Builder(vdisc.BuilderConfig{URL: filepath.Join(dir, "test.vdisc")})
+	for i := 0; i < 3; i++ {
+		url := filepath.Join(dir, "objects", fmt.Sprintf("file%d", i))
+		if err := os.MkdirAll(filepath.Dir(url), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(url, []byte(strings.Repeat("x", 3000)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.AddFile(fmt.Sprintf("file%d", i), url, -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	url, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressed, err := ioutil.ReadFile(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt loads a copy of the vdisc modified by fn
+	corrupt := func(fn func(uris vdisc_types_v1.ITrie_List, extents vdisc_types_v1.Extent_List)) error {
+		msg, err := capnp.Unmarshal(append([]byte(nil), raw...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := vdisc_types.ReadRootVDisc(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v1, err := root.V1()
+		if err != nil {
+			t.Fatal(err)
+		}
+		uris, err := v1.Uris()
+		if err != nil {
+			t.Fatal(err)
+		}
+		extents, err := v1.Extents()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn(uris, extents)
+
+		data, err := msg.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bad := filepath.Join(dir, "bad.vdisc")
+		if err := ioutil.WriteFile(bad, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := vdisc.Load(bad, caching.NopCache)
+		if err == nil {
+			v.Close()
+		}
+		return err
+	}
+
+	assert.Nil(t, corrupt(func(uris vdisc_types_v1.ITrie_List, extents vdisc_types_v1.Extent_List) {}))
+
+	for name, tc := range map[string]struct {
+		fn  func(uris vdisc_types_v1.ITrie_List, extents vdisc_types_v1.Extent_List)
+		msg string
+	}{
+		"cycle": {func(uris vdisc_types_v1.ITrie_List, extents vdisc_types_v1.Extent_List) {
+			for i := 0; i < uris.Len(); i++ {
+				uris.At(i).SetParent(uint32((i + 1) % uris.Len()))
+			}
+		}, "cycle"},
+		"parent": {func(uris vdisc_types_v1.ITrie_List, extents vdisc_types_v1.Extent_List) {
+			uris.At(uris.Len() - 1).SetParent(1 << 30)
+		}, "out of range"},
+		"prefix": {func(uris vdisc_types_v1.ITrie_List, extents vdisc_types_v1.Extent_List) {
+			extents.At(1).SetUriPrefix(1 << 30)
+		}, "uri prefix"},
+		"blocks": {func(uris vdisc_types_v1.ITrie_List, extents vdisc_types_v1.Extent_List) {
+			extents.At(1).SetBlocks(extents.At(1).Blocks() + 1)
+		}, "the volume has"},
+		"empty": {func(uris vdisc_types_v1.ITrie_List, extents vdisc_types_v1.Extent_List) {
+			extents.At(2).SetBlocks(extents.At(2).Blocks() + extents.At(1).Blocks())
+			extents.At(1).SetBlocks(0)
+			extents.At(1).SetPadding(0)
+		}, "no blocks"},
+		"padding": {func(uris vdisc_types_v1.ITrie_List, extents vdisc_types_v1.Extent_List) {
+			extents.At(1).SetPadding(60000)
+		}, "padding"},
+		"key": {func(uris vdisc_types_v1.ITrie_List, extents vdisc_types_v1.Extent_List) {
+			extents.At(1).SetKey(3)
+		}, "key"},
+		"checksum": {func(uris vdisc_types_v1.ITrie_List, extents vdisc_types_v1.Extent_List) {
+			extents.At(1).SetChecksumAlgorithm(vdisc.ChecksumSHA256)
+		}, "checksum"},
+	} {
+		err := corrupt(tc.fn)
+		if assert.NotNil(t, err, name) {
+			assert.Contains(t, err.Error(), tc.msg, name)
+		}
+	}
+}
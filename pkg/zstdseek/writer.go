@@ -0,0 +1,123 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zstdseek
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultFrameSize is the decompressed size of each frame written by
+// NewWriter when none is given. Reads fetch whole frames, so smaller
+// frames waste less on small reads but compress worse.
+const DefaultFrameSize = 1024 * 1024
+
+// Writer compresses to the seekable format, in frames of a fixed
+// decompressed size. The seek table is written by Close.
+type Writer struct {
+	w         io.Writer
+	enc       *zstd.Encoder
+	frameSize int
+	buf       []byte
+	out       []byte
+	sizes     [][2]uint32
+	closed    bool
+}
+
+// NewWriter returns a Writer to w with frames of frameSize bytes, or
+// DefaultFrameSize if frameSize is not positive
+func NewWriter(w io.Writer, frameSize int) (*Writer, error) {
+	if frameSize <= 0 {
+		frameSize = DefaultFrameSize
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:         w,
+		enc:       enc,
+		frameSize: frameSize,
+		buf:       make([]byte, 0, frameSize),
+	}, nil
+}
+
+func (zw *Writer) Write(p []byte) (int, error) {
+	if zw.closed {
+		return 0, errors.New("zstdseek: write to closed Writer")
+	}
+
+	var n int
+	for len(p) > 0 {
+		m := copy(zw.buf[len(zw.buf):zw.frameSize], p)
+		zw.buf = zw.buf[:len(zw.buf)+m]
+		p = p[m:]
+		n += m
+		if len(zw.buf) == zw.frameSize {
+			if err := zw.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush writes the buffered data as a frame
+func (zw *Writer) flush() error {
+	if len(zw.buf) == 0 {
+		return nil
+	}
+	zw.out = zw.enc.EncodeAll(zw.buf, zw.out[:0])
+	if _, err := zw.w.Write(zw.out); err != nil {
+		return err
+	}
+	zw.sizes = append(zw.sizes, [2]uint32{uint32(len(zw.out)), uint32(len(zw.buf))})
+	zw.buf = zw.buf[:0]
+	return nil
+}
+
+// Close writes the last frame and the seek table. It does not close the
+// underlying writer.
+func (zw *Writer) Close() error {
+	if zw.closed {
+		return nil
+	}
+	zw.closed = true
+	defer zw.enc.Close()
+
+	if err := zw.flush(); err != nil {
+		return err
+	}
+
+	tableSize := len(zw.sizes)*8 + footerSize
+	table := make([]byte, skippableHeaderSize+tableSize)
+	binary.LittleEndian.PutUint32(table, skippableMagic)
+	binary.LittleEndian.PutUint32(table[4:], uint32(tableSize))
+	entries := table[skippableHeaderSize:]
+	for i, size := range zw.sizes {
+		binary.LittleEndian.PutUint32(entries[i*8:], size[0])
+		binary.LittleEndian.PutUint32(entries[i*8+4:], size[1])
+	}
+	footer := entries[len(zw.sizes)*8:]
+	binary.LittleEndian.PutUint32(footer, uint32(len(zw.sizes)))
+	footer[4] = 0
+	binary.LittleEndian.PutUint32(footer[5:], seekableMagic)
+
+	_, err := zw.w.Write(table)
+	return err
+}
@@ -0,0 +1,191 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package zstdseek reads and writes the zstd seekable format, a series
+// of independent zstd frames followed by a table of their sizes in a
+// skippable frame. See
+// https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md
+package zstdseek
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	skippableMagic = 0x184D2A5E
+	seekableMagic  = 0x8F92EAB1
+
+	// Skippable frame header: magic and frame size
+	skippableHeaderSize = 8
+
+	// Seek table footer: number of frames, descriptor and magic
+	footerSize = 9
+
+	// The descriptor bit flagging a checksum in every entry
+	checksumFlag = 0x80
+)
+
+var (
+	decoderOnce sync.Once
+	decoder     *zstd.Decoder
+	decoderErr  error
+)
+
+// getDecoder returns a decoder shared by every Reader, since DecodeAll
+// may be used concurrently
+func getDecoder() (*zstd.Decoder, error) {
+	decoderOnce.Do(func() {
+		decoder, decoderErr = zstd.NewReader(nil)
+	})
+	return decoder, decoderErr
+}
+
+// SeekTable locates the frames of a seekable object. Entry i of
+// compressed and decompressed is the offset of frame i, and the final
+// entry the size of the whole.
+type SeekTable struct {
+	compressed   []int64
+	decompressed []int64
+}
+
+// ReadSeekTable reads the seek table at the end of a seekable object of
+// size bytes
+func ReadSeekTable(r io.ReaderAt, size int64) (*SeekTable, error) {
+	if size < skippableHeaderSize+footerSize {
+		return nil, errors.New("zstdseek: object too small for a seek table")
+	}
+
+	var footer [footerSize]byte
+	if _, err := r.ReadAt(footer[:], size-footerSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, errors.New("zstdseek: missing seek table")
+	}
+	frames := int64(binary.LittleEndian.Uint32(footer[:4]))
+	entrySize := int64(8)
+	if footer[4]&checksumFlag != 0 {
+		entrySize = 12
+	}
+
+	tableSize := frames*entrySize + footerSize
+	start := size - tableSize - skippableHeaderSize
+	if start < 0 {
+		return nil, fmt.Errorf("zstdseek: seek table of %d frames exceeds object size %d", frames, size)
+	}
+
+	buf := make([]byte, tableSize-footerSize+skippableHeaderSize)
+	if _, err := r.ReadAt(buf, start); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(buf) != skippableMagic || int64(binary.LittleEndian.Uint32(buf[4:])) != tableSize {
+		return nil, errors.New("zstdseek: invalid seek table frame")
+	}
+
+	t := &SeekTable{
+		compressed:   make([]int64, frames+1),
+		decompressed: make([]int64, frames+1),
+	}
+	entries := buf[skippableHeaderSize:]
+	for i := int64(0); i < frames; i++ {
+		entry := entries[i*entrySize:]
+		t.compressed[i+1] = t.compressed[i] + int64(binary.LittleEndian.Uint32(entry))
+		t.decompressed[i+1] = t.decompressed[i] + int64(binary.LittleEndian.Uint32(entry[4:]))
+	}
+	if t.compressed[frames] != start {
+		return nil, fmt.Errorf("zstdseek: frames end at %d, but the seek table starts at %d", t.compressed[frames], start)
+	}
+	return t, nil
+}
+
+// Size returns the decompressed size of the object
+func (t *SeekTable) Size() int64 {
+	return t.decompressed[len(t.decompressed)-1]
+}
+
+// Reader reads the decompressed content of a seekable object, fetching
+// and decompressing only the frames covering each read
+type Reader struct {
+	r     io.ReaderAt
+	table *SeekTable
+}
+
+// NewReader returns a Reader of r, whose frames are located by table
+func NewReader(r io.ReaderAt, table *SeekTable) *Reader {
+	return &Reader{r, table}
+}
+
+// Size returns the decompressed size of the object
+func (zr *Reader) Size() int64 {
+	return zr.table.Size()
+}
+
+func (zr *Reader) ReadAt(p []byte, off int64) (int, error) {
+	t := zr.table
+	if off < 0 {
+		return 0, errors.New("zstdseek: negative offset")
+	}
+	if off >= t.Size() {
+		return 0, io.EOF
+	}
+
+	end := off + int64(len(p))
+	if end > t.Size() {
+		end = t.Size()
+	}
+
+	// The frames overlapping [off, end) are fetched with a single read
+	first := sort.Search(len(t.decompressed)-1, func(i int) bool { return t.decompressed[i+1] > off })
+	last := sort.Search(len(t.decompressed)-1, func(i int) bool { return t.decompressed[i+1] >= end })
+	compressed := make([]byte, t.compressed[last+1]-t.compressed[first])
+	if _, err := zr.r.ReadAt(compressed, t.compressed[first]); err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	dec, err := getDecoder()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	var frame []byte
+	for i := first; i <= last; i++ {
+		src := compressed[t.compressed[i]-t.compressed[first] : t.compressed[i+1]-t.compressed[first]]
+		frame, err = dec.DecodeAll(src, frame[:0])
+		if err != nil {
+			return n, fmt.Errorf("zstdseek: frame %d: %v", i, err)
+		}
+		if int64(len(frame)) != t.decompressed[i+1]-t.decompressed[i] {
+			return n, fmt.Errorf("zstdseek: frame %d decompressed to %d bytes, expected %d", i, len(frame), t.decompressed[i+1]-t.decompressed[i])
+		}
+
+		lo := int64(0)
+		if i == first {
+			lo = off - t.decompressed[i]
+		}
+		n += copy(p[n:], frame[lo:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,96 @@
+// Copyright © 2019 NVIDIA Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zstdseek_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NVIDIA/vdisc/pkg/zstdseek"
+)
+
+func compress(t *testing.T, data []byte, frameSize int) []byte {
+	var buf bytes.Buffer
+	w, err := zstdseek.NewWriter(&buf, frameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadAt(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte('a' + rng.Intn(4))
+	}
+
+	compressed := compress(t, data, 4096)
+	assert.True(t, len(compressed) < len(data))
+
+	table, err := zstdseek.ReadSeekTable(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := zstdseek.NewReader(bytes.NewReader(compressed), table)
+	assert.Equal(t, int64(len(data)), r.Size())
+
+	// Reads within a frame, across frames and past the end
+	for _, tc := range []struct{ off, len int }{
+		{0, 10},
+		{4000, 200},
+		{4096, 4096},
+		{5000, 30000},
+		{99990, 10},
+		{0, 100000},
+	} {
+		p := make([]byte, tc.len)
+		n, err := r.ReadAt(p, int64(tc.off))
+		assert.Nil(t, err)
+		assert.Equal(t, tc.len, n)
+		assert.Equal(t, data[tc.off:tc.off+tc.len], p)
+	}
+
+	p := make([]byte, 100)
+	n, err := r.ReadAt(p, 99950)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 50, n)
+	assert.Equal(t, data[99950:], p[:n])
+
+	_, err = r.ReadAt(p, 100000)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestNotSeekable(t *testing.T) {
+	data := bytes.Repeat([]byte("not a seekable object"), 10)
+	_, err := zstdseek.ReadSeekTable(bytes.NewReader(data), int64(len(data)))
+	assert.NotNil(t, err)
+
+	empty := compress(t, nil, 0)
+	table, err := zstdseek.ReadSeekTable(bytes.NewReader(empty), int64(len(empty)))
+	if assert.Nil(t, err) {
+		assert.Equal(t, int64(0), table.Size())
+	}
+}